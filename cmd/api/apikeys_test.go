@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+func TestEndToEndAPIKeys(t *testing.T) {
+	a := newTestApp(t, pos.NewFake())
+	admin := firstAdmin(t, a, "e2e-device")
+	neighbour := firstAdmin(t, a, "e2e-neighbour")
+
+	admin.expect(fiber.StatusBadRequest, nil, fiber.MethodPost, "/v1/api-keys", fiber.Map{"name": " "})
+	var created struct {
+		APIKey models.APIKey `json:"apiKey"`
+		Key    string        `json:"key"`
+	}
+	admin.expect(fiber.StatusCreated, &created, fiber.MethodPost, "/v1/api-keys", fiber.Map{"name": "Bar tablet"})
+	if !services.IsAPIKey(created.Key) || !strings.HasPrefix(created.Key, created.APIKey.Prefix) {
+		t.Fatalf("key %q with prefix %q, want an API key starting with its prefix", created.Key, created.APIKey.Prefix)
+	}
+	if services.IsAPIKey("EAAAl-square-token") {
+		t.Error("a Square token looks like an API key")
+	}
+
+	// The key authenticates as the restaurant of the device that created it, the staff session carries over
+	tablet := &client{t: t, app: a, token: created.Key, session: admin.session}
+	var keys []models.APIKey
+	tablet.expect(fiber.StatusOK, &keys, fiber.MethodGet, "/v1/api-keys", nil)
+	if len(keys) != 1 || keys[0].ID != created.APIKey.ID || keys[0].LastUsedAt == nil {
+		t.Fatalf("keys %+v, want the new key with its use recorded", keys)
+	}
+
+	unknown := &client{t: t, app: a, token: services.APIKeyPrefix + "unknown", session: admin.session}
+	unknown.expect(fiber.StatusUnauthorized, nil, fiber.MethodGet, "/v1/api-keys", nil)
+
+	revoke := fmt.Sprintf("/v1/api-keys/%d", created.APIKey.ID)
+	neighbour.expect(fiber.StatusNotFound, nil, fiber.MethodDelete, revoke, nil)
+	admin.expect(fiber.StatusBadRequest, nil, fiber.MethodDelete, "/v1/api-keys/abc", nil)
+	admin.expect(fiber.StatusOK, nil, fiber.MethodDelete, revoke, nil)
+	admin.expect(fiber.StatusNotFound, nil, fiber.MethodDelete, revoke, nil)
+	tablet.expect(fiber.StatusUnauthorized, nil, fiber.MethodGet, "/v1/api-keys", nil)
+
+	admin.expect(fiber.StatusOK, &keys, fiber.MethodGet, "/v1/api-keys", nil)
+	if len(keys) != 1 || keys[0].RevokedAt == nil {
+		t.Errorf("keys %+v, want the key listed as revoked", keys)
+	}
+}
@@ -2,76 +2,259 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
-	"github.com/square/square-go-sdk"
-	"github.com/square/square-go-sdk/client"
-	"github.com/square/square-go-sdk/option"
 
+	"github.com/sasirura/restaurant-api/internal/auth"
+	"github.com/sasirura/restaurant-api/internal/keyring"
 	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/services"
 	"gorm.io/gorm"
 )
 
-func Authenticate(db *gorm.DB) fiber.Handler {
+// Authenticate accepts API keys issued to restaurant devices and, for existing integrations, raw Square tokens.
+// Raw tokens of unknown restaurants are verified in the default environment, known ones in the restaurant's own
+func Authenticate(db *gorm.DB, connector pos.Connector, environment pos.Environment, tokens *auth.TokenCache, keys *keyring.Keyring, apiKeys *services.APIKeyService) fiber.Handler {
 	ctx := context.TODO()
 
 	return func(c *fiber.Ctx) error {
-		token := c.Get("Authorization")
+		token := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
 		if token == "" {
 			log.Error("Authorization token missing")
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Authorization token required"})
 		}
 
-		client := client.NewClient(
-			option.WithToken(token),
-			option.WithBaseURL(
-				square.Environments.Sandbox,
-			),
-		)
-
-		tokenStatus, err := client.OAuth.RetrieveTokenStatus(ctx)
-		if err != nil || tokenStatus.MerchantID == nil {
-			log.Error("Failed to retrieve token status", "error", err.Error())
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve token status"})
+		if services.IsAPIKey(token) {
+			return authenticateAPIKey(c, ctx, connector, keys, apiKeys, token)
 		}
 
-		// Get merchant location
-		locations, err := client.Locations.List(ctx)
-		if err != nil || len(locations.Locations) == 0 {
-			log.Error("Failed to fetch locations", "error", err.Error())
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch Square locations"})
-		}
-		locationID := locations.Locations[0].ID
-
 		// Check if restaurant exists in database
 		var restaurant models.Restaurant
-		err = db.Where(models.Restaurant{
-			SqaureToken: token,
+		tokenHash := keys.Hash(token)
+		err := db.Where(models.Restaurant{
+			SquareTokenHash: tokenHash,
 		}).First(&restaurant).Error
-		if err == gorm.ErrRecordNotFound {
+		known := err == nil
+		if err != nil && err != gorm.ErrRecordNotFound {
+			log.Error("Database error", "error", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+		}
+		env := environment
+		if known {
+			env = restaurant.SquareEnvironment
+		}
+
+		gateway := connector.Connect(env, token)
+
+		verification, err := tokens.Verify(ctx, token, func(ctx context.Context) (*auth.Verification, error) {
+			return verifyToken(ctx, gateway)
+		})
+		if errors.Is(err, pos.ErrUnauthorized) || errors.Is(err, auth.ErrTokenExpired) {
+			log.Error("Authorization token rejected", "error", err)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid authorization token"})
+		} else if err != nil {
+			log.Error("Failed to verify token", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to verify token"})
+		}
+
+		if !known {
+			// Another token of a known merchant, e.g. one replaced by a refresh, belongs to the merchant's restaurant
+			err := db.Where(&models.Restaurant{MerchantID: verification.MerchantID, SquareEnvironment: env}).Order("id").First(&restaurant).Error
+			known = err == nil
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Error("Database error", "error", err.Error())
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+			}
+		}
+
+		if !known {
+			sealed, err := keys.Seal(token)
+			if err != nil {
+				log.Error("Failed to encrypt token", "error", err.Error())
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create restaurant"})
+			}
+
 			// Create new restaurant record
 			restaurant = models.Restaurant{
-				Name:        fmt.Sprintf("Restaurant-%s", *tokenStatus.MerchantID),
-				SqaureToken: token,
-				LocationID:  *locationID,
+				Name:              fmt.Sprintf("Restaurant-%s", verification.MerchantID),
+				SquareTokenHash:   tokenHash,
+				SquareToken:       sealed,
+				LocationID:        verification.LocationID,
+				MerchantID:        verification.MerchantID,
+				SquareEnvironment: env,
 			}
 			if err := db.Create(&restaurant).Error; err != nil {
-				log.Error("Failed to create restaurant", "error", err.Error(), "merchant_id", *tokenStatus.MerchantID)
+				log.Error("Failed to create restaurant", "error", err.Error(), "merchant_id", verification.MerchantID)
 				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create restaurant"})
 			}
-			log.Info("Created new restaurant", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "merchant_id", *tokenStatus.MerchantID)
-		} else if err != nil {
-			log.Error("Database error", "error", err.Error())
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+			log.Info("Created new restaurant", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "merchant_id", verification.MerchantID,
+				"environment", string(env))
+		} else if restaurant.MerchantID == "" {
+			// Restaurants created before merchants were recorded get theirs from the token
+			if err := db.Model(&restaurant).Update("merchant_id", verification.MerchantID).Error; err != nil {
+				log.Error("Failed to record merchant", "error", err.Error(), "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+			}
+		} else if restaurant.MerchantID != verification.MerchantID {
+			// A token of another merchant, e.g. from the other environment, must never reach this restaurant's data
+			log.Error("Token merchant does not match restaurant", "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid authorization token"})
 		}
 
-		log.Info("Restaurant authenticated", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "merchant_id", *tokenStatus.MerchantID)
+		if restaurant.RevokedAt != nil {
+			log.Error("Square authorization revoked", "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Square authorization revoked"})
+		}
+
+		log.Info("Restaurant authenticated", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "merchant_id", verification.MerchantID)
 		c.Locals("restaurant", restaurant)
-		c.Locals("client", client)
+		c.Locals("gateway", gateway)
 
 		log.Info("Restaurant authenticated", "restaurant_id", restaurant.ID)
 		return c.Next()
 	}
 }
+
+// authenticateAPIKey maps a device API key to its restaurant and the restaurant's stored Square token
+func authenticateAPIKey(c *fiber.Ctx, ctx context.Context, connector pos.Connector, keys *keyring.Keyring, apiKeys *services.APIKeyService, secret string) error {
+	key, restaurant, err := apiKeys.Authenticate(ctx, secret)
+	if errors.Is(err, services.ErrAPIKeyNotFound) || errors.Is(err, services.ErrAPIKeyRevoked) {
+		log.Error("API key rejected", "error", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid API key"})
+	} else if err != nil {
+		log.Error("Failed to authenticate API key", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	if restaurant.RevokedAt != nil {
+		log.Error("Square authorization revoked", "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Square authorization revoked"})
+	}
+
+	squareToken, err := keys.Open(restaurant.SquareToken)
+	if err != nil {
+		log.Error("Failed to decrypt Square token", "error", err, "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load Square credentials"})
+	}
+
+	log.Info("Restaurant authenticated", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "api_key_id", fmt.Sprintf("%d", key.ID))
+	c.Locals("restaurant", *restaurant)
+	c.Locals("apiKey", *key)
+	c.Locals("gateway", connector.Connect(restaurant.SquareEnvironment, squareToken))
+	return c.Next()
+}
+
+// verifyToken asks the POS who owns the token and which location to use
+func verifyToken(ctx context.Context, gateway pos.Gateway) (*auth.Verification, error) {
+	tokenStatus, err := gateway.RetrieveTokenStatus(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve token status: %w", err)
+	}
+	if tokenStatus.MerchantID == nil {
+		return nil, errors.New("token status has no merchant")
+	}
+
+	// Get merchant location
+	locations, err := gateway.ListLocations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch locations: %w", err)
+	}
+	if len(locations.Locations) == 0 || locations.Locations[0].ID == nil {
+		return nil, errors.New("merchant has no locations")
+	}
+
+	verification := &auth.Verification{
+		MerchantID: *tokenStatus.MerchantID,
+		LocationID: *locations.Locations[0].ID,
+	}
+	if tokenStatus.ExpiresAt != nil {
+		expiresAt, err := time.Parse(time.RFC3339, *tokenStatus.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token expiry: %w", err)
+		}
+		verification.ExpiresAt = expiresAt
+	}
+
+	return verification, nil
+}
+
+// StaffTokenHeader carries the session of the staff member using the device
+const StaffTokenHeader = "X-Staff-Token"
+
+// OptionalStaff loads the logged in staff member when the request carries a session
+func OptionalStaff(staffService *services.StaffService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Get(StaffTokenHeader) == "" {
+			return c.Next()
+		}
+		return requireStaff(c, staffService, "")
+	}
+}
+
+// RequirePermission only lets logged in staff whose role grants perm through
+func RequirePermission(staffService *services.StaffService, perm auth.Permission) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return requireStaff(c, staffService, perm)
+	}
+}
+
+func requireStaff(c *fiber.Ctx, staffService *services.StaffService, perm auth.Permission) error {
+	restaurant := c.Locals("restaurant").(models.Restaurant)
+
+	token := c.Get(StaffTokenHeader)
+	if token == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Staff login required"})
+	}
+
+	staff, err := staffService.Authenticate(c.Context(), restaurant, token)
+	if errors.Is(err, services.ErrSessionInvalid) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	} else if err != nil {
+		log.Error("Failed to authenticate staff", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	if perm != "" && !auth.Role(staff.Role).Can(perm) {
+		log.Info("Staff permission denied", "staff_id", fmt.Sprintf("%d", staff.ID), "permission", string(perm))
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Your role does not allow this action"})
+	}
+
+	c.Locals("staff", *staff)
+	return c.Next()
+}
+
+// LocationHeader selects the Square location a request operates on
+const LocationHeader = "X-Location-ID"
+
+// SelectLocation resolves the location from the :locationId path segment or the location header,
+// falling back to the restaurant's default location
+func SelectLocation(locationService *services.LocationService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		gateway := c.Locals("gateway").(pos.Gateway)
+
+		locationID := c.Params("locationId")
+		if locationID == "" {
+			locationID = c.Get(LocationHeader)
+		}
+
+		location, err := locationService.Resolve(c.Context(), restaurant, gateway, locationID)
+		if errors.Is(err, services.ErrLocationNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Location not found"})
+		} else if errors.Is(err, services.ErrLocationInactive) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			log.Error("Failed to resolve location", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load locations"})
+		}
+
+		c.Locals("location", *location)
+		return c.Next()
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sasirura/restaurant-api/internal/auth"
+	"github.com/sasirura/restaurant-api/internal/handlers"
+	"github.com/sasirura/restaurant-api/internal/keyring"
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/services"
+	"github.com/sasirura/restaurant-api/internal/squaretest"
+	"github.com/square/square-go-sdk"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// The end-to-end tests run the API against Postgres, each test in a schema of its own.
+// They are skipped unless TEST_DSN points at a database the tests may create schemas in
+
+// newTestApp builds the API as Initialize does, with connector in place of Square.
+// Options add the optional services, e.g. OAuth, before the routes are registered
+func newTestApp(t *testing.T, connector pos.Connector, options ...func(*App)) *App {
+	t.Helper()
+	dsn := os.Getenv("TEST_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DSN is not set")
+	}
+	config := &gorm.Config{Logger: gormlogger.Default.LogMode(gormlogger.Silent)}
+
+	admin, err := gorm.Open(postgres.Open(dsn), config)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	schema := fmt.Sprintf("e2e_%d", time.Now().UnixNano())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	db, err := gorm.Open(postgres.Open(withSearchPath(dsn, schema)), config)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	log := logger.New(log.LevelError, io.Discard)
+	keys, err := keyring.New(map[string][]byte{"test": bytes.Repeat([]byte{1}, 32)}, "test", bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	if err := migrate(db, keys, log); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	squareService := services.New(db, log)
+	locationService := services.NewLocations(db, log)
+	a := &App{
+		fiber:         fiber.New(fiber.Config{ErrorHandler: handlers.ErrorHandler}),
+		db:            db,
+		squareService: squareService,
+		apiKeyService: services.NewAPIKeys(db, keys, log),
+		staffService:  services.NewStaff(db, keys, time.Hour, log),
+		locations:     locationService,
+		pricing:       services.NewPricing(db, log),
+		menu:          services.NewMenu(db, log),
+		reconciler:    services.NewPaymentReconciler(db, squareService, connector, keys, log),
+		orders:        services.NewOrderReconciler(db, squareService, locationService, connector, keys, log),
+		idempotency:   services.NewIdempotency(db, time.Hour, log),
+		pos:           connector,
+		environment:   pos.Sandbox,
+		tokens:        auth.NewTokenCache(time.Minute),
+		keys:          keys,
+		logger:        log,
+	}
+	for _, option := range options {
+		option(a)
+	}
+	a.Routes()
+	return a
+}
+
+// withSearchPath makes the connections of dsn use schema, for both URL and keyword/value DSNs
+func withSearchPath(dsn, schema string) string {
+	if !strings.Contains(dsn, "://") {
+		return dsn + " search_path=" + schema
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// client sends requests as a device, with the session of the staff member logged in on it
+type client struct {
+	t       *testing.T
+	app     *App
+	token   string
+	session string
+}
+
+// do sends a request, headers are name and value pairs
+func (c *client) do(method, path string, body any, headers ...string) (int, http.Header, []byte) {
+	c.t.Helper()
+	status, header, raw, err := c.send(method, path, body, headers...)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return status, header, raw
+}
+
+// send is do for requests sent from other goroutines, which must not fail the test themselves
+func (c *client) send(method, path string, body any, headers ...string) (int, http.Header, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+c.token)
+	if c.session != "" {
+		req.Header.Set(StaffTokenHeader, c.session)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	// Payments wait for the Square SDK's retries, well past the default timeout
+	resp, err := c.app.fiber.Test(req, -1)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return resp.StatusCode, resp.Header, raw, nil
+}
+
+// parallel sends n copies of a request at once and counts the responses by status
+func (c *client) parallel(n int, method, path string, body any) map[int]int {
+	c.t.Helper()
+	statuses := make(chan int, n)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _, _, err := c.send(method, path, body)
+			if err != nil {
+				errs <- err
+				return
+			}
+			statuses <- status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	close(errs)
+	for err := range errs {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	return counts
+}
+
+// expect sends a request, fails the test unless it is answered with status and decodes the response into out
+func (c *client) expect(status int, out any, method, path string, body any, headers ...string) http.Header {
+	c.t.Helper()
+	got, header, raw := c.do(method, path, body, headers...)
+	if got != status {
+		c.t.Fatalf("%s %s = %d %s, want %d", method, path, got, raw, status)
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			c.t.Fatalf("%s %s: decode %s: %v", method, path, raw, err)
+		}
+	}
+	return header
+}
+
+// login returns a client with the staff member's session on the device
+func (c *client) login(staffID uint, pin string) *client {
+	c.t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	c.expect(fiber.StatusOK, &resp, fiber.MethodPost, "/v1/staff/login", fiber.Map{"staffId": staffID, "pin": pin})
+	return &client{t: c.t, app: c.app, token: c.token, session: resp.Token}
+}
+
+// firstAdmin creates the restaurant's first admin and logs them in
+func firstAdmin(t *testing.T, a *App, token string) *client {
+	t.Helper()
+	device := &client{t: t, app: a, token: token}
+	var admin models.Staff
+	device.expect(fiber.StatusCreated, &admin, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Ada", "role": "admin", "pin": "1234"})
+	return device.login(admin.ID, "1234")
+}
+
+func usd(amount int64) models.Money {
+	return models.NewMoney(amount, "USD")
+}
+
+func orderPath(order models.Order, rest string) string {
+	return "/v1/orders/" + order.ID + rest
+}
+
+func TestEndToEndOrderFlow(t *testing.T) {
+	a := newTestApp(t, pos.NewFake())
+	device := &client{t: t, app: a, token: "e2e-device"}
+
+	// Staff: the first member must be an admin and is created without a login, later ones need one
+	device.expect(fiber.StatusBadRequest, nil, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Max", "role": "manager", "pin": "1234"})
+	admin := firstAdmin(t, a, device.token)
+	device.expect(fiber.StatusUnauthorized, nil, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Eve", "role": "admin", "pin": "9999"})
+	device.expect(fiber.StatusUnauthorized, nil, fiber.MethodGet, "/v1/menu", nil)
+
+	var server models.Staff
+	admin.expect(fiber.StatusCreated, &server, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Sam", "role": "server", "pin": "5678"})
+	waiter := device.login(server.ID, "5678")
+
+	// The menu is synced from Square the first time it is read, after that items must come from it
+	var menu models.Menu
+	waiter.expect(fiber.StatusOK, &menu, fiber.MethodGet, "/v1/menu", nil)
+	if len(menu.Items) == 0 {
+		t.Fatal("menu has no items")
+	}
+	waiter.expect(fiber.StatusForbidden, nil, fiber.MethodPost, "/v1/orders", fiber.Map{
+		"tableNumber": "4",
+		"items":       []fiber.Map{{"name": "Off the menu", "quantity": 1, "unitPrice": usd(500)}},
+	})
+
+	var order models.Order
+	waiter.expect(fiber.StatusOK, &order, fiber.MethodPost, "/v1/orders", fiber.Map{
+		"tableNumber": "4",
+		"items":       []fiber.Map{{"variationId": pos.FakeVariationBurgerRegular, "quantity": 2}},
+	})
+	if order.State != models.OrderStateOpen || order.Totals.Due != usd(2400) || order.Version == 0 {
+		t.Fatalf("created order %s due %s at version %d, want open, 24.00 USD and a version", order.State, order.Totals.Due, order.Version)
+	}
+
+	// Changes must be based on the current version
+	fries := []fiber.Map{{"variationId": pos.FakeVariationFries, "quantity": 1}}
+	waiter.expect(fiber.StatusBadRequest, nil, fiber.MethodPost, orderPath(order, "/items"), fiber.Map{"items": fries})
+	waiter.expect(fiber.StatusConflict, nil, fiber.MethodPost, orderPath(order, "/items"), fiber.Map{"version": order.Version + 1, "items": fries})
+	waiter.expect(fiber.StatusOK, &order, fiber.MethodPost, orderPath(order, "/items"), fiber.Map{"version": order.Version, "items": fries})
+	if order.Totals.Due != usd(2850) {
+		t.Fatalf("due %s after adding fries, want 28.50 USD", order.Totals.Due)
+	}
+
+	for _, tt := range []struct {
+		state  models.OrderState
+		status int
+	}{
+		{models.OrderStateSentToKitchen, fiber.StatusOK},
+		{models.OrderStateOpen, fiber.StatusConflict},
+		{models.OrderStateServed, fiber.StatusOK},
+		{models.OrderStatePaid, fiber.StatusBadRequest},
+	} {
+		var moved models.Order
+		waiter.expect(tt.status, &moved, fiber.MethodPost, orderPath(order, "/state"), fiber.Map{"version": order.Version, "state": tt.state})
+		if tt.status == fiber.StatusOK {
+			if moved.State != tt.state {
+				t.Fatalf("order %s, want %s", moved.State, tt.state)
+			}
+			order = moved
+		}
+	}
+
+	// Servers do not take payments, the tip is kept out of what was paid towards the bill
+	pay := fiber.Map{"paymentId": "pay-1", "billAmount": usd(1000), "tipAmount": usd(200)}
+	waiter.expect(fiber.StatusForbidden, nil, fiber.MethodPost, orderPath(order, "/pay"), pay)
+	admin.expect(fiber.StatusOK, nil, fiber.MethodPost, orderPath(order, "/pay"), pay)
+	admin.expect(fiber.StatusOK, &order, fiber.MethodGet, orderPath(order, ""), nil)
+	if order.State != models.OrderStatePartiallyPaid || order.Totals.Paid != usd(1000) || order.Totals.Tips != usd(200) {
+		t.Fatalf("order %s paid %s with %s tips, want partially_paid, 10.00 USD and 2.00 USD", order.State, order.Totals.Paid, order.Totals.Tips)
+	}
+
+	// What is left is split between two guests, each pays their check
+	var checks []models.Check
+	admin.expect(fiber.StatusCreated, &checks, fiber.MethodPost, orderPath(order, "/split"), fiber.Map{"method": "even", "guests": 2})
+	if len(checks) != 2 || checks[0].Amount != usd(925) || checks[1].Amount != usd(925) {
+		t.Fatalf("checks %+v, want two of 9.25 USD", checks)
+	}
+	admin.expect(fiber.StatusBadRequest, nil, fiber.MethodPost, orderPath(order, "/pay"), fiber.Map{"paymentId": "pay-2", "checkId": checks[0].ID, "billAmount": usd(926)})
+	for i, check := range checks {
+		admin.expect(fiber.StatusOK, nil, fiber.MethodPost, orderPath(order, "/pay"), fiber.Map{
+			"paymentId": fmt.Sprintf("check-%d", i+1), "checkId": check.ID, "billAmount": check.Amount,
+		})
+	}
+
+	admin.expect(fiber.StatusOK, &order, fiber.MethodGet, orderPath(order, ""), nil)
+	if order.State != models.OrderStatePaid || order.Totals.Paid != usd(2850) {
+		t.Fatalf("order %s paid %s, want paid and 28.50 USD", order.State, order.Totals.Paid)
+	}
+	var payments []models.Payment
+	admin.expect(fiber.StatusOK, &payments, fiber.MethodGet, orderPath(order, "/payments"), nil)
+	if len(payments) != 3 {
+		t.Fatalf("%d payments, want 3", len(payments))
+	}
+	for _, payment := range payments {
+		if payment.Status != "COMPLETED" {
+			t.Errorf("payment %s is %s, want COMPLETED", payment.IdempotencyKey, payment.Status)
+		}
+	}
+}
+
+func TestEndToEndIdempotency(t *testing.T) {
+	a := newTestApp(t, pos.NewFake())
+	admin := firstAdmin(t, a, "e2e-device")
+	var server models.Staff
+	admin.expect(fiber.StatusCreated, &server, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Sam", "role": "server", "pin": "5678"})
+	waiter := admin.login(server.ID, "5678")
+
+	body := fiber.Map{"tableNumber": "7", "items": []fiber.Map{{"variationId": pos.FakeVariationLemonade, "quantity": 3}}}
+	var first, again models.Order
+	header := admin.expect(fiber.StatusOK, &first, fiber.MethodPost, "/v1/orders", body, IdempotencyKeyHeader, "order-7")
+	if header.Get("Idempotent-Replayed") != "" {
+		t.Fatal("first request was replayed")
+	}
+
+	tests := []struct {
+		name     string
+		client   *client
+		body     fiber.Map
+		status   int
+		replayed bool
+	}{
+		{"retried", admin, body, fiber.StatusOK, true},
+		{"retried again", admin, body, fiber.StatusOK, true},
+		{"another body", admin, fiber.Map{"tableNumber": "8"}, fiber.StatusUnprocessableEntity, false},
+		{"another staff member", waiter, body, fiber.StatusUnprocessableEntity, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.client.t = t
+			status, header, raw := tt.client.do(fiber.MethodPost, "/v1/orders", tt.body, IdempotencyKeyHeader, "order-7")
+			if status != tt.status {
+				t.Fatalf("status %d %s, want %d", status, raw, tt.status)
+			}
+			if got := header.Get("Idempotent-Replayed") == "true"; got != tt.replayed {
+				t.Errorf("replayed %v, want %v", got, tt.replayed)
+			}
+			if tt.replayed {
+				if err := json.Unmarshal(raw, &again); err != nil {
+					t.Fatalf("decode %s: %v", raw, err)
+				}
+				if again.ID != first.ID {
+					t.Errorf("replayed order %s, want %s", again.ID, first.ID)
+				}
+			}
+		})
+	}
+	admin.t, waiter.t = t, t
+
+	var orders []models.Order
+	admin.expect(fiber.StatusOK, &orders, fiber.MethodGet, "/v1/orders/table/7", nil)
+	if len(orders) != 1 {
+		t.Errorf("%d orders for table 7, want 1", len(orders))
+	}
+
+	// Logins issue credentials and are never stored
+	var login struct {
+		Token string `json:"token"`
+	}
+	pin := fiber.Map{"staffId": server.ID, "pin": "5678"}
+	header = admin.expect(fiber.StatusOK, &login, fiber.MethodPost, "/v1/staff/login", pin, IdempotencyKeyHeader, "login")
+	header2 := admin.expect(fiber.StatusOK, &login, fiber.MethodPost, "/v1/staff/login", pin, IdempotencyKeyHeader, "login")
+	if header.Get("Idempotent-Replayed") != "" || header2.Get("Idempotent-Replayed") != "" {
+		t.Error("login was replayed")
+	}
+}
+
+// lostResponses serves the stand-in Square API but, while lose is set, drops its answers to route
+// as if Square handled the requests and the connection failed before the response arrived
+type lostResponses struct {
+	*squaretest.Handler
+	route string
+	lose  atomic.Bool
+}
+
+func (h *lostResponses) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.lose.Load() && r.Method+" "+r.URL.Path == h.route {
+		h.Handler.ServeHTTP(httptest.NewRecorder(), r)
+		http.Error(w, "upstream connection reset", http.StatusInternalServerError)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestEndToEndPaymentReconciliation(t *testing.T) {
+	stand := &lostResponses{Handler: squaretest.NewHandler(), route: squaretest.RouteCreatePayment}
+	server := httptest.NewServer(stand)
+	t.Cleanup(server.Close)
+	a := newTestApp(t, pos.NewSquare(server.URL))
+	admin := firstAdmin(t, a, "e2e-device")
+
+	tests := []struct {
+		name string
+		// fail makes Square's answers to the payment go missing
+		fail func()
+		// retry sends the payment again with the same paymentId before the reconciler runs
+		retry      bool
+		wantStatus string
+		wantState  models.OrderState
+	}{
+		{
+			name:       "taken by Square",
+			fail:       func() { stand.lose.Store(true) },
+			wantStatus: "COMPLETED",
+			wantState:  models.OrderStatePaid,
+		},
+		{
+			name: "never taken",
+			fail: func() {
+				stand.Fail(squaretest.RouteCreatePayment, squaretest.Failure{
+					Status: http.StatusInternalServerError,
+					Code:   square.ErrorCodeInternalServerError,
+					Times:  2,
+				})
+			},
+			wantStatus: models.PaymentFailed,
+			wantState:  models.OrderStateOpen,
+		},
+		{
+			name:       "retried by the device",
+			fail:       func() { stand.lose.Store(true) },
+			retry:      true,
+			wantStatus: "COMPLETED",
+			wantState:  models.OrderStatePaid,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin.t = t
+			var order models.Order
+			admin.expect(fiber.StatusOK, &order, fiber.MethodPost, "/v1/orders", fiber.Map{
+				"tableNumber": fmt.Sprint(i + 1),
+				"items":       []fiber.Map{{"variationId": pos.FakeVariationBurgerRegular, "quantity": 1}},
+			})
+			pay := fiber.Map{"paymentId": fmt.Sprintf("lost-%d", i), "billAmount": usd(1200)}
+
+			tt.fail()
+			var processing struct {
+				Payment models.Payment `json:"payment"`
+			}
+			admin.expect(fiber.StatusAccepted, &processing, fiber.MethodPost, orderPath(order, "/pay"), pay)
+			stand.lose.Store(false)
+			stand.Reset()
+			if processing.Payment.Status != models.PaymentProcessing {
+				t.Fatalf("payment %s, want %s", processing.Payment.Status, models.PaymentProcessing)
+			}
+
+			if tt.retry {
+				admin.expect(fiber.StatusOK, nil, fiber.MethodPost, orderPath(order, "/pay"), pay)
+			}
+			if err := a.reconciler.Reconcile(context.Background(), 0); err != nil {
+				t.Fatalf("Reconcile: %v", err)
+			}
+
+			var payments []models.Payment
+			admin.expect(fiber.StatusOK, &payments, fiber.MethodGet, orderPath(order, "/payments"), nil)
+			if len(payments) != 1 || payments[0].Status != tt.wantStatus {
+				t.Fatalf("payments %+v, want one %s", payments, tt.wantStatus)
+			}
+			admin.expect(fiber.StatusOK, &order, fiber.MethodGet, orderPath(order, ""), nil)
+			if order.State != tt.wantState {
+				t.Errorf("order %s, want %s", order.State, tt.wantState)
+			}
+			// Square took the payment once however often it was sent
+			if tt.wantStatus == "COMPLETED" && order.Totals.Paid != usd(1200) {
+				t.Errorf("paid %s, want 12.00 USD", order.Totals.Paid)
+			}
+		})
+	}
+}
+
+func TestEndToEndUnknownLocation(t *testing.T) {
+	stand := squaretest.NewServer()
+	t.Cleanup(stand.Close)
+	a := newTestApp(t, pos.NewSquare(stand.URL))
+	admin := firstAdmin(t, a, "e2e-device")
+	admin.expect(fiber.StatusOK, nil, fiber.MethodGet, "/v1/menu", nil)
+	synced := stand.Calls(squaretest.RouteListLocations)
+
+	// Only the first request for a location the restaurant does not have looks for it in Square
+	for range 3 {
+		admin.expect(fiber.StatusNotFound, nil, fiber.MethodGet, "/v1/menu", nil, LocationHeader, "LUNKNOWN")
+	}
+	if calls := stand.Calls(squaretest.RouteListLocations) - synced; calls != 1 {
+		t.Errorf("%d location syncs, want 1", calls)
+	}
+}
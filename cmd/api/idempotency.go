@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// IdempotencyKeyHeader makes a mutating request safe to retry, retries get the response of the first request
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength fits the key column
+const maxIdempotencyKeyLength = 255
+
+// Idempotency replays the stored response for requests whose Idempotency-Key was already used by the same staff member.
+// It runs after the staff session and permission checks. Requests without the header, and reads, run as usual.
+// Routes whose responses carry credentials, e.g. logins and API keys, must not use it, responses are stored as sent
+func Idempotency(idempotency *services.IdempotencyService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := strings.TrimSpace(c.Get(IdempotencyKeyHeader))
+		if key == "" || c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead || c.Method() == fiber.MethodOptions {
+			return c.Next()
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Idempotency-Key must be at most 255 characters"})
+		}
+
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		// Staff may be missing on routes open to devices, e.g. creating the first admin
+		staff, _ := c.Locals("staff").(models.Staff)
+		record, replay, err := idempotency.Begin(c.Context(), restaurant.ID, staff.ID, key, requestFingerprint(c))
+		if errors.Is(err, services.ErrIdempotencyKeyReused) {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
+		} else if errors.Is(err, services.ErrIdempotencyInProgress) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+		}
+
+		if replay {
+			c.Set("Idempotent-Replayed", "true")
+			if record.ContentType != "" {
+				c.Set(fiber.HeaderContentType, record.ContentType)
+			}
+			return c.Status(record.StatusCode).Send(record.Body)
+		}
+
+		// Handlers pass the key on to Square so a retry is only made once there too
+		c.Locals("idempotencyKey", key)
+
+		if err := c.Next(); err != nil {
+			if err := idempotency.Release(c.Context(), record); err != nil {
+				log.Error("Failed to release idempotency key", "error", err)
+			}
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if !finalStatus(status) {
+			if err := idempotency.Release(c.Context(), record); err != nil {
+				log.Error("Failed to release idempotency key", "error", err)
+			}
+			return nil
+		}
+		if err := idempotency.Complete(c.Context(), record, status, string(c.Response().Header.ContentType()), c.Response().Body()); err != nil {
+			log.Error("Failed to store idempotent response", "error", err)
+		}
+		return nil
+	}
+}
+
+// finalStatus reports whether retrying a request with this response status would get the same answer.
+// Server errors, accepted requests still processing, missing logins and rate limits are worth retrying
+func finalStatus(status int) bool {
+	switch status {
+	case fiber.StatusAccepted, fiber.StatusUnauthorized, fiber.StatusForbidden, fiber.StatusTooManyRequests:
+		return false
+	}
+	return status < fiber.StatusInternalServerError
+}
+
+// requestFingerprint hashes what decides the outcome of a request: its method, URL, location and body
+func requestFingerprint(c *fiber.Ctx) string {
+	h := sha256.New()
+	h.Write([]byte(c.Method() + " " + c.OriginalURL() + "\n" + c.Get(LocationHeader) + "\n"))
+	h.Write(c.Body())
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/squaretest"
+	"github.com/square/square-go-sdk"
+)
+
+func TestFinalStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{fiber.StatusOK, true},
+		{fiber.StatusCreated, true},
+		{fiber.StatusAccepted, false},
+		{fiber.StatusBadRequest, true},
+		{fiber.StatusUnauthorized, false},
+		{fiber.StatusForbidden, false},
+		{fiber.StatusNotFound, true},
+		{fiber.StatusConflict, true},
+		{fiber.StatusUnprocessableEntity, true},
+		{fiber.StatusTooManyRequests, false},
+		{fiber.StatusInternalServerError, false},
+		{fiber.StatusBadGateway, false},
+	}
+
+	for _, tt := range tests {
+		if got := finalStatus(tt.status); got != tt.want {
+			t.Errorf("finalStatus(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRequestFingerprint(t *testing.T) {
+	type request struct {
+		method, path, location, body string
+	}
+	base := request{fiber.MethodPost, "/v1/orders/o1/pay", "L1", `{"paymentId":"p1"}`}
+
+	tests := []struct {
+		name string
+		req  request
+		same bool
+	}{
+		{"same request", base, true},
+		{"other method", request{fiber.MethodPatch, base.path, base.location, base.body}, false},
+		{"other path", request{base.method, "/v1/orders/o2/pay", base.location, base.body}, false},
+		{"other query", request{base.method, base.path + "?check=1", base.location, base.body}, false},
+		{"other location", request{base.method, base.path, "L2", base.body}, false},
+		{"other body", request{base.method, base.path, base.location, `{"paymentId":"p2"}`}, false},
+	}
+
+	fingerprint := func(t *testing.T, r request) string {
+		var got string
+		app := fiber.New()
+		app.Use(func(c *fiber.Ctx) error {
+			got = requestFingerprint(c)
+			return c.SendStatus(fiber.StatusNoContent)
+		})
+		req := httptest.NewRequest(r.method, r.path, strings.NewReader(r.body))
+		req.Header.Set(LocationHeader, r.location)
+		if _, err := app.Test(req); err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		return got
+	}
+
+	want := fingerprint(t, base)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fingerprint(t, tt.req); (got == want) != tt.same {
+				t.Errorf("fingerprint %s, first request %s, want same %v", got, want, tt.same)
+			}
+		})
+	}
+}
+
+func TestEndToEndOrderRetry(t *testing.T) {
+	stand := &lostResponses{Handler: squaretest.NewHandler(), route: squaretest.RouteCreateOrder}
+	server := httptest.NewServer(stand)
+	t.Cleanup(server.Close)
+	a := newTestApp(t, pos.NewSquare(server.URL))
+	admin := firstAdmin(t, a, "e2e-device")
+	body := fiber.Map{
+		"tableNumber": "5",
+		"items":       []fiber.Map{{"variationId": pos.FakeVariationBurgerRegular, "quantity": 1}},
+	}
+
+	// Square makes the order but its answer is lost, the retry gets the same order
+	stand.lose.Store(true)
+	admin.expect(fiber.StatusInternalServerError, nil, fiber.MethodPost, "/v1/orders", body, IdempotencyKeyHeader, "table-5")
+	stand.lose.Store(false)
+	var order models.Order
+	admin.expect(fiber.StatusOK, &order, fiber.MethodPost, "/v1/orders", body, IdempotencyKeyHeader, "table-5")
+	// Square's amounts are matched to the items by the UIDs sent the first time
+	if order.Totals.Due != usd(1200) || len(order.Items) != 1 || order.Items[0].Amount != usd(1200) {
+		t.Errorf("order due %s with items %+v, want 12.00 USD and the item's amount from Square", order.Totals.Due, order.Items)
+	}
+
+	resp, err := pos.NewSquare(server.URL).Connect(pos.Sandbox, admin.token).SearchOrders(context.Background(), &square.SearchOrdersRequest{
+		LocationIDs: []string{order.LocationID},
+	})
+	if err != nil {
+		t.Fatalf("SearchOrders: %v", err)
+	}
+	if len(resp.Orders) != 1 || *resp.Orders[0].ID != order.ID {
+		t.Fatalf("%d orders in Square, want only %s", len(resp.Orders), order.ID)
+	}
+	var orders []models.Order
+	admin.expect(fiber.StatusOK, &orders, fiber.MethodGet, "/v1/orders/table/5", nil)
+	if len(orders) != 1 {
+		t.Errorf("%d orders for table 5, want 1", len(orders))
+	}
+
+	// The same key at another restaurant is another order
+	neighbour := firstAdmin(t, a, "e2e-neighbour")
+	var other models.Order
+	neighbour.expect(fiber.StatusOK, &other, fiber.MethodPost, "/v1/orders", body, IdempotencyKeyHeader, "table-5")
+	if other.ID == order.ID {
+		t.Error("another restaurant got the same Square order")
+	}
+}
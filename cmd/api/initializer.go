@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
@@ -11,14 +15,27 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 	middlewareLogger "github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/joho/godotenv"
+	"github.com/sasirura/restaurant-api/internal/auth"
 	"github.com/sasirura/restaurant-api/internal/handlers"
+	"github.com/sasirura/restaurant-api/internal/keyring"
 	"github.com/sasirura/restaurant-api/internal/logger"
 	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
 	"github.com/sasirura/restaurant-api/internal/services"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+// defaultOAuthScopes are the Square permissions requested during onboarding
+var defaultOAuthScopes = []string{
+	"ITEMS_READ",
+	"MERCHANT_PROFILE_READ",
+	"ORDERS_READ",
+	"ORDERS_WRITE",
+	"PAYMENTS_READ",
+	"PAYMENTS_WRITE",
+}
+
 // Init initializes the application
 func Initialize() (*App, error) {
 	// Initialize logger
@@ -43,10 +60,14 @@ func Initialize() (*App, error) {
 		return nil, err
 	}
 
-	// Auto-migrate models
-	if err := db.AutoMigrate(&models.Restaurant{}, &models.Order{}, &models.OrderItem{},
-		&models.Discount{}, &models.Modifier{}, &models.OrderTotals{}, models.PaymentRequest{}); err != nil {
-		log.Error("Failed to migrate database", "error", err)
+	// Token encryption
+	// TOKEN_ENCRYPTION_KEYS lists master keys as id:base64key, TOKEN_ENCRYPTION_KEY_ID picks the one new tokens are sealed with
+	keys, err := loadKeyring()
+	if err != nil {
+		log.Error("Failed to load token encryption keys", "error", err)
+		return nil, err
+	}
+	if err := migrate(db, keys, log); err != nil {
 		return nil, err
 	}
 
@@ -76,13 +97,192 @@ func Initialize() (*App, error) {
 		Expiration: 60,
 	}))
 
+	// Token cache
+	// TOKEN_CACHE_TTL controls how long a verified Square token is trusted before asking Square again
+	tokenCacheTTL := 5 * time.Minute
+	if v := os.Getenv("TOKEN_CACHE_TTL"); v != "" {
+		tokenCacheTTL, err = time.ParseDuration(v)
+		if err != nil {
+			log.Error("Invalid TOKEN_CACHE_TTL", "error", err)
+			return nil, err
+		}
+	}
+	tokens := auth.NewTokenCache(tokenCacheTTL)
+
+	// Initialize POS gateway
+	// POS_GATEWAY=fake keeps orders and payments in memory so the API runs without Square
+	// SQUARE_BASE_URL points the Square gateway at another host, e.g. a local stand-in
+	// SQUARE_ENVIRONMENT (sandbox or production) is where new restaurants are created and onboarded
+	environment := pos.Sandbox
+	if v := os.Getenv("SQUARE_ENVIRONMENT"); v != "" {
+		environment, err = pos.ParseEnvironment(v)
+		if err != nil {
+			log.Error("Invalid SQUARE_ENVIRONMENT", "error", err)
+			return nil, err
+		}
+	}
+
+	var connector pos.Connector
+	switch os.Getenv("POS_GATEWAY") {
+	case "", "square":
+		baseURL := os.Getenv("SQUARE_BASE_URL")
+		log.Info("Using Square POS gateway", "environment", string(environment), "base_url", baseURL)
+		squareConnector := pos.NewSquare(baseURL)
+		squareConnector.OnUnauthorized = tokens.Invalidate
+		connector = squareConnector
+	case "fake":
+		log.Info("Using in-memory POS gateway")
+		connector = pos.NewFake()
+	default:
+		log.Error("Unknown POS_GATEWAY", "pos_gateway", os.Getenv("POS_GATEWAY"))
+		return nil, errors.New("POS_GATEWAY must be either square or fake")
+	}
+	if err := migrateMerchantIDs(context.Background(), db, connector, keys, log); err != nil {
+		log.Error("Failed to migrate merchant IDs", "error", err)
+		return nil, err
+	}
+
 	// Initialize services
 	squareService := services.New(db, log)
+	apiKeyService := services.NewAPIKeys(db, keys, log)
+	locationService := services.NewLocations(db, log)
+	pricingService := services.NewPricing(db, log)
+	menuService := services.NewMenu(db, log)
+
+	// STAFF_SESSION_TTL is how long a staff login lasts, roughly one shift
+	staffSessionTTL := 8 * time.Hour
+	if v := os.Getenv("STAFF_SESSION_TTL"); v != "" {
+		staffSessionTTL, err = time.ParseDuration(v)
+		if err != nil {
+			log.Error("Invalid STAFF_SESSION_TTL", "error", err)
+			return nil, err
+		}
+	}
+	staffService := services.NewStaff(db, keys, staffSessionTTL, log)
+
+	// IDEMPOTENCY_KEY_TTL is how long responses are kept for requests retried with the same Idempotency-Key
+	idempotencyKeyTTL := 24 * time.Hour
+	if v := os.Getenv("IDEMPOTENCY_KEY_TTL"); v != "" {
+		idempotencyKeyTTL, err = time.ParseDuration(v)
+		if err != nil {
+			log.Error("Invalid IDEMPOTENCY_KEY_TTL", "error", err)
+			return nil, err
+		}
+	}
+
+	// Square OAuth onboarding is enabled once the application credentials are configured
+	var oauthService *services.OAuthService
+	if applicationID := os.Getenv("SQUARE_APPLICATION_ID"); applicationID != "" {
+		scopes := strings.Fields(os.Getenv("SQUARE_OAUTH_SCOPES"))
+		if len(scopes) == 0 {
+			scopes = defaultOAuthScopes
+		}
+		oauthService = services.NewOAuth(db, connector, keys, services.OAuthConfig{
+			ApplicationID:     applicationID,
+			ApplicationSecret: os.Getenv("SQUARE_APPLICATION_SECRET"),
+			RedirectURL:       os.Getenv("SQUARE_OAUTH_REDIRECT_URL"),
+			Scopes:            scopes,
+			Environment:       environment,
+		}, log)
+	}
+
+	// Square webhooks are received once the subscription's signature key is configured.
+	// SQUARE_WEBHOOK_URL must be the notification URL exactly as registered with Square, it is part of the signature
+	var webhookService *services.WebhookService
+	if signatureKey := os.Getenv("SQUARE_WEBHOOK_SIGNATURE_KEY"); signatureKey != "" {
+		notificationURL := os.Getenv("SQUARE_WEBHOOK_URL")
+		if notificationURL == "" {
+			log.Error("SQUARE_WEBHOOK_URL is not set")
+			return nil, errors.New("SQUARE_WEBHOOK_URL is required when SQUARE_WEBHOOK_SIGNATURE_KEY is set")
+		}
+		webhookService = services.NewWebhooks(db, squareService, menuService, connector, keys, environment, signatureKey, notificationURL, log)
+	}
 
 	return &App{
 		fiber:         app,
 		db:            db,
 		squareService: squareService,
+		oauthService:  oauthService,
+		apiKeyService: apiKeyService,
+		staffService:  staffService,
+		locations:     locationService,
+		pricing:       pricingService,
+		menu:          menuService,
+		reconciler:    services.NewPaymentReconciler(db, squareService, connector, keys, log),
+		orders:        services.NewOrderReconciler(db, squareService, locationService, connector, keys, log),
+		idempotency:   services.NewIdempotency(db, idempotencyKeyTTL, log),
+		webhooks:      webhookService,
+		pos:           connector,
+		environment:   environment,
+		tokens:        tokens,
+		keys:          keys,
 		logger:        log,
 	}, nil
 }
+
+// migrate brings the schema and the stored data up to date
+func migrate(db *gorm.DB, keys *keyring.Keyring, log *logger.Logger) error {
+	// Auto-migrate models
+	if err := db.AutoMigrate(&models.Restaurant{}, &models.Order{}, &models.OrderItem{},
+		&models.Discount{}, &models.Modifier{}, &models.OrderTotals{}, models.PaymentRequest{}, &models.OAuthState{}, &models.APIKey{}, &models.Staff{}, &models.StaffSession{}, &models.Location{},
+		&models.TaxRule{}, &models.ServiceCharge{}, &models.OrderTransition{}, &models.Refund{}, &models.Payment{}, &models.Check{}, &models.IdempotencyRecord{}, &models.WebhookEvent{},
+		&models.MenuCategory{}, &models.MenuItem{}, &models.MenuVariation{}, &models.MenuModifierList{}, &models.MenuModifier{}); err != nil {
+		log.Error("Failed to migrate database", "error", err)
+		return err
+	}
+
+	if err := migrateSquareTokens(db, keys, log); err != nil {
+		log.Error("Failed to migrate Square tokens", "error", err)
+		return err
+	}
+	if err := migrateMoneyColumns(db, log); err != nil {
+		log.Error("Failed to migrate money columns", "error", err)
+		return err
+	}
+	if err := migrateOrderLocations(db, log); err != nil {
+		log.Error("Failed to migrate order locations", "error", err)
+		return err
+	}
+	if err := migrateOrderStates(db, log); err != nil {
+		log.Error("Failed to migrate order states", "error", err)
+		return err
+	}
+	if err := migratePaymentIndex(db, log); err != nil {
+		log.Error("Failed to migrate payment index", "error", err)
+		return err
+	}
+	if err := migrateIdempotencyRecords(db, log); err != nil {
+		log.Error("Failed to migrate idempotency records", "error", err)
+		return err
+	}
+	return nil
+}
+
+// loadKeyring reads the token encryption keys from the environment
+func loadKeyring() (*keyring.Keyring, error) {
+	spec := os.Getenv("TOKEN_ENCRYPTION_KEYS")
+	if spec == "" {
+		return nil, errors.New("TOKEN_ENCRYPTION_KEYS environment variable is required")
+	}
+	keys, err := keyring.ParseKeys(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	active := os.Getenv("TOKEN_ENCRYPTION_KEY_ID")
+	if active == "" {
+		if len(keys) != 1 {
+			return nil, errors.New("TOKEN_ENCRYPTION_KEY_ID is required when several keys are configured")
+		}
+		for id := range keys {
+			active = id
+		}
+	}
+
+	hashKey, err := base64.StdEncoding.DecodeString(os.Getenv("TOKEN_HASH_KEY"))
+	if err != nil {
+		return nil, errors.New("TOKEN_HASH_KEY must be base64 encoded")
+	}
+
+	return keyring.New(keys, active, hashKey)
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
+	"github.com/sasirura/restaurant-api/internal/auth"
+	"github.com/sasirura/restaurant-api/internal/keyring"
 	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/pos"
 	"github.com/sasirura/restaurant-api/internal/services"
 	"gorm.io/gorm"
 )
@@ -13,6 +19,20 @@ type App struct {
 	fiber         *fiber.App
 	db            *gorm.DB
 	squareService *services.SquareService
+	oauthService  *services.OAuthService
+	apiKeyService *services.APIKeyService
+	staffService  *services.StaffService
+	locations     *services.LocationService
+	pricing       *services.PricingService
+	menu          *services.MenuService
+	reconciler    *services.PaymentReconciler
+	orders        *services.OrderReconciler
+	idempotency   *services.IdempotencyService
+	webhooks      *services.WebhookService
+	pos           pos.Connector
+	environment   pos.Environment
+	tokens        *auth.TokenCache
+	keys          *keyring.Keyring
 	logger        *logger.Logger
 }
 
@@ -25,6 +45,19 @@ func main() {
 
 	app.Routes()
 
+	if app.oauthService != nil {
+		// Square access tokens last 30 days, renew them well before that
+		go app.oauthService.RunRefresher(context.Background(), time.Hour, 7*24*time.Hour)
+	}
+
+	go app.idempotency.RunPurger(context.Background(), time.Hour)
+
+	// Payments left processing by a crash or an unreachable Square are resolved once Square has had time to answer
+	go app.reconciler.Run(context.Background(), time.Minute, 5*time.Minute)
+
+	// Orders changed in Square whose webhooks were missed are repaired, each run overlaps the previous ones
+	go app.orders.Run(context.Background(), 15*time.Minute, time.Hour)
+
 	if err := app.Serve(); err != nil {
 		app.logger.Fatal("Failed to run app", "error", err)
 	}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sasirura/restaurant-api/internal/keyring"
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"gorm.io/gorm"
+)
+
+// legacyTokenColumn held Square tokens in plaintext before they were encrypted
+const legacyTokenColumn = "sqaure_token"
+
+// migrateSquareTokens encrypts plaintext tokens left by older versions and
+// rewraps tokens sealed with a key that is no longer the active one
+func migrateSquareTokens(db *gorm.DB, keys *keyring.Keyring, log *logger.Logger) error {
+	if db.Migrator().HasColumn(&models.Restaurant{}, legacyTokenColumn) {
+		var rows []struct {
+			ID          uint
+			SqaureToken string
+		}
+		if err := db.Table("restaurants").
+			Select("id", legacyTokenColumn).
+			Where(legacyTokenColumn + " IS NOT NULL AND " + legacyTokenColumn + " <> ''").
+			Scan(&rows).Error; err != nil {
+			return fmt.Errorf("failed to read plaintext tokens: %w", err)
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, row := range rows {
+				sealed, err := keys.Seal(row.SqaureToken)
+				if err != nil {
+					return err
+				}
+				if err := tx.Model(&models.Restaurant{}).Where("id = ?", row.ID).Updates(models.Restaurant{
+					SquareTokenHash: keys.Hash(row.SqaureToken),
+					SquareToken:     sealed,
+				}).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&models.Restaurant{}, legacyTokenColumn)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encrypt plaintext tokens: %w", err)
+		}
+		log.Info("Encrypted plaintext Square tokens", "count", fmt.Sprintf("%d", len(rows)))
+	}
+
+	var restaurants []models.Restaurant
+	if err := db.Where("square_token_key_id <> ? OR (square_refresh_token_key_id <> '' AND square_refresh_token_key_id <> ?)",
+		keys.ActiveKeyID(), keys.ActiveKeyID()).Find(&restaurants).Error; err != nil {
+		return fmt.Errorf("failed to find tokens to rotate: %w", err)
+	}
+	for _, restaurant := range restaurants {
+		sealed, err := keys.Rewrap(restaurant.SquareToken)
+		if err != nil {
+			return fmt.Errorf("failed to rotate token of restaurant %d: %w", restaurant.ID, err)
+		}
+		update := models.Restaurant{SquareToken: sealed}
+		if !restaurant.SquareRefreshToken.IsZero() {
+			update.SquareRefreshToken, err = keys.Rewrap(restaurant.SquareRefreshToken)
+			if err != nil {
+				return fmt.Errorf("failed to rotate refresh token of restaurant %d: %w", restaurant.ID, err)
+			}
+		}
+		if err := db.Model(&restaurant).Updates(update).Error; err != nil {
+			return fmt.Errorf("failed to rotate token of restaurant %d: %w", restaurant.ID, err)
+		}
+	}
+	if len(restaurants) > 0 {
+		log.Info("Rotated Square token keys", "count", fmt.Sprintf("%d", len(restaurants)), "key_id", keys.ActiveKeyID())
+	}
+
+	return nil
+}
+
+// migrateIdempotencyRecords deletes the responses older versions stored without a staff member. They may hold
+// staff session tokens and API keys, which are no longer stored, and can no longer be replayed
+func migrateIdempotencyRecords(db *gorm.DB, log *logger.Logger) error {
+	result := db.Unscoped().Where("staff_id = 0").Delete(&models.IdempotencyRecord{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete idempotency records: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		log.Info("Deleted idempotency records without staff", "count", fmt.Sprintf("%d", result.RowsAffected))
+	}
+	return nil
+}
+
+// migrateMerchantIDs asks Square for the merchant of restaurants created before merchants were recorded,
+// restaurants are found by merchant so later tokens and onboarding do not create a second one.
+// Restaurants whose token Square no longer accepts are left for their next request
+func migrateMerchantIDs(ctx context.Context, db *gorm.DB, connector pos.Connector, keys *keyring.Keyring, log *logger.Logger) error {
+	var restaurants []models.Restaurant
+	if err := db.Where("merchant_id = '' OR merchant_id IS NULL").Find(&restaurants).Error; err != nil {
+		return fmt.Errorf("failed to find restaurants without merchant: %w", err)
+	}
+	for _, restaurant := range restaurants {
+		token, err := keys.Open(restaurant.SquareToken)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt token of restaurant %d: %w", restaurant.ID, err)
+		}
+		status, err := connector.Connect(restaurant.SquareEnvironment, token).RetrieveTokenStatus(ctx)
+		if err != nil || status.MerchantID == nil {
+			log.Error("Failed to look up merchant", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "error", fmt.Sprint(err))
+			continue
+		}
+		if err := db.Model(&restaurant).Update("merchant_id", *status.MerchantID).Error; err != nil {
+			return fmt.Errorf("failed to record merchant of restaurant %d: %w", restaurant.ID, err)
+		}
+		log.Info("Recorded merchant", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "merchant_id", *status.MerchantID)
+	}
+	return nil
+}
+
+// migrateOrderLocations assigns orders placed before locations were tracked to their restaurant's default location
+func migrateOrderLocations(db *gorm.DB, log *logger.Logger) error {
+	result := db.Model(&models.Order{}).
+		Where("location_id IS NULL OR location_id = ''").
+		Update("location_id", db.Model(&models.Restaurant{}).Select("location_id").Where("restaurants.id = orders.restautant_id"))
+	if result.Error != nil {
+		return fmt.Errorf("failed to assign order locations: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		log.Info("Assigned locations to existing orders", "count", fmt.Sprintf("%d", result.RowsAffected))
+	}
+	return nil
+}
+
+// legacyCurrency is the currency every amount was charged in before money carried its currency
+const legacyCurrency = "USD"
+
+// legacyMoneyColumns were float columns holding minor units, each is now split into <column>_amount and <column>_currency
+var legacyMoneyColumns = []struct {
+	model   any
+	columns []string
+}{
+	{&models.OrderItem{}, []string{"unit_price", "amount"}},
+	{&models.Discount{}, []string{"amount"}},
+	{&models.Modifier{}, []string{"unit_price", "amount"}},
+	{&models.OrderTotals{}, []string{"discounts", "due", "tax", "service_charge", "paid", "tips", "total"}},
+	{&models.PaymentRequest{}, []string{"bill_amount", "tip_amount"}},
+}
+
+// migrateOrderStates gives orders closed by older versions the paid state and drops their is_closed flag,
+// the state column defaults to open
+func migrateOrderStates(db *gorm.DB, log *logger.Logger) error {
+	if !db.Migrator().HasColumn(&models.Order{}, "is_closed") {
+		return nil
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Order{}).
+			Where("is_closed = ? AND state = ?", true, models.OrderStateOpen).
+			Update("state", models.OrderStatePaid)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			log.Info("Marked closed orders as paid", "count", fmt.Sprintf("%d", result.RowsAffected))
+		}
+		return tx.Migrator().DropColumn(&models.Order{}, "is_closed")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate order states: %w", err)
+	}
+	return nil
+}
+
+// legacyPaymentIndex made Square payment IDs unique including the empty ID of processing payments
+const legacyPaymentIndex = "idx_payments_square_payment_id"
+
+// migratePaymentIndex drops the unique index older versions kept on Square payment IDs,
+// idx_payment_square_id replaces it and skips payments still processing
+func migratePaymentIndex(db *gorm.DB, log *logger.Logger) error {
+	if !db.Migrator().HasIndex(&models.Payment{}, legacyPaymentIndex) {
+		return nil
+	}
+	if err := db.Migrator().DropIndex(&models.Payment{}, legacyPaymentIndex); err != nil {
+		return fmt.Errorf("failed to drop %s: %w", legacyPaymentIndex, err)
+	}
+	log.Info("Dropped legacy payment index", "index", legacyPaymentIndex)
+	return nil
+}
+
+// migrateMoneyColumns moves amounts out of the float columns of older versions and drops them
+func migrateMoneyColumns(db *gorm.DB, log *logger.Logger) error {
+	migrated := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Discount values were either a percentage or an amount depending on is_percentage
+		if tx.Migrator().HasColumn(&models.Discount{}, "value") {
+			if err := tx.Unscoped().Model(&models.Discount{}).Where("value IS NOT NULL AND is_percentage").
+				Update("percentage", gorm.Expr("CAST(value AS TEXT)")).Error; err != nil {
+				return fmt.Errorf("discounts.value: %w", err)
+			}
+			if err := tx.Unscoped().Model(&models.Discount{}).Where("value IS NOT NULL AND NOT is_percentage").
+				Updates(map[string]any{"value_amount": gorm.Expr("ROUND(value)"), "value_currency": legacyCurrency}).Error; err != nil {
+				return fmt.Errorf("discounts.value: %w", err)
+			}
+			if err := tx.Migrator().DropColumn(&models.Discount{}, "value"); err != nil {
+				return fmt.Errorf("discounts.value: %w", err)
+			}
+			migrated++
+		}
+
+		// Orders were always charged in USD before they carried their currency
+		if err := tx.Unscoped().Model(&models.Order{}).Where("currency IS NULL OR currency = ''").
+			Update("currency", legacyCurrency).Error; err != nil {
+			return fmt.Errorf("orders.currency: %w", err)
+		}
+
+		for _, legacy := range legacyMoneyColumns {
+			for _, column := range legacy.columns {
+				if !tx.Migrator().HasColumn(legacy.model, column) {
+					continue
+				}
+				if err := tx.Unscoped().Model(legacy.model).Where(column + " IS NOT NULL").Updates(map[string]any{
+					column + "_amount":   gorm.Expr("ROUND(" + column + ")"),
+					column + "_currency": legacyCurrency,
+				}).Error; err != nil {
+					return fmt.Errorf("%s: %w", column, err)
+				}
+				if err := tx.Migrator().DropColumn(legacy.model, column); err != nil {
+					return fmt.Errorf("%s: %w", column, err)
+				}
+				migrated++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate money columns: %w", err)
+	}
+	if migrated > 0 {
+		log.Info("Migrated float money columns", "count", fmt.Sprintf("%d", migrated))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/services"
+	"github.com/square/square-go-sdk"
+)
+
+const testRedirectURL = "https://api.example.com/oauth/square/callback"
+
+// withOAuth enables Square OAuth onboarding
+func withOAuth(a *App) {
+	a.oauthService = services.NewOAuth(a.db, a.pos, a.keys, services.OAuthConfig{
+		ApplicationID:     "sandbox-app",
+		ApplicationSecret: "sandbox-secret",
+		RedirectURL:       testRedirectURL,
+		Scopes:            defaultOAuthScopes,
+		Environment:       pos.Sandbox,
+	}, a.logger)
+}
+
+// authorize starts an onboarding and returns the query Square sends back to the callback
+func authorize(t *testing.T, a *App) url.Values {
+	t.Helper()
+	device := &client{t: t, app: a}
+	status, header, raw := device.do(fiber.MethodGet, "/oauth/square/authorize", nil)
+	if status != fiber.StatusFound {
+		t.Fatalf("authorize = %d %s, want 302", status, raw)
+	}
+	redirect, err := url.Parse(header.Get(fiber.HeaderLocation))
+	if err != nil {
+		t.Fatalf("redirect: %v", err)
+	}
+	return redirect.Query()
+}
+
+type onboarded struct {
+	RestaurantID uint   `json:"restaurantId"`
+	MerchantID   string `json:"merchantId"`
+	Key          string `json:"key"`
+}
+
+// onboard completes an onboarding for the merchant of code and returns the restaurant's first API key
+func onboard(t *testing.T, a *App, code string) onboarded {
+	t.Helper()
+	state := authorize(t, a).Get("state")
+	var resp onboarded
+	device := &client{t: t, app: a}
+	device.expect(fiber.StatusCreated, &resp, fiber.MethodGet, "/oauth/square/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	return resp
+}
+
+func TestEndToEndOAuthCallback(t *testing.T) {
+	a := newTestApp(t, pos.NewFake(), withOAuth)
+	device := &client{t: t, app: a}
+
+	query := authorize(t, a)
+	if query.Get("code") == "" || query.Get("state") == "" {
+		t.Fatalf("redirected with %v, want a code and state", query)
+	}
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"declined by the merchant", url.Values{"error": {"access_denied"}, "state": {query.Get("state")}}, fiber.StatusBadRequest},
+		{"missing code", url.Values{"state": {query.Get("state")}}, fiber.StatusBadRequest},
+		{"unknown state", url.Values{"code": {query.Get("code")}, "state": {"forged"}}, fiber.StatusBadRequest},
+		{"missing state", url.Values{"code": {query.Get("code")}}, fiber.StatusBadRequest},
+		{"matching state", query, fiber.StatusCreated},
+		{"state used twice", query, fiber.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device.t = t
+			var resp onboarded
+			device.expect(tt.status, &resp, fiber.MethodGet, "/oauth/square/callback?"+tt.query.Encode(), nil)
+			if tt.status != fiber.StatusCreated {
+				return
+			}
+			if resp.MerchantID != pos.FakeMerchantID(query.Get("code")) || resp.RestaurantID == 0 {
+				t.Errorf("onboarded %+v, want the code's merchant", resp)
+			}
+			if !services.IsAPIKey(resp.Key) {
+				t.Errorf("key %q is not an API key", resp.Key)
+			}
+		})
+	}
+}
+
+func TestEndToEndOAuthRevocation(t *testing.T) {
+	a := newTestApp(t, pos.NewFake(), withOAuth)
+	ctx := context.Background()
+
+	kept := onboard(t, a, "kept")
+	revokedInSquare := onboard(t, a, "revoked-in-square")
+	admin := firstAdmin(t, a, kept.Key)
+	other := firstAdmin(t, a, revokedInSquare.Key)
+
+	// The merchant revokes our access in Square, the refresher finds out and stops accepting the restaurant's key
+	if _, err := a.pos.OAuth(pos.Sandbox).RevokeToken(ctx, "sandbox-secret", &square.RevokeTokenRequest{
+		MerchantID: square.String(revokedInSquare.MerchantID),
+	}); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	if err := a.oauthService.RefreshExpiring(ctx, 31*24*time.Hour); err != nil {
+		t.Fatalf("RefreshExpiring: %v", err)
+	}
+	admin.expect(fiber.StatusOK, nil, fiber.MethodGet, "/v1/staff", nil)
+	other.expect(fiber.StatusUnauthorized, nil, fiber.MethodGet, "/v1/staff", nil)
+
+	// Revoking through the API revokes the token in Square too
+	admin.expect(fiber.StatusOK, nil, fiber.MethodPost, "/v1/oauth/square/revoke", nil)
+	admin.expect(fiber.StatusUnauthorized, nil, fiber.MethodGet, "/v1/staff", nil)
+
+	// Onboarding the merchant again restores the restaurant, its keys and staff
+	again := onboard(t, a, "kept")
+	if again.RestaurantID != kept.RestaurantID {
+		t.Errorf("reconnected as restaurant %d, want %d", again.RestaurantID, kept.RestaurantID)
+	}
+	admin.expect(fiber.StatusOK, nil, fiber.MethodGet, "/v1/staff", nil)
+}
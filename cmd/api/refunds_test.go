@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+)
+
+func TestEndToEndRefunds(t *testing.T) {
+	a := newTestApp(t, pos.NewFake())
+	admin := firstAdmin(t, a, "e2e-device")
+	neighbour := firstAdmin(t, a, "e2e-neighbour")
+	waiter := admin.login(addStaff(admin, "server", "5678").ID, "5678")
+
+	var order models.Order
+	admin.expect(fiber.StatusOK, &order, fiber.MethodPost, "/v1/orders", fiber.Map{
+		"tableNumber": "3",
+		"items":       []fiber.Map{{"variationId": pos.FakeVariationBurgerRegular, "quantity": 1}},
+	})
+	admin.expect(fiber.StatusOK, nil, fiber.MethodPost, orderPath(order, "/pay"), fiber.Map{"paymentId": "pay-1", "billAmount": usd(1200), "tipAmount": usd(300)})
+	var payments []models.Payment
+	admin.expect(fiber.StatusOK, &payments, fiber.MethodGet, orderPath(order, "/payments"), nil)
+	if len(payments) != 1 || payments[0].SquarePaymentID == "" {
+		t.Fatalf("payments %+v, want one taken by Square", payments)
+	}
+	refunds := orderPath(order, "/payments/"+payments[0].SquarePaymentID+"/refunds")
+
+	tests := []struct {
+		name   string
+		client *client
+		path   string
+		body   fiber.Map
+		status int
+		// refunded is what the order has refunded afterwards
+		refunded models.Money
+		state    models.OrderState
+	}{
+		{"missing idempotency key", admin, refunds, fiber.Map{"reason": "cold"}, fiber.StatusBadRequest, usd(0), models.OrderStatePaid},
+		{"missing reason", admin, refunds, fiber.Map{"idempotencyKey": "r-1"}, fiber.StatusBadRequest, usd(0), models.OrderStatePaid},
+		{"servers cannot refund", waiter, refunds, fiber.Map{"idempotencyKey": "r-1", "reason": "cold"}, fiber.StatusForbidden, usd(0), models.OrderStatePaid},
+		{"another restaurant's order", neighbour, refunds, fiber.Map{"idempotencyKey": "r-1", "reason": "cold"}, fiber.StatusNotFound, usd(0), models.OrderStatePaid},
+		{"unknown payment", admin, orderPath(order, "/payments/unknown/refunds"), fiber.Map{"idempotencyKey": "r-1", "reason": "cold"}, fiber.StatusNotFound, usd(0), models.OrderStatePaid},
+		{"more than was paid", admin, refunds, fiber.Map{"idempotencyKey": "r-1", "reason": "cold", "amount": usd(1501)}, fiber.StatusBadRequest, usd(0), models.OrderStatePaid},
+		{"another currency", admin, refunds, fiber.Map{"idempotencyKey": "r-1", "reason": "cold", "amount": models.NewMoney(500, "EUR")}, fiber.StatusBadRequest, usd(0), models.OrderStatePaid},
+		{"part of the payment", admin, refunds, fiber.Map{"idempotencyKey": "r-1", "reason": "cold", "amount": usd(500)}, fiber.StatusOK, usd(500), models.OrderStatePaid},
+		{"retried", admin, refunds, fiber.Map{"idempotencyKey": "r-1", "reason": "cold", "amount": usd(500)}, fiber.StatusOK, usd(500), models.OrderStatePaid},
+		{"the rest", admin, refunds, fiber.Map{"idempotencyKey": "r-2", "reason": "left early"}, fiber.StatusOK, usd(1500), models.OrderStateRefunded},
+		{"nothing left", admin, refunds, fiber.Map{"idempotencyKey": "r-3", "reason": "again"}, fiber.StatusBadRequest, usd(1500), models.OrderStateRefunded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.client.t, admin.t = t, t
+			tt.client.expect(tt.status, nil, fiber.MethodPost, tt.path, tt.body)
+
+			var got models.Order
+			admin.expect(fiber.StatusOK, &got, fiber.MethodGet, orderPath(order, ""), nil)
+			if got.Totals.Refunded != tt.refunded || got.State != tt.state {
+				t.Errorf("order %s with %s refunded, want %s and %s", got.State, got.Totals.Refunded, tt.state, tt.refunded)
+			}
+		})
+	}
+	admin.t = t
+
+	// The retry returned the first refund rather than making another
+	var made []models.Refund
+	admin.expect(fiber.StatusOK, &made, fiber.MethodGet, orderPath(order, "/refunds"), nil)
+	if len(made) != 2 || made[0].Amount != usd(500) || made[1].Amount != usd(1000) || made[0].StaffID == 0 {
+		t.Fatalf("refunds %+v, want 5.00 USD and 10.00 USD by a staff member", made)
+	}
+	admin.expect(fiber.StatusOK, &payments, fiber.MethodGet, orderPath(order, "/payments"), nil)
+	if payments[0].Refunded != usd(1500) {
+		t.Errorf("payment refunded %s, want 15.00 USD", payments[0].Refunded)
+	}
+}
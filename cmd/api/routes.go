@@ -1,7 +1,9 @@
 package main
 
 import (
+	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/monitor"
+	"github.com/sasirura/restaurant-api/internal/auth"
 	"github.com/sasirura/restaurant-api/internal/handlers"
 )
 
@@ -12,13 +14,83 @@ func (a *App) Routes() {
 	// access this by baseUrl/metrics
 	a.fiber.Get("/metrics", monitor.New(monitor.Config{
 		Title: "Square POS API Metrics Page"}))
+
+	// Square OAuth onboarding
+	if a.oauthService != nil {
+		a.fiber.Get("/oauth/square/authorize", handlers.AuthorizeSquare(a.oauthService))
+		a.fiber.Get("/oauth/square/callback", handlers.SquareCallback(a.oauthService, a.apiKeyService))
+	}
+
+	// Square webhooks, authenticated by Square's signature
+	if a.webhooks != nil {
+		a.fiber.Post("/webhooks/square", handlers.SquareWebhook(a.webhooks))
+	}
+
 	v1 := a.fiber.Group("/v1")
 	{
 		// Authenticated routes
-		auth := v1.Group("/", Authenticate(a.db))
-		auth.Post("/orders", handlers.CreateOrder(a.squareService))
-		auth.Get("/orders/:id", handlers.GetOrderByID(a.squareService))
-		auth.Get("/orders/table/:tableNumber", handlers.GetOrdersByTable(a.squareService))
-		auth.Post("/orders/:orderId/pay", handlers.ProcessPayment(a.squareService))
+		// Devices authenticate the restaurant, staff log in on them and their role decides what they may do.
+		// Mutating requests sent with an Idempotency-Key are only carried out once, except those issuing credentials
+		protected := v1.Group("/", Authenticate(a.db, a.pos, a.environment, a.tokens, a.keys, a.apiKeyService))
+		once := Idempotency(a.idempotency)
+		protected.Post("/staff/login", handlers.StaffLogin(a.staffService))
+		protected.Post("/staff/logout", a.require(""), once, handlers.StaffLogout(a.staffService, StaffTokenHeader))
+		protected.Get("/staff", a.require(auth.PermManageStaff), handlers.ListStaff(a.staffService))
+		protected.Post("/staff", OptionalStaff(a.staffService), once, handlers.CreateStaff(a.staffService))
+		protected.Patch("/staff/:id", a.require(auth.PermManageStaff), once, handlers.UpdateStaff(a.staffService))
+
+		protected.Get("/locations", a.require(""), handlers.ListLocations(a.locations))
+		protected.Post("/locations/sync", a.require(auth.PermManageRestaurant), once, handlers.SyncLocations(a.locations))
+		protected.Post("/menu/sync", a.require(auth.PermManageRestaurant), once, handlers.SyncMenu(a.menu))
+
+		protected.Get("/payments", a.require(auth.PermTakePayments), handlers.ListPayments(a.squareService))
+
+		protected.Get("/tax-rules", a.require(""), handlers.ListTaxRules(a.pricing))
+		protected.Post("/tax-rules", a.require(auth.PermManageRestaurant), once, handlers.CreateTaxRule(a.pricing))
+		protected.Delete("/tax-rules/:id", a.require(auth.PermManageRestaurant), once, handlers.DeleteTaxRule(a.pricing))
+		protected.Get("/service-charges", a.require(""), handlers.ListServiceCharges(a.pricing))
+		protected.Post("/service-charges", a.require(auth.PermManageRestaurant), once, handlers.CreateServiceCharge(a.pricing))
+		protected.Delete("/service-charges/:id", a.require(auth.PermManageRestaurant), once, handlers.DeleteServiceCharge(a.pricing))
+
+		protected.Post("/orders/reconcile", a.require(auth.PermManageRestaurant), once, handlers.ReconcileOrders(a.orders))
+
+		// Orders and the menu use the location given by the X-Location-ID header, or the path prefix below, and the restaurant's default otherwise
+		a.orderRoutes(protected)
+		a.orderRoutes(protected.Group("/locations/:locationId"))
+
+		protected.Post("/api-keys", a.require(auth.PermManageAPIKeys), handlers.CreateAPIKey(a.apiKeyService))
+		protected.Get("/api-keys", a.require(auth.PermManageAPIKeys), handlers.ListAPIKeys(a.apiKeyService))
+		protected.Delete("/api-keys/:id", a.require(auth.PermManageAPIKeys), once, handlers.RevokeAPIKey(a.apiKeyService))
+		if a.oauthService != nil {
+			protected.Post("/oauth/square/revoke", a.require(auth.PermManageRestaurant), once, handlers.RevokeSquare(a.oauthService))
+		}
 	}
 }
+
+// orderRoutes registers the order and menu endpoints, scoped to the location selected for the request
+func (a *App) orderRoutes(router fiber.Router) {
+	location := SelectLocation(a.locations)
+	once := Idempotency(a.idempotency)
+	router.Get("/menu", a.require(""), location, handlers.GetMenu(a.menu))
+	router.Get("/menu/items/:id", a.require(""), location, handlers.GetMenuItem(a.menu))
+	router.Post("/orders", a.require(auth.PermCreateOrders), once, location, handlers.CreateOrder(a.squareService))
+	router.Get("/orders/:id", a.require(auth.PermViewOrders), location, handlers.GetOrderByID(a.squareService))
+	router.Get("/orders/table/:tableNumber", a.require(auth.PermViewOrders), location, handlers.GetOrdersByTable(a.squareService))
+	router.Post("/orders/:id/items", a.require(auth.PermCreateOrders), once, location, handlers.AddOrderItems(a.squareService))
+	router.Patch("/orders/:id/items/:itemId", a.require(auth.PermCreateOrders), once, location, handlers.UpdateOrderItem(a.squareService))
+	router.Delete("/orders/:id/items/:itemId", a.require(auth.PermCreateOrders), once, location, handlers.RemoveOrderItem(a.squareService))
+	router.Post("/orders/:id/state", a.require(auth.PermCreateOrders), once, location, handlers.TransitionOrder(a.squareService))
+	router.Post("/orders/:id/cancel", a.require(auth.PermCreateOrders), once, location, handlers.CancelOrder(a.squareService))
+	router.Post("/orders/:id/void", a.require(auth.PermVoidOrders), once, location, handlers.VoidOrder(a.squareService))
+	router.Post("/orders/:orderId/pay", a.require(auth.PermTakePayments), once, location, handlers.ProcessPayment(a.squareService))
+	router.Post("/orders/:id/payments/:paymentId/refunds", a.require(auth.PermRefundPayments), once, location, handlers.RefundPayment(a.squareService))
+	router.Get("/orders/:id/payments", a.require(auth.PermViewOrders), location, handlers.ListOrderPayments(a.squareService))
+	router.Get("/orders/:id/refunds", a.require(auth.PermViewOrders), location, handlers.ListRefunds(a.squareService))
+	router.Post("/orders/:id/split", a.require(auth.PermTakePayments), once, location, handlers.SplitOrder(a.squareService))
+	router.Get("/orders/:id/checks", a.require(auth.PermViewOrders), location, handlers.ListChecks(a.squareService))
+}
+
+// require checks the staff session of the request and, unless perm is empty, that its role grants perm
+func (a *App) require(perm auth.Permission) fiber.Handler {
+	return RequirePermission(a.staffService, perm)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+)
+
+// addStaff creates a staff member with the admin's session and returns them
+func addStaff(admin *client, role, pin string) models.Staff {
+	admin.t.Helper()
+	var staff models.Staff
+	admin.expect(fiber.StatusCreated, &staff, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Sam " + pin, "role": role, "pin": pin})
+	return staff
+}
+
+func TestEndToEndFirstAdminRace(t *testing.T) {
+	a := newTestApp(t, pos.NewFake())
+	device := &client{t: t, app: a, token: "e2e-device"}
+	// The device's restaurant is created by its first request
+	device.expect(fiber.StatusUnauthorized, nil, fiber.MethodGet, "/v1/staff", nil)
+
+	counts := device.parallel(5, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Ada", "role": "admin", "pin": "1234"})
+	if counts[fiber.StatusCreated] != 1 || counts[fiber.StatusUnauthorized] != 4 {
+		t.Fatalf("responses %v, want one 201 and four 401", counts)
+	}
+}
+
+func TestEndToEndStaffLockout(t *testing.T) {
+	a := newTestApp(t, pos.NewFake())
+	admin := firstAdmin(t, a, "e2e-device")
+	server := addStaff(admin, "server", "5678")
+	device := &client{t: t, app: a, token: admin.token}
+
+	// Guesses sent at once are still counted one by one, the fifth locks the account
+	counts := device.parallel(8, fiber.MethodPost, "/v1/staff/login", fiber.Map{"staffId": server.ID, "pin": "0000"})
+	if counts[fiber.StatusUnauthorized] != 5 || counts[fiber.StatusTooManyRequests] != 3 {
+		t.Fatalf("responses %v, want five 401 and three 429", counts)
+	}
+	device.expect(fiber.StatusTooManyRequests, nil, fiber.MethodPost, "/v1/staff/login", fiber.Map{"staffId": server.ID, "pin": "5678"})
+
+	// Failed logins below the limit are forgotten after a successful one
+	other := addStaff(admin, "server", "2468")
+	for range 4 {
+		device.expect(fiber.StatusUnauthorized, nil, fiber.MethodPost, "/v1/staff/login", fiber.Map{"staffId": other.ID, "pin": "0000"})
+	}
+	device.login(other.ID, "2468")
+	for range 4 {
+		device.expect(fiber.StatusUnauthorized, nil, fiber.MethodPost, "/v1/staff/login", fiber.Map{"staffId": other.ID, "pin": "0000"})
+	}
+	device.login(other.ID, "2468")
+}
+
+func TestEndToEndStaffSessions(t *testing.T) {
+	a := newTestApp(t, pos.NewFake())
+	admin := firstAdmin(t, a, "e2e-device")
+
+	tests := []struct {
+		name   string
+		change fiber.Map
+		// loggedOut is whether the staff member's sessions end
+		loggedOut bool
+	}{
+		{"renamed", fiber.Map{"name": "Samuel"}, false},
+		{"tables assigned", fiber.Map{"tables": "1,2"}, false},
+		{"deactivated", fiber.Map{"active": false}, true},
+		{"new PIN", fiber.Map{"pin": "97531"}, true},
+		{"new password", fiber.Map{"username": "sam", "password": "correct horse"}, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin.t = t
+			staff := addStaff(admin, "server", fmt.Sprintf("%04d", 1000+i))
+			session := admin.login(staff.ID, fmt.Sprintf("%04d", 1000+i))
+			session.expect(fiber.StatusOK, nil, fiber.MethodGet, "/v1/locations", nil)
+
+			admin.expect(fiber.StatusOK, nil, fiber.MethodPatch, fmt.Sprintf("/v1/staff/%d", staff.ID), tt.change)
+			want := fiber.StatusOK
+			if tt.loggedOut {
+				want = fiber.StatusUnauthorized
+			}
+			session.expect(want, nil, fiber.MethodGet, "/v1/locations", nil)
+		})
+	}
+	admin.t = t
+
+	// The new PIN replaces the old one
+	staff := addStaff(admin, "server", "1357")
+	admin.expect(fiber.StatusOK, nil, fiber.MethodPatch, fmt.Sprintf("/v1/staff/%d", staff.ID), fiber.Map{"pin": "8642"})
+	admin.expect(fiber.StatusUnauthorized, nil, fiber.MethodPost, "/v1/staff/login", fiber.Map{"staffId": staff.ID, "pin": "1357"})
+	admin.login(staff.ID, "8642")
+
+	// Deactivated staff cannot log in again
+	admin.expect(fiber.StatusOK, nil, fiber.MethodPatch, fmt.Sprintf("/v1/staff/%d", staff.ID), fiber.Map{"active": false})
+	admin.expect(fiber.StatusUnauthorized, nil, fiber.MethodPost, "/v1/staff/login", fiber.Map{"staffId": staff.ID, "pin": "8642"})
+}
+
+func TestEndToEndStaffRoles(t *testing.T) {
+	a := newTestApp(t, pos.NewFake())
+	admin := firstAdmin(t, a, "e2e-device")
+	var adminStaff []models.Staff
+	admin.expect(fiber.StatusOK, &adminStaff, fiber.MethodGet, "/v1/staff", nil)
+	manager := admin.login(addStaff(admin, "manager", "2222").ID, "2222")
+	waiter := admin.login(addStaff(admin, "server", "3333").ID, "3333")
+
+	tests := []struct {
+		name   string
+		client *client
+		method string
+		path   string
+		body   fiber.Map
+		status int
+	}{
+		{"manager adds a server", manager, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Sam", "role": "server", "pin": "4444"}, fiber.StatusCreated},
+		{"manager adds a manager", manager, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Max", "role": "manager", "pin": "4444"}, fiber.StatusForbidden},
+		{"manager changes the admin", manager, fiber.MethodPatch, fmt.Sprintf("/v1/staff/%d", adminStaff[0].ID), fiber.Map{"name": "Eve"}, fiber.StatusForbidden},
+		{"server lists staff", waiter, fiber.MethodGet, "/v1/staff", nil, fiber.StatusForbidden},
+		{"admin deactivates themselves", admin, fiber.MethodPatch, fmt.Sprintf("/v1/staff/%d", adminStaff[0].ID), fiber.Map{"active": false}, fiber.StatusBadRequest},
+		{"unknown role", admin, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Olly", "role": "owner", "pin": "4444"}, fiber.StatusBadRequest},
+		{"short PIN", admin, fiber.MethodPost, "/v1/staff", fiber.Map{"name": "Pat", "role": "server", "pin": "12"}, fiber.StatusBadRequest},
+		{"unknown staff member", admin, fiber.MethodPatch, "/v1/staff/999999", fiber.Map{"name": "Nobody"}, fiber.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.client.t = t
+			var body any
+			if tt.body != nil {
+				body = tt.body
+			}
+			tt.client.expect(tt.status, nil, tt.method, tt.path, body)
+		})
+	}
+}
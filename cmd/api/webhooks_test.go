@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/handlers"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/services"
+	"github.com/square/square-go-sdk"
+)
+
+const (
+	testSignatureKey    = "e2e-signature-key"
+	testNotificationURL = "https://api.example.com/webhooks/square"
+)
+
+// withWebhooks receives Square webhooks
+func withWebhooks(a *App) {
+	a.webhooks = services.NewWebhooks(a.db, a.squareService, a.menu, a.pos, a.keys, a.environment, testSignatureKey, testNotificationURL, a.logger)
+}
+
+// notify delivers a notification signed the way Square signs them and returns the response status
+func notify(t *testing.T, a *App, event fiber.Map) int {
+	t.Helper()
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("encode event: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(testSignatureKey))
+	mac.Write([]byte(testNotificationURL))
+	mac.Write(body)
+	device := &client{t: t, app: a}
+	status, _, _ := device.do(fiber.MethodPost, "/webhooks/square", json.RawMessage(body),
+		handlers.SquareSignatureHeader, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return status
+}
+
+func TestEndToEndWebhookRestaurants(t *testing.T) {
+	a := newTestApp(t, pos.NewFake(), withWebhooks)
+	admin := firstAdmin(t, a, "e2e-device")
+	merchantID := pos.FakeMerchantID(admin.token)
+
+	var order models.Order
+	admin.expect(fiber.StatusOK, &order, fiber.MethodPost, "/v1/orders", fiber.Map{
+		"tableNumber": "9",
+		"items":       []fiber.Map{{"variationId": pos.FakeVariationBurgerRegular, "quantity": 1}},
+	})
+
+	// Another restaurant of the merchant in the same environment gets the event too but does not own the order.
+	// A leftover row in the other environment has no usable token and must not be touched
+	token, err := a.keys.Seal(admin.token)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	for _, restaurant := range []models.Restaurant{
+		{Name: "Second", MerchantID: merchantID, SquareEnvironment: pos.Sandbox, SquareToken: token, SquareTokenHash: "e2e-second"},
+		{Name: "Production", MerchantID: merchantID, SquareEnvironment: pos.Production, SquareTokenHash: "e2e-production"},
+	} {
+		if err := a.db.Create(&restaurant).Error; err != nil {
+			t.Fatalf("create restaurant: %v", err)
+		}
+	}
+
+	// The guest pays on a Square terminal
+	gateway := a.pos.Connect(pos.Sandbox, admin.token)
+	if _, err := gateway.CreatePayment(context.Background(), &square.CreatePaymentRequest{
+		IdempotencyKey: "terminal-1",
+		SourceID:       "CASH",
+		OrderID:        square.String(order.ID),
+		AmountMoney:    &square.Money{Amount: square.Int64(1200), Currency: square.CurrencyUsd.Ptr()},
+		CashDetails:    &square.CashPaymentDetails{BuyerSuppliedMoney: &square.Money{Amount: square.Int64(1200), Currency: square.CurrencyUsd.Ptr()}},
+		LocationID:     square.String(order.LocationID),
+	}); err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+
+	status := notify(t, a, fiber.Map{
+		"merchant_id": merchantID,
+		"type":        "order.updated",
+		"event_id":    "event-1",
+		"data":        fiber.Map{"type": "order", "id": order.ID},
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("webhook = %d, want 200", status)
+	}
+	admin.expect(fiber.StatusOK, &order, fiber.MethodGet, orderPath(order, ""), nil)
+	if order.State != models.OrderStatePaid || order.Totals.Paid != usd(1200) {
+		t.Errorf("order %s paid %s, want paid and 12.00 USD", order.State, order.Totals.Paid)
+	}
+
+	// Events of merchants without a restaurant are acknowledged
+	status = notify(t, a, fiber.Map{
+		"merchant_id": "MLUNKNOWN",
+		"type":        "order.updated",
+		"event_id":    "event-2",
+		"data":        fiber.Map{"type": "order", "id": order.ID},
+	})
+	if status != fiber.StatusOK {
+		t.Errorf("webhook of an unknown merchant = %d, want 200", status)
+	}
+}
@@ -2,7 +2,12 @@ module github.com/sasirura/restaurant-api
 
 go 1.24.5
 
-require github.com/gofiber/fiber/v2 v2.52.9
+require (
+	github.com/gofiber/fiber/v2 v2.52.9
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sync v0.10.0
+	gorm.io/gorm v1.30.1
+)
 
 require (
 	github.com/jackc/pgpassfile v1.0.0 // indirect
@@ -13,10 +18,7 @@ require (
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/philhofer/fwd v1.1.3-0.20240916144458-20a13a1f6b7c // indirect
 	github.com/tinylib/msgp v1.2.5 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
-	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
-	gorm.io/gorm v1.30.1 // indirect
 )
 
 require (
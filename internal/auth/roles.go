@@ -0,0 +1,92 @@
+package auth
+
+// Role is the job of a staff member, which decides what they may do
+type Role string
+
+const (
+	RoleServer  Role = "server"
+	RoleCashier Role = "cashier"
+	RoleManager Role = "manager"
+	RoleAdmin   Role = "admin"
+)
+
+// Permission is an action guarded on the API
+type Permission string
+
+const (
+	PermViewOrders       Permission = "orders:read"
+	PermCreateOrders     Permission = "orders:create"
+	PermTakePayments     Permission = "payments:create"
+	PermVoidOrders       Permission = "orders:void"
+	PermRefundPayments   Permission = "payments:refund"
+	PermManageStaff      Permission = "staff:manage"
+	PermManageAPIKeys    Permission = "api_keys:manage"
+	PermManageRestaurant Permission = "restaurant:manage"
+	// PermOpenItems rings up items that are not on the menu at the price given, once the restaurant has a menu
+	PermOpenItems Permission = "orders:open_items"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleServer: {
+		PermViewOrders,
+		PermCreateOrders,
+	},
+	RoleCashier: {
+		PermViewOrders,
+		PermTakePayments,
+	},
+	RoleManager: {
+		PermViewOrders,
+		PermCreateOrders,
+		PermTakePayments,
+		PermVoidOrders,
+		PermRefundPayments,
+		PermManageStaff,
+		PermManageAPIKeys,
+		PermOpenItems,
+	},
+	RoleAdmin: {
+		PermViewOrders,
+		PermCreateOrders,
+		PermTakePayments,
+		PermVoidOrders,
+		PermRefundPayments,
+		PermManageStaff,
+		PermManageAPIKeys,
+		PermManageRestaurant,
+		PermOpenItems,
+	},
+}
+
+// roleRank orders roles so staff can only manage roles below their own
+var roleRank = map[Role]int{
+	RoleServer:  1,
+	RoleCashier: 1,
+	RoleManager: 2,
+	RoleAdmin:   3,
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// Can reports whether the role grants the permission
+func (r Role) Can(p Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// CanManage reports whether staff with role r may create or change staff with role other.
+// Admins manage everyone, managers only the roles below them.
+func (r Role) CanManage(other Role) bool {
+	if !r.Can(PermManageStaff) {
+		return false
+	}
+	return r == RoleAdmin || roleRank[r] > roleRank[other]
+}
@@ -0,0 +1,61 @@
+package auth
+
+import "testing"
+
+func TestRoleCanManage(t *testing.T) {
+	tests := []struct {
+		role  Role
+		other Role
+		want  bool
+	}{
+		{RoleAdmin, RoleAdmin, true},
+		{RoleAdmin, RoleManager, true},
+		{RoleAdmin, RoleServer, true},
+		{RoleManager, RoleAdmin, false},
+		{RoleManager, RoleManager, false},
+		{RoleManager, RoleCashier, true},
+		{RoleManager, RoleServer, true},
+		{RoleCashier, RoleServer, false},
+		{RoleServer, RoleServer, false},
+		{"owner", RoleServer, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.role)+"->"+string(tt.other), func(t *testing.T) {
+			if got := tt.role.CanManage(tt.other); got != tt.want {
+				t.Errorf("CanManage = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleCan(t *testing.T) {
+	tests := []struct {
+		role Role
+		perm Permission
+		want bool
+	}{
+		{RoleServer, PermCreateOrders, true},
+		{RoleServer, PermTakePayments, false},
+		{RoleCashier, PermTakePayments, true},
+		{RoleCashier, PermCreateOrders, false},
+		{RoleManager, PermVoidOrders, true},
+		{RoleManager, PermManageRestaurant, false},
+		{RoleAdmin, PermManageRestaurant, true},
+		{"owner", PermViewOrders, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.role.Can(tt.perm); got != tt.want {
+			t.Errorf("%s.Can(%s) = %v, want %v", tt.role, tt.perm, got, tt.want)
+		}
+	}
+	for _, role := range []Role{RoleServer, RoleCashier, RoleManager, RoleAdmin} {
+		if !role.Valid() {
+			t.Errorf("%s is not valid", role)
+		}
+	}
+	if Role("owner").Valid() {
+		t.Error("unknown role is valid")
+	}
+}
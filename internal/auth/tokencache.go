@@ -0,0 +1,125 @@
+// Package auth
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrTokenExpired is returned when the POS reports the token as already expired
+var ErrTokenExpired = errors.New("auth: access token expired")
+
+// expirySkew stops serving a cached verification shortly before the token itself expires
+const expirySkew = 30 * time.Second
+
+// Verification is what the POS told us about an access token
+type Verification struct {
+	MerchantID string
+	LocationID string
+	// ExpiresAt is zero for tokens that do not expire
+	ExpiresAt time.Time
+}
+
+// VerifyFunc checks a token against the POS
+type VerifyFunc func(ctx context.Context) (*Verification, error)
+
+type cacheEntry struct {
+	verification *Verification
+	expiresAt    time.Time
+}
+
+// TokenCache remembers verified tokens so requests do not hit the POS every time.
+// Tokens are keyed by their SHA-256 hash so raw tokens are never kept in memory.
+type TokenCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	group   singleflight.Group
+	now     func() time.Time
+}
+
+func NewTokenCache(ttl time.Duration) *TokenCache {
+	return &TokenCache{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+		now:     time.Now,
+	}
+}
+
+// Verify returns the cached verification for token, calling verify when there is none.
+// Concurrent callers for the same token share a single call to verify.
+func (c *TokenCache) Verify(ctx context.Context, token string, verify VerifyFunc) (*Verification, error) {
+	key := hashToken(token)
+
+	if v, ok := c.lookup(key); ok {
+		return v, nil
+	}
+
+	result, err, _ := c.group.Do(key, func() (any, error) {
+		if v, ok := c.lookup(key); ok {
+			return v, nil
+		}
+
+		v, err := verify(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		now := c.now()
+		if !v.ExpiresAt.IsZero() && !now.Before(v.ExpiresAt) {
+			return nil, ErrTokenExpired
+		}
+
+		expiresAt := now.Add(c.ttl)
+		if !v.ExpiresAt.IsZero() && v.ExpiresAt.Add(-expirySkew).Before(expiresAt) {
+			expiresAt = v.ExpiresAt.Add(-expirySkew)
+		}
+		if expiresAt.After(now) {
+			c.mu.Lock()
+			c.entries[key] = cacheEntry{verification: v, expiresAt: expiresAt}
+			c.mu.Unlock()
+		}
+
+		return v, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*Verification), nil
+}
+
+// Invalidate forgets the verification for token, e.g. after the POS rejected it
+func (c *TokenCache) Invalidate(token string) {
+	key := hashToken(token)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *TokenCache) lookup(key string) (*Verification, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.verification, true
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// clock is a settable time source for the cache
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestCache(ttl time.Duration) (*TokenCache, *clock) {
+	clk := &clock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	cache := NewTokenCache(ttl)
+	cache.now = clk.Now
+	return cache, clk
+}
+
+func TestTokenCacheRefresh(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		// after is how long after the first call the token is verified again
+		after     time.Duration
+		wantCalls int
+	}{
+		{"cached within the ttl", time.Time{}, 4 * time.Minute, 1},
+		{"refreshed after the ttl", time.Time{}, 5 * time.Minute, 2},
+		{"token expiring after the ttl", start.Add(time.Hour), 4 * time.Minute, 1},
+		{"cached until shortly before the token expires", start.Add(2 * time.Minute), time.Minute, 1},
+		{"refreshed shortly before the token expires", start.Add(2 * time.Minute), 90 * time.Second, 2},
+		{"token expiring within the skew is not cached", start.Add(20 * time.Second), time.Second, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, clk := newTestCache(5 * time.Minute)
+			calls := 0
+			verify := func(ctx context.Context) (*Verification, error) {
+				calls++
+				return &Verification{MerchantID: "M1", ExpiresAt: tt.expiresAt}, nil
+			}
+
+			for range 2 {
+				v, err := cache.Verify(context.Background(), "token", verify)
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				if v.MerchantID != "M1" {
+					t.Errorf("merchant %q, want M1", v.MerchantID)
+				}
+				clk.Advance(tt.after)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("verified %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestTokenCacheDoesNotKeepFailures(t *testing.T) {
+	rejected := errors.New("rejected")
+	tests := []struct {
+		name    string
+		result  *Verification
+		err     error
+		wantErr error
+	}{
+		{"verification error", nil, rejected, rejected},
+		{"expired token", &Verification{ExpiresAt: time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)}, nil, ErrTokenExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, _ := newTestCache(5 * time.Minute)
+			calls := 0
+			verify := func(ctx context.Context) (*Verification, error) {
+				calls++
+				return tt.result, tt.err
+			}
+			for range 2 {
+				if _, err := cache.Verify(context.Background(), "token", verify); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			}
+			if calls != 2 {
+				t.Errorf("verified %d times, want 2", calls)
+			}
+		})
+	}
+}
+
+func TestTokenCacheInvalidate(t *testing.T) {
+	cache, _ := newTestCache(5 * time.Minute)
+	calls := 0
+	verify := func(ctx context.Context) (*Verification, error) {
+		calls++
+		return &Verification{}, nil
+	}
+
+	cache.Verify(context.Background(), "token", verify)
+	cache.Verify(context.Background(), "other", verify)
+	cache.Invalidate("token")
+	cache.Verify(context.Background(), "token", verify)
+	cache.Verify(context.Background(), "other", verify)
+	if calls != 3 {
+		t.Errorf("verified %d times, want 3", calls)
+	}
+}
+
+func TestTokenCacheSharesConcurrentVerification(t *testing.T) {
+	cache, _ := newTestCache(5 * time.Minute)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	verify := func(ctx context.Context) (*Verification, error) {
+		calls.Add(1)
+		<-release
+		return &Verification{MerchantID: "M1"}, nil
+	}
+
+	const callers = 10
+	var started, done sync.WaitGroup
+	started.Add(callers)
+	done.Add(callers)
+	errs := make(chan error, callers)
+	for range callers {
+		go func() {
+			defer done.Done()
+			started.Done()
+			_, err := cache.Verify(context.Background(), "token", verify)
+			errs <- err
+		}()
+	}
+	started.Wait()
+	// Give the callers time to join the verification in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	done.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("verified %d times, want 1", got)
+	}
+}
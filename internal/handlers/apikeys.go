@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// CreateAPIKey issues an API key for a device of the authenticated restaurant
+func CreateAPIKey(apiKeyService *services.APIKeyService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		var req struct {
+			Name string `json:"name"`
+		}
+
+		if err := c.BodyParser(&req); err != nil {
+			apiKeyService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name is required"})
+		}
+
+		key, secret, err := apiKeyService.Create(c.Context(), restaurant, req.Name)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create API key"})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"apiKey": key,
+			"key":    secret,
+		})
+	}
+}
+
+// ListAPIKeys lists the API keys of the authenticated restaurant
+func ListAPIKeys(apiKeyService *services.APIKeyService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+
+		keys, err := apiKeyService.List(c.Context(), restaurant)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list API keys"})
+		}
+
+		return c.JSON(keys)
+	}
+}
+
+// RevokeAPIKey revokes an API key of the authenticated restaurant
+func RevokeAPIKey(apiKeyService *services.APIKeyService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		id, err := c.ParamsInt("id")
+		if err != nil || id <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid API key ID"})
+		}
+
+		err = apiKeyService.Revoke(c.Context(), restaurant, uint(id))
+		if errors.Is(err, services.ErrAPIKeyNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "API key not found"})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke API key"})
+		}
+
+		return c.JSON(fiber.Map{"status": "API key revoked"})
+	}
+}
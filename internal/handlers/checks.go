@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// SplitOrder splits the rest of an order's bill into checks
+func SplitOrder(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		orderID := c.Params("id")
+		var req models.SplitRequest
+
+		if err := c.BodyParser(&req); err != nil {
+			squareService.Logger.Error("Invalid split request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
+		}
+
+		checks, err := squareService.SplitOrder(c.Context(), restaurant, location, orderID, req)
+		if errors.Is(err, services.ErrCheckPaid) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return orderUpdateError(c, squareService, orderID, err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(checks)
+	}
+}
+
+// ListChecks lists the checks of a split order
+func ListChecks(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		orderID := c.Params("id")
+
+		checks, err := squareService.ListChecks(c.Context(), restaurant, location, orderID)
+		if errors.Is(err, services.ErrOrderNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(checks)
+	}
+}
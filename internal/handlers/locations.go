@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// ListLocations lists the locations of the authenticated restaurant
+func ListLocations(locationService *services.LocationService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		gateway := c.Locals("gateway").(pos.Gateway)
+
+		locations, err := locationService.List(c.Context(), restaurant, gateway)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list locations"})
+		}
+
+		return c.JSON(locations)
+	}
+}
+
+// SyncLocations refreshes the restaurant's locations from Square
+func SyncLocations(locationService *services.LocationService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		gateway := c.Locals("gateway").(pos.Gateway)
+
+		locations, err := locationService.Sync(c.Context(), restaurant, gateway)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Failed to sync locations from Square"})
+		}
+
+		return c.JSON(locations)
+	}
+}
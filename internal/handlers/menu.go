@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// GetMenu returns the menu of the selected location
+func GetMenu(menuService *services.MenuService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		gateway := c.Locals("gateway").(pos.Gateway)
+
+		menu, err := menuService.Get(c.Context(), restaurant, location, gateway)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load menu"})
+		}
+
+		return c.JSON(menu)
+	}
+}
+
+// GetMenuItem returns a menu item of the selected location by its Square ID
+func GetMenuItem(menuService *services.MenuService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+
+		item, err := menuService.GetItem(c.Context(), restaurant, location, c.Params("id"))
+		if errors.Is(err, services.ErrMenuItemNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Menu item not found"})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load menu item"})
+		}
+
+		return c.JSON(item)
+	}
+}
+
+// SyncMenu refreshes the restaurant's menu from the Square catalog
+func SyncMenu(menuService *services.MenuService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		gateway := c.Locals("gateway").(pos.Gateway)
+
+		menu, err := menuService.Sync(c.Context(), restaurant, gateway)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Failed to sync menu from Square"})
+		}
+
+		return c.JSON(menu)
+	}
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// AuthorizeSquare redirects the merchant to Square to grant access
+func AuthorizeSquare(oauthService *services.OAuthService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		url, err := oauthService.AuthorizeURL(c.Context())
+		if err != nil {
+			oauthService.Logger.Error("Failed to start OAuth authorization", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start authorization"})
+		}
+
+		return c.Redirect(url, fiber.StatusFound)
+	}
+}
+
+// SquareCallback completes the OAuth authorization started by AuthorizeSquare
+// The response carries the restaurant's first API key, used to set up its devices
+func SquareCallback(oauthService *services.OAuthService, apiKeyService *services.APIKeyService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if reason := c.Query("error"); reason != "" {
+			oauthService.Logger.Info("OAuth authorization declined", "error", reason)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Authorization declined", "reason": c.Query("error_description", reason)})
+		}
+
+		code := c.Query("code")
+		if code == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Authorization code missing"})
+		}
+
+		restaurant, err := oauthService.Complete(c.Context(), code, c.Query("state"))
+		if errors.Is(err, services.ErrInvalidOAuthState) {
+			oauthService.Logger.Error("Invalid OAuth state", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, services.ErrEnvironmentMismatch) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			oauthService.Logger.Error("Failed to complete OAuth authorization", "error", err)
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Failed to complete authorization"})
+		}
+
+		key, secret, err := apiKeyService.Create(c.Context(), *restaurant, "Onboarding")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create API key"})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"restaurantId": restaurant.ID,
+			"name":         restaurant.Name,
+			"merchantId":   restaurant.MerchantID,
+			"apiKey":       key,
+			"key":          secret,
+		})
+	}
+}
+
+// RevokeSquare revokes the authenticated restaurant's Square authorization
+func RevokeSquare(oauthService *services.OAuthService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+
+		err := oauthService.Revoke(c.Context(), restaurant)
+		if errors.Is(err, services.ErrEnvironmentMismatch) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			oauthService.Logger.Error("Failed to revoke Square authorization", "error", err, "restaurant_id", restaurant.ID)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke authorization"})
+		}
+
+		oauthService.Logger.Info("Square authorization revoked", "restaurant_id", restaurant.ID)
+		return c.JSON(fiber.Map{"status": "Authorization revoked"})
+	}
+}
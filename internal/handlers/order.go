@@ -2,10 +2,13 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
 	"github.com/sasirura/restaurant-api/internal/services"
-	"github.com/square/square-go-sdk/client"
 )
 
 func ErrorHandler(c *fiber.Ctx, err error) error {
@@ -18,18 +21,33 @@ func ErrorHandler(c *fiber.Ctx, err error) error {
 func CreateOrder(squareService *services.SquareService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		restaurant := c.Locals("restaurant").(models.Restaurant)
-		client := c.Locals("client").(*client.Client)
-		var req struct {
-			TableNumber string             `json:"tableNumber"`
-			Items       []models.OrderItem `json:"items"`
-		}
+		location := c.Locals("location").(models.Location)
+		gateway := c.Locals("gateway").(pos.Gateway)
+		staff := c.Locals("staff").(models.Staff)
+		var req models.OrderRequest
 
 		if err := c.BodyParser(&req); err != nil {
 			squareService.Logger.Error("Invalid request body", "error", err)
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
 		}
 
-		order, err := squareService.CreateOrder(c.Context(), restaurant, client, req.TableNumber, req.Items)
+		req.IdempotencyKey, _ = c.Locals("idempotencyKey").(string)
+
+		if !services.CanOpenTable(staff, req.TableNumber) {
+			squareService.Logger.Info("Table not assigned to staff", "staff_id", staff.ID, "table_number", req.TableNumber)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Table is not assigned to you"})
+		}
+
+		order, err := squareService.CreateOrder(c.Context(), restaurant, location, gateway, staff, req)
+		if errors.Is(err, services.ErrInvalidOrder) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, services.ErrOpenItem) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, services.ErrNoCurrency) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
 		if err != nil {
 			squareService.Logger.Error("Failed to create order", "error", err, "restaurant_id", restaurant.ID)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
@@ -44,9 +62,10 @@ func CreateOrder(squareService *services.SquareService) fiber.Handler {
 func GetOrdersByTable(squareService *services.SquareService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
 		tableNumber := c.Params("tableNumber")
 
-		orders, err := squareService.GetOrdersByTable(c.Context(), restaurant, tableNumber)
+		orders, err := squareService.GetOrdersByTable(c.Context(), restaurant, location, tableNumber)
 		if err != nil {
 			squareService.Logger.Error("Failed to fetch orders by table", "error", err, "table_number", tableNumber)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
@@ -61,9 +80,10 @@ func GetOrdersByTable(squareService *services.SquareService) fiber.Handler {
 func GetOrderByID(squareService *services.SquareService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
 		orderID := c.Params("id")
 
-		order, err := squareService.GetOrderByID(c.Context(), restaurant, orderID)
+		order, err := squareService.GetOrderByID(c.Context(), restaurant, location, orderID)
 		if err != nil {
 			squareService.Logger.Error("Failed to fetch order by ID", "error", err, "order_id", orderID)
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
@@ -78,21 +98,220 @@ func GetOrderByID(squareService *services.SquareService) fiber.Handler {
 func ProcessPayment(squareService *services.SquareService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		restaurant := c.Locals("restaurant").(models.Restaurant)
-		client := c.Locals("client").(*client.Client)
+		location := c.Locals("location").(models.Location)
+		gateway := c.Locals("gateway").(pos.Gateway)
+		staff := c.Locals("staff").(models.Staff)
 		orderID := c.Params("orderId")
 		var req models.PaymentRequest
 
 		if err := c.BodyParser(&req); err != nil {
 			squareService.Logger.Error("Invalid payment request body", "error", err)
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
 		}
 
-		if err := squareService.ProcessPayment(c.Context(), restaurant, client, orderID, req); err != nil {
+		payment, err := squareService.ProcessPayment(c.Context(), restaurant, location, gateway, staff, orderID, req)
+		if errors.Is(err, services.ErrPaymentProcessing) {
+			return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"status": "Payment is processing, retry with the same paymentId", "payment": payment})
+		}
+		if errors.Is(err, services.ErrInvalidPayment) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, services.ErrOrderNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+		}
+		if errors.Is(err, services.ErrCheckNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, services.ErrIllegalTransition) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
 			squareService.Logger.Error("Failed to process payment", "error", err, "order_id", orderID)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
 		squareService.Logger.Info("Payment processed successfully", "order_id", orderID, "payment_id", req.PaymentID)
-		return c.JSON(fiber.Map{"status": "Payment processed successfully"})
+		return c.JSON(fiber.Map{"status": "Payment processed successfully", "squarePaymentId": payment.SquarePaymentID, "changeDue": payment.Change, "payment": payment})
+	}
+}
+
+// AddOrderItems adds items to an open order
+func AddOrderItems(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		gateway := c.Locals("gateway").(pos.Gateway)
+		staff := c.Locals("staff").(models.Staff)
+		orderID := c.Params("id")
+		var req models.AddItemsRequest
+
+		if err := c.BodyParser(&req); err != nil {
+			squareService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
+		}
+		if resp := checkTable(c, squareService, restaurant, location, orderID); resp != nil {
+			return resp
+		}
+
+		order, err := squareService.AddItems(c.Context(), restaurant, location, gateway, staff, orderID, req)
+		if err != nil {
+			return orderUpdateError(c, squareService, orderID, err)
+		}
+
+		squareService.Logger.Info("Items added to order", "order_id", orderID, "count", fmt.Sprintf("%d", len(req.Items)))
+		return c.JSON(order)
+	}
+}
+
+// UpdateOrderItem changes the quantity or comment of an item of an open order
+func UpdateOrderItem(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		gateway := c.Locals("gateway").(pos.Gateway)
+		orderID := c.Params("id")
+		itemID, err := c.ParamsInt("itemId")
+		if err != nil || itemID <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid item ID"})
+		}
+		var req models.ItemUpdate
+
+		if err := c.BodyParser(&req); err != nil {
+			squareService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
+		}
+		if resp := checkTable(c, squareService, restaurant, location, orderID); resp != nil {
+			return resp
+		}
+
+		order, err := squareService.UpdateItem(c.Context(), restaurant, location, gateway, orderID, uint(itemID), req)
+		if err != nil {
+			return orderUpdateError(c, squareService, orderID, err)
+		}
+
+		squareService.Logger.Info("Order item updated", "order_id", orderID, "item_id", fmt.Sprintf("%d", itemID))
+		return c.JSON(order)
+	}
+}
+
+// RemoveOrderItem removes an item from an open order, the version is passed as a query parameter
+func RemoveOrderItem(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		gateway := c.Locals("gateway").(pos.Gateway)
+		orderID := c.Params("id")
+		itemID, err := c.ParamsInt("itemId")
+		if err != nil || itemID <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid item ID"})
+		}
+		version := c.QueryInt("version")
+
+		if resp := checkTable(c, squareService, restaurant, location, orderID); resp != nil {
+			return resp
+		}
+
+		order, err := squareService.RemoveItem(c.Context(), restaurant, location, gateway, orderID, uint(itemID), version)
+		if err != nil {
+			return orderUpdateError(c, squareService, orderID, err)
+		}
+
+		squareService.Logger.Info("Order item removed", "order_id", orderID, "item_id", fmt.Sprintf("%d", itemID))
+		return c.JSON(order)
+	}
+}
+
+// TransitionOrder moves an order to another state, e.g. sent to the kitchen or served
+func TransitionOrder(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		gateway := c.Locals("gateway").(pos.Gateway)
+		staff := c.Locals("staff").(models.Staff)
+		orderID := c.Params("id")
+		var req models.TransitionRequest
+
+		if err := c.BodyParser(&req); err != nil {
+			squareService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
+		}
+		if resp := checkTable(c, squareService, restaurant, location, orderID); resp != nil {
+			return resp
+		}
+
+		order, err := squareService.TransitionOrder(c.Context(), restaurant, location, gateway, staff, orderID, req)
+		if err != nil {
+			return orderUpdateError(c, squareService, orderID, err)
+		}
+		return c.JSON(order)
+	}
+}
+
+// CancelOrder cancels an open order of one of the staff member's tables
+func CancelOrder(squareService *services.SquareService) fiber.Handler {
+	return cancelOrder(squareService, false)
+}
+
+// VoidOrder cancels any open order, for managers
+func VoidOrder(squareService *services.SquareService) fiber.Handler {
+	return cancelOrder(squareService, true)
+}
+
+func cancelOrder(squareService *services.SquareService, void bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		gateway := c.Locals("gateway").(pos.Gateway)
+		staff := c.Locals("staff").(models.Staff)
+		orderID := c.Params("id")
+		var req models.CancelRequest
+
+		if err := c.BodyParser(&req); err != nil {
+			squareService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
+		}
+		if !void {
+			if resp := checkTable(c, squareService, restaurant, location, orderID); resp != nil {
+				return resp
+			}
+		}
+
+		order, err := squareService.CancelOrder(c.Context(), restaurant, location, gateway, staff, orderID, req, void)
+		if err != nil {
+			return orderUpdateError(c, squareService, orderID, err)
+		}
+		return c.JSON(order)
+	}
+}
+
+// checkTable responds with an error unless the order exists and its table is assigned to the staff member
+func checkTable(c *fiber.Ctx, squareService *services.SquareService, restaurant models.Restaurant, location models.Location, orderID string) error {
+	staff := c.Locals("staff").(models.Staff)
+	order, err := squareService.GetOrderByID(c.Context(), restaurant, location, orderID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	}
+	if !services.CanOpenTable(staff, order.TableNumber) {
+		squareService.Logger.Info("Table not assigned to staff", "staff_id", fmt.Sprintf("%d", staff.ID), "table_number", order.TableNumber)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Table is not assigned to you"})
+	}
+	return nil
+}
+
+func orderUpdateError(c *fiber.Ctx, squareService *services.SquareService, orderID string, err error) error {
+	switch {
+	case errors.Is(err, services.ErrInvalidOrder):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrOpenItem):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrOrderNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	case errors.Is(err, services.ErrItemNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrOrderNotOpen), errors.Is(err, services.ErrVersionConflict), errors.Is(err, services.ErrOrderHasPayments),
+		errors.Is(err, services.ErrIllegalTransition):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
 	}
+	squareService.Logger.Error("Failed to update order", "error", err, "order_id", orderID)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 }
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// ListOrderPayments lists the payments of an order
+func ListOrderPayments(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		orderID := c.Params("id")
+
+		payments, err := squareService.ListOrderPayments(c.Context(), restaurant, location, orderID)
+		if errors.Is(err, services.ErrOrderNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(payments)
+	}
+}
+
+// ListPayments lists the restaurant's payments between the from and to query parameters,
+// which are RFC 3339 times or dates and default to the last 24 hours
+func ListPayments(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+
+		to := time.Now()
+		if c.Query("to") != "" {
+			t, err := parseTime(c.Query("to"))
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid to: " + err.Error()})
+			}
+			to = t
+		}
+		from := to.Add(-24 * time.Hour)
+		if c.Query("from") != "" {
+			t, err := parseTime(c.Query("from"))
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid from: " + err.Error()})
+			}
+			from = t
+		}
+
+		payments, err := squareService.ListPayments(c.Context(), restaurant, from, to, c.Query("locationId"))
+		if errors.Is(err, services.ErrInvalidPayment) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(payments)
+	}
+}
+
+// parseTime accepts an RFC 3339 time or a date, which is taken as midnight UTC
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+func pricingErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidPricingRule):
+		return fiber.StatusBadRequest
+	case errors.Is(err, services.ErrPricingRuleNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, services.ErrNoCurrency):
+		return fiber.StatusConflict
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
+
+// ListTaxRules lists the tax rules of the authenticated restaurant
+func ListTaxRules(pricingService *services.PricingService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+
+		rules, err := pricingService.ListTaxRules(c.Context(), restaurant)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list tax rules"})
+		}
+
+		return c.JSON(rules)
+	}
+}
+
+// CreateTaxRule adds a tax rule to the authenticated restaurant
+func CreateTaxRule(pricingService *services.PricingService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		var req models.TaxRule
+
+		if err := c.BodyParser(&req); err != nil {
+			pricingService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
+		}
+
+		rule, err := pricingService.CreateTaxRule(c.Context(), restaurant, req)
+		if err != nil {
+			return c.Status(pricingErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(rule)
+	}
+}
+
+// DeleteTaxRule removes a tax rule of the authenticated restaurant
+func DeleteTaxRule(pricingService *services.PricingService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		id, err := c.ParamsInt("id")
+		if err != nil || id <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid tax rule ID"})
+		}
+
+		if err := pricingService.DeleteTaxRule(c.Context(), restaurant, uint(id)); err != nil {
+			return c.Status(pricingErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{"status": "Tax rule deleted"})
+	}
+}
+
+// ListServiceCharges lists the service charges of the authenticated restaurant
+func ListServiceCharges(pricingService *services.PricingService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+
+		charges, err := pricingService.ListServiceCharges(c.Context(), restaurant)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list service charges"})
+		}
+
+		return c.JSON(charges)
+	}
+}
+
+// CreateServiceCharge adds a service charge to the authenticated restaurant
+func CreateServiceCharge(pricingService *services.PricingService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		var req models.ServiceCharge
+
+		if err := c.BodyParser(&req); err != nil {
+			pricingService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
+		}
+
+		charge, err := pricingService.CreateServiceCharge(c.Context(), restaurant, req)
+		if err != nil {
+			return c.Status(pricingErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(charge)
+	}
+}
+
+// DeleteServiceCharge removes a service charge of the authenticated restaurant
+func DeleteServiceCharge(pricingService *services.PricingService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		id, err := c.ParamsInt("id")
+		if err != nil || id <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid service charge ID"})
+		}
+
+		if err := pricingService.DeleteServiceCharge(c.Context(), restaurant, uint(id)); err != nil {
+			return c.Status(pricingErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{"status": "Service charge deleted"})
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// defaultReconcileWindow is reconciled when the request does not say from when
+const defaultReconcileWindow = 24 * time.Hour
+
+// ReconcileOrders compares the restaurant's orders updated in Square between the from and to query parameters,
+// RFC 3339 timestamps defaulting to the last day, with the stored ones and reports what it fixed
+func ReconcileOrders(reconciler *services.OrderReconciler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		gateway := c.Locals("gateway").(pos.Gateway)
+
+		to := time.Now()
+		if param := c.Query("to"); param != "" {
+			t, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "to must be an RFC 3339 timestamp"})
+			}
+			to = t
+		}
+		from := to.Add(-defaultReconcileWindow)
+		if param := c.Query("from"); param != "" {
+			t, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "from must be an RFC 3339 timestamp"})
+			}
+			from = t
+		}
+
+		report, err := reconciler.ReconcileRestaurant(c.Context(), restaurant, gateway, from, to)
+		if errors.Is(err, services.ErrInvalidWindow) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(report)
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// RefundPayment refunds all or part of a payment of an order
+func RefundPayment(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		gateway := c.Locals("gateway").(pos.Gateway)
+		staff := c.Locals("staff").(models.Staff)
+		orderID := c.Params("id")
+		paymentID := c.Params("paymentId")
+		var req models.RefundRequest
+
+		if err := c.BodyParser(&req); err != nil {
+			squareService.Logger.Error("Invalid refund request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body: " + err.Error()})
+		}
+
+		refund, err := squareService.RefundPayment(c.Context(), restaurant, location, gateway, staff, orderID, paymentID, req)
+		switch {
+		case errors.Is(err, services.ErrInvalidRefund):
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, services.ErrOrderNotFound):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+		case errors.Is(err, services.ErrPaymentNotFound):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Payment not found"})
+		case err != nil:
+			squareService.Logger.Error("Failed to refund payment", "error", err, "order_id", orderID)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(refund)
+	}
+}
+
+// ListRefunds lists the refunds of an order
+func ListRefunds(squareService *services.SquareService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		location := c.Locals("location").(models.Location)
+		orderID := c.Params("id")
+
+		refunds, err := squareService.ListRefunds(c.Context(), restaurant, location, orderID)
+		if errors.Is(err, services.ErrOrderNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(refunds)
+	}
+}
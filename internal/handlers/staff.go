@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/auth"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// staffErrorStatus maps staff service errors to HTTP statuses
+func staffErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidStaff):
+		return fiber.StatusBadRequest
+	case errors.Is(err, services.ErrStaffNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, services.ErrForbidden):
+		return fiber.StatusForbidden
+	case errors.Is(err, services.ErrInvalidCredentials), errors.Is(err, services.ErrLoginRequired):
+		return fiber.StatusUnauthorized
+	case errors.Is(err, services.ErrStaffLocked):
+		return fiber.StatusTooManyRequests
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
+
+// StaffLogin starts a staff session on the authenticated device
+func StaffLogin(staffService *services.StaffService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		var req services.LoginRequest
+
+		if err := c.BodyParser(&req); err != nil {
+			staffService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		token, session, staff, err := staffService.Login(c.Context(), restaurant, req)
+		if err != nil {
+			status := staffErrorStatus(err)
+			if status == fiber.StatusInternalServerError {
+				return c.Status(status).JSON(fiber.Map{"error": "Failed to log in"})
+			}
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{
+			"token":     token,
+			"expiresAt": session.ExpiresAt,
+			"staff":     staff,
+		})
+	}
+}
+
+// StaffLogout ends the staff session of the request
+func StaffLogout(staffService *services.StaffService, header string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := staffService.Logout(c.Context(), c.Get(header)); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to log out"})
+		}
+		return c.JSON(fiber.Map{"status": "Logged out"})
+	}
+}
+
+// ListStaff lists the staff of the authenticated restaurant
+func ListStaff(staffService *services.StaffService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+
+		staff, err := staffService.List(c.Context(), restaurant)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list staff"})
+		}
+		return c.JSON(staff)
+	}
+}
+
+// CreateStaff adds a staff member. A restaurant without staff may create its first admin without logging in.
+func CreateStaff(staffService *services.StaffService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		var req services.StaffInput
+
+		if err := c.BodyParser(&req); err != nil {
+			staffService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		// Without a staff session only the first admin can be created, which the service checks
+		var actor *models.Staff
+		if staff, ok := c.Locals("staff").(models.Staff); ok {
+			if !auth.Role(staff.Role).Can(auth.PermManageStaff) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Your role does not allow this action"})
+			}
+			actor = &staff
+		}
+
+		staff, err := staffService.Create(c.Context(), restaurant, actor, req)
+		if err != nil {
+			status := staffErrorStatus(err)
+			if status == fiber.StatusInternalServerError {
+				return c.Status(status).JSON(fiber.Map{"error": "Failed to create staff"})
+			}
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(staff)
+	}
+}
+
+// UpdateStaff changes a staff member, e.g. their role, PIN or whether they are active
+func UpdateStaff(staffService *services.StaffService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		restaurant := c.Locals("restaurant").(models.Restaurant)
+		actor := c.Locals("staff").(models.Staff)
+		id, err := c.ParamsInt("id")
+		if err != nil || id <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid staff ID"})
+		}
+		var req services.StaffInput
+
+		if err := c.BodyParser(&req); err != nil {
+			staffService.Logger.Error("Invalid request body", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		staff, err := staffService.Update(c.Context(), restaurant, actor, uint(id), req)
+		if err != nil {
+			status := staffErrorStatus(err)
+			if status == fiber.StatusInternalServerError {
+				return c.Status(status).JSON(fiber.Map{"error": "Failed to update staff"})
+			}
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(staff)
+	}
+}
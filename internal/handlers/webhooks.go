@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sasirura/restaurant-api/internal/services"
+)
+
+// SquareSignatureHeader carries Square's signature of a webhook notification
+const SquareSignatureHeader = "X-Square-Hmacsha256-Signature"
+
+// SquareWebhook receives Square's webhook notifications. Failures answer with a server error so Square retries
+func SquareWebhook(webhookService *services.WebhookService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		body := c.Body()
+		if err := webhookService.Verify(body, c.Get(SquareSignatureHeader)); err != nil {
+			webhookService.Logger.Error("Rejected webhook notification", "error", err)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid signature"})
+		}
+
+		err := webhookService.Handle(c.Context(), body)
+		if errors.Is(err, services.ErrInvalidWebhook) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.SendStatus(fiber.StatusOK)
+	}
+}
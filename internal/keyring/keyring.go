@@ -0,0 +1,199 @@
+// Package keyring
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownKey is returned when a value was sealed with a key that is not configured
+var ErrUnknownKey = errors.New("keyring: unknown key")
+
+// Sealed is a value encrypted with its own data key, which is in turn encrypted with a master key
+type Sealed struct {
+	KeyID      string
+	DataKey    []byte
+	Ciphertext []byte
+}
+
+// IsZero reports whether nothing has been sealed
+func (s Sealed) IsZero() bool {
+	return s.KeyID == "" && len(s.Ciphertext) == 0
+}
+
+// Keyring holds the master keys used to seal secrets and the key used to hash them for lookups
+type Keyring struct {
+	keys    map[string][]byte
+	active  string
+	hashKey []byte
+}
+
+// New builds a keyring, new values are sealed with the active key
+func New(keys map[string][]byte, active string, hashKey []byte) (*Keyring, error) {
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("keyring: key %q must be 32 bytes", id)
+		}
+	}
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("keyring: active key %q: %w", active, ErrUnknownKey)
+	}
+	if len(hashKey) < 32 {
+		return nil, errors.New("keyring: hash key must be at least 32 bytes")
+	}
+
+	return &Keyring{
+		keys:    keys,
+		active:  active,
+		hashKey: hashKey,
+	}, nil
+}
+
+// ParseKeys parses "id:base64key,id:base64key" into master keys
+func ParseKeys(spec string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("keyring: key entry %q must be id:base64key", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("keyring: key %q: %w", id, err)
+		}
+		keys[id] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("keyring: no keys configured")
+	}
+	return keys, nil
+}
+
+// ActiveKeyID returns the ID of the key new values are sealed with
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// Seal encrypts plaintext under a fresh data key wrapped with the active master key
+func (k *Keyring) Seal(plaintext string) (Sealed, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return Sealed{}, err
+	}
+
+	ciphertext, err := encrypt(dataKey, []byte(plaintext))
+	if err != nil {
+		return Sealed{}, err
+	}
+	wrapped, err := encrypt(k.keys[k.active], dataKey)
+	if err != nil {
+		return Sealed{}, err
+	}
+
+	return Sealed{
+		KeyID:      k.active,
+		DataKey:    wrapped,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// Open decrypts a sealed value
+func (k *Keyring) Open(s Sealed) (string, error) {
+	dataKey, err := k.unwrap(s)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := decrypt(dataKey, s.Ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap re-encrypts the data key of s with the active master key, leaving the ciphertext as is
+func (k *Keyring) Rewrap(s Sealed) (Sealed, error) {
+	if s.KeyID == k.active {
+		return s, nil
+	}
+
+	dataKey, err := k.unwrap(s)
+	if err != nil {
+		return Sealed{}, err
+	}
+	wrapped, err := encrypt(k.keys[k.active], dataKey)
+	if err != nil {
+		return Sealed{}, err
+	}
+
+	return Sealed{
+		KeyID:      k.active,
+		DataKey:    wrapped,
+		Ciphertext: s.Ciphertext,
+	}, nil
+}
+
+// Hash returns a keyed hash of value that is stable across key rotations, for equality lookups
+func (k *Keyring) Hash(value string) string {
+	mac := hmac.New(sha256.New, k.hashKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (k *Keyring) unwrap(s Sealed) ([]byte, error) {
+	masterKey, ok := k.keys[s.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q: %w", s.KeyID, ErrUnknownKey)
+	}
+	return decrypt(masterKey, s.DataKey)
+}
+
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("keyring: ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("keyring: failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,194 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func mustNew(t *testing.T, keys map[string][]byte, active string, hashKey []byte) *Keyring {
+	t.Helper()
+	k, err := New(keys, active, hashKey)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return k
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    map[string][]byte
+		active  string
+		hashKey []byte
+		wantErr bool
+	}{
+		{"valid", map[string][]byte{"k1": key(1)}, "k1", key(9), false},
+		{"short master key", map[string][]byte{"k1": key(1)[:16]}, "k1", key(9), true},
+		{"unknown active key", map[string][]byte{"k1": key(1)}, "k2", key(9), true},
+		{"short hash key", map[string][]byte{"k1": key(1)}, "k1", key(9)[:31], true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.keys, tt.active, tt.hashKey)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(key(1))
+	tests := []struct {
+		spec    string
+		wantIDs []string
+		wantErr bool
+	}{
+		{"k1:" + encoded, []string{"k1"}, false},
+		{" k1:" + encoded + " , k2:" + encoded + ",", []string{"k1", "k2"}, false},
+		{"", nil, true},
+		{"k1", nil, true},
+		{":" + encoded, nil, true},
+		{"k1:not base64!", nil, true},
+	}
+
+	for _, tt := range tests {
+		keys, err := ParseKeys(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseKeys(%q) = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		for _, id := range tt.wantIDs {
+			if !bytes.Equal(keys[id], key(1)) {
+				t.Errorf("ParseKeys(%q) key %s = %x", tt.spec, id, keys[id])
+			}
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	k := mustNew(t, map[string][]byte{"k1": key(1)}, "k1", key(9))
+	for _, plaintext := range []string{"", "EAAAl-square-token", "ünïcode ✓"} {
+		sealed, err := k.Seal(plaintext)
+		if err != nil {
+			t.Fatalf("Seal: %v", err)
+		}
+		if sealed.KeyID != "k1" || sealed.IsZero() {
+			t.Errorf("sealed with %q, want k1", sealed.KeyID)
+		}
+		if plaintext != "" && bytes.Contains(sealed.Ciphertext, []byte(plaintext)) {
+			t.Errorf("ciphertext contains %q", plaintext)
+		}
+		got, err := k.Open(sealed)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if got != plaintext {
+			t.Errorf("Open = %q, want %q", got, plaintext)
+		}
+	}
+
+	a, _ := k.Seal("same")
+	b, _ := k.Seal("same")
+	if bytes.Equal(a.Ciphertext, b.Ciphertext) || bytes.Equal(a.DataKey, b.DataKey) {
+		t.Error("sealing twice gave the same ciphertext or data key")
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	k := mustNew(t, map[string][]byte{"k1": key(1)}, "k1", key(9))
+	other := mustNew(t, map[string][]byte{"k1": key(2)}, "k1", key(9))
+	sealed, err := k.Seal("token")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	flip := func(b []byte) []byte {
+		b = bytes.Clone(b)
+		b[len(b)-1] ^= 1
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		sealed  Sealed
+		wantErr error
+	}{
+		{"unknown key", k, Sealed{KeyID: "k9", DataKey: sealed.DataKey, Ciphertext: sealed.Ciphertext}, ErrUnknownKey},
+		{"other master key", other, sealed, nil},
+		{"changed data key", k, Sealed{KeyID: "k1", DataKey: flip(sealed.DataKey), Ciphertext: sealed.Ciphertext}, nil},
+		{"changed ciphertext", k, Sealed{KeyID: "k1", DataKey: sealed.DataKey, Ciphertext: flip(sealed.Ciphertext)}, nil},
+		{"truncated ciphertext", k, Sealed{KeyID: "k1", DataKey: sealed.DataKey, Ciphertext: sealed.Ciphertext[:4]}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.keyring.Open(tt.sealed)
+			if err == nil {
+				t.Fatal("Open succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old := mustNew(t, map[string][]byte{"k1": key(1)}, "k1", key(9))
+	sealed, err := old.Seal("token")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	// k2 becomes active, k1 stays configured until every value has been rewrapped
+	rotated := mustNew(t, map[string][]byte{"k1": key(1), "k2": key(2)}, "k2", key(9))
+	if got, err := rotated.Open(sealed); err != nil || got != "token" {
+		t.Fatalf("Open with the old key = %q, %v", got, err)
+	}
+	rewrapped, err := rotated.Rewrap(sealed)
+	if err != nil {
+		t.Fatalf("Rewrap: %v", err)
+	}
+	if rewrapped.KeyID != "k2" || !bytes.Equal(rewrapped.Ciphertext, sealed.Ciphertext) {
+		t.Errorf("rewrapped with %q, want k2 and the same ciphertext", rewrapped.KeyID)
+	}
+	again, err := rotated.Rewrap(rewrapped)
+	if err != nil || !bytes.Equal(again.DataKey, rewrapped.DataKey) {
+		t.Errorf("rewrapping with the active key changed the value: %v", err)
+	}
+
+	retired := mustNew(t, map[string][]byte{"k2": key(2)}, "k2", key(9))
+	if got, err := retired.Open(rewrapped); err != nil || got != "token" {
+		t.Errorf("Open after retiring k1 = %q, %v", got, err)
+	}
+	if _, err := retired.Open(sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Open of a value sealed with a retired key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestHash(t *testing.T) {
+	k := mustNew(t, map[string][]byte{"k1": key(1)}, "k1", key(9))
+	rotated := mustNew(t, map[string][]byte{"k1": key(1), "k2": key(2)}, "k2", key(9))
+	otherHashKey := mustNew(t, map[string][]byte{"k1": key(1)}, "k1", key(8))
+
+	if k.Hash("token") != k.Hash("token") {
+		t.Error("hash is not deterministic")
+	}
+	if k.Hash("token") == k.Hash("other") {
+		t.Error("different values hash the same")
+	}
+	if k.Hash("token") != rotated.Hash("token") {
+		t.Error("hash changed with the active master key, lookups would break on rotation")
+	}
+	if k.Hash("token") == otherHashKey.Hash("token") {
+		t.Error("hash does not depend on the hash key")
+	}
+}
@@ -2,74 +2,528 @@
 package models
 
 import (
+	"slices"
 	"time"
 
+	"github.com/sasirura/restaurant-api/internal/keyring"
+	"github.com/sasirura/restaurant-api/internal/pos"
 	"gorm.io/gorm"
 )
 
 type Restaurant struct {
 	gorm.Model
-	ID          uint `gorm:"primaryKey"`
-	Name        string
-	SqaureToken string `gorm:"unique"`
-	LocationID  string
+	ID   uint `gorm:"primaryKey"`
+	Name string
+	// SquareTokenHash is a keyed hash of the access token used to find the restaurant for a request
+	SquareTokenHash string         `gorm:"uniqueIndex" json:"-"`
+	SquareToken     keyring.Sealed `gorm:"embedded;embeddedPrefix:square_token_" json:"-"`
+	LocationID      string
+	MerchantID      string `gorm:"index"`
+	// Currency is the currency of the default location
+	Currency string `gorm:"size:3"`
+	// SquareEnvironment is fixed when the restaurant is created, its tokens, locations and orders all live there
+	SquareEnvironment pos.Environment `gorm:"not null;default:sandbox"`
+	// Set for restaurants onboarded through Square OAuth
+	SquareRefreshToken   keyring.Sealed `gorm:"embedded;embeddedPrefix:square_refresh_token_" json:"-"`
+	SquareTokenExpiresAt *time.Time
+	RevokedAt            *time.Time
+	// MenuSyncedAt is when the menu was last synced from the Square catalog, nil until it is first needed
+	MenuSyncedAt *time.Time
+}
+
+// OAuthState is the one-time state parameter of an OAuth authorization in progress
+type OAuthState struct {
+	gorm.Model
+	State     string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+}
+
+// Location is a site of a restaurant, synced from the Square Locations API
+type Location struct {
+	gorm.Model
+	RestaurantID     uint   `gorm:"uniqueIndex:idx_location_square_id" json:"restaurantId"`
+	SquareLocationID string `gorm:"uniqueIndex:idx_location_square_id" json:"squareLocationId"`
+	Name             string `json:"name"`
+	Status           string `json:"status"`
+	Timezone         string `json:"timezone"`
+	Currency         string `json:"currency"`
+}
+
+// TaxRule is a tax the restaurant charges on its orders
+type TaxRule struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"index" json:"restaurantId"`
+	Name         string `json:"name"`
+	// Percentage is a decimal string such as "8.875"
+	Percentage string `json:"percentage"`
+	// Inclusive taxes are already part of item prices, additive ones are charged on top
+	Inclusive bool `json:"inclusive"`
+	// Category limits the tax to items of that category, empty applies it to every item
+	Category string `json:"category"`
+}
+
+// ServiceCharge is added to orders, e.g. an automatic gratuity for large parties
+type ServiceCharge struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"index" json:"restaurantId"`
+	Name         string `json:"name"`
+	// Either a decimal Percentage of the order subtotal or a fixed Amount
+	Percentage string `json:"percentage,omitempty"`
+	Amount     Money  `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	// MinGuests only adds the charge to orders with at least that many guests, 0 adds it to every order
+	MinGuests int  `json:"minGuests"`
+	Taxable   bool `json:"taxable"`
+}
+
+// CatalogPresence records the locations a catalog object is sold at
+type CatalogPresence struct {
+	// PresentAtAllLocations sells the object everywhere but AbsentAtLocationIDs, otherwise only at PresentAtLocationIDs
+	PresentAtAllLocations bool     `json:"presentAtAllLocations"`
+	PresentAtLocationIDs  []string `gorm:"serializer:json" json:"presentAtLocationIds,omitempty"`
+	AbsentAtLocationIDs   []string `gorm:"serializer:json" json:"absentAtLocationIds,omitempty"`
+}
+
+// SoldAt reports whether the object is sold at the Square location
+func (p CatalogPresence) SoldAt(locationID string) bool {
+	if p.PresentAtAllLocations {
+		return !slices.Contains(p.AbsentAtLocationIDs, locationID)
+	}
+	return slices.Contains(p.PresentAtLocationIDs, locationID)
+}
+
+// MenuCategory groups the items of the restaurant's menu, synced from the Square catalog
+type MenuCategory struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"uniqueIndex:idx_menu_category_square_id" json:"restaurantId"`
+	SquareID     string `gorm:"uniqueIndex:idx_menu_category_square_id" json:"squareId"`
+	Name         string `json:"name"`
+	Ordinal      int64  `json:"ordinal"`
+}
+
+// MenuItem is an item of the restaurant's Square catalog, ordered by one of its variations
+type MenuItem struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"uniqueIndex:idx_menu_item_square_id" json:"restaurantId"`
+	SquareID     string `gorm:"uniqueIndex:idx_menu_item_square_id" json:"squareId"`
+	// CategoryID is the Square ID of the item's category, empty for uncategorized items
+	CategoryID  string `gorm:"index" json:"categoryId"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	CatalogPresence
+	Variations []MenuVariation `gorm:"foreignKey:MenuItemID" json:"variations"`
+	// ModifierListIDs are the Square IDs of the modifier lists enabled for the item
+	ModifierListIDs []string `gorm:"serializer:json" json:"modifierListIds"`
+}
+
+// MenuVariation is a size or version of a menu item with its price
+type MenuVariation struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"uniqueIndex:idx_menu_variation_square_id" json:"restaurantId"`
+	SquareID     string `gorm:"uniqueIndex:idx_menu_variation_square_id" json:"squareId"`
+	MenuItemID   uint   `gorm:"index" json:"menuItemId"`
+	Name         string `json:"name"`
+	Ordinal      int    `json:"ordinal"`
+	// Price is empty for variable priced variations, their price is given when ordering
+	Price           Money `gorm:"embedded;embeddedPrefix:price_" json:"price"`
+	VariablePricing bool  `json:"variablePricing"`
+	CatalogPresence
+}
+
+// MenuModifierList is a choice offered with menu items, e.g. sauces or add-ons
+type MenuModifierList struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"uniqueIndex:idx_menu_modifier_list_square_id" json:"restaurantId"`
+	SquareID     string `gorm:"uniqueIndex:idx_menu_modifier_list_square_id" json:"squareId"`
+	Name         string `json:"name"`
+	// SelectionType is SINGLE when at most one of the modifiers may be chosen, MULTIPLE otherwise
+	SelectionType string         `json:"selectionType"`
+	Modifiers     []MenuModifier `gorm:"foreignKey:ModifierListID" json:"modifiers"`
+}
+
+// MenuModifier is an option of a modifier list with its price
+type MenuModifier struct {
+	gorm.Model
+	RestaurantID   uint   `gorm:"uniqueIndex:idx_menu_modifier_square_id" json:"restaurantId"`
+	SquareID       string `gorm:"uniqueIndex:idx_menu_modifier_square_id" json:"squareId"`
+	ModifierListID uint   `gorm:"index" json:"modifierListId"`
+	Name           string `json:"name"`
+	Ordinal        int    `json:"ordinal"`
+	Price          Money  `gorm:"embedded;embeddedPrefix:price_" json:"price"`
+}
+
+// Menu is what a location sells, items reference their category and modifier lists by Square ID
+type Menu struct {
+	Categories    []MenuCategory     `json:"categories"`
+	Items         []MenuItem         `json:"items"`
+	ModifierLists []MenuModifierList `json:"modifierLists"`
+	// SyncedAt is when the menu was last synced from Square
+	SyncedAt *time.Time `json:"syncedAt"`
+}
+
+// APIKey authenticates a front-of-house device on behalf of a restaurant
+type APIKey struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"index" json:"restaurantId"`
+	Name         string `json:"name"`
+	// Prefix is the start of the key, shown so staff can tell keys apart
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `gorm:"uniqueIndex" json:"-"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+// IdempotencyRecord is a request sent with an Idempotency-Key header and the response it got,
+// which is replayed when the request is retried
+type IdempotencyRecord struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"uniqueIndex:idx_idempotency_key"`
+	Key          string `gorm:"uniqueIndex:idx_idempotency_key;size:255"`
+	// StaffID is the staff member who sent the request, only their retries get the response
+	StaffID uint
+	// Fingerprint is a hash of the request, a key can only be used again for the same request
+	Fingerprint string
+	// StatusCode is 0 while the first request is still running
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+// WebhookEvent is a Square webhook notification that has been handled, Square may deliver an event more than once
+type WebhookEvent struct {
+	gorm.Model
+	EventID    string `gorm:"uniqueIndex"`
+	MerchantID string
+	Type       string
+}
+
+// Staff is an employee of a restaurant who logs in on its devices
+type Staff struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"index;uniqueIndex:idx_staff_username" json:"restaurantId"`
+	Name         string `json:"name"`
+	// Username is only needed for password logins, PIN logins use the staff ID
+	Username     *string `gorm:"uniqueIndex:idx_staff_username" json:"username"`
+	Role         string  `json:"role"`
+	PasswordHash []byte  `json:"-"`
+	PINHash      []byte  `json:"-"`
+	// Tables lists the table numbers a server may open orders for, comma separated, empty means any
+	Tables       string     `json:"tables"`
+	Active       bool       `json:"active"`
+	FailedLogins int        `json:"-"`
+	LockedUntil  *time.Time `json:"-"`
+	LastLoginAt  *time.Time `json:"lastLoginAt"`
+}
+
+// StaffSession is a short-lived login of a staff member
+type StaffSession struct {
+	gorm.Model
+	StaffID      uint `gorm:"index"`
+	RestaurantID uint
+	TokenHash    string `gorm:"uniqueIndex"`
+	ExpiresAt    time.Time
+	RevokedAt    *time.Time
 }
 
 type Order struct {
 	gorm.Model
 	ID           string `gorm:"primaryKey"`
 	RestautantID uint
-	TableNumber  string
-	IsClosed     bool
-	Items        []OrderItem `gorm:"foreignKey:OrderID"`
-	Totals       OrderTotals `gorm:"foreignKey:OrderID"`
-	OpenAt       time.Time
+	// LocationID is the Square location the order was placed at
+	LocationID string `gorm:"index"`
+	// StaffID is the staff member who opened the order
+	StaffID     uint
+	Currency    string `gorm:"size:3"`
+	TableNumber string
+	GuestCount  int
+	State       OrderState `gorm:"size:32;not null;default:open;index"`
+	// Transitions is the history of the order's state, oldest first
+	Transitions []OrderTransition `gorm:"foreignKey:OrderID"`
+	// Checks split the bill between guests, each is paid separately
+	Checks []Check `gorm:"foreignKey:OrderID"`
+	// CancelReason, CanceledBy and CanceledAt record who cancelled or voided the order and why
+	CancelReason string
+	CanceledBy   uint
+	CanceledAt   *time.Time
+	// Voided is set when a manager cancelled the order instead of its server
+	Voided bool
+	// Version is the Square order version, updates must be based on the current one
+	Version int
+	Items   []OrderItem `gorm:"foreignKey:OrderID"`
+	// Discounts apply to the whole order, item discounts are kept on the items
+	Discounts []Discount  `gorm:"foreignKey:OrderID"`
+	Totals    OrderTotals `gorm:"foreignKey:OrderID"`
+	OpenAt    time.Time
+}
+
+// OrderTransition records an order moving from one state to another
+type OrderTransition struct {
+	gorm.Model
+	OrderID string     `gorm:"index;not null" json:"orderId"`
+	From    OrderState `gorm:"size:32" json:"from"`
+	To      OrderState `gorm:"size:32;not null" json:"to"`
+	// StaffID is the staff member who made the change, 0 when it was made in Square
+	StaffID uint   `json:"staffId"`
+	Reason  string `json:"reason"`
 }
 
 type OrderItem struct {
 	gorm.Model
-	OrderID   string
+	OrderID string
+	// SquareUID identifies the line item within the Square order
+	SquareUID string
 	Name      string
 	Comment   string
-	UnitPrice float64
-	Quantity  int
+	// Category selects the tax rules that apply to the item
+	Category string
+	// VariationID is the Square catalog item variation ordered, the item's name, category and price come from the menu
+	VariationID string
+	// CatalogPriced leaves the item's price to Square, set for variations with a fixed price
+	CatalogPriced bool  `gorm:"-" json:"-"`
+	UnitPrice     Money `gorm:"embedded;embeddedPrefix:unit_price_"`
+	Quantity      int
+	// Seat is the guest's seat at the table, 0 when the item is shared
+	Seat int
+	// CheckID is the check the item is paid on when the bill is split by item or seat
+	CheckID   uint
 	Discounts []Discount `gorm:"foreignKey:OrderItemID"`
 	Modifiers []Modifier `gorm:"foreignKey:OrderItemID"`
-	Amount    float64
+	Amount    Money      `gorm:"embedded;embeddedPrefix:amount_"`
 }
 
 type Discount struct {
 	gorm.Model
+	// OrderID is only set for order level discounts
+	OrderID      string `gorm:"index"`
 	OrderItemID  uint
+	SquareUID    string
 	Name         string
 	IsPercentage bool
-	Value        float64
-	Amount       float64
+	// Percentage is a decimal string such as "12.5", used when IsPercentage is set
+	Percentage string
+	// Value is the fixed amount taken off, used when IsPercentage is not set
+	Value  Money `gorm:"embedded;embeddedPrefix:value_"`
+	Amount Money `gorm:"embedded;embeddedPrefix:amount_"`
 }
 
 type Modifier struct {
 	gorm.Model
 	OrderItemID uint
-	Name        string
-	UnitPrice   float64
-	Quantity    int
-	Amount      float64
+	SquareUID   string
+	// ModifierID is the Square catalog modifier chosen, its name and price come from the menu
+	ModifierID string
+	Name       string
+	UnitPrice  Money `gorm:"embedded;embeddedPrefix:unit_price_"`
+	Quantity   int
+	Amount     Money `gorm:"embedded;embeddedPrefix:amount_"`
 }
 
 type OrderTotals struct {
 	gorm.Model
 	OrderID       string
-	Discounts     float64
-	Due           float64
-	Tax           float64
-	ServiceCharge float64
-	Paid          float64
-	Tips          float64
-	Total         float64
+	Discounts     Money `gorm:"embedded;embeddedPrefix:discounts_"`
+	Due           Money `gorm:"embedded;embeddedPrefix:due_"`
+	Tax           Money `gorm:"embedded;embeddedPrefix:tax_"`
+	ServiceCharge Money `gorm:"embedded;embeddedPrefix:service_charge_"`
+	Paid          Money `gorm:"embedded;embeddedPrefix:paid_"`
+	Tips          Money `gorm:"embedded;embeddedPrefix:tips_"`
+	Total         Money `gorm:"embedded;embeddedPrefix:total_"`
+	// Refunded is given back through refunds that were not rejected, tips included
+	Refunded Money `gorm:"embedded;embeddedPrefix:refunded_"`
+}
+
+// Check is part of an order's bill paid separately
+type Check struct {
+	gorm.Model
+	OrderID string `gorm:"index" json:"orderId"`
+	Number  int    `json:"number"`
+	Amount  Money  `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	Paid    Money  `gorm:"embedded;embeddedPrefix:paid_" json:"paid"`
+	Settled bool   `json:"settled"`
+	// ItemIDs are the items on the check when the bill was split by item or seat
+	ItemIDs []uint `gorm:"-" json:"itemIds,omitempty"`
+}
+
+// Payment is a payment taken for an order
+type Payment struct {
+	gorm.Model
+	RestaurantID uint   `gorm:"index;uniqueIndex:idx_payment_idempotency" json:"restaurantId"`
+	LocationID   string `gorm:"index" json:"locationId"`
+	OrderID      string `gorm:"index" json:"orderId"`
+	// CheckID is the check the payment was for, 0 when the bill was not split
+	CheckID uint `json:"checkId,omitempty"`
+	// SquarePaymentID is empty while the payment is processing
+	SquarePaymentID string `gorm:"uniqueIndex:idx_payment_square_id,where:square_payment_id <> ''" json:"squarePaymentId"`
+	// IdempotencyKey is the paymentId the client sent, a retried payment is only taken once
+	IdempotencyKey string `gorm:"uniqueIndex:idx_payment_idempotency" json:"idempotencyKey"`
+	// TenderType is how the payment was made, e.g. CASH, CARD or EXTERNAL
+	TenderType string `json:"tenderType"`
+	Amount     Money  `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	Tip        Money  `gorm:"embedded;embeddedPrefix:tip_" json:"tip"`
+	Refunded   Money  `gorm:"embedded;embeddedPrefix:refunded_" json:"refunded"`
+	// Change is the cash given back to the guest
+	Change Money `gorm:"embedded;embeddedPrefix:change_" json:"change"`
+	// Status is Square's payment status, e.g. COMPLETED, or PROCESSING until Square has answered
+	Status    string `gorm:"index" json:"status"`
+	CardBrand string `json:"cardBrand,omitempty"`
+	CardLast4 string `json:"cardLast4,omitempty"`
+	StaffID   uint   `json:"staffId"`
+}
+
+// PaymentProcessing is the status of a payment recorded before asking Square to take it.
+// Payments left processing, e.g. by a crash, are resolved by the payment reconciler
+const PaymentProcessing = "PROCESSING"
+
+// PaymentFailed is the status of a payment Square refused or never took
+const PaymentFailed = "FAILED"
+
+// Refund is money given back for a payment of an order
+type Refund struct {
+	gorm.Model
+	RestaurantID    uint   `gorm:"uniqueIndex:idx_refund_idempotency" json:"restaurantId"`
+	OrderID         string `gorm:"index" json:"orderId"`
+	SquarePaymentID string `gorm:"index" json:"squarePaymentId"`
+	SquareRefundID  string `gorm:"uniqueIndex" json:"squareRefundId"`
+	// IdempotencyKey is chosen by the client so a retried refund is only made once per restaurant
+	IdempotencyKey string `gorm:"uniqueIndex:idx_refund_idempotency" json:"idempotencyKey"`
+	Amount         Money  `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	Reason         string `json:"reason"`
+	// Status is Square's refund status, PENDING, COMPLETED, REJECTED or FAILED
+	Status  string `json:"status"`
+	StaffID uint   `json:"staffId"`
+}
+
+// OrderRequest is the body of a create order request
+type OrderRequest struct {
+	TableNumber string      `json:"tableNumber"`
+	GuestCount  int         `json:"guestCount"`
+	Items       []OrderItem `json:"items"`
+	Discounts   []Discount  `json:"discounts"`
+	// Draft orders can still be changed but not paid until they are opened
+	Draft bool `json:"draft"`
+	// IdempotencyKey is the request's Idempotency-Key header, a retried request creates one Square order
+	IdempotencyKey string `json:"-"`
+}
+
+// AddItemsRequest is the body of a request adding items to an open order
+type AddItemsRequest struct {
+	// Version is the order version the change is based on, it is required
+	Version int         `json:"version"`
+	Items   []OrderItem `json:"items"`
+}
+
+// ItemUpdate is the body of a request changing an item of an open order, nil fields are left alone
+type ItemUpdate struct {
+	Version  int     `json:"version"`
+	Quantity *int    `json:"quantity"`
+	Comment  *string `json:"comment"`
 }
 
+// TransitionRequest is the body of a request moving an order to another state
+type TransitionRequest struct {
+	Version int        `json:"version"`
+	State   OrderState `json:"state"`
+	Reason  string     `json:"reason"`
+}
+
+// RefundRequest is the body of a refund request, a zero amount refunds what is left of the payment
+type RefundRequest struct {
+	IdempotencyKey string `json:"idempotencyKey"`
+	Amount         Money  `json:"amount"`
+	Reason         string `json:"reason"`
+}
+
+// SplitMethod is how a bill is split into checks
+type SplitMethod string
+
+const (
+	// SplitEven splits the bill evenly between Guests checks
+	SplitEven SplitMethod = "even"
+	// SplitItems puts the items listed in Checks on each check
+	SplitItems SplitMethod = "items"
+	// SplitSeats makes a check per seat, items without a seat are shared evenly
+	SplitSeats SplitMethod = "seats"
+	// SplitAmounts makes a check per amount in Amounts
+	SplitAmounts SplitMethod = "amounts"
+)
+
+// SplitRequest is the body of a request splitting an order's bill into checks
+type SplitRequest struct {
+	Method  SplitMethod  `json:"method"`
+	Guests  int          `json:"guests"`
+	Checks  []SplitCheck `json:"checks"`
+	Amounts []Money      `json:"amounts"`
+}
+
+// SplitCheck lists the items of a check when splitting by item
+type SplitCheck struct {
+	Items []uint `json:"items"`
+}
+
+// CancelRequest is the body of a request cancelling or voiding an order
+type CancelRequest struct {
+	Version int    `json:"version"`
+	Reason  string `json:"reason"`
+}
+
+// TenderType is how a payment is made
+type TenderType string
+
+const (
+	TenderCash TenderType = "CASH"
+	// TenderCard is a card nonce or token from the Web Payments or In-App Payments SDK
+	TenderCard TenderType = "CARD"
+	// TenderCardOnFile is a card stored for a Square customer
+	TenderCardOnFile TenderType = "CARD_ON_FILE"
+	// TenderGiftCard is a Square gift card nonce or ID
+	TenderGiftCard TenderType = "GIFT_CARD"
+	// TenderExternal is money taken outside of Square, e.g. a cheque or a third party gift card
+	TenderExternal TenderType = "EXTERNAL"
+)
+
 type PaymentRequest struct {
-	BillAmount float64 `json:"billAmount"`
-	TipAmount  float64 `json:"tipAmount"`
-	PaymentID  string  `json:"paymentId"`
+	BillAmount Money  `json:"billAmount" gorm:"embedded;embeddedPrefix:bill_amount_"`
+	TipAmount  Money  `json:"tipAmount" gorm:"embedded;embeddedPrefix:tip_amount_"`
+	PaymentID  string `json:"paymentId"`
+	// CheckID pays one check of a split bill
+	CheckID uint `json:"checkId"`
+	// TenderType defaults to CASH
+	TenderType TenderType `json:"tenderType"`
+	// SourceID is the card nonce or token, card on file ID or gift card nonce or ID
+	SourceID string `json:"sourceId"`
+	// CustomerID is the Square customer owning a card on file
+	CustomerID string `json:"customerId"`
+	// BuyerSupplied is the cash handed over, defaults to the bill and tip
+	BuyerSupplied Money `json:"buyerSupplied" gorm:"embedded;embeddedPrefix:buyer_supplied_"`
+	// External describes an EXTERNAL tender
+	External *ExternalTender `json:"external" gorm:"-"`
+}
+
+// ExternalTender is a payment taken outside of Square
+type ExternalTender struct {
+	// Type is one of Square's external payment types, e.g. CHECK, BANK_TRANSFER, OTHER_GIFT_CARD or OTHER
+	Type string `json:"type"`
+	// Source names where the money came from, e.g. the gift card provider
+	Source string `json:"source"`
+}
+
+// Reconciliation reports what a comparison of the stored orders with Square changed
+type Reconciliation struct {
+	// From and To bound when the Square orders were last updated
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Checked counts the Square orders compared
+	Checked  int                `json:"checked"`
+	Updated  []OrderDiscrepancy `json:"updated"`
+	Imported []OrderDiscrepancy `json:"imported"`
+	// Errors lists the restaurants and orders that could not be reconciled
+	Errors []string `json:"errors"`
+}
+
+// OrderDiscrepancy describes how a stored order differed from Square, it was changed to match
+type OrderDiscrepancy struct {
+	OrderID      string   `json:"orderId"`
+	RestaurantID uint     `json:"restaurantId"`
+	LocationID   string   `json:"locationId"`
+	Changes      []string `json:"changes"`
 }
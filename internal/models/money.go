@@ -0,0 +1,168 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in the smallest unit of its currency, e.g. cents for USD
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency" gorm:"size:3"`
+}
+
+// currencyExponents lists the ISO 4217 currencies whose minor unit is not a hundredth
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// CurrencyExponent is the number of decimals of the currency's minor unit, e.g. 2 for USD and 0 for JPY
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[currency]; ok {
+		return exp
+	}
+	return 2
+}
+
+// NewMoney returns amount minor units of currency
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Add returns the sum of m and o, which must share a currency
+func (m Money) Add(o Money) Money {
+	if m.Currency == "" {
+		m.Currency = o.Currency
+	}
+	m.Amount += o.Amount
+	return m
+}
+
+// String formats the amount with the currency's decimals, e.g. "29.00 USD" or "2900 JPY"
+func (m Money) String() string {
+	return fmt.Sprintf("%s %s", m.Decimal(), m.Currency)
+}
+
+// Decimal formats the amount in major units with the currency's decimals, e.g. "29.00" for USD or "2900" for JPY
+func (m Money) Decimal() string {
+	exp := CurrencyExponent(m.Currency)
+	if exp == 0 {
+		return strconv.FormatInt(m.Amount, 10)
+	}
+
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	unit := int64(1)
+	for range exp {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exp, amount%unit)
+}
+
+// parseDecimal reads a decimal in major units of currency, e.g. "29.5" for USD is 2950. More decimals than the
+// currency has are rejected instead of being rounded
+func parseDecimal(decimal, currency string) (int64, error) {
+	exp := CurrencyExponent(currency)
+	whole, fraction, _ := strings.Cut(strings.TrimPrefix(decimal, "-"), ".")
+	if whole == "" || strings.Trim(whole+fraction, "0123456789") != "" || strings.HasSuffix(decimal, ".") {
+		return 0, fmt.Errorf("money decimal must be a number like \"29.50\", got %q", decimal)
+	}
+	if len(fraction) > exp {
+		return 0, fmt.Errorf("%s amounts have %d decimals, got %q", currency, exp, decimal)
+	}
+	amount, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", exp-len(fraction)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("money decimal %q is out of range", decimal)
+	}
+	if strings.HasPrefix(decimal, "-") {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// Validate checks the currency is an ISO 4217 code
+func (m Money) Validate() error {
+	if len(m.Currency) != 3 {
+		return fmt.Errorf("invalid currency %q", m.Currency)
+	}
+	for _, r := range m.Currency {
+		if r < 'A' || r > 'Z' {
+			return fmt.Errorf("invalid currency %q", m.Currency)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON adds the amount in major units as "decimal" once the currency is known
+func (m Money) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Decimal  string `json:"decimal,omitempty"`
+	}{Amount: m.Amount, Currency: m.Currency}
+	if m.Currency != "" {
+		out.Decimal = m.Decimal()
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON only accepts whole minor units, so 29.00 is rejected instead of being read as 29 cents. The amount
+// may be sent as a "decimal" string in major units instead, which may not have more decimals than the currency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) == 0 || data[0] != '{' {
+		return errors.New(`money must be an object like {"amount": 1250, "currency": "USD"}`)
+	}
+
+	var raw struct {
+		Amount   json.Number `json:"amount"`
+		Currency string      `json:"currency"`
+		Decimal  string      `json:"decimal"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return fmt.Errorf("invalid money: %w", err)
+	}
+	if raw.Amount == "" && raw.Decimal == "" {
+		return errors.New("money amount is required")
+	}
+
+	var amount int64
+	if raw.Amount != "" {
+		var err error
+		if amount, err = strconv.ParseInt(raw.Amount.String(), 10, 64); err != nil {
+			return fmt.Errorf("money amount must be a whole number of minor units, got %s", raw.Amount)
+		}
+	}
+	if raw.Decimal != "" {
+		if raw.Currency == "" {
+			return errors.New("money currency is required with decimal")
+		}
+		parsed, err := parseDecimal(raw.Decimal, raw.Currency)
+		if err != nil {
+			return err
+		}
+		if raw.Amount != "" && parsed != amount {
+			return fmt.Errorf("money amount %d does not match decimal %q", amount, raw.Decimal)
+		}
+		amount = parsed
+	}
+
+	m.Amount = amount
+	m.Currency = raw.Currency
+	return nil
+}
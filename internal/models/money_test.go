@@ -0,0 +1,123 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{NewMoney(2900, "USD"), "29.00 USD"},
+		{NewMoney(5, "USD"), "0.05 USD"},
+		{NewMoney(-1250, "EUR"), "-12.50 EUR"},
+		{NewMoney(2900, "JPY"), "2900 JPY"},
+		{NewMoney(1234, "KWD"), "1.234 KWD"},
+		{NewMoney(12345, "CLF"), "1.2345 CLF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.money.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    Money
+		wantErr bool
+	}{
+		{name: "minor units", body: `{"amount": 2900, "currency": "USD"}`, want: NewMoney(2900, "USD")},
+		{name: "currency left out", body: `{"amount": 2900}`, want: NewMoney(2900, "")},
+		{name: "decimal", body: `{"decimal": "29.5", "currency": "USD"}`, want: NewMoney(2950, "USD")},
+		{name: "negative decimal", body: `{"decimal": "-0.05", "currency": "USD"}`, want: NewMoney(-5, "USD")},
+		{name: "decimal of a currency without minor units", body: `{"decimal": "2900", "currency": "JPY"}`, want: NewMoney(2900, "JPY")},
+		{name: "decimal with three places", body: `{"decimal": "1.234", "currency": "KWD"}`, want: NewMoney(1234, "KWD")},
+		{name: "amount matching decimal", body: `{"amount": 2900, "decimal": "29.00", "currency": "USD"}`, want: NewMoney(2900, "USD")},
+		{name: "fractional amount", body: `{"amount": 29.00, "currency": "USD"}`, wantErr: true},
+		{name: "too many decimals", body: `{"decimal": "12.345", "currency": "USD"}`, wantErr: true},
+		{name: "decimals for a currency without minor units", body: `{"decimal": "12.5", "currency": "JPY"}`, wantErr: true},
+		{name: "decimal without currency", body: `{"decimal": "12.50"}`, wantErr: true},
+		{name: "decimal that is not a number", body: `{"decimal": "12,50", "currency": "USD"}`, wantErr: true},
+		{name: "decimal ending in a point", body: `{"decimal": "12.", "currency": "USD"}`, wantErr: true},
+		{name: "amount not matching decimal", body: `{"amount": 2900, "decimal": "2.90", "currency": "USD"}`, wantErr: true},
+		{name: "missing amount", body: `{"currency": "USD"}`, wantErr: true},
+		{name: "unknown field", body: `{"amount": 1, "value": 1}`, wantErr: true},
+		{name: "not an object", body: `2900`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Money
+			err := json.Unmarshal([]byte(tt.body), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyMarshalJSON(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{NewMoney(2900, "USD"), `{"amount":2900,"currency":"USD","decimal":"29.00"}`},
+		{NewMoney(2900, "JPY"), `{"amount":2900,"currency":"JPY","decimal":"2900"}`},
+		{Money{}, `{"amount":0,"currency":""}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			body, err := json.Marshal(tt.money)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if string(body) != tt.want {
+				t.Errorf("got %s, want %s", body, tt.want)
+			}
+
+			// What is sent out can be sent back
+			var back Money
+			if err := json.Unmarshal(body, &back); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if back != tt.money {
+				t.Errorf("round trip gave %+v, want %+v", back, tt.money)
+			}
+		})
+	}
+}
+
+func TestMoneyValidate(t *testing.T) {
+	tests := []struct {
+		currency string
+		wantErr  bool
+	}{
+		{"USD", false},
+		{"JPY", false},
+		{"", true},
+		{"usd", true},
+		{"US", true},
+		{"USDT", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.currency, func(t *testing.T) {
+			err := NewMoney(100, tt.currency).Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package models
+
+// OrderState is where an order is in its lifecycle
+type OrderState string
+
+const (
+	// OrderStateDraft orders are being put together and cannot be paid yet
+	OrderStateDraft         OrderState = "draft"
+	OrderStateOpen          OrderState = "open"
+	OrderStateSentToKitchen OrderState = "sent_to_kitchen"
+	OrderStateServed        OrderState = "served"
+	OrderStatePartiallyPaid OrderState = "partially_paid"
+	OrderStatePaid          OrderState = "paid"
+	// OrderStateClosed orders are paid and the table has been cleared
+	OrderStateClosed   OrderState = "closed"
+	OrderStateCanceled OrderState = "canceled"
+	OrderStateRefunded OrderState = "refunded"
+)
+
+// orderTransitions lists the states an order may move to from each state, new orders start from ""
+var orderTransitions = map[OrderState][]OrderState{
+	"":                      {OrderStateDraft, OrderStateOpen},
+	OrderStateDraft:         {OrderStateOpen, OrderStateCanceled},
+	OrderStateOpen:          {OrderStateSentToKitchen, OrderStateServed, OrderStatePartiallyPaid, OrderStatePaid, OrderStateCanceled},
+	OrderStateSentToKitchen: {OrderStateServed, OrderStatePartiallyPaid, OrderStatePaid, OrderStateCanceled},
+	OrderStateServed:        {OrderStatePartiallyPaid, OrderStatePaid, OrderStateCanceled},
+	OrderStatePartiallyPaid: {OrderStatePaid, OrderStateCanceled},
+	OrderStatePaid:          {OrderStateClosed, OrderStateRefunded},
+	OrderStateClosed:        {OrderStateRefunded},
+}
+
+// CanTransition reports whether an order in state s may move to state to
+func (s OrderState) CanTransition(to OrderState) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Editable reports whether items of an order in state s may still be changed
+func (s OrderState) Editable() bool {
+	switch s {
+	case OrderStateDraft, OrderStateOpen, OrderStateSentToKitchen, OrderStateServed:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package models
+
+import "testing"
+
+func TestOrderStateCanTransition(t *testing.T) {
+	tests := []struct {
+		from OrderState
+		to   OrderState
+		want bool
+	}{
+		{"", OrderStateDraft, true},
+		{"", OrderStateOpen, true},
+		{"", OrderStatePaid, false},
+		{OrderStateDraft, OrderStateOpen, true},
+		{OrderStateDraft, OrderStatePaid, false},
+		{OrderStateOpen, OrderStateSentToKitchen, true},
+		{OrderStateOpen, OrderStateDraft, false},
+		{OrderStateSentToKitchen, OrderStateServed, true},
+		{OrderStateSentToKitchen, OrderStateOpen, false},
+		{OrderStateServed, OrderStatePartiallyPaid, true},
+		{OrderStatePartiallyPaid, OrderStatePaid, true},
+		{OrderStatePartiallyPaid, OrderStateServed, false},
+		{OrderStatePaid, OrderStateClosed, true},
+		{OrderStatePaid, OrderStateCanceled, false},
+		{OrderStateClosed, OrderStateRefunded, true},
+		{OrderStateClosed, OrderStateOpen, false},
+		{OrderStateCanceled, OrderStateOpen, false},
+		{OrderStateRefunded, OrderStatePaid, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"->"+string(tt.to), func(t *testing.T) {
+			if got := tt.from.CanTransition(tt.to); got != tt.want {
+				t.Errorf("CanTransition = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderStateEditable(t *testing.T) {
+	for state, want := range map[OrderState]bool{
+		OrderStateDraft:         true,
+		OrderStateOpen:          true,
+		OrderStateSentToKitchen: true,
+		OrderStateServed:        true,
+		OrderStatePartiallyPaid: false,
+		OrderStatePaid:          false,
+		OrderStateClosed:        false,
+		OrderStateCanceled:      false,
+		OrderStateRefunded:      false,
+	} {
+		if got := state.Editable(); got != want {
+			t.Errorf("%s.Editable() = %v, want %v", state, got, want)
+		}
+	}
+}
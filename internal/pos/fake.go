@@ -0,0 +1,511 @@
+package pos
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/square-go-sdk"
+)
+
+// Fake is an in-process point of sale that keeps orders and payments in memory.
+// Every non-empty token is accepted and maps to its own merchant with a single location.
+type Fake struct {
+	mu          sync.Mutex
+	orders      map[string]*fakeOrder
+	payments    map[string]*square.Payment
+	refunds     map[string]*square.PaymentRefund
+	idempotency map[string]string
+	// tokens maps access and refresh tokens issued through OAuth to their merchant
+	tokens        map[string]fakeToken
+	refreshTokens map[string]string
+}
+
+type fakeToken struct {
+	merchantID string
+	expiresAt  time.Time
+	revoked    bool
+}
+
+type fakeOrder struct {
+	merchantID string
+	order      *square.Order
+}
+
+// snapshot copies the order so callers never observe later mutations
+func (o *fakeOrder) snapshot() *square.Order {
+	order := *o.order
+	order.Version = square.Int(*o.order.Version)
+	order.LineItems = append([]*square.OrderLineItem(nil), o.order.LineItems...)
+	order.Tenders = append([]*square.Tender(nil), o.order.Tenders...)
+	order.Refunds = append([]*square.Refund(nil), o.order.Refunds...)
+	return &order
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		orders:        make(map[string]*fakeOrder),
+		payments:      make(map[string]*square.Payment),
+		refunds:       make(map[string]*square.PaymentRefund),
+		idempotency:   make(map[string]string),
+		tokens:        make(map[string]fakeToken),
+		refreshTokens: make(map[string]string),
+	}
+}
+
+// Connect ignores env, the fake keeps a single set of data
+func (f *Fake) Connect(env Environment, token string) Gateway {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	merchantID := FakeMerchantID(token)
+	issued, ok := f.tokens[token]
+	if ok {
+		merchantID = issued.merchantID
+	}
+	return &fakeGateway{
+		fake:       f,
+		token:      token,
+		merchantID: merchantID,
+	}
+}
+
+func (f *Fake) OAuth(env Environment) OAuth {
+	return &fakeOAuth{fake: f}
+}
+
+// FakeMerchantID returns the merchant ID the fake assigns to a token
+func FakeMerchantID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "MLFAKE" + strings.ToUpper(hex.EncodeToString(sum[:5]))
+}
+
+// FakeLocationID returns the ID of the single location of a fake merchant
+func FakeLocationID(merchantID string) string {
+	return "L" + strings.TrimPrefix(merchantID, "ML")
+}
+
+type fakeGateway struct {
+	fake       *Fake
+	token      string
+	merchantID string
+}
+
+func (g *fakeGateway) RetrieveTokenStatus(ctx context.Context) (*square.RetrieveTokenStatusResponse, error) {
+	g.fake.mu.Lock()
+	defer g.fake.mu.Unlock()
+
+	resp := &square.RetrieveTokenStatusResponse{
+		MerchantID: square.String(g.merchantID),
+		Scopes:     []string{"ORDERS_READ", "ORDERS_WRITE", "PAYMENTS_READ", "PAYMENTS_WRITE"},
+	}
+	if issued, ok := g.fake.tokens[g.token]; ok {
+		if issued.revoked || !time.Now().Before(issued.expiresAt) {
+			return nil, ErrUnauthorized
+		}
+		resp.ExpiresAt = square.String(issued.expiresAt.UTC().Format(time.RFC3339))
+	}
+	return resp, nil
+}
+
+func (g *fakeGateway) ListLocations(ctx context.Context) (*square.ListLocationsResponse, error) {
+	return &square.ListLocationsResponse{
+		Locations: []*square.Location{
+			{
+				ID:         square.String(FakeLocationID(g.merchantID)),
+				Name:       square.String("Fake Location"),
+				MerchantID: square.String(g.merchantID),
+				Status:     square.LocationStatusActive.Ptr(),
+				Currency:   square.CurrencyUsd.Ptr(),
+			},
+		},
+	}, nil
+}
+
+func (g *fakeGateway) CreateOrder(ctx context.Context, req *square.CreateOrderRequest) (*square.CreateOrderResponse, error) {
+	if req.Order == nil {
+		return nil, fmt.Errorf("pos: order is required")
+	}
+
+	g.fake.mu.Lock()
+	defer g.fake.mu.Unlock()
+
+	key := ""
+	if req.IdempotencyKey != nil {
+		key = "order:" + g.merchantID + ":" + *req.IdempotencyKey
+		if id, ok := g.fake.idempotency[key]; ok {
+			return &square.CreateOrderResponse{Order: g.fake.orders[id].snapshot()}, nil
+		}
+	}
+
+	in := *req.Order
+	lines, err := catalogLines(in.LineItems)
+	if err != nil {
+		return nil, err
+	}
+	in.LineItems = lines
+	order, err := priceFakeOrder(&in)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	order.ID = square.String(newFakeID())
+	order.State = square.OrderStateOpen.Ptr()
+	if req.Order.State != nil && *req.Order.State == square.OrderStateDraft {
+		order.State = square.OrderStateDraft.Ptr()
+	}
+	order.Version = square.Int(1)
+	order.CreatedAt = square.String(now)
+	order.UpdatedAt = square.String(now)
+
+	g.fake.orders[*order.ID] = &fakeOrder{merchantID: g.merchantID, order: order}
+	if key != "" {
+		g.fake.idempotency[key] = *order.ID
+	}
+
+	return &square.CreateOrderResponse{Order: g.fake.orders[*order.ID].snapshot()}, nil
+}
+
+func (g *fakeGateway) GetOrder(ctx context.Context, orderID string) (*square.GetOrderResponse, error) {
+	g.fake.mu.Lock()
+	defer g.fake.mu.Unlock()
+
+	stored, ok := g.fake.orders[orderID]
+	if !ok || stored.merchantID != g.merchantID {
+		return nil, fmt.Errorf("order %s: %w", orderID, ErrNotFound)
+	}
+
+	return &square.GetOrderResponse{Order: stored.snapshot()}, nil
+}
+
+func (g *fakeGateway) CreatePayment(ctx context.Context, req *square.CreatePaymentRequest) (*square.CreatePaymentResponse, error) {
+	if req.IdempotencyKey == "" {
+		return nil, fmt.Errorf("%w: idempotency key is required", ErrRejected)
+	}
+	if req.AmountMoney == nil || req.AmountMoney.Amount == nil {
+		return nil, fmt.Errorf("%w: amount is required", ErrRejected)
+	}
+
+	g.fake.mu.Lock()
+	defer g.fake.mu.Unlock()
+
+	key := "payment:" + g.merchantID + ":" + req.IdempotencyKey
+	if id, ok := g.fake.idempotency[key]; ok {
+		return &square.CreatePaymentResponse{Payment: g.fake.payments[id]}, nil
+	}
+
+	amount := *req.AmountMoney.Amount
+	var tip int64
+	if req.TipMoney != nil && req.TipMoney.Amount != nil {
+		tip = *req.TipMoney.Amount
+	}
+	currency := square.CurrencyUsd
+	if req.AmountMoney.Currency != nil {
+		currency = *req.AmountMoney.Currency
+	}
+
+	var stored *fakeOrder
+	if req.OrderID != nil {
+		var ok bool
+		stored, ok = g.fake.orders[*req.OrderID]
+		if !ok || stored.merchantID != g.merchantID {
+			return nil, fmt.Errorf("order %s: %w", *req.OrderID, ErrNotFound)
+		}
+		if *stored.order.State != square.OrderStateOpen {
+			return nil, fmt.Errorf("%w: order %s is %s", ErrRejected, *req.OrderID, *stored.order.State)
+		}
+	}
+
+	locationID := req.LocationID
+	if locationID == nil {
+		locationID = square.String(FakeLocationID(g.merchantID))
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	sourceType, tenderType := "CARD", square.TenderTypeCard
+	switch req.SourceID {
+	case "CASH":
+		sourceType, tenderType = "CASH", square.TenderTypeCash
+	case "EXTERNAL":
+		sourceType, tenderType = "EXTERNAL", square.TenderTypeOther
+	}
+	payment := &square.Payment{
+		ID:          square.String(newFakeID()),
+		CreatedAt:   square.String(now),
+		UpdatedAt:   square.String(now),
+		AmountMoney: fakeMoney(amount, currency),
+		TipMoney:    fakeMoney(tip, currency),
+		TotalMoney:  fakeMoney(amount+tip, currency),
+		Status:      square.String("COMPLETED"),
+		SourceType:  square.String(sourceType),
+		LocationID:  locationID,
+		OrderID:     req.OrderID,
+		ReferenceID: req.ReferenceID,
+		Note:        req.Note,
+	}
+	switch sourceType {
+	case "CASH":
+		if req.CashDetails != nil {
+			cash := *req.CashDetails
+			if supplied := fakeAmount(cash.BuyerSuppliedMoney); supplied > amount+tip {
+				cash.ChangeBackMoney = fakeMoney(supplied-amount-tip, currency)
+			}
+			payment.CashDetails = &cash
+		}
+	case "EXTERNAL":
+		payment.ExternalDetails = req.ExternalDetails
+	case "CARD":
+		// Gift card IDs start with gftc:, any other source is charged as a Visa card
+		brand := square.CardBrandVisa
+		if strings.HasPrefix(req.SourceID, "gftc:") {
+			brand = square.CardBrandSquareGiftCard
+		}
+		payment.CardDetails = &square.CardPaymentDetails{
+			Status: square.String("CAPTURED"),
+			Card: &square.Card{
+				CardBrand: brand.Ptr(),
+				Last4:     square.String("1111"),
+			},
+		}
+	}
+	g.fake.payments[*payment.ID] = payment
+	g.fake.idempotency[key] = *payment.ID
+
+	if stored != nil {
+		order := stored.order
+		due := *order.NetAmountDueMoney.Amount - amount
+		if due < 0 {
+			due = 0
+		}
+		order.NetAmountDueMoney = fakeMoney(due, currency)
+		order.TotalTipMoney = fakeMoney(*order.TotalTipMoney.Amount+tip, currency)
+		order.TotalMoney = fakeMoney(*order.TotalMoney.Amount+tip, currency)
+		// Like Square, the tender's amount includes the tip
+		order.Tenders = append(order.Tenders, &square.Tender{
+			ID:          payment.ID,
+			LocationID:  square.String(order.LocationID),
+			PaymentID:   payment.ID,
+			AmountMoney: fakeMoney(amount+tip, currency),
+			TipMoney:    payment.TipMoney,
+			Type:        tenderType,
+		})
+		if due == 0 {
+			order.State = square.OrderStateCompleted.Ptr()
+			order.ClosedAt = square.String(now)
+		}
+		order.UpdatedAt = square.String(now)
+		*order.Version++
+	}
+
+	return &square.CreatePaymentResponse{Payment: payment}, nil
+}
+
+func (g *fakeGateway) GetPayment(ctx context.Context, paymentID string) (*square.GetPaymentResponse, error) {
+	g.fake.mu.Lock()
+	defer g.fake.mu.Unlock()
+
+	payment, ok := g.fake.payments[paymentID]
+	if !ok || !g.fake.ownsPayment(g.merchantID, payment) {
+		return nil, fmt.Errorf("payment %s: %w", paymentID, ErrNotFound)
+	}
+	copied := *payment
+	copied.RefundIDs = append([]string(nil), payment.RefundIDs...)
+	return &square.GetPaymentResponse{Payment: &copied}, nil
+}
+
+func (g *fakeGateway) RefundPayment(ctx context.Context, req *square.RefundPaymentRequest) (*square.RefundPaymentResponse, error) {
+	if req.IdempotencyKey == "" {
+		return nil, fmt.Errorf("pos: idempotency key is required")
+	}
+	if req.PaymentID == nil {
+		return nil, fmt.Errorf("pos: payment ID is required")
+	}
+	if req.AmountMoney == nil || req.AmountMoney.Amount == nil || *req.AmountMoney.Amount <= 0 {
+		return nil, fmt.Errorf("pos: refund amount must be positive")
+	}
+
+	g.fake.mu.Lock()
+	defer g.fake.mu.Unlock()
+
+	key := "refund:" + g.merchantID + ":" + req.IdempotencyKey
+	if id, ok := g.fake.idempotency[key]; ok {
+		return &square.RefundPaymentResponse{Refund: g.fake.refunds[id]}, nil
+	}
+
+	payment, ok := g.fake.payments[*req.PaymentID]
+	if !ok || !g.fake.ownsPayment(g.merchantID, payment) {
+		return nil, fmt.Errorf("payment %s: %w", *req.PaymentID, ErrNotFound)
+	}
+
+	var refunded int64
+	if payment.RefundedMoney != nil {
+		refunded = *payment.RefundedMoney.Amount
+	}
+	amount := *req.AmountMoney.Amount
+	if refunded+amount > *payment.TotalMoney.Amount {
+		return nil, fmt.Errorf("pos: refund of %d exceeds the refundable amount of payment %s", amount, *req.PaymentID)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	currency := *payment.TotalMoney.Currency
+	refund := &square.PaymentRefund{
+		ID:          newFakeID(),
+		Status:      square.String("COMPLETED"),
+		LocationID:  payment.LocationID,
+		AmountMoney: fakeMoney(amount, currency),
+		PaymentID:   payment.ID,
+		OrderID:     payment.OrderID,
+		Reason:      req.Reason,
+		CreatedAt:   square.String(now),
+		UpdatedAt:   square.String(now),
+	}
+	g.fake.refunds[refund.ID] = refund
+	reason := ""
+	if req.Reason != nil {
+		reason = *req.Reason
+	}
+	g.fake.idempotency[key] = refund.ID
+
+	// Square lists the refunds of an order's payments on the order
+	if payment.OrderID != nil {
+		if stored, ok := g.fake.orders[*payment.OrderID]; ok {
+			stored.order.Refunds = append(stored.order.Refunds, &square.Refund{
+				ID:          refund.ID,
+				LocationID:  *payment.LocationID,
+				TenderID:    *payment.ID,
+				CreatedAt:   refund.CreatedAt,
+				Reason:      reason,
+				AmountMoney: refund.AmountMoney,
+				Status:      square.RefundStatusApproved,
+			})
+			stored.order.UpdatedAt = square.String(now)
+		}
+	}
+
+	payment.RefundedMoney = fakeMoney(refunded+amount, currency)
+	payment.RefundIDs = append(payment.RefundIDs, refund.ID)
+	payment.UpdatedAt = square.String(now)
+
+	return &square.RefundPaymentResponse{Refund: refund}, nil
+}
+
+// fakeTokenLifetime matches the lifetime of Square OAuth access tokens
+const fakeTokenLifetime = 30 * 24 * time.Hour
+
+// fakeOAuth grants every authorization code, the merchant is derived from the code
+type fakeOAuth struct {
+	fake *Fake
+}
+
+func (o *fakeOAuth) AuthorizeURL(clientID string, scopes []string, state, redirectURI string) string {
+	// There is no consent screen, go straight back to the application with a code
+	query := url.Values{
+		"code":  {"FAKECODE" + newFakeID()},
+		"state": {state},
+	}
+	return redirectURI + "?" + query.Encode()
+}
+
+func (o *fakeOAuth) ObtainToken(ctx context.Context, req *square.ObtainTokenRequest) (*square.ObtainTokenResponse, error) {
+	o.fake.mu.Lock()
+	defer o.fake.mu.Unlock()
+
+	var merchantID string
+	switch req.GrantType {
+	case "authorization_code":
+		if req.Code == nil || *req.Code == "" {
+			return nil, fmt.Errorf("pos: authorization code is required")
+		}
+		merchantID = FakeMerchantID(*req.Code)
+	case "refresh_token":
+		if req.RefreshToken == nil {
+			return nil, fmt.Errorf("pos: refresh token is required")
+		}
+		var ok bool
+		merchantID, ok = o.fake.refreshTokens[*req.RefreshToken]
+		if !ok {
+			return nil, ErrUnauthorized
+		}
+	default:
+		return nil, fmt.Errorf("pos: unsupported grant type %q", req.GrantType)
+	}
+
+	accessToken := "FAKEACCESS" + newFakeID()
+	expiresAt := time.Now().Add(fakeTokenLifetime)
+	o.fake.tokens[accessToken] = fakeToken{merchantID: merchantID, expiresAt: expiresAt}
+
+	refreshToken := "FAKEREFRESH" + newFakeID()
+	if req.RefreshToken != nil {
+		refreshToken = *req.RefreshToken
+	}
+	o.fake.refreshTokens[refreshToken] = merchantID
+
+	return &square.ObtainTokenResponse{
+		AccessToken:  square.String(accessToken),
+		TokenType:    square.String("bearer"),
+		ExpiresAt:    square.String(expiresAt.UTC().Format(time.RFC3339)),
+		MerchantID:   square.String(merchantID),
+		RefreshToken: square.String(refreshToken),
+	}, nil
+}
+
+func (o *fakeOAuth) RevokeToken(ctx context.Context, clientSecret string, req *square.RevokeTokenRequest) (*square.RevokeTokenResponse, error) {
+	o.fake.mu.Lock()
+	defer o.fake.mu.Unlock()
+
+	merchantID := ""
+	if req.MerchantID != nil {
+		merchantID = *req.MerchantID
+	} else if req.AccessToken != nil {
+		if issued, ok := o.fake.tokens[*req.AccessToken]; ok {
+			merchantID = issued.merchantID
+		}
+	}
+	if merchantID == "" {
+		return nil, fmt.Errorf("token: %w", ErrNotFound)
+	}
+
+	// Like Square, revoking one token revokes every token of the merchant
+	for token, issued := range o.fake.tokens {
+		if issued.merchantID == merchantID {
+			issued.revoked = true
+			o.fake.tokens[token] = issued
+		}
+	}
+	if req.RevokeOnlyAccessToken == nil || !*req.RevokeOnlyAccessToken {
+		for token, owner := range o.fake.refreshTokens {
+			if owner == merchantID {
+				delete(o.fake.refreshTokens, token)
+			}
+		}
+	}
+
+	return &square.RevokeTokenResponse{Success: square.Bool(true)}, nil
+}
+
+// ownsPayment reports whether the payment was taken by the merchant
+func (f *Fake) ownsPayment(merchantID string, payment *square.Payment) bool {
+	return payment.LocationID != nil && *payment.LocationID == FakeLocationID(merchantID)
+}
+
+func fakeMoney(amount int64, currency square.Currency) *square.Money {
+	return &square.Money{
+		Amount:   square.Int64(amount),
+		Currency: currency.Ptr(),
+	}
+}
+
+func newFakeID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
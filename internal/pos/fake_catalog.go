@@ -0,0 +1,203 @@
+package pos
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/square/square-go-sdk"
+)
+
+// Catalog object IDs of the menu every fake merchant sells
+const (
+	FakeCategoryMains          = "FAKE_CATEGORY_MAINS"
+	FakeCategoryDrinks         = "FAKE_CATEGORY_DRINKS"
+	FakeModifierListAddOns     = "FAKE_MODIFIER_LIST_ADD_ONS"
+	FakeModifierCheese         = "FAKE_MODIFIER_CHEESE"
+	FakeModifierBacon          = "FAKE_MODIFIER_BACON"
+	FakeItemBurger             = "FAKE_ITEM_BURGER"
+	FakeVariationBurgerRegular = "FAKE_VARIATION_BURGER_REGULAR"
+	FakeVariationBurgerDouble  = "FAKE_VARIATION_BURGER_DOUBLE"
+	FakeItemFries              = "FAKE_ITEM_FRIES"
+	FakeVariationFries         = "FAKE_VARIATION_FRIES_REGULAR"
+	FakeItemLemonade           = "FAKE_ITEM_LEMONADE"
+	FakeVariationLemonade      = "FAKE_VARIATION_LEMONADE_REGULAR"
+	FakeItemSpecial            = "FAKE_ITEM_SPECIAL"
+	FakeVariationSpecial       = "FAKE_VARIATION_SPECIAL_REGULAR"
+)
+
+// fakeCatalogLimit is the page size Square uses when a catalog search has no limit
+const fakeCatalogLimit = 100
+
+// fakeCatalog returns the menu every fake merchant sells in USD, the daily special is priced when it is ordered
+func fakeCatalog() []*square.CatalogObject {
+	category := func(id, name string) *square.CatalogObject {
+		return &square.CatalogObject{Type: "CATEGORY", Category: &square.CatalogObjectCategory{
+			ID:                    square.String(id),
+			PresentAtAllLocations: square.Bool(true),
+			CategoryData:          &square.CatalogCategory{Name: square.String(name)},
+		}}
+	}
+	modifier := func(id, name string, price int64) *square.CatalogObject {
+		return &square.CatalogObject{Type: "MODIFIER", Modifier: &square.CatalogObjectModifier{
+			ID:                    id,
+			PresentAtAllLocations: square.Bool(true),
+			ModifierData: &square.CatalogModifier{
+				Name:           square.String(name),
+				PriceMoney:     fakeMoney(price, square.CurrencyUsd),
+				ModifierListID: square.String(FakeModifierListAddOns),
+			},
+		}}
+	}
+	variation := func(id, itemID, name string, price int64) *square.CatalogObject {
+		data := &square.CatalogItemVariation{
+			ItemID:      square.String(itemID),
+			Name:        square.String(name),
+			PricingType: square.CatalogPricingTypeFixedPricing.Ptr(),
+			PriceMoney:  fakeMoney(price, square.CurrencyUsd),
+		}
+		if price == 0 {
+			data.PricingType = square.CatalogPricingTypeVariablePricing.Ptr()
+			data.PriceMoney = nil
+		}
+		return &square.CatalogObject{Type: "ITEM_VARIATION", ItemVariation: &square.CatalogObjectItemVariation{
+			ID:                    id,
+			PresentAtAllLocations: square.Bool(true),
+			ItemVariationData:     data,
+		}}
+	}
+	item := func(id, name, categoryID string, modifierLists []string, variations ...*square.CatalogObject) *square.CatalogObject {
+		data := &square.CatalogItem{
+			Name:       square.String(name),
+			Categories: []*square.CatalogObjectCategory{{ID: square.String(categoryID)}},
+			Variations: variations,
+		}
+		for _, list := range modifierLists {
+			data.ModifierListInfo = append(data.ModifierListInfo, &square.CatalogItemModifierListInfo{ModifierListID: list, Enabled: square.Bool(true)})
+		}
+		return &square.CatalogObject{Type: "ITEM", Item: &square.CatalogObjectItem{
+			ID:                    id,
+			PresentAtAllLocations: square.Bool(true),
+			ItemData:              data,
+		}}
+	}
+
+	return []*square.CatalogObject{
+		category(FakeCategoryMains, "Mains"),
+		category(FakeCategoryDrinks, "Drinks"),
+		{Type: "MODIFIER_LIST", ModifierList: &square.CatalogObjectModifierList{
+			ID:                    FakeModifierListAddOns,
+			PresentAtAllLocations: square.Bool(true),
+			ModifierListData: &square.CatalogModifierList{
+				Name:          square.String("Add-ons"),
+				SelectionType: square.CatalogModifierListSelectionTypeMultiple.Ptr(),
+				Modifiers: []*square.CatalogObject{
+					modifier(FakeModifierCheese, "Extra cheese", 100),
+					modifier(FakeModifierBacon, "Bacon", 200),
+				},
+			},
+		}},
+		item(FakeItemBurger, "Burger", FakeCategoryMains, []string{FakeModifierListAddOns},
+			variation(FakeVariationBurgerRegular, FakeItemBurger, "Regular", 1200),
+			variation(FakeVariationBurgerDouble, FakeItemBurger, "Double", 1600)),
+		item(FakeItemFries, "Fries", FakeCategoryMains, nil,
+			variation(FakeVariationFries, FakeItemFries, "Regular", 450)),
+		item(FakeItemLemonade, "Lemonade", FakeCategoryDrinks, nil,
+			variation(FakeVariationLemonade, FakeItemLemonade, "Regular", 350)),
+		item(FakeItemSpecial, "Daily special", FakeCategoryMains, nil,
+			variation(FakeVariationSpecial, FakeItemSpecial, "Regular", 0)),
+	}
+}
+
+// SearchCatalog supports the object type filter of Square's search. The cursor is the offset of the next page
+func (g *fakeGateway) SearchCatalog(ctx context.Context, req *square.SearchCatalogObjectsRequest) (*square.SearchCatalogObjectsResponse, error) {
+	limit := fakeCatalogLimit
+	if req.Limit != nil && *req.Limit > 0 && *req.Limit < limit {
+		limit = *req.Limit
+	}
+	offset := 0
+	if req.Cursor != nil && *req.Cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(*req.Cursor); err != nil || offset < 0 {
+			return nil, fmt.Errorf("%w: invalid cursor", ErrRejected)
+		}
+	}
+
+	var objects []*square.CatalogObject
+	for _, object := range fakeCatalog() {
+		if len(req.ObjectTypes) == 0 || slices.Contains(req.ObjectTypes, square.CatalogObjectType(object.Type)) {
+			objects = append(objects, object)
+		}
+	}
+
+	resp := &square.SearchCatalogObjectsResponse{}
+	if offset >= len(objects) {
+		return resp, nil
+	}
+	end := min(offset+limit, len(objects))
+	resp.Objects = objects[offset:end]
+	if end < len(objects) {
+		resp.Cursor = square.String(strconv.Itoa(end))
+	}
+	return resp, nil
+}
+
+// catalogLines prices the line items and modifiers that reference the catalog like Square does, a price sent with
+// them overrides the catalog's. Lines are copied so the request is left alone
+func catalogLines(lines []*square.OrderLineItem) ([]*square.OrderLineItem, error) {
+	variations := make(map[string]*square.CatalogItemVariation)
+	items := make(map[string]*square.CatalogItem)
+	modifiers := make(map[string]*square.CatalogModifier)
+	for _, object := range fakeCatalog() {
+		switch {
+		case object.Item != nil:
+			items[object.Item.ID] = object.Item.ItemData
+			for _, v := range object.Item.ItemData.Variations {
+				variations[v.ItemVariation.ID] = v.ItemVariation.ItemVariationData
+			}
+		case object.ModifierList != nil:
+			for _, m := range object.ModifierList.ModifierListData.Modifiers {
+				modifiers[m.Modifier.ID] = m.Modifier.ModifierData
+			}
+		}
+	}
+
+	priced := make([]*square.OrderLineItem, len(lines))
+	for i, l := range lines {
+		line := *l
+		priced[i] = &line
+		if line.CatalogObjectID != nil {
+			variation, ok := variations[*line.CatalogObjectID]
+			if !ok {
+				return nil, fmt.Errorf("%w: catalog object %s not found", ErrRejected, *line.CatalogObjectID)
+			}
+			line.Name = items[*variation.ItemID].Name
+			line.VariationName = variation.Name
+			if line.BasePriceMoney == nil {
+				if variation.PriceMoney == nil {
+					return nil, fmt.Errorf("%w: variable priced item %s needs a base price", ErrRejected, *line.CatalogObjectID)
+				}
+				line.BasePriceMoney = variation.PriceMoney
+			}
+		}
+
+		line.Modifiers = slices.Clone(line.Modifiers)
+		for j, m := range line.Modifiers {
+			if m.CatalogObjectID == nil {
+				continue
+			}
+			catalog, ok := modifiers[*m.CatalogObjectID]
+			if !ok {
+				return nil, fmt.Errorf("%w: catalog object %s not found", ErrRejected, *m.CatalogObjectID)
+			}
+			modifier := *m
+			modifier.Name = catalog.Name
+			if modifier.BasePriceMoney == nil {
+				modifier.BasePriceMoney = catalog.PriceMoney
+			}
+			line.Modifiers[j] = &modifier
+		}
+	}
+	return priced, nil
+}
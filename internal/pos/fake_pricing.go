@@ -0,0 +1,275 @@
+package pos
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/square/square-go-sdk"
+)
+
+// priceFakeOrder copies the order and computes the amounts Square would charge for its
+// line items, modifiers and discounts
+func priceFakeOrder(in *square.Order) (*square.Order, error) {
+	order := *in
+	currency := square.CurrencyUsd
+	for _, line := range in.LineItems {
+		if line.BasePriceMoney != nil && line.BasePriceMoney.Currency != nil {
+			currency = *line.BasePriceMoney.Currency
+			break
+		}
+	}
+
+	order.Discounts = make([]*square.OrderLineItemDiscount, len(in.Discounts))
+	discounts := make(map[string]*square.OrderLineItemDiscount, len(in.Discounts))
+	for i, d := range in.Discounts {
+		discount := *d
+		if discount.UID == nil {
+			discount.UID = square.String(newFakeID())
+		}
+		discount.AppliedMoney = fakeMoney(0, currency)
+		order.Discounts[i] = &discount
+		discounts[*discount.UID] = &discount
+	}
+
+	order.LineItems = make([]*square.OrderLineItem, len(in.LineItems))
+	gross := make([]int64, len(in.LineItems))
+	discounted := make([]int64, len(in.LineItems))
+	for i, item := range in.LineItems {
+		line := *item
+		if line.UID == nil {
+			line.UID = square.String(newFakeID())
+		}
+		quantity, err := strconv.ParseInt(line.Quantity, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("pos: invalid quantity %q", line.Quantity)
+		}
+
+		line.AppliedTaxes = append([]*square.OrderLineItemAppliedTax(nil), item.AppliedTaxes...)
+
+		unit := fakeAmount(line.BasePriceMoney)
+		line.Modifiers = make([]*square.OrderLineItemModifier, len(item.Modifiers))
+		for j, m := range item.Modifiers {
+			modifier := *m
+			if modifier.UID == nil {
+				modifier.UID = square.String(newFakeID())
+			}
+			modifierQuantity := int64(1)
+			if modifier.Quantity != nil {
+				if modifierQuantity, err = strconv.ParseInt(*modifier.Quantity, 10, 64); err != nil {
+					return nil, fmt.Errorf("pos: invalid modifier quantity %q", *modifier.Quantity)
+				}
+			}
+			price := fakeAmount(modifier.BasePriceMoney) * modifierQuantity
+			modifier.TotalPriceMoney = fakeMoney(price*quantity, currency)
+			unit += price
+			line.Modifiers[j] = &modifier
+		}
+		gross[i] = unit * quantity
+
+		// Line item discounts apply one after the other to what is left of the line,
+		// order discounts applied by an earlier pricing are spread again below
+		line.AppliedDiscounts = nil
+		for _, a := range item.AppliedDiscounts {
+			discount, ok := discounts[a.DiscountUID]
+			if !ok {
+				return nil, fmt.Errorf("pos: unknown discount %q", a.DiscountUID)
+			}
+			if discount.Scope != nil && *discount.Scope == square.OrderLineItemDiscountScopeOrder {
+				continue
+			}
+			amount := fakeDiscount(discount, gross[i]-discounted[i])
+			discounted[i] += amount
+			*discount.AppliedMoney.Amount += amount
+
+			applied := *a
+			applied.AppliedMoney = fakeMoney(amount, currency)
+			line.AppliedDiscounts = append(line.AppliedDiscounts, &applied)
+		}
+		order.LineItems[i] = &line
+	}
+
+	// Order discounts are spread over the lines in proportion to what is left of them
+	for _, discount := range order.Discounts {
+		if discount.Scope == nil || *discount.Scope != square.OrderLineItemDiscountScopeOrder {
+			continue
+		}
+		var base int64
+		for i := range order.LineItems {
+			base += gross[i] - discounted[i]
+		}
+		if base <= 0 {
+			continue
+		}
+
+		amount := fakeDiscount(discount, base)
+		remaining := amount
+		for i, line := range order.LineItems {
+			share := amount * (gross[i] - discounted[i]) / base
+			if i == len(order.LineItems)-1 {
+				share = remaining
+			}
+			remaining -= share
+			discounted[i] += share
+			line.AppliedDiscounts = append(line.AppliedDiscounts, &square.OrderLineItemAppliedDiscount{
+				UID:          square.String(newFakeID()),
+				DiscountUID:  *discount.UID,
+				AppliedMoney: fakeMoney(share, currency),
+			})
+		}
+		*discount.AppliedMoney.Amount += amount
+	}
+
+	// Service charges are calculated on the subtotal after discounts
+	var subtotal int64
+	for i := range order.LineItems {
+		subtotal += gross[i] - discounted[i]
+	}
+	order.ServiceCharges = make([]*square.OrderServiceCharge, len(in.ServiceCharges))
+	for i, c := range in.ServiceCharges {
+		charge := *c
+		if charge.UID == nil {
+			charge.UID = square.String(newFakeID())
+		}
+		var amount int64
+		if charge.Percentage != nil {
+			amount = fakePercentage(subtotal, *charge.Percentage)
+		} else {
+			amount = fakeAmount(charge.AmountMoney)
+		}
+		charge.AppliedMoney = fakeMoney(amount, currency)
+		charge.AppliedTaxes = nil
+		order.ServiceCharges[i] = &charge
+	}
+
+	// Additive taxes are charged on top of the discounted line, inclusive taxes are carved out of it.
+	// Order scoped taxes also apply to taxable service charges
+	lineTax := make([]int64, len(order.LineItems))
+	lineAdded := make([]int64, len(order.LineItems))
+	chargeTax := make([]int64, len(order.ServiceCharges))
+	var totalTax int64
+	order.Taxes = make([]*square.OrderLineItemTax, len(in.Taxes))
+	for k, t := range in.Taxes {
+		tax := *t
+		if tax.UID == nil {
+			tax.UID = square.String(newFakeID())
+		}
+		percentage := ""
+		if tax.Percentage != nil {
+			percentage = *tax.Percentage
+		}
+		inclusive := tax.Type != nil && *tax.Type == square.OrderLineItemTaxTypeInclusive
+		orderScope := tax.Scope == nil || *tax.Scope == square.OrderLineItemTaxScopeOrder
+
+		var applied int64
+		taxOf := func(base int64) int64 {
+			if inclusive {
+				return base - fakeExclusive(base, percentage)
+			}
+			return fakePercentage(base, percentage)
+		}
+		for i, line := range order.LineItems {
+			var entry *square.OrderLineItemAppliedTax
+			for j, a := range line.AppliedTaxes {
+				if a.TaxUID == *tax.UID {
+					copied := *a
+					line.AppliedTaxes[j] = &copied
+					entry = &copied
+				}
+			}
+			if entry == nil && !orderScope {
+				continue
+			}
+			if entry == nil {
+				entry = &square.OrderLineItemAppliedTax{UID: square.String(newFakeID()), TaxUID: *tax.UID}
+				line.AppliedTaxes = append(line.AppliedTaxes, entry)
+			}
+			amount := taxOf(gross[i] - discounted[i])
+			entry.AppliedMoney = fakeMoney(amount, currency)
+			lineTax[i] += amount
+			if !inclusive {
+				lineAdded[i] += amount
+			}
+			applied += amount
+		}
+		if orderScope && !inclusive {
+			for i, charge := range order.ServiceCharges {
+				if charge.Taxable == nil || !*charge.Taxable {
+					continue
+				}
+				amount := fakePercentage(*charge.AppliedMoney.Amount, percentage)
+				charge.AppliedTaxes = append(charge.AppliedTaxes, &square.OrderLineItemAppliedTax{
+					UID:          square.String(newFakeID()),
+					TaxUID:       *tax.UID,
+					AppliedMoney: fakeMoney(amount, currency),
+				})
+				chargeTax[i] += amount
+				applied += amount
+			}
+		}
+		tax.AppliedMoney = fakeMoney(applied, currency)
+		totalTax += applied
+		order.Taxes[k] = &tax
+	}
+
+	var total, totalDiscount, totalServiceCharge int64
+	for i, line := range order.LineItems {
+		line.GrossSalesMoney = fakeMoney(gross[i], currency)
+		line.TotalDiscountMoney = fakeMoney(discounted[i], currency)
+		line.TotalTaxMoney = fakeMoney(lineTax[i], currency)
+		line.TotalMoney = fakeMoney(gross[i]-discounted[i]+lineAdded[i], currency)
+		total += gross[i] - discounted[i] + lineAdded[i]
+		totalDiscount += discounted[i]
+	}
+	for i, charge := range order.ServiceCharges {
+		amount := *charge.AppliedMoney.Amount
+		charge.TotalTaxMoney = fakeMoney(chargeTax[i], currency)
+		charge.TotalMoney = fakeMoney(amount+chargeTax[i], currency)
+		total += amount + chargeTax[i]
+		totalServiceCharge += amount
+	}
+
+	order.TotalMoney = fakeMoney(total, currency)
+	order.TotalTaxMoney = fakeMoney(totalTax, currency)
+	order.TotalDiscountMoney = fakeMoney(totalDiscount, currency)
+	order.TotalTipMoney = fakeMoney(0, currency)
+	order.TotalServiceChargeMoney = fakeMoney(totalServiceCharge, currency)
+	order.NetAmountDueMoney = fakeMoney(total, currency)
+	return &order, nil
+}
+
+// fakeDiscount is what the discount takes off base, never more than base
+func fakeDiscount(discount *square.OrderLineItemDiscount, base int64) int64 {
+	var amount int64
+	if discount.Percentage != nil {
+		amount = fakePercentage(base, *discount.Percentage)
+	} else {
+		amount = fakeAmount(discount.AmountMoney)
+	}
+	return min(max(amount, 0), base)
+}
+
+func fakeAmount(m *square.Money) int64 {
+	if m == nil || m.Amount == nil {
+		return 0
+	}
+	return *m.Amount
+}
+
+// fakePercentage is the rounded percentage of base, 0 for percentages that do not parse
+func fakePercentage(base int64, percentage string) int64 {
+	p, err := strconv.ParseFloat(percentage, 64)
+	if err != nil {
+		return 0
+	}
+	return int64(math.Round(float64(base) * p / 100))
+}
+
+// fakeExclusive is what is left of base once an inclusive tax of percentage is taken out
+func fakeExclusive(base int64, percentage string) int64 {
+	p, err := strconv.ParseFloat(percentage, 64)
+	if err != nil {
+		return base
+	}
+	return int64(math.Round(float64(base) * 100 / (100 + p)))
+}
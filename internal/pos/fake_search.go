@@ -0,0 +1,138 @@
+package pos
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/square/square-go-sdk"
+)
+
+// fakeSearchLimit is the page size Square uses when a search has no limit
+const fakeSearchLimit = 500
+
+// SearchOrders supports the location, state and date time filters and the sort of Square's search.
+// The cursor is the offset of the next page
+func (g *fakeGateway) SearchOrders(ctx context.Context, req *square.SearchOrdersRequest) (*square.SearchOrdersResponse, error) {
+	if len(req.LocationIDs) == 0 {
+		return nil, fmt.Errorf("%w: location_ids is required", ErrRejected)
+	}
+	limit := fakeSearchLimit
+	if req.Limit != nil && *req.Limit > 0 && *req.Limit < limit {
+		limit = *req.Limit
+	}
+	offset := 0
+	if req.Cursor != nil && *req.Cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(*req.Cursor); err != nil || offset < 0 {
+			return nil, fmt.Errorf("%w: invalid cursor", ErrRejected)
+		}
+	}
+
+	var filter *square.SearchOrdersFilter
+	sortField, sortOrder := square.SearchOrdersSortFieldCreatedAt, square.SortOrderDesc
+	if req.Query != nil {
+		filter = req.Query.Filter
+		if req.Query.Sort != nil {
+			sortField = req.Query.Sort.SortField
+			if req.Query.Sort.SortOrder != nil {
+				sortOrder = *req.Query.Sort.SortOrder
+			}
+		}
+	}
+
+	g.fake.mu.Lock()
+	defer g.fake.mu.Unlock()
+
+	var orders []*square.Order
+	for _, stored := range g.fake.orders {
+		if stored.merchantID != g.merchantID || !slices.Contains(req.LocationIDs, stored.order.LocationID) {
+			continue
+		}
+		if !fakeSearchMatches(stored.order, filter) {
+			continue
+		}
+		orders = append(orders, stored.snapshot())
+	}
+	slices.SortFunc(orders, func(a, b *square.Order) int {
+		c := strings.Compare(fakeSortTime(a, sortField), fakeSortTime(b, sortField))
+		if c == 0 {
+			c = strings.Compare(*a.ID, *b.ID)
+		}
+		if sortOrder == square.SortOrderDesc {
+			return -c
+		}
+		return c
+	})
+
+	resp := &square.SearchOrdersResponse{}
+	if offset >= len(orders) {
+		return resp, nil
+	}
+	end := min(offset+limit, len(orders))
+	resp.Orders = orders[offset:end]
+	if end < len(orders) {
+		resp.Cursor = square.String(strconv.Itoa(end))
+	}
+	return resp, nil
+}
+
+func fakeSearchMatches(order *square.Order, filter *square.SearchOrdersFilter) bool {
+	if filter == nil {
+		return true
+	}
+	if filter.StateFilter != nil && !slices.Contains(filter.StateFilter.States, *order.State) {
+		return false
+	}
+	if filter.DateTimeFilter == nil {
+		return true
+	}
+	dates := filter.DateTimeFilter
+	return fakeInRange(order.CreatedAt, dates.CreatedAt) &&
+		fakeInRange(order.UpdatedAt, dates.UpdatedAt) &&
+		fakeInRange(order.ClosedAt, dates.ClosedAt)
+}
+
+// fakeInRange reports whether the timestamp falls in the range, start inclusive and end exclusive
+func fakeInRange(at *string, r *square.TimeRange) bool {
+	if r == nil {
+		return true
+	}
+	if at == nil {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, *at)
+	if err != nil {
+		return false
+	}
+	if r.StartAt != nil {
+		if start, err := time.Parse(time.RFC3339, *r.StartAt); err == nil && t.Before(start) {
+			return false
+		}
+	}
+	if r.EndAt != nil {
+		if end, err := time.Parse(time.RFC3339, *r.EndAt); err == nil && !t.Before(end) {
+			return false
+		}
+	}
+	return true
+}
+
+func fakeSortTime(order *square.Order, field square.SearchOrdersSortField) string {
+	var at *string
+	switch field {
+	case square.SearchOrdersSortFieldUpdatedAt:
+		at = order.UpdatedAt
+	case square.SearchOrdersSortFieldClosedAt:
+		at = order.ClosedAt
+	default:
+		at = order.CreatedAt
+	}
+	if at == nil {
+		return ""
+	}
+	return *at
+}
@@ -0,0 +1,522 @@
+package pos
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/square/square-go-sdk"
+)
+
+func usd(amount int64) *square.Money {
+	return fakeMoney(amount, square.CurrencyUsd)
+}
+
+func TestFakeCreateOrderPricing(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    *square.Order
+		total    int64
+		tax      int64
+		discount int64
+		charge   int64
+	}{
+		{
+			name: "catalog variation with modifier",
+			order: &square.Order{LineItems: []*square.OrderLineItem{{
+				CatalogObjectID: square.String(FakeVariationBurgerDouble),
+				Quantity:        "2",
+				Modifiers:       []*square.OrderLineItemModifier{{CatalogObjectID: square.String(FakeModifierBacon)}},
+			}}},
+			total: 2 * (1600 + 200),
+		},
+		{
+			name: "price sent overrides the catalog",
+			order: &square.Order{LineItems: []*square.OrderLineItem{{
+				CatalogObjectID: square.String(FakeVariationSpecial),
+				Quantity:        "1",
+				BasePriceMoney:  usd(1450),
+			}}},
+			total: 1450,
+		},
+		{
+			name: "additive order tax",
+			order: &square.Order{
+				LineItems: []*square.OrderLineItem{{Name: square.String("Soup"), Quantity: "1", BasePriceMoney: usd(1000)}},
+				Taxes:     []*square.OrderLineItemTax{{UID: square.String("tax"), Percentage: square.String("10"), Scope: square.OrderLineItemTaxScopeOrder.Ptr()}},
+			},
+			total: 1100,
+			tax:   100,
+		},
+		{
+			name: "inclusive tax is part of the price",
+			order: &square.Order{
+				LineItems: []*square.OrderLineItem{{Name: square.String("Soup"), Quantity: "1", BasePriceMoney: usd(1100)}},
+				Taxes: []*square.OrderLineItemTax{{
+					UID:        square.String("vat"),
+					Percentage: square.String("10"),
+					Type:       square.OrderLineItemTaxTypeInclusive.Ptr(),
+					Scope:      square.OrderLineItemTaxScopeOrder.Ptr(),
+				}},
+			},
+			total: 1100,
+			tax:   100,
+		},
+		{
+			name: "order discount spread over the lines",
+			order: &square.Order{
+				LineItems: []*square.OrderLineItem{
+					{Name: square.String("Soup"), Quantity: "1", BasePriceMoney: usd(1000)},
+					{Name: square.String("Bread"), Quantity: "1", BasePriceMoney: usd(500)},
+				},
+				Discounts: []*square.OrderLineItemDiscount{{
+					UID:         square.String("voucher"),
+					AmountMoney: usd(300),
+					Scope:       square.OrderLineItemDiscountScopeOrder.Ptr(),
+				}},
+			},
+			total:    1200,
+			discount: 300,
+		},
+		{
+			name: "taxable percentage service charge",
+			order: &square.Order{
+				LineItems:      []*square.OrderLineItem{{Name: square.String("Soup"), Quantity: "1", BasePriceMoney: usd(1000)}},
+				ServiceCharges: []*square.OrderServiceCharge{{Name: square.String("Gratuity"), Percentage: square.String("20"), Taxable: square.Bool(true)}},
+				Taxes:          []*square.OrderLineItemTax{{UID: square.String("tax"), Percentage: square.String("10"), Scope: square.OrderLineItemTaxScopeOrder.Ptr()}},
+			},
+			total:  1000 + 100 + 200 + 20,
+			tax:    120,
+			charge: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := NewFake().Connect(Sandbox, "token")
+			resp, err := gateway.CreateOrder(context.Background(), &square.CreateOrderRequest{Order: tt.order})
+			if err != nil {
+				t.Fatalf("CreateOrder: %v", err)
+			}
+			order := resp.Order
+			if got := fakeAmount(order.TotalMoney); got != tt.total {
+				t.Errorf("total = %d, want %d", got, tt.total)
+			}
+			if got := fakeAmount(order.NetAmountDueMoney); got != tt.total {
+				t.Errorf("due = %d, want %d", got, tt.total)
+			}
+			if got := fakeAmount(order.TotalTaxMoney); got != tt.tax {
+				t.Errorf("tax = %d, want %d", got, tt.tax)
+			}
+			if got := fakeAmount(order.TotalDiscountMoney); got != tt.discount {
+				t.Errorf("discount = %d, want %d", got, tt.discount)
+			}
+			if got := fakeAmount(order.TotalServiceChargeMoney); got != tt.charge {
+				t.Errorf("service charge = %d, want %d", got, tt.charge)
+			}
+			if *order.State != square.OrderStateOpen || *order.Version != 1 {
+				t.Errorf("state %s version %d, want OPEN at version 1", *order.State, *order.Version)
+			}
+		})
+	}
+}
+
+func TestFakeCreateOrderRejectsUnknownCatalogObjects(t *testing.T) {
+	tests := []struct {
+		name string
+		line *square.OrderLineItem
+	}{
+		{"unknown variation", &square.OrderLineItem{CatalogObjectID: square.String("NOPE"), Quantity: "1"}},
+		{"variable price without a price", &square.OrderLineItem{CatalogObjectID: square.String(FakeVariationSpecial), Quantity: "1"}},
+		{"unknown modifier", &square.OrderLineItem{
+			CatalogObjectID: square.String(FakeVariationBurgerRegular),
+			Quantity:        "1",
+			Modifiers:       []*square.OrderLineItemModifier{{CatalogObjectID: square.String("NOPE")}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := NewFake().Connect(Sandbox, "token")
+			_, err := gateway.CreateOrder(context.Background(), &square.CreateOrderRequest{
+				Order: &square.Order{LineItems: []*square.OrderLineItem{tt.line}},
+			})
+			if !errors.Is(err, ErrRejected) {
+				t.Fatalf("err = %v, want ErrRejected", err)
+			}
+		})
+	}
+}
+
+func TestFakeCreateOrderIdempotency(t *testing.T) {
+	gateway := NewFake().Connect(Sandbox, "token")
+	req := &square.CreateOrderRequest{
+		IdempotencyKey: square.String("key"),
+		Order:          &square.Order{LineItems: []*square.OrderLineItem{{Name: square.String("Soup"), Quantity: "1", BasePriceMoney: usd(1000)}}},
+	}
+	first, err := gateway.CreateOrder(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	second, err := gateway.CreateOrder(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateOrder again: %v", err)
+	}
+	if *first.Order.ID != *second.Order.ID {
+		t.Errorf("retry created order %s, want %s", *second.Order.ID, *first.Order.ID)
+	}
+}
+
+func TestFakePaymentsSettleOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		payments [][2]int64
+		due      int64
+		tips     int64
+		state    square.OrderState
+	}{
+		{"partial payment", [][2]int64{{400, 0}}, 600, 0, square.OrderStateOpen},
+		{"partial payment with tip", [][2]int64{{400, 100}}, 600, 100, square.OrderStateOpen},
+		{"paid in two payments with tips", [][2]int64{{400, 50}, {600, 100}}, 0, 150, square.OrderStateCompleted},
+		{"paid at once", [][2]int64{{1000, 0}}, 0, 0, square.OrderStateCompleted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			gateway := NewFake().Connect(Sandbox, "token")
+			created, err := gateway.CreateOrder(ctx, &square.CreateOrderRequest{
+				Order: &square.Order{LineItems: []*square.OrderLineItem{{Name: square.String("Soup"), Quantity: "1", BasePriceMoney: usd(1000)}}},
+			})
+			if err != nil {
+				t.Fatalf("CreateOrder: %v", err)
+			}
+			orderID := *created.Order.ID
+
+			for i, p := range tt.payments {
+				resp, err := gateway.CreatePayment(ctx, &square.CreatePaymentRequest{
+					IdempotencyKey: string(rune('a' + i)),
+					SourceID:       "CASH",
+					AmountMoney:    usd(p[0]),
+					TipMoney:       usd(p[1]),
+					OrderID:        square.String(orderID),
+				})
+				if err != nil {
+					t.Fatalf("CreatePayment: %v", err)
+				}
+				if got := fakeAmount(resp.Payment.TotalMoney); got != p[0]+p[1] {
+					t.Errorf("payment total = %d, want %d", got, p[0]+p[1])
+				}
+			}
+
+			got, err := gateway.GetOrder(ctx, orderID)
+			if err != nil {
+				t.Fatalf("GetOrder: %v", err)
+			}
+			order := got.Order
+			if due := fakeAmount(order.NetAmountDueMoney); due != tt.due {
+				t.Errorf("due = %d, want %d", due, tt.due)
+			}
+			if tips := fakeAmount(order.TotalTipMoney); tips != tt.tips {
+				t.Errorf("tips = %d, want %d", tips, tt.tips)
+			}
+			if *order.State != tt.state {
+				t.Errorf("state = %s, want %s", *order.State, tt.state)
+			}
+			// Like Square, each tender's amount includes its tip
+			for i, tender := range order.Tenders {
+				if got, want := fakeAmount(tender.AmountMoney), tt.payments[i][0]+tt.payments[i][1]; got != want {
+					t.Errorf("tender %d amount = %d, want %d", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFakeUpdateOrderKeepsTendersAndTips(t *testing.T) {
+	ctx := context.Background()
+	gateway := NewFake().Connect(Sandbox, "token")
+	created, err := gateway.CreateOrder(ctx, &square.CreateOrderRequest{
+		Order: &square.Order{LineItems: []*square.OrderLineItem{{UID: square.String("soup"), Name: square.String("Soup"), Quantity: "1", BasePriceMoney: usd(1000)}}},
+	})
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	orderID := *created.Order.ID
+	if _, err := gateway.CreatePayment(ctx, &square.CreatePaymentRequest{
+		IdempotencyKey: "pay",
+		SourceID:       "CASH",
+		AmountMoney:    usd(400),
+		TipMoney:       usd(100),
+		OrderID:        square.String(orderID),
+	}); err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+
+	resp, err := gateway.UpdateOrder(ctx, &square.UpdateOrderRequest{
+		OrderID: orderID,
+		Order: &square.Order{
+			Version:   square.Int(2),
+			LineItems: []*square.OrderLineItem{{Name: square.String("Bread"), Quantity: "1", BasePriceMoney: usd(500)}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+	order := resp.Order
+	if got := fakeAmount(order.NetAmountDueMoney); got != 1100 {
+		t.Errorf("due = %d, want 1100", got)
+	}
+	if got := fakeAmount(order.TotalTipMoney); got != 100 {
+		t.Errorf("tips = %d, want 100", got)
+	}
+	if got := fakeAmount(order.TotalMoney); got != 1600 {
+		t.Errorf("total = %d, want 1600", got)
+	}
+	if *order.Version != 3 {
+		t.Errorf("version = %d, want 3", *order.Version)
+	}
+}
+
+func TestFakeUpdateOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  func(version int) *square.Order
+		clear   []string
+		wantErr error
+		lines   int
+		state   square.OrderState
+	}{
+		{
+			name:    "stale version",
+			update:  func(version int) *square.Order { return &square.Order{Version: square.Int(version - 1)} },
+			wantErr: ErrVersionMismatch,
+		},
+		{
+			name:    "missing version",
+			update:  func(version int) *square.Order { return &square.Order{} },
+			wantErr: ErrVersionMismatch,
+		},
+		{
+			name:   "remove a line",
+			update: func(version int) *square.Order { return &square.Order{Version: square.Int(version)} },
+			clear:  []string{"line_items[soup]"},
+			lines:  0,
+			state:  square.OrderStateOpen,
+		},
+		{
+			name: "change a line's quantity",
+			update: func(version int) *square.Order {
+				return &square.Order{Version: square.Int(version), LineItems: []*square.OrderLineItem{{UID: square.String("soup"), Quantity: "3"}}}
+			},
+			lines: 1,
+			state: square.OrderStateOpen,
+		},
+		{
+			name: "cancel",
+			update: func(version int) *square.Order {
+				return &square.Order{Version: square.Int(version), State: square.OrderStateCanceled.Ptr()}
+			},
+			lines: 1,
+			state: square.OrderStateCanceled,
+		},
+		{
+			name: "complete is left to Square",
+			update: func(version int) *square.Order {
+				return &square.Order{Version: square.Int(version), State: square.OrderStateCompleted.Ptr()}
+			},
+			wantErr: errors.New("cannot be moved"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			gateway := NewFake().Connect(Sandbox, "token")
+			created, err := gateway.CreateOrder(ctx, &square.CreateOrderRequest{
+				Order: &square.Order{LineItems: []*square.OrderLineItem{{UID: square.String("soup"), Name: square.String("Soup"), Quantity: "1", BasePriceMoney: usd(1000)}}},
+			})
+			if err != nil {
+				t.Fatalf("CreateOrder: %v", err)
+			}
+
+			resp, err := gateway.UpdateOrder(ctx, &square.UpdateOrderRequest{
+				OrderID:       *created.Order.ID,
+				Order:         tt.update(*created.Order.Version),
+				FieldsToClear: tt.clear,
+			})
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("UpdateOrder succeeded, want %v", tt.wantErr)
+				}
+				if errors.Is(tt.wantErr, ErrVersionMismatch) && !errors.Is(err, ErrVersionMismatch) {
+					t.Fatalf("err = %v, want ErrVersionMismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UpdateOrder: %v", err)
+			}
+			if len(resp.Order.LineItems) != tt.lines {
+				t.Errorf("%d lines, want %d", len(resp.Order.LineItems), tt.lines)
+			}
+			if *resp.Order.State != tt.state {
+				t.Errorf("state = %s, want %s", *resp.Order.State, tt.state)
+			}
+		})
+	}
+}
+
+func TestFakeMerchantsAreSeparate(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake()
+	alice, bob := fake.Connect(Sandbox, "alice"), fake.Connect(Sandbox, "bob")
+
+	created, err := alice.CreateOrder(ctx, &square.CreateOrderRequest{
+		Order: &square.Order{LineItems: []*square.OrderLineItem{{Name: square.String("Soup"), Quantity: "1", BasePriceMoney: usd(1000)}}},
+	})
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	if _, err := bob.GetOrder(ctx, *created.Order.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("other merchant's GetOrder err = %v, want ErrNotFound", err)
+	}
+	payment, err := alice.CreatePayment(ctx, &square.CreatePaymentRequest{IdempotencyKey: "pay", SourceID: "CASH", AmountMoney: usd(1000)})
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if _, err := bob.GetPayment(ctx, *payment.Payment.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("other merchant's GetPayment err = %v, want ErrNotFound", err)
+	}
+
+	status, err := bob.RetrieveTokenStatus(ctx)
+	if err != nil {
+		t.Fatalf("RetrieveTokenStatus: %v", err)
+	}
+	if *status.MerchantID != FakeMerchantID("bob") {
+		t.Errorf("merchant = %s, want %s", *status.MerchantID, FakeMerchantID("bob"))
+	}
+}
+
+func TestFakeRefunds(t *testing.T) {
+	tests := []struct {
+		name    string
+		refunds []int64
+		wantErr bool
+	}{
+		{"partial refund", []int64{500}, false},
+		{"tip can be refunded", []int64{1200}, false},
+		{"two refunds up to the total", []int64{700, 500}, false},
+		{"more than the total", []int64{700, 600}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			gateway := NewFake().Connect(Sandbox, "token")
+			payment, err := gateway.CreatePayment(ctx, &square.CreatePaymentRequest{
+				IdempotencyKey: "pay",
+				SourceID:       "card-nonce",
+				AmountMoney:    usd(1000),
+				TipMoney:       usd(200),
+			})
+			if err != nil {
+				t.Fatalf("CreatePayment: %v", err)
+			}
+
+			var refunded int64
+			for i, amount := range tt.refunds {
+				_, err = gateway.RefundPayment(ctx, &square.RefundPaymentRequest{
+					IdempotencyKey: string(rune('a' + i)),
+					PaymentID:      payment.Payment.ID,
+					AmountMoney:    usd(amount),
+				})
+				if err != nil {
+					break
+				}
+				refunded += amount
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+
+			got, err := gateway.GetPayment(ctx, *payment.Payment.ID)
+			if err != nil {
+				t.Fatalf("GetPayment: %v", err)
+			}
+			if amount := fakeAmount(got.Payment.RefundedMoney); amount != refunded {
+				t.Errorf("refunded = %d, want %d", amount, refunded)
+			}
+		})
+	}
+}
+
+func TestFakeOAuth(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake()
+	oauth := fake.OAuth(Sandbox)
+
+	token, err := oauth.ObtainToken(ctx, &square.ObtainTokenRequest{GrantType: "authorization_code", Code: square.String("code")})
+	if err != nil {
+		t.Fatalf("ObtainToken: %v", err)
+	}
+	if *token.MerchantID != FakeMerchantID("code") {
+		t.Errorf("merchant = %s, want %s", *token.MerchantID, FakeMerchantID("code"))
+	}
+	gateway := fake.Connect(Sandbox, *token.AccessToken)
+	if _, err := gateway.RetrieveTokenStatus(ctx); err != nil {
+		t.Fatalf("RetrieveTokenStatus: %v", err)
+	}
+
+	refreshed, err := oauth.ObtainToken(ctx, &square.ObtainTokenRequest{GrantType: "refresh_token", RefreshToken: token.RefreshToken})
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if *refreshed.MerchantID != *token.MerchantID {
+		t.Errorf("refreshed merchant = %s, want %s", *refreshed.MerchantID, *token.MerchantID)
+	}
+
+	if _, err := oauth.RevokeToken(ctx, "secret", &square.RevokeTokenRequest{MerchantID: token.MerchantID}); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	if _, err := gateway.RetrieveTokenStatus(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("revoked token status err = %v, want ErrUnauthorized", err)
+	}
+	if _, err := oauth.ObtainToken(ctx, &square.ObtainTokenRequest{GrantType: "refresh_token", RefreshToken: token.RefreshToken}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("revoked refresh err = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestFakeSearchCatalogPages(t *testing.T) {
+	ctx := context.Background()
+	gateway := NewFake().Connect(Sandbox, "token")
+
+	var objects []*square.CatalogObject
+	var cursor *string
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("catalog search does not end")
+		}
+		resp, err := gateway.SearchCatalog(ctx, &square.SearchCatalogObjectsRequest{
+			ObjectTypes: []square.CatalogObjectType{square.CatalogObjectTypeItem},
+			Limit:       square.Int(2),
+			Cursor:      cursor,
+		})
+		if err != nil {
+			t.Fatalf("SearchCatalog: %v", err)
+		}
+		objects = append(objects, resp.Objects...)
+		if resp.Cursor == nil {
+			break
+		}
+		cursor = resp.Cursor
+	}
+	if len(objects) != 4 {
+		t.Fatalf("%d items, want 4", len(objects))
+	}
+	for _, object := range objects {
+		if object.Item == nil {
+			t.Errorf("object of type %s, want only items", object.Type)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package pos
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/square/square-go-sdk"
+)
+
+// clearPath matches the fields_to_clear paths the fake supports, e.g. line_items[uid] or line_items[uid].note
+var clearPath = regexp.MustCompile(`^(line_items|discounts|taxes|service_charges)\[([^\]]+)\](?:\.(note))?$`)
+
+func (g *fakeGateway) UpdateOrder(ctx context.Context, req *square.UpdateOrderRequest) (*square.UpdateOrderResponse, error) {
+	if req.Order == nil {
+		return nil, fmt.Errorf("pos: order is required")
+	}
+
+	g.fake.mu.Lock()
+	defer g.fake.mu.Unlock()
+
+	stored, ok := g.fake.orders[req.OrderID]
+	if !ok || stored.merchantID != g.merchantID {
+		return nil, fmt.Errorf("order %s: %w", req.OrderID, ErrNotFound)
+	}
+	if *stored.order.State != square.OrderStateOpen && *stored.order.State != square.OrderStateDraft {
+		return nil, fmt.Errorf("pos: order %s is %s", req.OrderID, *stored.order.State)
+	}
+	if req.Order.Version == nil || *req.Order.Version != *stored.order.Version {
+		return nil, fmt.Errorf("order %s is at version %d: %w", req.OrderID, *stored.order.Version, ErrVersionMismatch)
+	}
+
+	current := stored.snapshot()
+	current.Discounts = slices.Clone(current.Discounts)
+	current.Taxes = slices.Clone(current.Taxes)
+	current.ServiceCharges = slices.Clone(current.ServiceCharges)
+
+	for _, path := range req.FieldsToClear {
+		m := clearPath.FindStringSubmatch(path)
+		if m == nil {
+			return nil, fmt.Errorf("pos: unsupported field to clear %q", path)
+		}
+		collection, uid, field := m[1], m[2], m[3]
+		switch {
+		case collection == "line_items" && field == "note":
+			for i, line := range current.LineItems {
+				if fakeUID(line.UID) == uid {
+					copied := *line
+					copied.Note = nil
+					current.LineItems[i] = &copied
+				}
+			}
+		case collection == "line_items":
+			current.LineItems = slices.DeleteFunc(current.LineItems, func(l *square.OrderLineItem) bool { return fakeUID(l.UID) == uid })
+		case collection == "discounts":
+			current.Discounts = slices.DeleteFunc(current.Discounts, func(d *square.OrderLineItemDiscount) bool { return fakeUID(d.UID) == uid })
+		case collection == "taxes":
+			current.Taxes = slices.DeleteFunc(current.Taxes, func(t *square.OrderLineItemTax) bool { return fakeUID(t.UID) == uid })
+		case collection == "service_charges":
+			current.ServiceCharges = slices.DeleteFunc(current.ServiceCharges, func(c *square.OrderServiceCharge) bool { return fakeUID(c.UID) == uid })
+		}
+	}
+
+	// Drafts can be opened and any order cancelled, Square completes orders by itself once they are paid
+	if req.Order.State != nil {
+		switch {
+		case *req.Order.State == square.OrderStateCanceled:
+			current.State = square.OrderStateCanceled.Ptr()
+			current.ClosedAt = square.String(time.Now().UTC().Format(time.RFC3339))
+		case *req.Order.State == square.OrderStateOpen && *current.State == square.OrderStateDraft:
+			current.State = square.OrderStateOpen.Ptr()
+		case *req.Order.State != *current.State:
+			return nil, fmt.Errorf("pos: order %s cannot be moved from %s to %s", req.OrderID, *current.State, *req.Order.State)
+		}
+	}
+
+	// Objects with a known UID are updated field by field, any other is added
+	for _, line := range req.Order.LineItems {
+		i := slices.IndexFunc(current.LineItems, func(l *square.OrderLineItem) bool { return line.UID != nil && fakeUID(l.UID) == *line.UID })
+		if i < 0 {
+			current.LineItems = append(current.LineItems, line)
+			continue
+		}
+		merged := *current.LineItems[i]
+		if line.Name != nil {
+			merged.Name = line.Name
+		}
+		if line.Quantity != "" {
+			merged.Quantity = line.Quantity
+		}
+		if line.Note != nil {
+			merged.Note = line.Note
+		}
+		if line.BasePriceMoney != nil {
+			merged.BasePriceMoney = line.BasePriceMoney
+		}
+		merged.Modifiers = append(slices.Clone(merged.Modifiers), line.Modifiers...)
+		merged.AppliedDiscounts = append(slices.Clone(merged.AppliedDiscounts), line.AppliedDiscounts...)
+		merged.AppliedTaxes = append(slices.Clone(merged.AppliedTaxes), line.AppliedTaxes...)
+		current.LineItems[i] = &merged
+	}
+	current.Discounts = append(current.Discounts, req.Order.Discounts...)
+	current.Taxes = append(current.Taxes, req.Order.Taxes...)
+	current.ServiceCharges = append(current.ServiceCharges, req.Order.ServiceCharges...)
+
+	// Discounts of removed lines no longer apply to anything
+	for i, l := range current.LineItems {
+		line := *l
+		current.LineItems[i] = &line
+		line.AppliedDiscounts = slices.DeleteFunc(slices.Clone(line.AppliedDiscounts), func(a *square.OrderLineItemAppliedDiscount) bool {
+			return !slices.ContainsFunc(current.Discounts, func(d *square.OrderLineItemDiscount) bool { return fakeUID(d.UID) == a.DiscountUID })
+		})
+		line.AppliedTaxes = slices.DeleteFunc(slices.Clone(line.AppliedTaxes), func(a *square.OrderLineItemAppliedTax) bool {
+			return !slices.ContainsFunc(current.Taxes, func(t *square.OrderLineItemTax) bool { return fakeUID(t.UID) == a.TaxUID })
+		})
+	}
+
+	lines, err := catalogLines(current.LineItems)
+	if err != nil {
+		return nil, err
+	}
+	current.LineItems = lines
+	order, err := priceFakeOrder(current)
+	if err != nil {
+		return nil, err
+	}
+	settleFakeOrder(order, stored.order.Tenders)
+	order.Version = square.Int(*stored.order.Version + 1)
+	order.UpdatedAt = square.String(time.Now().UTC().Format(time.RFC3339))
+	stored.order = order
+
+	return &square.UpdateOrderResponse{Order: stored.snapshot()}, nil
+}
+
+// settleFakeOrder accounts for the tenders already taken on a repriced order
+func settleFakeOrder(order *square.Order, tenders []*square.Tender) {
+	currency := *order.TotalMoney.Currency
+	var paid, tips int64
+	for _, tender := range tenders {
+		tip := fakeAmount(tender.TipMoney)
+		paid += fakeAmount(tender.AmountMoney) - tip
+		tips += tip
+	}
+
+	order.Tenders = tenders
+	order.TotalTipMoney = fakeMoney(tips, currency)
+	order.NetAmountDueMoney = fakeMoney(max(*order.TotalMoney.Amount-paid, 0), currency)
+	order.TotalMoney = fakeMoney(*order.TotalMoney.Amount+tips, currency)
+}
+
+func fakeUID(uid *string) string {
+	if uid == nil {
+		return ""
+	}
+	return *uid
+}
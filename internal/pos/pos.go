@@ -0,0 +1,76 @@
+// Package pos
+package pos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/square/square-go-sdk"
+)
+
+// ErrNotFound is returned when the requested object does not exist for the merchant
+var ErrNotFound = errors.New("pos: not found")
+
+// ErrUnauthorized is returned when the point of sale rejects the access token
+var ErrUnauthorized = errors.New("pos: access token rejected")
+
+// ErrVersionMismatch is returned when an order changed since the version an update was based on
+var ErrVersionMismatch = errors.New("pos: order version mismatch")
+
+// ErrRejected is returned when the point of sale answered a request by refusing it, e.g. a declined card.
+// Errors without it, such as timeouts, leave open whether the request was carried out
+var ErrRejected = errors.New("pos: request rejected")
+
+// VersionMismatch is the error code Square reports for updates of an outdated order version
+const VersionMismatch square.ErrorCode = "VERSION_MISMATCH"
+
+// Gateway is the subset of the point of sale API used by the service,
+// scoped to a single merchant access token
+type Gateway interface {
+	RetrieveTokenStatus(ctx context.Context) (*square.RetrieveTokenStatusResponse, error)
+	ListLocations(ctx context.Context) (*square.ListLocationsResponse, error)
+	CreateOrder(ctx context.Context, req *square.CreateOrderRequest) (*square.CreateOrderResponse, error)
+	GetOrder(ctx context.Context, orderID string) (*square.GetOrderResponse, error)
+	// SearchOrders pages through the orders of req.LocationIDs, use the returned cursor for the next page
+	SearchOrders(ctx context.Context, req *square.SearchOrdersRequest) (*square.SearchOrdersResponse, error)
+	// UpdateOrder applies a sparse update to an open order, req.Order.Version must be the current version
+	UpdateOrder(ctx context.Context, req *square.UpdateOrderRequest) (*square.UpdateOrderResponse, error)
+	CreatePayment(ctx context.Context, req *square.CreatePaymentRequest) (*square.CreatePaymentResponse, error)
+	GetPayment(ctx context.Context, paymentID string) (*square.GetPaymentResponse, error)
+	RefundPayment(ctx context.Context, req *square.RefundPaymentRequest) (*square.RefundPaymentResponse, error)
+	// SearchCatalog pages through the merchant's catalog objects of req.ObjectTypes, use the returned cursor for the next page
+	SearchCatalog(ctx context.Context, req *square.SearchCatalogObjectsRequest) (*square.SearchCatalogObjectsResponse, error)
+}
+
+// OAuth is the application level authorization API of the point of sale
+type OAuth interface {
+	// AuthorizeURL is where a merchant is sent to grant the application access
+	AuthorizeURL(clientID string, scopes []string, state, redirectURI string) string
+	ObtainToken(ctx context.Context, req *square.ObtainTokenRequest) (*square.ObtainTokenResponse, error)
+	RevokeToken(ctx context.Context, clientSecret string, req *square.RevokeTokenRequest) (*square.RevokeTokenResponse, error)
+}
+
+// Environment is the point of sale environment a merchant's data lives in
+type Environment string
+
+const (
+	Sandbox    Environment = "sandbox"
+	Production Environment = "production"
+)
+
+// ParseEnvironment validates an environment name
+func ParseEnvironment(s string) (Environment, error) {
+	switch env := Environment(s); env {
+	case Sandbox, Production:
+		return env, nil
+	default:
+		return "", fmt.Errorf("pos: unknown environment %q", s)
+	}
+}
+
+// Connector opens a Gateway for a merchant access token in the given environment
+type Connector interface {
+	Connect(env Environment, token string) Gateway
+	OAuth(env Environment) OAuth
+}
@@ -0,0 +1,212 @@
+package pos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/square/square-go-sdk"
+	"github.com/square/square-go-sdk/client"
+	"github.com/square/square-go-sdk/core"
+	"github.com/square/square-go-sdk/option"
+)
+
+// SquareConnector opens gateways backed by the Square SDK
+type SquareConnector struct {
+	baseURLs map[Environment]string
+	// OnUnauthorized is called with the token whenever Square rejects it
+	OnUnauthorized func(token string)
+}
+
+// NewSquare connects to Square's sandbox and production hosts, or to baseURL for both when it is set
+func NewSquare(baseURL string) *SquareConnector {
+	baseURLs := map[Environment]string{
+		Sandbox:    square.Environments.Sandbox,
+		Production: square.Environments.Production,
+	}
+	if baseURL != "" {
+		baseURLs[Sandbox] = baseURL
+		baseURLs[Production] = baseURL
+	}
+	return &SquareConnector{
+		baseURLs: baseURLs,
+	}
+}
+
+func (s *SquareConnector) Connect(env Environment, token string) Gateway {
+	return &squareGateway{
+		connector: s,
+		token:     token,
+		client: client.NewClient(
+			option.WithToken(token),
+			option.WithBaseURL(s.baseURL(env)),
+		),
+	}
+}
+
+func (s *SquareConnector) OAuth(env Environment) OAuth {
+	return &squareOAuth{
+		baseURL: s.baseURL(env),
+		client:  client.NewClient(option.WithBaseURL(s.baseURL(env))),
+	}
+}
+
+// baseURL never falls back to production, an unset environment talks to the sandbox
+func (s *SquareConnector) baseURL(env Environment) string {
+	if env == Production {
+		return s.baseURLs[Production]
+	}
+	return s.baseURLs[Sandbox]
+}
+
+type squareGateway struct {
+	connector *SquareConnector
+	token     string
+	client    *client.Client
+}
+
+func (g *squareGateway) RetrieveTokenStatus(ctx context.Context) (*square.RetrieveTokenStatusResponse, error) {
+	resp, err := g.client.OAuth.RetrieveTokenStatus(ctx)
+	return resp, g.wrapError(err)
+}
+
+func (g *squareGateway) ListLocations(ctx context.Context) (*square.ListLocationsResponse, error) {
+	resp, err := g.client.Locations.List(ctx)
+	return resp, g.wrapError(err)
+}
+
+func (g *squareGateway) CreateOrder(ctx context.Context, req *square.CreateOrderRequest) (*square.CreateOrderResponse, error) {
+	resp, err := g.client.Orders.Create(ctx, req)
+	return resp, g.wrapError(err)
+}
+
+func (g *squareGateway) GetOrder(ctx context.Context, orderID string) (*square.GetOrderResponse, error) {
+	resp, err := g.client.Orders.Get(ctx, &square.GetOrdersRequest{OrderID: orderID})
+	return resp, g.wrapError(err)
+}
+
+func (g *squareGateway) SearchOrders(ctx context.Context, req *square.SearchOrdersRequest) (*square.SearchOrdersResponse, error) {
+	resp, err := g.client.Orders.Search(ctx, req)
+	return resp, g.wrapError(err)
+}
+
+func (g *squareGateway) UpdateOrder(ctx context.Context, req *square.UpdateOrderRequest) (*square.UpdateOrderResponse, error) {
+	resp, err := g.client.Orders.Update(ctx, req)
+	return resp, g.wrapError(err)
+}
+
+func (g *squareGateway) CreatePayment(ctx context.Context, req *square.CreatePaymentRequest) (*square.CreatePaymentResponse, error) {
+	resp, err := g.client.Payments.Create(ctx, req)
+	return resp, g.wrapError(err)
+}
+
+func (g *squareGateway) GetPayment(ctx context.Context, paymentID string) (*square.GetPaymentResponse, error) {
+	resp, err := g.client.Payments.Get(ctx, &square.GetPaymentsRequest{PaymentID: paymentID})
+	return resp, g.wrapError(err)
+}
+
+func (g *squareGateway) RefundPayment(ctx context.Context, req *square.RefundPaymentRequest) (*square.RefundPaymentResponse, error) {
+	resp, err := g.client.Refunds.RefundPayment(ctx, req)
+	return resp, g.wrapError(err)
+}
+
+func (g *squareGateway) SearchCatalog(ctx context.Context, req *square.SearchCatalogObjectsRequest) (*square.SearchCatalogObjectsResponse, error) {
+	resp, err := g.client.Catalog.Search(ctx, req)
+	return resp, g.wrapError(err)
+}
+
+type squareOAuth struct {
+	baseURL string
+	client  *client.Client
+}
+
+func (o *squareOAuth) AuthorizeURL(clientID string, scopes []string, state, redirectURI string) string {
+	query := url.Values{
+		"client_id": {clientID},
+		"scope":     {strings.Join(scopes, " ")},
+		"session":   {"false"},
+		"state":     {state},
+	}
+	if redirectURI != "" {
+		query.Set("redirect_uri", redirectURI)
+	}
+	return o.baseURL + "/oauth2/authorize?" + query.Encode()
+}
+
+func (o *squareOAuth) ObtainToken(ctx context.Context, req *square.ObtainTokenRequest) (*square.ObtainTokenResponse, error) {
+	resp, err := o.client.OAuth.ObtainToken(ctx, req)
+	return resp, wrapOAuthError(err)
+}
+
+func (o *squareOAuth) RevokeToken(ctx context.Context, clientSecret string, req *square.RevokeTokenRequest) (*square.RevokeTokenResponse, error) {
+	resp, err := o.client.OAuth.RevokeToken(ctx, req, option.WithHTTPHeader(http.Header{
+		"Authorization": {"Client " + clientSecret},
+	}))
+	return resp, wrapOAuthError(err)
+}
+
+// wrapOAuthError reports rejected grants, e.g. a revoked refresh token, as ErrUnauthorized
+func wrapOAuthError(err error) error {
+	var apiErr *core.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return err
+}
+
+// wrapError maps Square status codes onto the package errors
+func (g *squareGateway) wrapError(err error) error {
+	var apiErr *core.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	switch apiErr.StatusCode {
+	case http.StatusUnauthorized:
+		if g.connector.OnUnauthorized != nil {
+			g.connector.OnUnauthorized(g.token)
+		}
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	case http.StatusConflict:
+		return fmt.Errorf("%w: %v", ErrVersionMismatch, err)
+	case http.StatusBadRequest:
+		if slices.Contains(errorCodes(apiErr), VersionMismatch) {
+			return fmt.Errorf("%w: %v", ErrVersionMismatch, err)
+		}
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return err
+	default:
+		if apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+		return err
+	}
+}
+
+// errorCodes reads the codes of Square's error body, which the SDK keeps as the error message
+func errorCodes(apiErr *core.APIError) []square.ErrorCode {
+	if apiErr.Unwrap() == nil {
+		return nil
+	}
+	var body struct {
+		Errors []*square.Error `json:"errors"`
+	}
+	if json.Unmarshal([]byte(apiErr.Unwrap().Error()), &body) != nil {
+		return nil
+	}
+	codes := make([]square.ErrorCode, 0, len(body.Errors))
+	for _, e := range body.Errors {
+		if e != nil {
+			codes = append(codes, e.Code)
+		}
+	}
+	return codes
+}
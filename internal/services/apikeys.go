@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/keyring"
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every key issued by the API, so they can be told apart from Square tokens
+const APIKeyPrefix = "rk_"
+
+// lastUsedPrecision limits how often LastUsedAt is written for a busy key
+const lastUsedPrecision = time.Minute
+
+var (
+	// ErrAPIKeyNotFound is returned for unknown keys and keys of another restaurant
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	// ErrAPIKeyRevoked is returned when a revoked key is used
+	ErrAPIKeyRevoked = errors.New("API key revoked")
+)
+
+// APIKeyService issues and checks the API keys used by restaurant devices
+type APIKeyService struct {
+	db     *gorm.DB
+	keys   *keyring.Keyring
+	Logger *logger.Logger
+}
+
+func NewAPIKeys(db *gorm.DB, keys *keyring.Keyring, log *logger.Logger) *APIKeyService {
+	return &APIKeyService{
+		db:     db,
+		keys:   keys,
+		Logger: log,
+	}
+}
+
+// IsAPIKey reports whether a credential looks like a key issued by the API
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// Create issues a key for the restaurant, the secret is only ever returned here
+func (s *APIKeyService) Create(ctx context.Context, restaurant models.Restaurant, name string) (*models.APIKey, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	key := &models.APIKey{
+		RestaurantID: restaurant.ID,
+		Name:         name,
+		Prefix:       secret[:len(APIKeyPrefix)+6],
+		KeyHash:      s.keys.Hash(secret),
+	}
+	if err := s.db.Create(key).Error; err != nil {
+		s.Logger.Error("Failed to create API key", "error", err, "restaurant_id", restaurant.ID)
+		return nil, "", fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	s.Logger.Info("API key created", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "api_key_id", fmt.Sprintf("%d", key.ID))
+	return key, secret, nil
+}
+
+// List returns the restaurant's keys, including revoked ones
+func (s *APIKeyService) List(ctx context.Context, restaurant models.Restaurant) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	if err := s.db.Where(&models.APIKey{RestaurantID: restaurant.ID}).Order("id").Find(&keys).Error; err != nil {
+		s.Logger.Error("Failed to list API keys", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	return keys, nil
+}
+
+// Revoke stops the key from authenticating
+func (s *APIKeyService) Revoke(ctx context.Context, restaurant models.Restaurant, id uint) error {
+	result := s.db.Model(&models.APIKey{}).
+		Where("id = ? AND restaurant_id = ? AND revoked_at IS NULL", id, restaurant.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		s.Logger.Error("Failed to revoke API key", "error", result.Error, "api_key_id", id)
+		return fmt.Errorf("failed to revoke API key: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	s.Logger.Info("API key revoked", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "api_key_id", fmt.Sprintf("%d", id))
+	return nil
+}
+
+// Authenticate resolves a key to its restaurant and records its use
+func (s *APIKeyService) Authenticate(ctx context.Context, secret string) (*models.APIKey, *models.Restaurant, error) {
+	var key models.APIKey
+	err := s.db.Where(&models.APIKey{KeyHash: s.keys.Hash(secret)}).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up API key: %w", err)
+	}
+	if key.RevokedAt != nil {
+		return nil, nil, ErrAPIKeyRevoked
+	}
+
+	var restaurant models.Restaurant
+	if err := s.db.First(&restaurant, key.RestaurantID).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to load restaurant of API key: %w", err)
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedPrecision {
+		key.LastUsedAt = &now
+		if err := s.db.Model(&key).Update("last_used_at", now).Error; err != nil {
+			s.Logger.Error("Failed to record API key use", "error", err, "api_key_id", key.ID)
+		}
+	}
+
+	return &key, &restaurant, nil
+}
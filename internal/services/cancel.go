@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+)
+
+// ErrOrderHasPayments is returned when cancelling an order whose payments have not all been refunded
+var ErrOrderHasPayments = errors.New("order has payments that were not refunded")
+
+// CancelOrder cancels an open order in Square and records who cancelled it and why.
+// Voiding is the same for a manager overriding the order's server
+func (s *SquareService) CancelOrder(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway, staff models.Staff, orderID string, req models.CancelRequest, void bool) (*models.Order, error) {
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		return nil, fmt.Errorf("%w: reason is required", ErrInvalidOrder)
+	}
+
+	order, err := s.loadOrder(restaurant, location, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !order.State.CanTransition(models.OrderStateCanceled) {
+		return nil, fmt.Errorf("%w: a %s order cannot be cancelled", ErrIllegalTransition, order.State)
+	}
+	current, err := s.currentOrder(ctx, gateway, order, req.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	captured, refunded := capturedPayments(current)
+	if captured > refunded {
+		return nil, fmt.Errorf("%w: %s of %s paid is not refunded", ErrOrderHasPayments,
+			models.NewMoney(captured-refunded, order.Currency), models.NewMoney(captured, order.Currency))
+	}
+
+	now := time.Now()
+	order.CancelReason = reason
+	order.CanceledBy = staff.ID
+	order.CanceledAt = &now
+	order.Voided = void
+	recordTransition(order, models.OrderStateCanceled, staff.ID, reason)
+
+	order, err = s.updateOrder(ctx, restaurant, gateway, order, current, &square.Order{State: square.OrderStateCanceled.Ptr()}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Logger.Info("Order cancelled", "order_id", order.ID, "staff_id", fmt.Sprintf("%d", staff.ID), "voided", fmt.Sprintf("%t", void), "reason", reason)
+	return order, nil
+}
+
+// capturedPayments sums the tenders Square captured for the order and the refunds that were not rejected
+func capturedPayments(order *square.Order) (captured, refunded int64) {
+	for _, tender := range order.Tenders {
+		if tender.CardDetails != nil && tender.CardDetails.Status != nil && *tender.CardDetails.Status != square.TenderCardDetailsStatusCaptured {
+			continue
+		}
+		if tender.AmountMoney != nil && tender.AmountMoney.Amount != nil {
+			captured += *tender.AmountMoney.Amount
+		}
+	}
+	for _, refund := range order.Refunds {
+		if refund.Status == square.RefundStatusRejected || refund.Status == square.RefundStatusFailed {
+			continue
+		}
+		if refund.AmountMoney != nil && refund.AmountMoney.Amount != nil {
+			refunded += *refund.AmountMoney.Amount
+		}
+	}
+	return captured, refunded
+}
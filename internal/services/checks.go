@@ -0,0 +1,258 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrCheckNotFound is returned for checks that do not belong to the order
+	ErrCheckNotFound = errors.New("check not found")
+	// ErrCheckPaid is returned when splitting a bill again after one of its checks has been paid
+	ErrCheckPaid = errors.New("check has payments")
+)
+
+// maxChecks limits how many checks a bill can be split into
+const maxChecks = 50
+
+// SplitOrder splits what is left to pay of an order into checks that are paid separately.
+// Splitting again replaces the checks as long as none of them has been paid
+func (s *SquareService) SplitOrder(ctx context.Context, restaurant models.Restaurant, location models.Location, orderID string, req models.SplitRequest) ([]models.Check, error) {
+	order, err := s.loadOrder(restaurant, location, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !order.State.CanTransition(models.OrderStatePaid) {
+		return nil, fmt.Errorf("%w: a %s order cannot be split", ErrIllegalTransition, order.State)
+	}
+	for _, check := range order.Checks {
+		if check.Paid.Amount > 0 {
+			return nil, fmt.Errorf("%w: check %d has been paid, the bill cannot be split again", ErrCheckPaid, check.Number)
+		}
+	}
+
+	currency := order.Currency
+	balance := order.Totals.Due.Amount - order.Totals.Paid.Amount
+	if balance <= 0 {
+		return nil, fmt.Errorf("%w: nothing is left to pay", ErrInvalidOrder)
+	}
+	amounts, items, err := splitBill(order, balance, req)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make([]models.Check, len(amounts))
+	for i, amount := range amounts {
+		checks[i] = models.Check{
+			OrderID: orderID,
+			Number:  i + 1,
+			Amount:  models.NewMoney(amount, currency),
+			Paid:    models.NewMoney(0, currency),
+			Settled: amount == 0,
+			ItemIDs: items[i],
+		}
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("order_id = ?", orderID).Delete(&models.Check{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.OrderItem{}).Where("order_id = ?", orderID).Update("check_id", 0).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&checks).Error; err != nil {
+			return err
+		}
+		for _, check := range checks {
+			if len(check.ItemIDs) == 0 {
+				continue
+			}
+			err := tx.Model(&models.OrderItem{}).Where("order_id = ? AND id IN ?", orderID, check.ItemIDs).Update("check_id", check.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.Logger.Error("Failed to save checks", "error", err, "order_id", orderID)
+		return nil, fmt.Errorf("failed to save checks: %w", err)
+	}
+
+	s.Logger.Info("Order split", "order_id", orderID, "method", string(req.Method), "checks", fmt.Sprintf("%d", len(checks)))
+	return checks, nil
+}
+
+// ListChecks returns the checks of an order with the items on them
+func (s *SquareService) ListChecks(ctx context.Context, restaurant models.Restaurant, location models.Location, orderID string) ([]models.Check, error) {
+	order, err := s.loadOrder(restaurant, location, orderID)
+	if err != nil {
+		return nil, err
+	}
+	checks := order.Checks
+	for i := range checks {
+		for _, item := range order.Items {
+			if item.CheckID == checks[i].ID {
+				checks[i].ItemIDs = append(checks[i].ItemIDs, item.ID)
+			}
+		}
+	}
+	slices.SortFunc(checks, func(a, b models.Check) int { return a.Number - b.Number })
+	return checks, nil
+}
+
+// splitBill works out the amount of each check and the items on it
+func splitBill(order *models.Order, balance int64, req models.SplitRequest) ([]int64, [][]uint, error) {
+	switch req.Method {
+	case models.SplitEven:
+		if req.Guests < 2 || req.Guests > maxChecks {
+			return nil, nil, fmt.Errorf("%w: guests must be between 2 and %d", ErrInvalidOrder, maxChecks)
+		}
+		weights := make([]int64, req.Guests)
+		for i := range weights {
+			weights[i] = 1
+		}
+		return apportion(balance, weights), make([][]uint, req.Guests), nil
+
+	case models.SplitItems:
+		if len(req.Checks) < 2 || len(req.Checks) > maxChecks {
+			return nil, nil, fmt.Errorf("%w: checks must list between 2 and %d checks", ErrInvalidOrder, maxChecks)
+		}
+		weights := make([]int64, len(req.Checks))
+		items := make([][]uint, len(req.Checks))
+		assigned := make(map[uint]bool)
+		for i, check := range req.Checks {
+			if len(check.Items) == 0 {
+				return nil, nil, fmt.Errorf("%w: checks[%d]: items are required", ErrInvalidOrder, i)
+			}
+			for _, id := range check.Items {
+				idx := slices.IndexFunc(order.Items, func(item models.OrderItem) bool { return item.ID == id })
+				if idx < 0 {
+					return nil, nil, fmt.Errorf("%w: checks[%d]: item %d", ErrItemNotFound, i, id)
+				}
+				if assigned[id] {
+					return nil, nil, fmt.Errorf("%w: item %d is on more than one check", ErrInvalidOrder, id)
+				}
+				assigned[id] = true
+				weights[i] += order.Items[idx].Amount.Amount
+				items[i] = append(items[i], id)
+			}
+		}
+		if len(assigned) != len(order.Items) {
+			return nil, nil, fmt.Errorf("%w: every item must be on a check", ErrInvalidOrder)
+		}
+		return apportion(balance, weights), items, nil
+
+	case models.SplitSeats:
+		var seats []int
+		for _, item := range order.Items {
+			if item.Seat > 0 && !slices.Contains(seats, item.Seat) {
+				seats = append(seats, item.Seat)
+			}
+		}
+		if len(seats) < 2 || len(seats) > maxChecks {
+			return nil, nil, fmt.Errorf("%w: items must be on between 2 and %d seats", ErrInvalidOrder, maxChecks)
+		}
+		slices.Sort(seats)
+
+		// Shared items are spread evenly over the seats, so each seat's own items count once per seat
+		weights := make([]int64, len(seats))
+		items := make([][]uint, len(seats))
+		var shared int64
+		for _, item := range order.Items {
+			if item.Seat == 0 {
+				shared += item.Amount.Amount
+				continue
+			}
+			i := slices.Index(seats, item.Seat)
+			weights[i] += int64(len(seats)) * item.Amount.Amount
+			items[i] = append(items[i], item.ID)
+		}
+		for i := range weights {
+			weights[i] += shared
+		}
+		return apportion(balance, weights), items, nil
+
+	case models.SplitAmounts:
+		if len(req.Amounts) < 2 || len(req.Amounts) > maxChecks {
+			return nil, nil, fmt.Errorf("%w: amounts must list between 2 and %d amounts", ErrInvalidOrder, maxChecks)
+		}
+		amounts := make([]int64, len(req.Amounts))
+		var sum int64
+		for i := range req.Amounts {
+			if err := checkMoney(fmt.Sprintf("amounts[%d]", i), &req.Amounts[i], order.Currency); err != nil {
+				return nil, nil, fmt.Errorf("%w: %v", ErrInvalidOrder, err)
+			}
+			if req.Amounts[i].Amount == 0 {
+				return nil, nil, fmt.Errorf("%w: amounts[%d]: amount must be positive", ErrInvalidOrder, i)
+			}
+			amounts[i] = req.Amounts[i].Amount
+			sum += amounts[i]
+		}
+		if sum != balance {
+			return nil, nil, fmt.Errorf("%w: amounts must add up to the %s left to pay", ErrInvalidOrder, models.NewMoney(balance, order.Currency))
+		}
+		return amounts, make([][]uint, len(amounts)), nil
+	}
+	return nil, nil, fmt.Errorf("%w: unknown split method %q", ErrInvalidOrder, req.Method)
+}
+
+// apportion shares total out in proportion to weights, the last share takes what rounding leaves over.
+// Weights that are all zero share it evenly
+func apportion(total int64, weights []int64) []int64 {
+	var sum int64
+	for _, weight := range weights {
+		sum += weight
+	}
+	if sum == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		sum = int64(len(weights))
+	}
+
+	shares := make([]int64, len(weights))
+	var given int64
+	for i := range weights[:len(weights)-1] {
+		shares[i] = total * weights[i] / sum
+		given += shares[i]
+	}
+	shares[len(shares)-1] = total - given
+	return shares
+}
+
+// payableCheck finds the check a payment is for once the bill has been split. reserved is what other payments
+// still processing take from the check
+func payableCheck(order *models.Order, req models.PaymentRequest, reserved int64) (*models.Check, error) {
+	if len(order.Checks) == 0 {
+		if req.CheckID != 0 {
+			return nil, fmt.Errorf("%w: check %d", ErrCheckNotFound, req.CheckID)
+		}
+		return nil, nil
+	}
+	if req.CheckID == 0 {
+		return nil, fmt.Errorf("%w: the bill is split, checkId is required", ErrInvalidPayment)
+	}
+	idx := slices.IndexFunc(order.Checks, func(check models.Check) bool { return check.ID == req.CheckID })
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: check %d", ErrCheckNotFound, req.CheckID)
+	}
+	check := &order.Checks[idx]
+	if check.Settled {
+		return nil, fmt.Errorf("%w: check %d is already paid", ErrInvalidPayment, check.Number)
+	}
+	if left := check.Amount.Amount - check.Paid.Amount - reserved; req.BillAmount.Amount > left {
+		return nil, fmt.Errorf("%w: only %s is left to pay on check %d", ErrInvalidPayment, models.NewMoney(max(left, 0), order.Currency), check.Number)
+	}
+	return check, nil
+}
+
+// checksSettled reports whether every check of a split bill has been paid
+func checksSettled(order *models.Order) bool {
+	return !slices.ContainsFunc(order.Checks, func(check models.Check) bool { return !check.Settled })
+}
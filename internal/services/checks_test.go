@@ -0,0 +1,253 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+)
+
+func TestApportion(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int64
+		weights []int64
+		want    []int64
+	}{
+		{"even", 900, []int64{1, 1, 1}, []int64{300, 300, 300}},
+		{"last share takes the odd cents", 1000, []int64{1, 1, 1}, []int64{333, 333, 334}},
+		{"in proportion", 1000, []int64{3000, 1000}, []int64{750, 250}},
+		{"zero weights share evenly", 1001, []int64{0, 0}, []int64{500, 501}},
+		{"a zero weight gets nothing", 500, []int64{0, 5}, []int64{0, 500}},
+		{"single share", 1234, []int64{7}, []int64{1234}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := apportion(tt.total, slices.Clone(tt.weights))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("apportion(%d, %v) = %v, want %v", tt.total, tt.weights, got, tt.want)
+			}
+			var sum int64
+			for _, share := range got {
+				sum += share
+			}
+			if sum != tt.total {
+				t.Errorf("shares add up to %d, want %d", sum, tt.total)
+			}
+		})
+	}
+}
+
+func splitOrder() *models.Order {
+	item := func(id uint, amount int64, seat int) models.OrderItem {
+		item := models.OrderItem{Seat: seat, Amount: models.NewMoney(amount, "USD")}
+		item.ID = id
+		return item
+	}
+	return &models.Order{
+		Currency: "USD",
+		Items: []models.OrderItem{
+			item(1, 2000, 1),
+			item(2, 1000, 2),
+			item(3, 600, 0),
+		},
+	}
+}
+
+func TestSplitBill(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance int64
+		req     models.SplitRequest
+		want    []int64
+		items   [][]uint
+		wantErr error
+	}{
+		{
+			name:    "even",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitEven, Guests: 3},
+			want:    []int64{1200, 1200, 1200},
+			items:   [][]uint{nil, nil, nil},
+		},
+		{
+			name:    "even needs two guests",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitEven, Guests: 1},
+			wantErr: ErrInvalidOrder,
+		},
+		{
+			name:    "by items",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitItems, Checks: []models.SplitCheck{{Items: []uint{1}}, {Items: []uint{2, 3}}}},
+			want:    []int64{2000, 1600},
+			items:   [][]uint{{1}, {2, 3}},
+		},
+		{
+			name:    "by items after a partial payment",
+			balance: 1800,
+			req:     models.SplitRequest{Method: models.SplitItems, Checks: []models.SplitCheck{{Items: []uint{1}}, {Items: []uint{2, 3}}}},
+			want:    []int64{1000, 800},
+			items:   [][]uint{{1}, {2, 3}},
+		},
+		{
+			name:    "by items leaving one out",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitItems, Checks: []models.SplitCheck{{Items: []uint{1}}, {Items: []uint{2}}}},
+			wantErr: ErrInvalidOrder,
+		},
+		{
+			name:    "by items listing one twice",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitItems, Checks: []models.SplitCheck{{Items: []uint{1, 3}}, {Items: []uint{2, 3}}}},
+			wantErr: ErrInvalidOrder,
+		},
+		{
+			name:    "by items with an unknown item",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitItems, Checks: []models.SplitCheck{{Items: []uint{1, 2, 3}}, {Items: []uint{9}}}},
+			wantErr: ErrItemNotFound,
+		},
+		{
+			name:    "by seats sharing items without a seat",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitSeats},
+			want:    []int64{2300, 1300},
+			items:   [][]uint{{1}, {2}},
+		},
+		{
+			name:    "by amounts",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitAmounts, Amounts: []models.Money{models.NewMoney(1000, ""), models.NewMoney(2600, "USD")}},
+			want:    []int64{1000, 2600},
+			items:   [][]uint{nil, nil},
+		},
+		{
+			name:    "by amounts not adding up",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitAmounts, Amounts: []models.Money{models.NewMoney(1000, "USD"), models.NewMoney(2000, "USD")}},
+			wantErr: ErrInvalidOrder,
+		},
+		{
+			name:    "by amounts in another currency",
+			balance: 3600,
+			req:     models.SplitRequest{Method: models.SplitAmounts, Amounts: []models.Money{models.NewMoney(1000, "EUR"), models.NewMoney(2600, "EUR")}},
+			wantErr: ErrInvalidOrder,
+		},
+		{
+			name:    "unknown method",
+			balance: 3600,
+			req:     models.SplitRequest{Method: "dice"},
+			wantErr: ErrInvalidOrder,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amounts, items, err := splitBill(splitOrder(), tt.balance, tt.req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitBill: %v", err)
+			}
+			if !slices.Equal(amounts, tt.want) {
+				t.Errorf("amounts = %v, want %v", amounts, tt.want)
+			}
+			if len(items) != len(tt.items) {
+				t.Fatalf("%d item lists, want %d", len(items), len(tt.items))
+			}
+			for i := range items {
+				if !slices.Equal(items[i], tt.items[i]) {
+					t.Errorf("check %d items = %v, want %v", i+1, items[i], tt.items[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPayableCheck(t *testing.T) {
+	order := &models.Order{
+		Currency: "USD",
+		Checks: []models.Check{
+			{Number: 1, Amount: models.NewMoney(1000, "USD"), Paid: models.NewMoney(400, "USD")},
+			{Number: 2, Amount: models.NewMoney(1000, "USD"), Paid: models.NewMoney(1000, "USD"), Settled: true},
+		},
+	}
+	order.Checks[0].ID, order.Checks[1].ID = 1, 2
+	pay := func(checkID uint, amount int64) models.PaymentRequest {
+		return models.PaymentRequest{CheckID: checkID, BillAmount: models.NewMoney(amount, "USD")}
+	}
+
+	tests := []struct {
+		name     string
+		order    *models.Order
+		req      models.PaymentRequest
+		reserved int64
+		want     uint
+		wantErr  error
+	}{
+		{name: "bill not split", order: &models.Order{}, req: pay(0, 500)},
+		{name: "check of a bill not split", order: &models.Order{}, req: pay(1, 500), wantErr: ErrCheckNotFound},
+		{name: "split bill needs a check", order: order, req: pay(0, 500), wantErr: ErrInvalidPayment},
+		{name: "unknown check", order: order, req: pay(9, 500), wantErr: ErrCheckNotFound},
+		{name: "settled check", order: order, req: pay(2, 100), wantErr: ErrInvalidPayment},
+		{name: "what is left", order: order, req: pay(1, 600), want: 1},
+		{name: "more than is left", order: order, req: pay(1, 601), wantErr: ErrInvalidPayment},
+		{name: "what processing payments leave", order: order, req: pay(1, 200), reserved: 400, want: 1},
+		{name: "more than processing payments leave", order: order, req: pay(1, 201), reserved: 400, wantErr: ErrInvalidPayment},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check, err := payableCheck(tt.order, tt.req, tt.reserved)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("payableCheck: %v", err)
+			}
+			if tt.want == 0 {
+				if check != nil {
+					t.Errorf("got check %d, want none", check.ID)
+				}
+				return
+			}
+			if check == nil || check.ID != tt.want {
+				t.Errorf("got check %v, want %d", check, tt.want)
+			}
+		})
+	}
+}
+
+func TestChecksSettled(t *testing.T) {
+	tests := []struct {
+		name    string
+		settled []bool
+		want    bool
+	}{
+		{"no checks", nil, true},
+		{"all settled", []bool{true, true}, true},
+		{"one open", []bool{true, false}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := &models.Order{}
+			for _, settled := range tt.settled {
+				order.Checks = append(order.Checks, models.Check{Settled: settled})
+			}
+			if got := checksSettled(order); got != tt.want {
+				t.Errorf("checksSettled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// idempotencyLockTimeout is how long a request holds its key before a retry may take it over,
+// longer than any request is expected to run
+const idempotencyLockTimeout = 5 * time.Minute
+
+var (
+	// ErrIdempotencyKeyReused is returned when a key is sent again with a different request
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for another request")
+	// ErrIdempotencyInProgress is returned when a key is sent again while the first request is still running
+	ErrIdempotencyInProgress = errors.New("a request with this idempotency key is in progress")
+)
+
+// IdempotencyService stores the responses of requests sent with an idempotency key so retries get the same answer
+type IdempotencyService struct {
+	db     *gorm.DB
+	ttl    time.Duration
+	Logger *logger.Logger
+}
+
+func NewIdempotency(db *gorm.DB, ttl time.Duration, log *logger.Logger) *IdempotencyService {
+	return &IdempotencyService{
+		db:     db,
+		ttl:    ttl,
+		Logger: log,
+	}
+}
+
+// Begin claims the restaurant's key for a request of the staff member. When the request was already answered the
+// stored record is returned with replay set, otherwise the caller runs the request and completes or releases the record
+func (s *IdempotencyService) Begin(ctx context.Context, restaurantID, staffID uint, key, fingerprint string) (record *models.IdempotencyRecord, replay bool, err error) {
+	now := time.Now()
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var existing models.IdempotencyRecord
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where(&models.IdempotencyRecord{RestaurantID: restaurantID, Key: key}).First(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			record = &models.IdempotencyRecord{
+				RestaurantID: restaurantID,
+				Key:          key,
+				StaffID:      staffID,
+				Fingerprint:  fingerprint,
+				ExpiresAt:    now.Add(s.ttl),
+			}
+			// Another request may have claimed the key since the lookup
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return ErrIdempotencyInProgress
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case existing.ExpiresAt.Before(now), existing.StatusCode == 0 && existing.UpdatedAt.Before(now.Add(-idempotencyLockTimeout)):
+			// The key expired or its request never finished, it starts over
+			existing.StaffID = staffID
+			existing.Fingerprint = fingerprint
+			existing.StatusCode = 0
+			existing.ContentType = ""
+			existing.Body = nil
+			existing.ExpiresAt = now.Add(s.ttl)
+			record = &existing
+			return tx.Save(record).Error
+		case existing.StaffID != staffID, existing.Fingerprint != fingerprint:
+			return ErrIdempotencyKeyReused
+		case existing.StatusCode == 0:
+			return ErrIdempotencyInProgress
+		}
+		record, replay = &existing, true
+		return nil
+	})
+	if errors.Is(err, ErrIdempotencyKeyReused) || errors.Is(err, ErrIdempotencyInProgress) {
+		return nil, false, err
+	}
+	if err != nil {
+		s.Logger.Error("Failed to claim idempotency key", "error", err, "restaurant_id", restaurantID)
+		return nil, false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	return record, replay, nil
+}
+
+// Complete stores the response of a claimed request for its retries
+func (s *IdempotencyService) Complete(ctx context.Context, record *models.IdempotencyRecord, statusCode int, contentType string, body []byte) error {
+	record.StatusCode = statusCode
+	record.ContentType = contentType
+	record.Body = body
+	if err := s.db.Save(record).Error; err != nil {
+		s.Logger.Error("Failed to store idempotent response", "error", err, "key", record.Key)
+		return fmt.Errorf("failed to store idempotent response: %w", err)
+	}
+	return nil
+}
+
+// Release gives up a claimed key without a response, so a retry runs the request again
+func (s *IdempotencyService) Release(ctx context.Context, record *models.IdempotencyRecord) error {
+	if err := s.db.Unscoped().Delete(record).Error; err != nil {
+		s.Logger.Error("Failed to release idempotency key", "error", err, "key", record.Key)
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// PurgeExpired deletes the records of expired keys
+func (s *IdempotencyService) PurgeExpired(ctx context.Context) error {
+	result := s.db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.IdempotencyRecord{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to purge idempotency keys: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		s.Logger.Info("Purged expired idempotency keys", "count", fmt.Sprintf("%d", result.RowsAffected))
+	}
+	return nil
+}
+
+// RunPurger purges expired keys every interval until ctx is done
+func (s *IdempotencyService) RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.PurgeExpired(ctx); err != nil {
+			s.Logger.Error("Failed to purge idempotency keys", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/square/square-go-sdk"
+)
+
+// validateOrderRequest checks items, modifiers and discounts and fills in omitted currencies
+func validateOrderRequest(req *models.OrderRequest, currency string) error {
+	if len(req.Items) == 0 {
+		return fmt.Errorf("%w: at least one item is required", ErrInvalidOrder)
+	}
+	if req.GuestCount < 0 {
+		return fmt.Errorf("%w: guestCount must not be negative", ErrInvalidOrder)
+	}
+	if err := validateItems(req.Items, currency); err != nil {
+		return err
+	}
+
+	for i := range req.Discounts {
+		if err := validateDiscount(fmt.Sprintf("discounts[%d]", i), &req.Discounts[i], currency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateItems checks items with their modifiers and discounts and fills in omitted currencies
+func validateItems(items []models.OrderItem, currency string) error {
+	for i := range items {
+		item := &items[i]
+		field := fmt.Sprintf("items[%d]", i)
+		if item.Quantity <= 0 {
+			return fmt.Errorf("%w: %s: quantity must be positive", ErrInvalidOrder, field)
+		}
+		if item.Seat < 0 {
+			return fmt.Errorf("%w: %s: seat must not be negative", ErrInvalidOrder, field)
+		}
+		// Items are put on checks by splitting the bill
+		item.CheckID = 0
+		if err := checkMoney(field+".unitPrice", &item.UnitPrice, currency); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidOrder, err)
+		}
+
+		for j := range item.Modifiers {
+			modifier := &item.Modifiers[j]
+			field := fmt.Sprintf("%s.modifiers[%d]", field, j)
+			if modifier.Name == "" {
+				return fmt.Errorf("%w: %s: name is required", ErrInvalidOrder, field)
+			}
+			if modifier.Quantity < 0 {
+				return fmt.Errorf("%w: %s: quantity must not be negative", ErrInvalidOrder, field)
+			}
+			if modifier.Quantity == 0 {
+				modifier.Quantity = 1
+			}
+			if err := checkMoney(field+".unitPrice", &modifier.UnitPrice, currency); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidOrder, err)
+			}
+		}
+
+		for j := range item.Discounts {
+			if err := validateDiscount(fmt.Sprintf("%s.discounts[%d]", field, j), &item.Discounts[j], currency); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateDiscount(field string, discount *models.Discount, currency string) error {
+	if discount.Name == "" {
+		return fmt.Errorf("%w: %s: name is required", ErrInvalidOrder, field)
+	}
+
+	if discount.IsPercentage {
+		if !validPercentage(discount.Percentage) {
+			return fmt.Errorf("%w: %s: percentage must be a decimal between 0 and 100", ErrInvalidOrder, field)
+		}
+		discount.Value = models.Money{}
+		return nil
+	}
+
+	discount.Percentage = ""
+	if err := checkMoney(field+".value", &discount.Value, currency); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOrder, err)
+	}
+	if discount.Value.Amount == 0 {
+		return fmt.Errorf("%w: %s: value must be positive", ErrInvalidOrder, field)
+	}
+	return nil
+}
+
+// newSquareUID returns a UID for a line item, modifier or discount so Square's amounts can be matched back
+func newSquareUID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// orderIdempotencyKey returns the Square idempotency key for creating an order. A request retried with the same
+// Idempotency-Key gets the same Square key, scoped to the restaurant and location, without one the key is random
+func orderIdempotencyKey(restaurant models.Restaurant, location models.Location, key string) string {
+	if key == "" {
+		return newSquareUID() + newSquareUID()
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d\n%s\n%s", restaurant.ID, location.SquareLocationID, key))
+	return hex.EncodeToString(sum[:])
+}
+
+// squareUIDs returns UIDs derived from an idempotency key, so a retried create matches the order Square already made
+func squareUIDs(key string) func() string {
+	n := 0
+	return func() string {
+		n++
+		sum := sha256.Sum256(fmt.Appendf(nil, "%s\n%d", key, n))
+		return hex.EncodeToString(sum[:8])
+	}
+}
+
+// assignUIDs gives new items, their modifiers and discounts, and order discounts their Square UIDs from uid
+func assignUIDs(items []models.OrderItem, discounts []models.Discount, uid func() string) {
+	for i := range items {
+		items[i].SquareUID = uid()
+		for j := range items[i].Modifiers {
+			items[i].Modifiers[j].SquareUID = uid()
+		}
+		for j := range items[i].Discounts {
+			items[i].Discounts[j].SquareUID = uid()
+		}
+	}
+	for i := range discounts {
+		discounts[i].SquareUID = uid()
+	}
+}
+
+func taxUID(rule models.TaxRule) string {
+	return fmt.Sprintf("tax-%d", rule.ID)
+}
+
+func serviceChargeUID(charge models.ServiceCharge) string {
+	return fmt.Sprintf("service-charge-%d", charge.ID)
+}
+
+// squareOrder maps the request and the restaurant's pricing rules onto a Square order.
+// Item discounts are line item scoped, order discounts order scoped, and taxes limited to a category only apply to its items
+func squareOrder(locationID string, req models.OrderRequest, taxes []models.TaxRule, charges []models.ServiceCharge) *square.Order {
+	order := &square.Order{
+		LocationID: locationID,
+	}
+	order.LineItems, order.Discounts = squareLineItems(req.Items, taxes)
+
+	for _, discount := range req.Discounts {
+		order.Discounts = append(order.Discounts, squareDiscount(discount, square.OrderLineItemDiscountScopeOrder))
+	}
+
+	for _, rule := range taxes {
+		tax := &square.OrderLineItemTax{
+			UID:        square.String(taxUID(rule)),
+			Name:       square.String(rule.Name),
+			Percentage: square.String(rule.Percentage),
+			Type:       square.OrderLineItemTaxTypeAdditive.Ptr(),
+			Scope:      square.OrderLineItemTaxScopeOrder.Ptr(),
+		}
+		if rule.Inclusive {
+			tax.Type = square.OrderLineItemTaxTypeInclusive.Ptr()
+		}
+		if rule.Category != "" {
+			tax.Scope = square.OrderLineItemTaxScopeLineItem.Ptr()
+		}
+		order.Taxes = append(order.Taxes, tax)
+	}
+
+	for _, charge := range charges {
+		if req.GuestCount < charge.MinGuests {
+			continue
+		}
+		serviceCharge := &square.OrderServiceCharge{
+			UID:              square.String(serviceChargeUID(charge)),
+			Name:             square.String(charge.Name),
+			CalculationPhase: square.OrderServiceChargeCalculationPhaseSubtotalPhase.Ptr(),
+			Taxable:          square.Bool(charge.Taxable),
+		}
+		if charge.Percentage != "" {
+			serviceCharge.Percentage = square.String(charge.Percentage)
+		} else {
+			serviceCharge.AmountMoney = squareMoney(charge.Amount)
+		}
+		order.ServiceCharges = append(order.ServiceCharges, serviceCharge)
+	}
+
+	return order
+}
+
+// squareLineItems maps items onto Square line items and the line item scoped discounts they reference.
+// Taxes limited to a category are applied to the items of that category
+func squareLineItems(items []models.OrderItem, taxes []models.TaxRule) ([]*square.OrderLineItem, []*square.OrderLineItemDiscount) {
+	lines := make([]*square.OrderLineItem, len(items))
+	var discounts []*square.OrderLineItemDiscount
+	for i, item := range items {
+		line := &square.OrderLineItem{
+			UID:            square.String(item.SquareUID),
+			Name:           square.String(item.Name),
+			Quantity:       strconv.Itoa(item.Quantity),
+			BasePriceMoney: squareMoney(item.UnitPrice),
+		}
+		// Square names and prices items ordered from the catalog itself
+		if item.VariationID != "" {
+			line.CatalogObjectID = square.String(item.VariationID)
+			line.Name = nil
+			if item.CatalogPriced {
+				line.BasePriceMoney = nil
+			}
+		}
+		if item.Comment != "" {
+			line.Note = square.String(item.Comment)
+		}
+
+		for _, modifier := range item.Modifiers {
+			m := &square.OrderLineItemModifier{
+				UID:            square.String(modifier.SquareUID),
+				Name:           square.String(modifier.Name),
+				Quantity:       square.String(strconv.Itoa(modifier.Quantity)),
+				BasePriceMoney: squareMoney(modifier.UnitPrice),
+			}
+			if modifier.ModifierID != "" {
+				m.CatalogObjectID = square.String(modifier.ModifierID)
+				m.Name = nil
+				m.BasePriceMoney = nil
+			}
+			line.Modifiers = append(line.Modifiers, m)
+		}
+
+		for _, discount := range item.Discounts {
+			discounts = append(discounts, squareDiscount(discount, square.OrderLineItemDiscountScopeLineItem))
+			line.AppliedDiscounts = append(line.AppliedDiscounts, &square.OrderLineItemAppliedDiscount{
+				DiscountUID: discount.SquareUID,
+			})
+		}
+
+		for _, rule := range taxes {
+			if rule.Category != "" && strings.EqualFold(rule.Category, item.Category) {
+				line.AppliedTaxes = append(line.AppliedTaxes, &square.OrderLineItemAppliedTax{
+					TaxUID: taxUID(rule),
+				})
+			}
+		}
+
+		lines[i] = line
+	}
+	return lines, discounts
+}
+
+func squareDiscount(discount models.Discount, scope square.OrderLineItemDiscountScope) *square.OrderLineItemDiscount {
+	d := &square.OrderLineItemDiscount{
+		UID:   square.String(discount.SquareUID),
+		Name:  square.String(discount.Name),
+		Scope: scope.Ptr(),
+	}
+	if discount.IsPercentage {
+		d.Type = square.OrderLineItemDiscountTypeFixedPercentage.Ptr()
+		d.Percentage = square.String(discount.Percentage)
+	} else {
+		d.Type = square.OrderLineItemDiscountTypeFixedAmount.Ptr()
+		d.AmountMoney = squareMoney(discount.Value)
+	}
+	return d
+}
+
+// applySquareAmounts writes the amounts Square charged back onto the items, their modifiers and discounts,
+// and the order discounts. Catalog items and modifiers also take Square's price
+func applySquareAmounts(items []models.OrderItem, orderDiscounts []models.Discount, order *square.Order, currency string) {
+	lines := make(map[string]*square.OrderLineItem, len(order.LineItems))
+	modifiers := make(map[string]*square.OrderLineItemModifier)
+	for _, line := range order.LineItems {
+		if line.UID == nil {
+			continue
+		}
+		lines[*line.UID] = line
+		for _, modifier := range line.Modifiers {
+			if modifier.UID != nil {
+				modifiers[*modifier.UID] = modifier
+			}
+		}
+	}
+	discounts := make(map[string]*square.OrderLineItemDiscount, len(order.Discounts))
+	for _, discount := range order.Discounts {
+		if discount.UID != nil {
+			discounts[*discount.UID] = discount
+		}
+	}
+
+	for i := range items {
+		item := &items[i]
+		if line, ok := lines[item.SquareUID]; ok {
+			item.Amount = moneyFromSquare(line.TotalMoney, currency)
+			if item.VariationID != "" && line.BasePriceMoney != nil {
+				item.UnitPrice = moneyFromSquare(line.BasePriceMoney, currency)
+			}
+			if quantity, err := strconv.Atoi(line.Quantity); err == nil {
+				item.Quantity = quantity
+			}
+			item.Comment = ""
+			if line.Note != nil {
+				item.Comment = *line.Note
+			}
+		}
+		for j := range item.Modifiers {
+			if modifier, ok := modifiers[item.Modifiers[j].SquareUID]; ok {
+				item.Modifiers[j].Amount = moneyFromSquare(modifier.TotalPriceMoney, currency)
+				if item.Modifiers[j].ModifierID != "" && modifier.BasePriceMoney != nil {
+					item.Modifiers[j].UnitPrice = moneyFromSquare(modifier.BasePriceMoney, currency)
+				}
+			}
+		}
+		for j := range item.Discounts {
+			if discount, ok := discounts[item.Discounts[j].SquareUID]; ok {
+				item.Discounts[j].Amount = moneyFromSquare(discount.AppliedMoney, currency)
+			}
+		}
+	}
+
+	for i := range orderDiscounts {
+		if discount, ok := discounts[orderDiscounts[i].SquareUID]; ok {
+			orderDiscounts[i].Amount = moneyFromSquare(discount.AppliedMoney, currency)
+		}
+	}
+}
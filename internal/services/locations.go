@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrLocationNotFound is returned for locations that do not belong to the restaurant
+	ErrLocationNotFound = errors.New("location not found")
+	// ErrLocationInactive is returned for locations deactivated in Square
+	ErrLocationInactive = errors.New("location is inactive")
+)
+
+// locationResyncInterval is the least time between syncs looking for a location the restaurant does not have,
+// so requests naming an unknown location do not call Square every time
+const locationResyncInterval = time.Minute
+
+// LocationService keeps the restaurant's sites in sync with Square
+type LocationService struct {
+	db     *gorm.DB
+	Logger *logger.Logger
+
+	mu sync.Mutex
+	// resynced is when each restaurant's locations were last synced for an unknown location
+	resynced map[uint]time.Time
+	now      func() time.Time
+}
+
+func NewLocations(db *gorm.DB, log *logger.Logger) *LocationService {
+	return &LocationService{
+		db:       db,
+		Logger:   log,
+		resynced: make(map[uint]time.Time),
+		now:      time.Now,
+	}
+}
+
+// Sync stores every location Square reports for the restaurant
+func (s *LocationService) Sync(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway) ([]models.Location, error) {
+	resp, err := gateway.ListLocations(ctx)
+	if err != nil {
+		s.Logger.Error("Failed to fetch locations", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to fetch locations: %w", err)
+	}
+
+	locations := make([]models.Location, 0, len(resp.Locations))
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for _, l := range resp.Locations {
+			if l.ID == nil {
+				continue
+			}
+
+			var location models.Location
+			err := tx.Where(&models.Location{RestaurantID: restaurant.ID, SquareLocationID: *l.ID}).First(&location).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+
+			location.RestaurantID = restaurant.ID
+			location.SquareLocationID = *l.ID
+			location.Name = stringValue(l.Name)
+			location.Timezone = stringValue(l.Timezone)
+			location.Status = ""
+			if l.Status != nil {
+				location.Status = string(*l.Status)
+			}
+			location.Currency = ""
+			if l.Currency != nil {
+				location.Currency = string(*l.Currency)
+			}
+
+			if err := tx.Save(&location).Error; err != nil {
+				return err
+			}
+			if location.SquareLocationID == restaurant.LocationID && location.Currency != restaurant.Currency {
+				if err := tx.Model(&restaurant).Update("currency", location.Currency).Error; err != nil {
+					return err
+				}
+			}
+			locations = append(locations, location)
+		}
+		return nil
+	})
+	if err != nil {
+		s.Logger.Error("Failed to save locations", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to save locations: %w", err)
+	}
+
+	s.Logger.Info("Synced locations", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "count", fmt.Sprintf("%d", len(locations)))
+	return locations, nil
+}
+
+// List returns the restaurant's stored locations, syncing them from Square the first time
+func (s *LocationService) List(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway) ([]models.Location, error) {
+	var locations []models.Location
+	if err := s.db.Where(&models.Location{RestaurantID: restaurant.ID}).Order("name").Find(&locations).Error; err != nil {
+		s.Logger.Error("Failed to list locations", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to list locations: %w", err)
+	}
+	if len(locations) == 0 {
+		return s.Sync(ctx, restaurant, gateway)
+	}
+	return locations, nil
+}
+
+// Resolve returns the active location with the given Square ID, or the restaurant's default location when empty.
+// Locations not stored yet are synced from Square before giving up, at most once per locationResyncInterval
+func (s *LocationService) Resolve(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, squareLocationID string) (*models.Location, error) {
+	if squareLocationID == "" {
+		squareLocationID = restaurant.LocationID
+	}
+
+	locations, err := s.List(ctx, restaurant, gateway)
+	if err != nil {
+		return nil, err
+	}
+	location := findLocation(locations, squareLocationID)
+	if location == nil && s.allowResync(restaurant.ID) {
+		if locations, err = s.Sync(ctx, restaurant, gateway); err != nil {
+			return nil, err
+		}
+		location = findLocation(locations, squareLocationID)
+	}
+
+	if location == nil {
+		return nil, ErrLocationNotFound
+	}
+	if location.Status != "" && location.Status != string(square.LocationStatusActive) {
+		return nil, ErrLocationInactive
+	}
+	return location, nil
+}
+
+// allowResync reports whether the restaurant's locations may be synced for an unknown location now, and if so
+// holds off the next sync for locationResyncInterval
+func (s *LocationService) allowResync(restaurantID uint) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if last, ok := s.resynced[restaurantID]; ok && now.Sub(last) < locationResyncInterval {
+		return false
+	}
+	s.resynced[restaurantID] = now
+	return true
+}
+
+func findLocation(locations []models.Location, squareLocationID string) *models.Location {
+	for i := range locations {
+		if locations[i].SquareLocationID == squareLocationID {
+			return &locations[i]
+		}
+	}
+	return nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowResync(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := NewLocations(nil, nil)
+	s.now = func() time.Time { return now }
+
+	tests := []struct {
+		name       string
+		after      time.Duration
+		restaurant uint
+		want       bool
+	}{
+		{"first unknown location", 0, 1, true},
+		{"right after", time.Second, 1, false},
+		{"another restaurant", 0, 2, true},
+		{"just inside the interval", locationResyncInterval - 2*time.Second, 1, false},
+		{"once the interval has passed", locationResyncInterval, 1, true},
+		{"held off again", time.Second, 1, false},
+	}
+	for _, tt := range tests {
+		now = now.Add(tt.after)
+		if got := s.allowResync(tt.restaurant); got != tt.want {
+			t.Errorf("%s: allowResync = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
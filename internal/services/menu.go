@@ -0,0 +1,438 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/auth"
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrMenuItemNotFound is returned for menu items the location does not sell
+	ErrMenuItemNotFound = errors.New("menu item not found")
+	// ErrOpenItem is returned when staff without PermOpenItems order an item that is not on the menu
+	ErrOpenItem = errors.New("item is not on the menu")
+)
+
+// catalogSearchLimit is the largest page of catalog objects Square returns
+const catalogSearchLimit = 1000
+
+// MenuService keeps a copy of each restaurant's Square catalog for clients to order from
+type MenuService struct {
+	db     *gorm.DB
+	Logger *logger.Logger
+}
+
+func NewMenu(db *gorm.DB, log *logger.Logger) *MenuService {
+	return &MenuService{
+		db:     db,
+		Logger: log,
+	}
+}
+
+// Sync replaces the restaurant's menu with its Square catalog and returns it for all locations
+func (s *MenuService) Sync(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway) (*models.Menu, error) {
+	var objects []*square.CatalogObject
+	var cursor *string
+	for {
+		resp, err := gateway.SearchCatalog(ctx, &square.SearchCatalogObjectsRequest{
+			ObjectTypes: []square.CatalogObjectType{square.CatalogObjectTypeCategory, square.CatalogObjectTypeItem, square.CatalogObjectTypeModifierList},
+			Limit:       square.Int(catalogSearchLimit),
+			Cursor:      cursor,
+		})
+		if err != nil {
+			s.Logger.Error("Failed to fetch catalog", "error", err.Error(), "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+			return nil, fmt.Errorf("failed to fetch catalog: %w", err)
+		}
+		objects = append(objects, resp.Objects...)
+		if resp.Cursor == nil || *resp.Cursor == "" {
+			break
+		}
+		cursor = resp.Cursor
+	}
+
+	// Prices without a currency of their own, e.g. variable prices, get the default location's currency
+	currency, err := locationCurrency(s.db, restaurant)
+	if err != nil {
+		return nil, err
+	}
+
+	menu := menuFromCatalog(restaurant, currency, objects)
+	now := time.Now()
+	menu.SyncedAt = &now
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// The menu is replaced as a whole, clients and orders refer to it by Square IDs that stay the same
+		for _, model := range []any{&models.MenuModifier{}, &models.MenuModifierList{}, &models.MenuVariation{}, &models.MenuItem{}, &models.MenuCategory{}} {
+			if err := tx.Unscoped().Where("restaurant_id = ?", restaurant.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if len(menu.Categories) > 0 {
+			if err := tx.CreateInBatches(&menu.Categories, 100).Error; err != nil {
+				return err
+			}
+		}
+		if len(menu.ModifierLists) > 0 {
+			if err := tx.CreateInBatches(&menu.ModifierLists, 100).Error; err != nil {
+				return err
+			}
+		}
+		if len(menu.Items) > 0 {
+			if err := tx.CreateInBatches(&menu.Items, 100).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.Restaurant{}).Where("id = ?", restaurant.ID).Update("menu_synced_at", now).Error
+	})
+	if err != nil {
+		s.Logger.Error("Failed to save menu", "error", err.Error(), "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+		return nil, fmt.Errorf("failed to save menu: %w", err)
+	}
+
+	s.Logger.Info("Synced menu", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "items", fmt.Sprintf("%d", len(menu.Items)))
+	return menu, nil
+}
+
+// Get returns what the location sells. The menu is synced from Square the first time it is needed
+func (s *MenuService) Get(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway) (*models.Menu, error) {
+	// The restaurant of the request may be cached, the sync time is read again
+	var synced models.Restaurant
+	if err := s.db.Select("menu_synced_at").First(&synced, restaurant.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load restaurant: %w", err)
+	}
+	if synced.MenuSyncedAt == nil {
+		fetched, err := s.Sync(ctx, restaurant, gateway)
+		if err != nil {
+			return nil, err
+		}
+		synced.MenuSyncedAt = fetched.SyncedAt
+	}
+
+	menu := &models.Menu{SyncedAt: synced.MenuSyncedAt}
+	if err := s.db.Where("restaurant_id = ?", restaurant.ID).Order("ordinal, name").Find(&menu.Categories).Error; err != nil {
+		return nil, fmt.Errorf("failed to load menu: %w", err)
+	}
+	if err := s.db.Where("restaurant_id = ?", restaurant.ID).Preload("Variations", func(db *gorm.DB) *gorm.DB {
+		return db.Order("ordinal, name")
+	}).Order("name").Find(&menu.Items).Error; err != nil {
+		return nil, fmt.Errorf("failed to load menu: %w", err)
+	}
+	if err := s.db.Where("restaurant_id = ?", restaurant.ID).Preload("Modifiers", func(db *gorm.DB) *gorm.DB {
+		return db.Order("ordinal, name")
+	}).Order("name").Find(&menu.ModifierLists).Error; err != nil {
+		return nil, fmt.Errorf("failed to load menu: %w", err)
+	}
+	// Only what the location sells is listed, with the categories and modifier lists its items use
+	menu.Items = slices.DeleteFunc(menu.Items, func(item models.MenuItem) bool {
+		return !soldAt(&item, location.SquareLocationID)
+	})
+	var categories, lists []string
+	for i, item := range menu.Items {
+		categories = append(categories, item.CategoryID)
+		lists = append(lists, item.ModifierListIDs...)
+		for j := range item.Variations {
+			priceIn(&menu.Items[i].Variations[j].Price, location.Currency)
+		}
+	}
+	menu.Categories = slices.DeleteFunc(menu.Categories, func(category models.MenuCategory) bool {
+		return !slices.Contains(categories, category.SquareID)
+	})
+	menu.ModifierLists = slices.DeleteFunc(menu.ModifierLists, func(list models.MenuModifierList) bool {
+		return !slices.Contains(lists, list.SquareID)
+	})
+	for i, list := range menu.ModifierLists {
+		for j := range list.Modifiers {
+			priceIn(&menu.ModifierLists[i].Modifiers[j].Price, location.Currency)
+		}
+	}
+	return menu, nil
+}
+
+// priceIn gives prices synced without a currency the location's currency
+func priceIn(price *models.Money, currency string) {
+	if price.Currency == "" {
+		price.Currency = currency
+	}
+}
+
+// GetItem returns a menu item the location sells by its Square ID
+func (s *MenuService) GetItem(ctx context.Context, restaurant models.Restaurant, location models.Location, squareID string) (*models.MenuItem, error) {
+	var item models.MenuItem
+	err := s.db.Where(&models.MenuItem{RestaurantID: restaurant.ID, SquareID: squareID}).Preload("Variations", func(db *gorm.DB) *gorm.DB {
+		return db.Order("ordinal, name")
+	}).First(&item).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMenuItemNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load menu item: %w", err)
+	}
+	if !soldAt(&item, location.SquareLocationID) {
+		return nil, ErrMenuItemNotFound
+	}
+	for i := range item.Variations {
+		priceIn(&item.Variations[i].Price, location.Currency)
+	}
+	return &item, nil
+}
+
+// soldAt drops the item's variations the location does not sell and reports whether any are left
+func soldAt(item *models.MenuItem, locationID string) bool {
+	if !item.SoldAt(locationID) {
+		return false
+	}
+	item.Variations = slices.DeleteFunc(item.Variations, func(variation models.MenuVariation) bool {
+		return !variation.SoldAt(locationID)
+	})
+	return len(item.Variations) > 0
+}
+
+// menuFromCatalog maps the catalog's categories, items with their variations, and modifier lists with their modifiers
+// onto the menu. Prices keep the currency Square gives them, currency is for those without one. Archived items are left out
+func menuFromCatalog(restaurant models.Restaurant, currency string, objects []*square.CatalogObject) *models.Menu {
+	menu := &models.Menu{
+		Categories:    []models.MenuCategory{},
+		Items:         []models.MenuItem{},
+		ModifierLists: []models.MenuModifierList{},
+	}
+	for _, object := range objects {
+		switch {
+		case object.Category != nil && object.Category.ID != nil:
+			category := object.Category
+			menu.Categories = append(menu.Categories, models.MenuCategory{
+				RestaurantID: restaurant.ID,
+				SquareID:     *category.ID,
+				Name:         stringValue(category.GetCategoryData().GetName()),
+				Ordinal:      int64Value(category.Ordinal),
+			})
+
+		case object.Item != nil && object.Item.ItemData != nil:
+			data := object.Item.ItemData
+			if data.IsArchived != nil && *data.IsArchived {
+				continue
+			}
+			item := models.MenuItem{
+				RestaurantID:    restaurant.ID,
+				SquareID:        object.Item.ID,
+				CategoryID:      catalogCategory(data),
+				Name:            stringValue(data.Name),
+				Description:     stringValue(data.Description),
+				CatalogPresence: catalogPresence(object.Item.PresentAtAllLocations, object.Item.PresentAtLocationIDs, object.Item.AbsentAtLocationIDs),
+				ModifierListIDs: []string{},
+			}
+			for _, info := range data.ModifierListInfo {
+				if info.Enabled == nil || *info.Enabled {
+					item.ModifierListIDs = append(item.ModifierListIDs, info.ModifierListID)
+				}
+			}
+			for _, v := range data.Variations {
+				if v.ItemVariation == nil || v.ItemVariation.ItemVariationData == nil {
+					continue
+				}
+				variation := v.ItemVariation.ItemVariationData
+				item.Variations = append(item.Variations, models.MenuVariation{
+					RestaurantID: restaurant.ID,
+					SquareID:     v.ItemVariation.ID,
+					Name:         stringValue(variation.Name),
+					Ordinal:      intValue(variation.Ordinal),
+					Price:        moneyFromSquare(variation.PriceMoney, currency),
+					VariablePricing: variation.PriceMoney == nil ||
+						variation.PricingType != nil && *variation.PricingType == square.CatalogPricingTypeVariablePricing,
+					CatalogPresence: catalogPresence(v.ItemVariation.PresentAtAllLocations, v.ItemVariation.PresentAtLocationIDs, v.ItemVariation.AbsentAtLocationIDs),
+				})
+			}
+			menu.Items = append(menu.Items, item)
+
+		case object.ModifierList != nil && object.ModifierList.ModifierListData != nil:
+			data := object.ModifierList.ModifierListData
+			list := models.MenuModifierList{
+				RestaurantID:  restaurant.ID,
+				SquareID:      object.ModifierList.ID,
+				Name:          stringValue(data.Name),
+				SelectionType: string(square.CatalogModifierListSelectionTypeMultiple),
+			}
+			if data.SelectionType != nil {
+				list.SelectionType = string(*data.SelectionType)
+			}
+			for _, m := range data.Modifiers {
+				if m.Modifier == nil || m.Modifier.ModifierData == nil {
+					continue
+				}
+				list.Modifiers = append(list.Modifiers, models.MenuModifier{
+					RestaurantID: restaurant.ID,
+					SquareID:     m.Modifier.ID,
+					Name:         stringValue(m.Modifier.ModifierData.Name),
+					Ordinal:      intValue(m.Modifier.ModifierData.Ordinal),
+					Price:        moneyFromSquare(m.Modifier.ModifierData.PriceMoney, currency),
+				})
+			}
+			menu.ModifierLists = append(menu.ModifierLists, list)
+		}
+	}
+	return menu
+}
+
+// catalogCategory picks the item's reporting category, Square's main category of the item
+func catalogCategory(data *square.CatalogItem) string {
+	if data.ReportingCategory != nil && data.ReportingCategory.ID != nil {
+		return *data.ReportingCategory.ID
+	}
+	for _, category := range data.Categories {
+		if category.ID != nil {
+			return *category.ID
+		}
+	}
+	return stringValue(data.CategoryID)
+}
+
+// catalogPresence reads where an object is sold, Square sells objects at all locations unless told otherwise
+func catalogPresence(all *bool, present, absent []string) models.CatalogPresence {
+	return models.CatalogPresence{
+		PresentAtAllLocations: all == nil || *all,
+		PresentAtLocationIDs:  present,
+		AbsentAtLocationIDs:   absent,
+	}
+}
+
+func intValue(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+func int64Value(i *int64) int64 {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+// applyMenu names and prices the items ordered by catalog variation from the restaurant's menu and leaves their
+// price to Square. Once the restaurant has a menu, only staff with PermOpenItems may order items without a
+// variation, which keep the name and price sent
+func (s *SquareService) applyMenu(restaurant models.Restaurant, location models.Location, staff models.Staff, items []models.OrderItem) error {
+	// The restaurant of the request may be cached, the sync time is read again
+	var synced models.Restaurant
+	if err := s.db.Select("menu_synced_at").First(&synced, restaurant.ID).Error; err != nil {
+		return fmt.Errorf("failed to load restaurant: %w", err)
+	}
+	openItems := synced.MenuSyncedAt == nil || auth.Role(staff.Role).Can(auth.PermOpenItems)
+
+	var variationIDs, modifierIDs []string
+	for i, item := range items {
+		if item.VariationID != "" {
+			variationIDs = append(variationIDs, item.VariationID)
+		} else if !openItems {
+			return fmt.Errorf("%w: items[%d]: variationId is required, only managers may add items that are not on the menu", ErrOpenItem, i)
+		}
+		for j, modifier := range item.Modifiers {
+			if modifier.ModifierID == "" {
+				continue
+			}
+			if item.VariationID == "" {
+				return fmt.Errorf("%w: items[%d].modifiers[%d]: modifierId needs the item's variationId", ErrInvalidOrder, i, j)
+			}
+			modifierIDs = append(modifierIDs, modifier.ModifierID)
+		}
+	}
+	if len(variationIDs) == 0 {
+		return nil
+	}
+
+	var variations []models.MenuVariation
+	if err := s.db.Where("restaurant_id = ? AND square_id IN ?", restaurant.ID, variationIDs).Find(&variations).Error; err != nil {
+		return fmt.Errorf("failed to load menu: %w", err)
+	}
+	itemIDs := make([]uint, 0, len(variations))
+	for _, variation := range variations {
+		itemIDs = append(itemIDs, variation.MenuItemID)
+	}
+	var menuItems []models.MenuItem
+	if err := s.db.Where("id IN ?", itemIDs).Preload("Variations").Find(&menuItems).Error; err != nil {
+		return fmt.Errorf("failed to load menu: %w", err)
+	}
+	var categories []models.MenuCategory
+	if err := s.db.Where("restaurant_id = ?", restaurant.ID).Find(&categories).Error; err != nil {
+		return fmt.Errorf("failed to load menu: %w", err)
+	}
+	var modifiers []models.MenuModifier
+	var lists []models.MenuModifierList
+	if len(modifierIDs) > 0 {
+		if err := s.db.Where("restaurant_id = ? AND square_id IN ?", restaurant.ID, modifierIDs).Find(&modifiers).Error; err != nil {
+			return fmt.Errorf("failed to load menu: %w", err)
+		}
+		if err := s.db.Where("restaurant_id = ?", restaurant.ID).Find(&lists).Error; err != nil {
+			return fmt.Errorf("failed to load menu: %w", err)
+		}
+	}
+
+	for i := range items {
+		item := &items[i]
+		if item.VariationID == "" {
+			continue
+		}
+		field := fmt.Sprintf("items[%d]", i)
+		v := slices.IndexFunc(variations, func(variation models.MenuVariation) bool { return variation.SquareID == item.VariationID })
+		if v < 0 {
+			return fmt.Errorf("%w: %s: variation %s is not on the menu", ErrInvalidOrder, field, item.VariationID)
+		}
+		variation := variations[v]
+		m := slices.IndexFunc(menuItems, func(menuItem models.MenuItem) bool { return menuItem.ID == variation.MenuItemID })
+		if m < 0 {
+			return fmt.Errorf("%w: %s: variation %s is not on the menu", ErrInvalidOrder, field, item.VariationID)
+		}
+		menuItem := menuItems[m]
+		if !menuItem.SoldAt(location.SquareLocationID) || !variation.SoldAt(location.SquareLocationID) {
+			return fmt.Errorf("%w: %s: %s is not sold at this location", ErrInvalidOrder, field, menuItem.Name)
+		}
+
+		item.Name = menuItem.Name
+		if len(menuItem.Variations) > 1 && variation.Name != "" {
+			item.Name = fmt.Sprintf("%s (%s)", menuItem.Name, variation.Name)
+		}
+		if c := slices.IndexFunc(categories, func(category models.MenuCategory) bool { return category.SquareID == menuItem.CategoryID }); c >= 0 {
+			item.Category = categories[c].Name
+		}
+		// Variable priced items are priced when they are ordered
+		item.CatalogPriced = !variation.VariablePricing
+		if item.CatalogPriced {
+			item.UnitPrice = variation.Price
+		} else if item.UnitPrice.Amount <= 0 {
+			return fmt.Errorf("%w: %s: unitPrice is required for %s", ErrInvalidOrder, field, menuItem.Name)
+		}
+
+		chosen := make(map[uint]int)
+		for j := range item.Modifiers {
+			modifier := &item.Modifiers[j]
+			field := fmt.Sprintf("%s.modifiers[%d]", field, j)
+			if modifier.ModifierID == "" {
+				return fmt.Errorf("%w: %s: modifierId is required for menu items", ErrInvalidOrder, field)
+			}
+			k := slices.IndexFunc(modifiers, func(m models.MenuModifier) bool { return m.SquareID == modifier.ModifierID })
+			if k < 0 {
+				return fmt.Errorf("%w: %s: modifier %s is not on the menu", ErrInvalidOrder, field, modifier.ModifierID)
+			}
+			l := slices.IndexFunc(lists, func(list models.MenuModifierList) bool { return list.ID == modifiers[k].ModifierListID })
+			if l < 0 || !slices.Contains(menuItem.ModifierListIDs, lists[l].SquareID) {
+				return fmt.Errorf("%w: %s: %s is not offered with %s", ErrInvalidOrder, field, modifiers[k].Name, menuItem.Name)
+			}
+			list := lists[l]
+			chosen[list.ID]++
+			if list.SelectionType == string(square.CatalogModifierListSelectionTypeSingle) && chosen[list.ID] > 1 {
+				return fmt.Errorf("%w: %s: only one of %s may be chosen", ErrInvalidOrder, field, list.Name)
+			}
+			modifier.Name = modifiers[k].Name
+			modifier.UnitPrice = modifiers[k].Price
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+)
+
+func TestMenuFromFakeCatalog(t *testing.T) {
+	resp, err := pos.NewFake().Connect(pos.Sandbox, "token").SearchCatalog(context.Background(), &square.SearchCatalogObjectsRequest{})
+	if err != nil {
+		t.Fatalf("SearchCatalog: %v", err)
+	}
+	restaurant := models.Restaurant{}
+	restaurant.ID = 7
+	// The restaurant's own currency is left empty, prices take Square's or the one passed in
+	menu := menuFromCatalog(restaurant, "CAD", resp.Objects)
+
+	if len(menu.Categories) != 2 || len(menu.Items) != 4 || len(menu.ModifierLists) != 1 {
+		t.Fatalf("%d categories, %d items and %d modifier lists, want 2, 4 and 1", len(menu.Categories), len(menu.Items), len(menu.ModifierLists))
+	}
+
+	tests := []struct {
+		variation string
+		price     models.Money
+		variable  bool
+	}{
+		{pos.FakeVariationBurgerRegular, models.NewMoney(1200, "USD"), false},
+		{pos.FakeVariationBurgerDouble, models.NewMoney(1600, "USD"), false},
+		{pos.FakeVariationLemonade, models.NewMoney(350, "USD"), false},
+		{pos.FakeVariationSpecial, models.NewMoney(0, "CAD"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.variation, func(t *testing.T) {
+			var found *models.MenuVariation
+			for _, item := range menu.Items {
+				if item.RestaurantID != restaurant.ID {
+					t.Errorf("item %s belongs to restaurant %d", item.SquareID, item.RestaurantID)
+				}
+				if i := slices.IndexFunc(item.Variations, func(v models.MenuVariation) bool { return v.SquareID == tt.variation }); i >= 0 {
+					found = &item.Variations[i]
+				}
+			}
+			if found == nil {
+				t.Fatalf("variation %s is not on the menu", tt.variation)
+			}
+			if found.Price != tt.price {
+				t.Errorf("price = %+v, want %+v", found.Price, tt.price)
+			}
+			if found.VariablePricing != tt.variable {
+				t.Errorf("variable pricing = %v, want %v", found.VariablePricing, tt.variable)
+			}
+			if !found.SoldAt(pos.FakeLocationID(pos.FakeMerchantID("token"))) {
+				t.Errorf("variation %s is not sold at the fake location", tt.variation)
+			}
+		})
+	}
+
+	burger := menu.Items[slices.IndexFunc(menu.Items, func(item models.MenuItem) bool { return item.SquareID == pos.FakeItemBurger })]
+	if burger.CategoryID != pos.FakeCategoryMains || !slices.Equal(burger.ModifierListIDs, []string{pos.FakeModifierListAddOns}) {
+		t.Errorf("burger in %s with modifier lists %v, want mains with the add-ons", burger.CategoryID, burger.ModifierListIDs)
+	}
+}
+
+func TestPriceIn(t *testing.T) {
+	tests := []struct {
+		price models.Money
+		want  models.Money
+	}{
+		{models.NewMoney(0, ""), models.NewMoney(0, "EUR")},
+		{models.NewMoney(1200, "USD"), models.NewMoney(1200, "USD")},
+	}
+	for _, tt := range tests {
+		price := tt.price
+		priceIn(&price, "EUR")
+		if price != tt.want {
+			t.Errorf("priceIn(%+v) = %+v, want %+v", tt.price, price, tt.want)
+		}
+	}
+}
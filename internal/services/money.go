@@ -0,0 +1,70 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/square/square-go-sdk"
+	"gorm.io/gorm"
+)
+
+// ErrNoCurrency is returned for locations whose currency is not known yet
+var ErrNoCurrency = errors.New("location has no currency, sync its locations")
+
+// squareMoney maps Money onto Square's money object
+func squareMoney(m models.Money) *square.Money {
+	return &square.Money{
+		Amount:   square.Int64(m.Amount),
+		Currency: square.Currency(m.Currency).Ptr(),
+	}
+}
+
+// moneyFromSquare maps a Square money object, which may be absent, onto Money in the given currency
+func moneyFromSquare(m *square.Money, currency string) models.Money {
+	money := models.NewMoney(0, currency)
+	if m == nil {
+		return money
+	}
+	if m.Amount != nil {
+		money.Amount = *m.Amount
+	}
+	if m.Currency != nil {
+		money.Currency = string(*m.Currency)
+	}
+	return money
+}
+
+// locationCurrency returns the currency of the restaurant's default location, or of its first location when the
+// default one has none. It is empty until the locations have been synced
+func locationCurrency(db *gorm.DB, restaurant models.Restaurant) (string, error) {
+	var locations []models.Location
+	if err := db.Where("restaurant_id = ? AND currency <> ''", restaurant.ID).Order("id").Find(&locations).Error; err != nil {
+		return "", fmt.Errorf("failed to load locations: %w", err)
+	}
+	if i := slices.IndexFunc(locations, func(l models.Location) bool { return l.SquareLocationID == restaurant.LocationID }); i >= 0 {
+		return locations[i].Currency, nil
+	}
+	if len(locations) > 0 {
+		return locations[0].Currency, nil
+	}
+	return "", nil
+}
+
+// checkMoney fills in the currency of m when omitted and rejects amounts that are negative or in another currency
+func checkMoney(field string, m *models.Money, currency string) error {
+	if m.Currency == "" {
+		m.Currency = currency
+	}
+	if err := m.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	if m.Currency != currency {
+		return fmt.Errorf("%s: currency %s does not match the location's currency %s", field, m.Currency, currency)
+	}
+	if m.Amount < 0 {
+		return fmt.Errorf("%s: amount must not be negative", field)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/keyring"
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidOAuthState is returned when the callback state is unknown, already used or expired
+	ErrInvalidOAuthState = errors.New("invalid or expired OAuth state")
+	// ErrEnvironmentMismatch is returned when a merchant is already onboarded in the other Square environment
+	ErrEnvironmentMismatch = errors.New("restaurant belongs to another Square environment")
+)
+
+const oauthStateLifetime = 10 * time.Minute
+
+// OAuthConfig holds the Square application credentials used for onboarding
+type OAuthConfig struct {
+	ApplicationID     string
+	ApplicationSecret string
+	RedirectURL       string
+	Scopes            []string
+	// Environment is where merchants are onboarded, the application credentials belong to it
+	Environment pos.Environment
+}
+
+// OAuthService onboards restaurants through Square OAuth and keeps their tokens fresh
+type OAuthService struct {
+	db        *gorm.DB
+	connector pos.Connector
+	keys      *keyring.Keyring
+	config    OAuthConfig
+	Logger    *logger.Logger
+}
+
+func NewOAuth(db *gorm.DB, connector pos.Connector, keys *keyring.Keyring, config OAuthConfig, log *logger.Logger) *OAuthService {
+	return &OAuthService{
+		db:        db,
+		connector: connector,
+		keys:      keys,
+		config:    config,
+		Logger:    log,
+	}
+}
+
+// AuthorizeURL starts an authorization and returns where to send the merchant
+func (s *OAuthService) AuthorizeURL(ctx context.Context) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(b)
+
+	if err := s.db.Create(&models.OAuthState{
+		State:     state,
+		ExpiresAt: time.Now().Add(oauthStateLifetime),
+	}).Error; err != nil {
+		s.Logger.Error("Failed to store OAuth state", "error", err)
+		return "", fmt.Errorf("failed to store OAuth state: %w", err)
+	}
+
+	return s.connector.OAuth(s.config.Environment).AuthorizeURL(s.config.ApplicationID, s.config.Scopes, state, s.config.RedirectURL), nil
+}
+
+// Complete exchanges the authorization code for tokens and creates or updates the merchant's restaurant
+func (s *OAuthService) Complete(ctx context.Context, code, state string) (*models.Restaurant, error) {
+	// States are single use, remove it and any that expired meanwhile
+	result := s.db.Unscoped().Where("state = ? AND expires_at > ?", state, time.Now()).Delete(&models.OAuthState{})
+	if result.Error != nil {
+		s.Logger.Error("Failed to consume OAuth state", "error", result.Error)
+		return nil, fmt.Errorf("failed to consume OAuth state: %w", result.Error)
+	}
+	s.db.Unscoped().Where("expires_at <= ?", time.Now()).Delete(&models.OAuthState{})
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidOAuthState
+	}
+
+	resp, err := s.connector.OAuth(s.config.Environment).ObtainToken(ctx, &square.ObtainTokenRequest{
+		ClientID:     s.config.ApplicationID,
+		ClientSecret: square.String(s.config.ApplicationSecret),
+		Code:         square.String(code),
+		RedirectURI:  square.String(s.config.RedirectURL),
+		GrantType:    "authorization_code",
+	})
+	if err != nil {
+		s.Logger.Error("Failed to obtain Square token", "error", err)
+		return nil, fmt.Errorf("failed to obtain token: %w", err)
+	}
+	if resp.AccessToken == nil || resp.RefreshToken == nil || resp.MerchantID == nil {
+		return nil, errors.New("incomplete token response from Square")
+	}
+
+	locations, err := s.connector.Connect(s.config.Environment, *resp.AccessToken).ListLocations(ctx)
+	if err != nil {
+		s.Logger.Error("Failed to fetch locations", "error", err, "merchant_id", *resp.MerchantID)
+		return nil, fmt.Errorf("failed to fetch locations: %w", err)
+	}
+	if len(locations.Locations) == 0 || locations.Locations[0].ID == nil {
+		return nil, errors.New("merchant has no locations")
+	}
+	location := locations.Locations[0]
+
+	var restaurant models.Restaurant
+	err = s.db.Where(&models.Restaurant{MerchantID: *resp.MerchantID}).First(&restaurant).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		s.Logger.Error("Failed to look up restaurant", "error", err, "merchant_id", *resp.MerchantID)
+		return nil, fmt.Errorf("failed to look up restaurant: %w", err)
+	}
+	if err == nil && restaurant.SquareEnvironment != s.config.Environment {
+		s.Logger.Error("Restaurant onboarded in another environment", "restaurant_id", fmt.Sprintf("%d", restaurant.ID),
+			"environment", string(restaurant.SquareEnvironment))
+		return nil, ErrEnvironmentMismatch
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		restaurant = models.Restaurant{
+			Name:              fmt.Sprintf("Restaurant-%s", *resp.MerchantID),
+			MerchantID:        *resp.MerchantID,
+			LocationID:        *location.ID,
+			SquareEnvironment: s.config.Environment,
+		}
+		if location.BusinessName != nil {
+			restaurant.Name = *location.BusinessName
+		}
+	}
+	restaurant.RevokedAt = nil
+
+	if err := s.applyTokens(&restaurant, resp); err != nil {
+		return nil, err
+	}
+	if err := s.db.Save(&restaurant).Error; err != nil {
+		s.Logger.Error("Failed to save restaurant", "error", err, "merchant_id", *resp.MerchantID)
+		return nil, fmt.Errorf("failed to save restaurant: %w", err)
+	}
+
+	s.Logger.Info("Restaurant onboarded", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "merchant_id", *resp.MerchantID)
+	return &restaurant, nil
+}
+
+// RefreshExpiring renews the access tokens of restaurants in the configured environment that expire within the given window
+func (s *OAuthService) RefreshExpiring(ctx context.Context, within time.Duration) error {
+	var restaurants []models.Restaurant
+	if err := s.db.Where("revoked_at IS NULL AND square_environment = ? AND square_refresh_token_key_id <> '' AND square_token_expires_at < ?",
+		s.config.Environment, time.Now().Add(within)).Find(&restaurants).Error; err != nil {
+		s.Logger.Error("Failed to find expiring tokens", "error", err)
+		return fmt.Errorf("failed to find expiring tokens: %w", err)
+	}
+
+	var errs []error
+	for i := range restaurants {
+		if err := s.refresh(ctx, &restaurants[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunRefresher refreshes expiring tokens every interval until ctx is done
+func (s *OAuthService) RunRefresher(ctx context.Context, interval, within time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.RefreshExpiring(ctx, within); err != nil {
+			s.Logger.Error("Failed to refresh Square tokens", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Revoke revokes the restaurant's Square authorization and stops accepting its token
+func (s *OAuthService) Revoke(ctx context.Context, restaurant models.Restaurant) error {
+	if restaurant.SquareEnvironment != s.config.Environment {
+		return ErrEnvironmentMismatch
+	}
+
+	accessToken, err := s.keys.Open(restaurant.SquareToken)
+	if err != nil {
+		s.Logger.Error("Failed to decrypt token", "error", err, "restaurant_id", restaurant.ID)
+		return fmt.Errorf("failed to decrypt token: %w", err)
+	}
+
+	if _, err := s.connector.OAuth(restaurant.SquareEnvironment).RevokeToken(ctx, s.config.ApplicationSecret, &square.RevokeTokenRequest{
+		ClientID:    square.String(s.config.ApplicationID),
+		AccessToken: square.String(accessToken),
+	}); err != nil {
+		s.Logger.Error("Failed to revoke Square token", "error", err, "restaurant_id", restaurant.ID)
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	return s.markRevoked(&restaurant)
+}
+
+func (s *OAuthService) refresh(ctx context.Context, restaurant *models.Restaurant) error {
+	refreshToken, err := s.keys.Open(restaurant.SquareRefreshToken)
+	if err != nil {
+		return fmt.Errorf("restaurant %d: failed to decrypt refresh token: %w", restaurant.ID, err)
+	}
+
+	resp, err := s.connector.OAuth(restaurant.SquareEnvironment).ObtainToken(ctx, &square.ObtainTokenRequest{
+		ClientID:     s.config.ApplicationID,
+		ClientSecret: square.String(s.config.ApplicationSecret),
+		RefreshToken: square.String(refreshToken),
+		GrantType:    "refresh_token",
+	})
+	if errors.Is(err, pos.ErrUnauthorized) {
+		// The merchant revoked our access in Square
+		s.Logger.Info("Square authorization revoked", "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+		return s.markRevoked(restaurant)
+	}
+	if err != nil {
+		return fmt.Errorf("restaurant %d: failed to refresh token: %w", restaurant.ID, err)
+	}
+	if resp.AccessToken == nil {
+		return fmt.Errorf("restaurant %d: refresh returned no access token", restaurant.ID)
+	}
+	if resp.RefreshToken == nil {
+		resp.RefreshToken = square.String(refreshToken)
+	}
+
+	if err := s.applyTokens(restaurant, resp); err != nil {
+		return fmt.Errorf("restaurant %d: %w", restaurant.ID, err)
+	}
+	if err := s.db.Save(restaurant).Error; err != nil {
+		return fmt.Errorf("restaurant %d: failed to save refreshed token: %w", restaurant.ID, err)
+	}
+
+	s.Logger.Info("Refreshed Square token", "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+	return nil
+}
+
+func (s *OAuthService) applyTokens(restaurant *models.Restaurant, resp *square.ObtainTokenResponse) error {
+	accessToken, err := s.keys.Seal(*resp.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt access token: %w", err)
+	}
+	refreshToken, err := s.keys.Seal(*resp.RefreshToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt refresh token: %w", err)
+	}
+
+	restaurant.SquareTokenHash = s.keys.Hash(*resp.AccessToken)
+	restaurant.SquareToken = accessToken
+	restaurant.SquareRefreshToken = refreshToken
+	restaurant.SquareTokenExpiresAt = nil
+	if resp.ExpiresAt != nil {
+		expiresAt, err := time.Parse(time.RFC3339, *resp.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("invalid token expiry: %w", err)
+		}
+		restaurant.SquareTokenExpiresAt = &expiresAt
+	}
+	return nil
+}
+
+func (s *OAuthService) markRevoked(restaurant *models.Restaurant) error {
+	now := time.Now()
+	restaurant.RevokedAt = &now
+	if err := s.db.Model(restaurant).Update("revoked_at", now).Error; err != nil {
+		s.Logger.Error("Failed to mark restaurant revoked", "error", err, "restaurant_id", restaurant.ID)
+		return fmt.Errorf("failed to mark restaurant revoked: %w", err)
+	}
+	return nil
+}
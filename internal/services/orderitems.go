@@ -0,0 +1,368 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrOrderNotOpen is returned when changing an order that is closed or no longer open in Square
+	ErrOrderNotOpen = errors.New("order is not open")
+	// ErrVersionConflict is returned when the order changed since the version the request is based on
+	ErrVersionConflict = errors.New("order was changed by someone else")
+	// ErrItemNotFound is returned for items that are not part of the order
+	ErrItemNotFound = errors.New("item not found")
+)
+
+// AddItems adds items to an open order, e.g. a second round for the table
+func (s *SquareService) AddItems(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway, staff models.Staff, orderID string, req models.AddItemsRequest) (*models.Order, error) {
+	order, current, err := s.openOrder(ctx, restaurant, location, gateway, orderID, req.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Items) == 0 {
+		return nil, fmt.Errorf("%w: at least one item is required", ErrInvalidOrder)
+	}
+	if err := s.applyMenu(restaurant, location, staff, req.Items); err != nil {
+		return nil, err
+	}
+	if err := validateItems(req.Items, order.Currency); err != nil {
+		return nil, err
+	}
+	for i := range req.Items {
+		req.Items[i].ID = 0
+		req.Items[i].OrderID = order.ID
+	}
+	assignUIDs(req.Items, nil, newSquareUID)
+
+	// New items only get the category taxes the order was created with, order wide taxes apply to them by themselves
+	taxes, _, err := loadPricing(s.db, restaurant.ID)
+	if err != nil {
+		s.Logger.Error("Failed to load pricing rules", "error", err, "restaurant_id", restaurant.ID)
+		return nil, err
+	}
+	taxes = slices.DeleteFunc(taxes, func(rule models.TaxRule) bool {
+		return !slices.ContainsFunc(current.Taxes, func(tax *square.OrderLineItemTax) bool {
+			return tax.UID != nil && *tax.UID == taxUID(rule)
+		})
+	})
+
+	update := &square.Order{}
+	update.LineItems, update.Discounts = squareLineItems(req.Items, taxes)
+	order.Items = append(order.Items, req.Items...)
+
+	return s.updateOrder(ctx, restaurant, gateway, order, current, update, nil)
+}
+
+// UpdateItem changes the quantity or comment of an item of an open order
+func (s *SquareService) UpdateItem(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway, orderID string, itemID uint, req models.ItemUpdate) (*models.Order, error) {
+	order, current, err := s.openOrder(ctx, restaurant, location, gateway, orderID, req.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(order.Items, func(item models.OrderItem) bool { return item.ID == itemID })
+	if i < 0 || order.Items[i].SquareUID == "" {
+		return nil, ErrItemNotFound
+	}
+	item := order.Items[i]
+
+	quantity := item.Quantity
+	if req.Quantity != nil {
+		if *req.Quantity <= 0 {
+			return nil, fmt.Errorf("%w: quantity must be positive, remove the item instead", ErrInvalidOrder)
+		}
+		quantity = *req.Quantity
+	}
+
+	// Square requires the quantity of every line item sent, the other fields are left as they are
+	line := &square.OrderLineItem{
+		UID:      square.String(item.SquareUID),
+		Quantity: fmt.Sprintf("%d", quantity),
+	}
+	var clear []string
+	if req.Comment != nil {
+		if *req.Comment == "" {
+			clear = append(clear, fmt.Sprintf("line_items[%s].note", item.SquareUID))
+		} else {
+			line.Note = square.String(*req.Comment)
+		}
+	}
+
+	update := &square.Order{LineItems: []*square.OrderLineItem{line}}
+	return s.updateOrder(ctx, restaurant, gateway, order, current, update, clear)
+}
+
+// RemoveItem removes an item and its discounts from an open order
+func (s *SquareService) RemoveItem(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway, orderID string, itemID uint, version int) (*models.Order, error) {
+	order, current, err := s.openOrder(ctx, restaurant, location, gateway, orderID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(order.Items, func(item models.OrderItem) bool { return item.ID == itemID })
+	if i < 0 || order.Items[i].SquareUID == "" {
+		return nil, ErrItemNotFound
+	}
+	if len(order.Items) == 1 {
+		return nil, fmt.Errorf("%w: the last item of an order cannot be removed", ErrInvalidOrder)
+	}
+	item := order.Items[i]
+
+	clear := []string{fmt.Sprintf("line_items[%s]", item.SquareUID)}
+	for _, discount := range item.Discounts {
+		clear = append(clear, fmt.Sprintf("discounts[%s]", discount.SquareUID))
+	}
+
+	return s.updateOrder(ctx, restaurant, gateway, order, current, &square.Order{}, clear)
+}
+
+// openOrder loads an order whose items can still be changed together with its current state in Square.
+// The version must match the Square order's version
+func (s *SquareService) openOrder(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway, orderID string, version int) (*models.Order, *square.Order, error) {
+	order, err := s.loadOrder(restaurant, location, orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !order.State.Editable() {
+		return nil, nil, fmt.Errorf("%w: the order is %s", ErrOrderNotOpen, order.State)
+	}
+
+	current, err := s.currentOrder(ctx, gateway, order, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return order, current, nil
+}
+
+// loadOrder loads an order of the location with its items, discounts, totals and history
+func (s *SquareService) loadOrder(restaurant models.Restaurant, location models.Location, orderID string) (*models.Order, error) {
+	var order models.Order
+	if err := s.db.Where(&models.Order{
+		ID:           orderID,
+		RestautantID: restaurant.ID,
+		LocationID:   location.SquareLocationID,
+	}).Preload("Items.Modifiers").Preload("Items.Discounts").Preload("Discounts").Preload("Totals").Preload("Transitions").Preload("Checks").First(&order).Error; err != nil {
+		s.Logger.Error("Order not found in database", "error", err, "order_id", orderID)
+		return nil, fmt.Errorf("%w: %v", ErrOrderNotFound, err)
+	}
+	return &order, nil
+}
+
+// currentOrder fetches the order from Square, where it must still be open or a draft.
+// The version must match the Square order's version
+func (s *SquareService) currentOrder(ctx context.Context, gateway pos.Gateway, order *models.Order, version int) (*square.Order, error) {
+	if err := requireVersion(version); err != nil {
+		return nil, err
+	}
+	resp, err := gateway.GetOrder(ctx, order.ID)
+	if err != nil {
+		s.Logger.Error("Failed to fetch square order", "error", err, "order_id", order.ID)
+		return nil, fmt.Errorf("failed to fetch square order: %w", err)
+	}
+	current := resp.Order
+	if current.State == nil || (*current.State != square.OrderStateOpen && *current.State != square.OrderStateDraft) {
+		return nil, ErrOrderNotOpen
+	}
+	if current.Version == nil || *current.Version != version {
+		return nil, fmt.Errorf("%w: the order is at version %d", ErrVersionConflict, squareVersion(current))
+	}
+
+	adoptSquareUIDs(order, current)
+	return current, nil
+}
+
+// requireVersion rejects changes that do not say which version of the order they are based on,
+// they would silently overwrite changes made since
+func requireVersion(version int) error {
+	if version <= 0 {
+		return fmt.Errorf("%w: version is required", ErrInvalidOrder)
+	}
+	return nil
+}
+
+// updateOrder sends the changes to Square based on its current version and stores the order Square returns
+func (s *SquareService) updateOrder(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, order *models.Order, current *square.Order, update *square.Order, clear []string) (*models.Order, error) {
+	update.LocationID = current.LocationID
+	update.Version = current.Version
+
+	resp, err := gateway.UpdateOrder(ctx, &square.UpdateOrderRequest{
+		OrderID:        order.ID,
+		Order:          update,
+		FieldsToClear:  clear,
+		IdempotencyKey: square.String(newSquareUID()),
+	})
+	if errors.Is(err, pos.ErrVersionMismatch) {
+		return nil, fmt.Errorf("%w: %v", ErrVersionConflict, err)
+	}
+	if err != nil {
+		s.Logger.Error("Failed to update square order", "error", err, "order_id", order.ID)
+		return nil, fmt.Errorf("failed to update square order: %w", err)
+	}
+
+	if err := s.storeSquareOrder(order, resp.Order); err != nil {
+		return nil, err
+	}
+
+	s.Logger.Info("Order updated", "order_id", order.ID, "restautant_id", restaurant.ID, "version", fmt.Sprintf("%d", order.Version))
+	return order, nil
+}
+
+// storeSquareOrder syncs the order with the Square order and saves it, deleting the items Square no longer has
+func (s *SquareService) storeSquareOrder(order *models.Order, sq *square.Order) error {
+	due := order.Totals.Due
+	removed := syncOrder(order, sq)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return saveSyncedOrder(tx, order, due, removed)
+	})
+	if err != nil {
+		s.Logger.Error("Failed to save updated order", "error", err, "order_id", order.ID)
+		return fmt.Errorf("failed to save order: %w", err)
+	}
+	return nil
+}
+
+// lockSyncedOrder locks the order and loads it with everything syncing it with Square changes.
+// The row stays locked until the transaction ends, so payments and other syncs of the order wait
+func lockSyncedOrder(tx *gorm.DB, restaurantID uint, orderID string) (*models.Order, error) {
+	if _, err := lockOrder(tx, restaurantID, orderID); err != nil {
+		return nil, err
+	}
+	var order models.Order
+	if err := tx.Where(&models.Order{ID: orderID, RestautantID: restaurantID}).
+		Preload("Items.Modifiers").Preload("Items.Discounts").Preload("Discounts").Preload("Totals").Preload("Transitions").Preload("Checks").
+		First(&order).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// saveSyncedOrder saves an order synced with Square whose amount due was due before, deleting the removed items.
+// Checks are not part of the Square order and are only written when the bill has to be split again
+func saveSyncedOrder(tx *gorm.DB, order *models.Order, due models.Money, removed []models.OrderItem) error {
+	// A changed bill has to be split again unless one of its checks has been paid
+	resplit := len(order.Checks) > 0 && order.Totals.Due.Amount != due.Amount &&
+		!slices.ContainsFunc(order.Checks, func(check models.Check) bool { return check.Paid.Amount > 0 })
+	if resplit {
+		if err := tx.Where("order_id = ?", order.ID).Delete(&models.Check{}).Error; err != nil {
+			return err
+		}
+		order.Checks = nil
+		for i := range order.Items {
+			order.Items[i].CheckID = 0
+		}
+	}
+
+	if err := tx.Session(&gorm.Session{FullSaveAssociations: true}).Omit("Checks").Save(order).Error; err != nil {
+		return err
+	}
+	for _, item := range removed {
+		if err := tx.Where("order_item_id = ?", item.ID).Delete(&models.Discount{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("order_item_id = ?", item.ID).Delete(&models.Modifier{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&item).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncOrder copies quantities, comments, amounts, totals and the version from the Square order.
+// Items Square no longer has are taken off the order and returned
+func syncOrder(order *models.Order, sq *square.Order) []models.OrderItem {
+	applySquareAmounts(order.Items, order.Discounts, sq, order.Currency)
+
+	var removed []models.OrderItem
+	order.Items = slices.DeleteFunc(order.Items, func(item models.OrderItem) bool {
+		gone := item.SquareUID != "" && !slices.ContainsFunc(sq.LineItems, func(line *square.OrderLineItem) bool {
+			return line.UID != nil && *line.UID == item.SquareUID
+		})
+		if gone {
+			removed = append(removed, item)
+		}
+		return gone
+	})
+
+	currency := order.Currency
+	// A tender's amount includes its tip, tips are kept apart from what was paid towards the bill
+	var paid int64
+	for _, tender := range sq.Tenders {
+		paid += moneyFromSquare(tender.AmountMoney, currency).Amount - moneyFromSquare(tender.TipMoney, currency).Amount
+	}
+	total := moneyFromSquare(sq.TotalMoney, currency)
+	tips := moneyFromSquare(sq.TotalTipMoney, currency)
+
+	order.Totals.OrderID = order.ID
+	order.Totals.Discounts = moneyFromSquare(sq.TotalDiscountMoney, currency)
+	order.Totals.Due = models.NewMoney(total.Amount-tips.Amount, currency)
+	order.Totals.Tax = moneyFromSquare(sq.TotalTaxMoney, currency)
+	order.Totals.ServiceCharge = moneyFromSquare(sq.TotalServiceChargeMoney, currency)
+	order.Totals.Paid = models.NewMoney(paid, currency)
+	_, refunded := capturedPayments(sq)
+	order.Totals.Refunded = models.NewMoney(refunded, currency)
+	order.Totals.Tips = tips
+	order.Totals.Total = total
+
+	order.Version = squareVersion(sq)
+	syncState(order, sq)
+	return removed
+}
+
+// adoptSquareUIDs fills in the UIDs of orders stored before they were kept, matching items by position
+func adoptSquareUIDs(order *models.Order, sq *square.Order) {
+	if len(order.Items) != len(sq.LineItems) {
+		return
+	}
+	for i := range order.Items {
+		item, line := &order.Items[i], sq.LineItems[i]
+		if item.SquareUID == "" && line.UID != nil {
+			item.SquareUID = *line.UID
+		}
+		if len(item.Modifiers) == len(line.Modifiers) {
+			for j := range item.Modifiers {
+				if item.Modifiers[j].SquareUID == "" && line.Modifiers[j].UID != nil {
+					item.Modifiers[j].SquareUID = *line.Modifiers[j].UID
+				}
+			}
+		}
+		if len(item.Discounts) == len(line.AppliedDiscounts) {
+			for j := range item.Discounts {
+				if item.Discounts[j].SquareUID == "" {
+					item.Discounts[j].SquareUID = line.AppliedDiscounts[j].DiscountUID
+				}
+			}
+		}
+	}
+
+	var orderDiscounts []*square.OrderLineItemDiscount
+	for _, discount := range sq.Discounts {
+		if discount.Scope != nil && *discount.Scope == square.OrderLineItemDiscountScopeOrder {
+			orderDiscounts = append(orderDiscounts, discount)
+		}
+	}
+	if len(order.Discounts) == len(orderDiscounts) {
+		for i := range order.Discounts {
+			if order.Discounts[i].SquareUID == "" && orderDiscounts[i].UID != nil {
+				order.Discounts[i].SquareUID = *orderDiscounts[i].UID
+			}
+		}
+	}
+}
+
+func squareVersion(order *square.Order) int {
+	if order.Version == nil {
+		return 0
+	}
+	return *order.Version
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+)
+
+func TestSyncOrderFromFake(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    models.OrderState
+		payments [][2]int64
+		refund   int64
+		want     models.OrderTotals
+		wantTo   models.OrderState
+	}{
+		{
+			name:   "nothing paid",
+			state:  models.OrderStateOpen,
+			want:   models.OrderTotals{Due: usd(2400), Paid: usd(0), Tips: usd(0), Total: usd(2400), Refunded: usd(0)},
+			wantTo: models.OrderStateOpen,
+		},
+		{
+			name:     "partly paid with a tip",
+			state:    models.OrderStateServed,
+			payments: [][2]int64{{1000, 200}},
+			want:     models.OrderTotals{Due: usd(2400), Paid: usd(1000), Tips: usd(200), Total: usd(2600), Refunded: usd(0)},
+			wantTo:   models.OrderStatePartiallyPaid,
+		},
+		{
+			name:     "tips do not count towards the bill",
+			state:    models.OrderStateServed,
+			payments: [][2]int64{{1400, 500}},
+			want:     models.OrderTotals{Due: usd(2400), Paid: usd(1400), Tips: usd(500), Total: usd(2900), Refunded: usd(0)},
+			wantTo:   models.OrderStatePartiallyPaid,
+		},
+		{
+			name:     "paid in Square",
+			state:    models.OrderStateServed,
+			payments: [][2]int64{{1400, 100}, {1000, 200}},
+			want:     models.OrderTotals{Due: usd(2400), Paid: usd(2400), Tips: usd(300), Total: usd(2700), Refunded: usd(0)},
+			wantTo:   models.OrderStatePaid,
+		},
+		{
+			name:     "refunded with the tip in Square",
+			state:    models.OrderStatePaid,
+			payments: [][2]int64{{2400, 300}},
+			refund:   2700,
+			want:     models.OrderTotals{Due: usd(2400), Paid: usd(2400), Tips: usd(300), Total: usd(2700), Refunded: usd(2700)},
+			wantTo:   models.OrderStateRefunded,
+		},
+		{
+			name:     "refunded without the tip",
+			state:    models.OrderStatePaid,
+			payments: [][2]int64{{2400, 300}},
+			refund:   2400,
+			want:     models.OrderTotals{Due: usd(2400), Paid: usd(2400), Tips: usd(300), Total: usd(2700), Refunded: usd(2400)},
+			wantTo:   models.OrderStatePaid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			gateway := pos.NewFake().Connect(pos.Sandbox, "token")
+			created, err := gateway.CreateOrder(ctx, &square.CreateOrderRequest{
+				Order: &square.Order{LineItems: []*square.OrderLineItem{{
+					UID:             square.String("burger"),
+					CatalogObjectID: square.String(pos.FakeVariationBurgerRegular),
+					Quantity:        "2",
+				}}},
+			})
+			if err != nil {
+				t.Fatalf("CreateOrder: %v", err)
+			}
+			orderID := *created.Order.ID
+
+			var paymentID string
+			for i, p := range tt.payments {
+				resp, err := gateway.CreatePayment(ctx, &square.CreatePaymentRequest{
+					IdempotencyKey: fmt.Sprintf("pay-%d", i),
+					SourceID:       "CASH",
+					AmountMoney:    squareMoney(usd(p[0])),
+					TipMoney:       squareMoney(usd(p[1])),
+					OrderID:        square.String(orderID),
+				})
+				if err != nil {
+					t.Fatalf("CreatePayment: %v", err)
+				}
+				paymentID = *resp.Payment.ID
+			}
+			if tt.refund > 0 {
+				if _, err := gateway.RefundPayment(ctx, &square.RefundPaymentRequest{
+					IdempotencyKey: "refund",
+					PaymentID:      square.String(paymentID),
+					AmountMoney:    squareMoney(usd(tt.refund)),
+				}); err != nil {
+					t.Fatalf("RefundPayment: %v", err)
+				}
+			}
+			sq, err := gateway.GetOrder(ctx, orderID)
+			if err != nil {
+				t.Fatalf("GetOrder: %v", err)
+			}
+
+			order := &models.Order{
+				ID:       orderID,
+				Currency: "USD",
+				State:    tt.state,
+				Items:    []models.OrderItem{{SquareUID: "burger", Name: "Burger", Quantity: 2, UnitPrice: usd(1200)}},
+			}
+			if removed := syncOrder(order, sq.Order); len(removed) != 0 {
+				t.Errorf("removed %d items, want none", len(removed))
+			}
+
+			got := order.Totals
+			for _, field := range []struct {
+				name      string
+				got, want models.Money
+			}{
+				{"due", got.Due, tt.want.Due},
+				{"paid", got.Paid, tt.want.Paid},
+				{"tips", got.Tips, tt.want.Tips},
+				{"total", got.Total, tt.want.Total},
+				{"refunded", got.Refunded, tt.want.Refunded},
+			} {
+				if field.got != field.want {
+					t.Errorf("%s = %s, want %s", field.name, field.got, field.want)
+				}
+			}
+			if order.State != tt.wantTo {
+				t.Errorf("state = %s, want %s", order.State, tt.wantTo)
+			}
+			if order.Version != squareVersion(sq.Order) {
+				t.Errorf("version = %d, want %d", order.Version, squareVersion(sq.Order))
+			}
+		})
+	}
+}
+
+func TestSyncOrderDropsItemsRemovedInSquare(t *testing.T) {
+	ctx := context.Background()
+	gateway := pos.NewFake().Connect(pos.Sandbox, "token")
+	created, err := gateway.CreateOrder(ctx, &square.CreateOrderRequest{
+		Order: &square.Order{LineItems: []*square.OrderLineItem{
+			{UID: square.String("burger"), CatalogObjectID: square.String(pos.FakeVariationBurgerRegular), Quantity: "1"},
+			{UID: square.String("fries"), CatalogObjectID: square.String(pos.FakeVariationFries), Quantity: "1"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	updated, err := gateway.UpdateOrder(ctx, &square.UpdateOrderRequest{
+		OrderID:       *created.Order.ID,
+		Order:         &square.Order{Version: created.Order.Version},
+		FieldsToClear: []string{"line_items[fries]"},
+	})
+	if err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+
+	order := &models.Order{
+		ID:       *created.Order.ID,
+		Currency: "USD",
+		State:    models.OrderStateOpen,
+		Items: []models.OrderItem{
+			{SquareUID: "burger", Name: "Burger", Quantity: 1},
+			{SquareUID: "fries", Name: "Fries", Quantity: 1},
+		},
+	}
+	removed := syncOrder(order, updated.Order)
+	if len(removed) != 1 || removed[0].SquareUID != "fries" {
+		t.Fatalf("removed %+v, want the fries", removed)
+	}
+	if len(order.Items) != 1 || order.Items[0].Amount != usd(1200) {
+		t.Errorf("items = %+v, want the burger at 12.00", order.Items)
+	}
+	if order.Totals.Due != usd(1200) {
+		t.Errorf("due = %s, want 12.00 USD", order.Totals.Due)
+	}
+}
+
+func TestRequireVersion(t *testing.T) {
+	for version, wantErr := range map[int]bool{-1: true, 0: true, 1: false, 7: false} {
+		if err := requireVersion(version); (err != nil) != wantErr {
+			t.Errorf("requireVersion(%d) = %v, want error %v", version, err, wantErr)
+		}
+	}
+}
+
+func usd(amount int64) models.Money {
+	return models.NewMoney(amount, "USD")
+}
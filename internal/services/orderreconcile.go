@@ -0,0 +1,402 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/keyring"
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxReconcileWindow bounds how far apart the ends of a reconciliation may be
+	maxReconcileWindow = 31 * 24 * time.Hour
+	// orderSearchLimit is the page size of order searches
+	orderSearchLimit = 100
+	// orderSearchLocations is the most locations Square searches at once
+	orderSearchLocations = 10
+	// importDelay leaves orders just created in Square to the request creating them, it stores them itself
+	importDelay = 5 * time.Minute
+)
+
+// ErrInvalidWindow is returned for reconciliations whose time window is empty or too long
+var ErrInvalidWindow = errors.New("invalid reconciliation window")
+
+// OrderReconciler repairs the drift between the stored orders and Square left by missed webhooks
+type OrderReconciler struct {
+	db        *gorm.DB
+	orders    *SquareService
+	locations *LocationService
+	connector pos.Connector
+	keys      *keyring.Keyring
+	Logger    *logger.Logger
+}
+
+func NewOrderReconciler(db *gorm.DB, orders *SquareService, locations *LocationService, connector pos.Connector, keys *keyring.Keyring, log *logger.Logger) *OrderReconciler {
+	return &OrderReconciler{
+		db:        db,
+		orders:    orders,
+		locations: locations,
+		connector: connector,
+		keys:      keys,
+		Logger:    log,
+	}
+}
+
+// Reconcile compares the orders updated in Square between from and to with the stored ones for every connected restaurant.
+// Restaurants and orders that fail are listed in the report and do not stop the others
+func (r *OrderReconciler) Reconcile(ctx context.Context, from, to time.Time) (*models.Reconciliation, error) {
+	if err := validateWindow(from, to); err != nil {
+		return nil, err
+	}
+	var restaurants []models.Restaurant
+	if err := r.db.Where("revoked_at IS NULL").Order("id").Find(&restaurants).Error; err != nil {
+		return nil, fmt.Errorf("failed to find restaurants: %w", err)
+	}
+
+	report := newReconciliation(from, to)
+	for _, restaurant := range restaurants {
+		gateway, err := connectRestaurant(r.connector, r.keys, restaurant)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		r.reconcileRestaurant(ctx, restaurant, gateway, report)
+	}
+	r.logReport(report)
+	return report, nil
+}
+
+// ReconcileRestaurant compares the restaurant's orders updated in Square between from and to with the stored ones
+func (r *OrderReconciler) ReconcileRestaurant(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, from, to time.Time) (*models.Reconciliation, error) {
+	if err := validateWindow(from, to); err != nil {
+		return nil, err
+	}
+	report := newReconciliation(from, to)
+	r.reconcileRestaurant(ctx, restaurant, gateway, report)
+	r.logReport(report)
+	return report, nil
+}
+
+// Run reconciles the orders updated in the last lookback right away and then every interval until ctx is done
+func (r *OrderReconciler) Run(ctx context.Context, interval, lookback time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if _, err := r.Reconcile(ctx, now.Add(-lookback), now); err != nil {
+			r.Logger.Error("Failed to reconcile orders", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func validateWindow(from, to time.Time) error {
+	if !from.Before(to) {
+		return fmt.Errorf("%w: from must be before to", ErrInvalidWindow)
+	}
+	if to.Sub(from) > maxReconcileWindow {
+		return fmt.Errorf("%w: at most %d days can be reconciled at once", ErrInvalidWindow, int(maxReconcileWindow.Hours()/24))
+	}
+	return nil
+}
+
+func newReconciliation(from, to time.Time) *models.Reconciliation {
+	return &models.Reconciliation{
+		From:     from,
+		To:       to,
+		Updated:  []models.OrderDiscrepancy{},
+		Imported: []models.OrderDiscrepancy{},
+		Errors:   []string{},
+	}
+}
+
+func (r *OrderReconciler) logReport(report *models.Reconciliation) {
+	r.Logger.Info("Reconciled orders",
+		"checked", fmt.Sprintf("%d", report.Checked),
+		"updated", fmt.Sprintf("%d", len(report.Updated)),
+		"imported", fmt.Sprintf("%d", len(report.Imported)),
+		"errors", fmt.Sprintf("%d", len(report.Errors)))
+	for _, err := range report.Errors {
+		r.Logger.Error("Failed to reconcile orders", "error", err)
+	}
+}
+
+// reconcileRestaurant searches the restaurant's locations for orders updated in the report's window and reconciles them
+func (r *OrderReconciler) reconcileRestaurant(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, report *models.Reconciliation) {
+	locations, err := r.locations.List(ctx, restaurant, gateway)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("restaurant %d: %v", restaurant.ID, err))
+		return
+	}
+	ids := make([]string, 0, len(locations))
+	for _, location := range locations {
+		ids = append(ids, location.SquareLocationID)
+	}
+
+	// Orders are searched by when they were last updated, oldest first
+	query := &square.SearchOrdersQuery{
+		Filter: &square.SearchOrdersFilter{
+			DateTimeFilter: &square.SearchOrdersDateTimeFilter{
+				UpdatedAt: &square.TimeRange{
+					StartAt: square.String(report.From.UTC().Format(time.RFC3339)),
+					EndAt:   square.String(report.To.UTC().Format(time.RFC3339)),
+				},
+			},
+		},
+		Sort: &square.SearchOrdersSort{
+			SortField: square.SearchOrdersSortFieldUpdatedAt,
+			SortOrder: square.SortOrderAsc.Ptr(),
+		},
+	}
+	for batch := range slices.Chunk(ids, orderSearchLocations) {
+		var cursor *string
+		for {
+			resp, err := gateway.SearchOrders(ctx, &square.SearchOrdersRequest{
+				LocationIDs: batch,
+				Query:       query,
+				Limit:       square.Int(orderSearchLimit),
+				Cursor:      cursor,
+			})
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("restaurant %d: failed to search orders: %v", restaurant.ID, err))
+				break
+			}
+
+			for _, sq := range resp.Orders {
+				report.Checked++
+				discrepancy, imported, err := r.orders.reconcileOrder(ctx, restaurant, gateway, sq)
+				switch {
+				case err != nil:
+					report.Errors = append(report.Errors, fmt.Sprintf("restaurant %d: order %s: %v", restaurant.ID, stringValue(sq.ID), err))
+				case discrepancy == nil:
+				case imported:
+					report.Imported = append(report.Imported, *discrepancy)
+				default:
+					report.Updated = append(report.Updated, *discrepancy)
+				}
+			}
+
+			if resp.Cursor == nil || *resp.Cursor == "" {
+				break
+			}
+			cursor = resp.Cursor
+		}
+	}
+}
+
+// reconcileOrder brings the stored order in line with the Square order, importing orders the API does not know.
+// It returns nil when the order already matched
+func (s *SquareService) reconcileOrder(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, sq *square.Order) (discrepancy *models.OrderDiscrepancy, imported bool, err error) {
+	if sq.ID == nil {
+		return nil, false, nil
+	}
+
+	var stored int64
+	if err := s.db.Model(&models.Order{}).Where(&models.Order{ID: *sq.ID, RestautantID: restaurant.ID}).Count(&stored).Error; err != nil {
+		return nil, false, fmt.Errorf("failed to look up order: %w", err)
+	}
+	if stored == 0 {
+		if created, err := time.Parse(time.RFC3339, stringValue(sq.CreatedAt)); err == nil && time.Since(created) < importDelay {
+			return nil, false, nil
+		}
+		discrepancy, err = s.importSquareOrder(ctx, restaurant, gateway, sq)
+		return discrepancy, discrepancy != nil, err
+	}
+
+	// Payments are stored first, completing one the API was processing updates the order
+	changes, err := s.importSquareTenders(ctx, restaurant, gateway, sq)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The stored order is read and saved with its row locked, so a payment or webhook sync in between is not overwritten
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		order, err := lockSyncedOrder(tx, restaurant.ID, *sq.ID)
+		if err != nil {
+			return err
+		}
+		// The search found an older version than the one stored since, e.g. by a change made through the API
+		if order.Version > squareVersion(sq) {
+			return nil
+		}
+
+		before := snapshotOrder(order)
+		due := order.Totals.Due
+		adoptSquareUIDs(order, sq)
+		known := len(order.Items)
+		importLineItems(order, sq)
+		added := slices.Clone(order.Items[known:])
+		removed := syncOrder(order, sq)
+
+		synced := before.changes(order, added, removed)
+		if len(synced) == 0 {
+			return nil
+		}
+		changes = append(changes, synced...)
+		return saveSyncedOrder(tx, order, due, removed)
+	})
+	if err != nil {
+		s.Logger.Error("Failed to save updated order", "error", err, "order_id", *sq.ID)
+		return nil, false, fmt.Errorf("failed to save order: %w", err)
+	}
+	if len(changes) == 0 {
+		return nil, false, nil
+	}
+	s.Logger.Info("Reconciled order", "order_id", *sq.ID, "restautant_id", fmt.Sprintf("%d", restaurant.ID))
+	return &models.OrderDiscrepancy{
+		OrderID:      *sq.ID,
+		RestaurantID: restaurant.ID,
+		LocationID:   sq.LocationID,
+		Changes:      changes,
+	}, false, nil
+}
+
+// importSquareOrder stores an order created outside the API, e.g. on a terminal, with its payments
+func (s *SquareService) importSquareOrder(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, sq *square.Order) (*models.OrderDiscrepancy, error) {
+	currency := moneyFromSquare(sq.TotalMoney, restaurant.Currency).Currency
+	var location models.Location
+	if err := s.db.Where(&models.Location{RestaurantID: restaurant.ID, SquareLocationID: sq.LocationID}).First(&location).Error; err == nil && location.Currency != "" {
+		currency = location.Currency
+	}
+
+	order := &models.Order{
+		ID:           *sq.ID,
+		RestautantID: restaurant.ID,
+		LocationID:   sq.LocationID,
+		Currency:     currency,
+		OpenAt:       time.Now(),
+	}
+	if created, err := time.Parse(time.RFC3339, stringValue(sq.CreatedAt)); err == nil {
+		order.OpenAt = created
+	}
+	initial := models.OrderStateOpen
+	if sq.State != nil && *sq.State == square.OrderStateDraft {
+		initial = models.OrderStateDraft
+	}
+	recordTransition(order, initial, 0, "")
+	importLineItems(order, sq)
+	syncOrder(order, sq)
+
+	if err := s.db.Create(order).Error; err != nil {
+		return nil, fmt.Errorf("failed to save order: %w", err)
+	}
+	changes := []string{fmt.Sprintf("imported %s order of %d items totalling %s", order.State, len(order.Items), order.Totals.Total)}
+
+	payments, err := s.importSquareTenders(ctx, restaurant, gateway, sq)
+	if err != nil {
+		return nil, err
+	}
+	s.Logger.Info("Imported order", "order_id", order.ID, "restautant_id", fmt.Sprintf("%d", restaurant.ID), "location_id", order.LocationID)
+	return &models.OrderDiscrepancy{
+		OrderID:      order.ID,
+		RestaurantID: restaurant.ID,
+		LocationID:   order.LocationID,
+		Changes:      append(changes, payments...),
+	}, nil
+}
+
+// importSquareTenders stores the payments of the Square order's tenders the API has no record of
+func (s *SquareService) importSquareTenders(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, sq *square.Order) ([]string, error) {
+	var changes []string
+	for _, tender := range sq.Tenders {
+		if tender.PaymentID == nil {
+			continue
+		}
+		var stored int64
+		if err := s.db.Model(&models.Payment{}).Where("square_payment_id = ?", *tender.PaymentID).Count(&stored).Error; err != nil {
+			return nil, fmt.Errorf("failed to look up payment: %w", err)
+		}
+		if stored > 0 {
+			continue
+		}
+
+		resp, err := gateway.GetPayment(ctx, *tender.PaymentID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch square payment: %w", err)
+		}
+		payment, err := s.storeSquarePayment(ctx, restaurant, gateway, resp.Payment)
+		if err != nil {
+			return nil, err
+		}
+		if payment != nil {
+			changes = append(changes, fmt.Sprintf("stored %s payment %s of %s", payment.Status, payment.SquarePaymentID, payment.Amount))
+		}
+	}
+	return changes, nil
+}
+
+// orderSnapshot is what reconciling compares an order by
+type orderSnapshot struct {
+	state      models.OrderState
+	version    int
+	totals     models.OrderTotals
+	quantities map[uint]int
+}
+
+func snapshotOrder(order *models.Order) orderSnapshot {
+	snapshot := orderSnapshot{
+		state:      order.State,
+		version:    order.Version,
+		totals:     order.Totals,
+		quantities: make(map[uint]int, len(order.Items)),
+	}
+	for _, item := range order.Items {
+		snapshot.quantities[item.ID] = item.Quantity
+	}
+	return snapshot
+}
+
+// changes describes how the order differs from the snapshot after syncing, given the items it added and removed
+func (b orderSnapshot) changes(order *models.Order, added, removed []models.OrderItem) []string {
+	var changes []string
+	if b.state != order.State {
+		changes = append(changes, fmt.Sprintf("state %s → %s", b.state, order.State))
+	}
+	for _, item := range added {
+		changes = append(changes, fmt.Sprintf("added %d × %s", item.Quantity, item.Name))
+	}
+	for _, item := range removed {
+		changes = append(changes, fmt.Sprintf("removed %d × %s", item.Quantity, item.Name))
+	}
+	for _, item := range order.Items {
+		if quantity, ok := b.quantities[item.ID]; ok && quantity != item.Quantity {
+			changes = append(changes, fmt.Sprintf("%s quantity %d → %d", item.Name, quantity, item.Quantity))
+		}
+	}
+
+	totals := []struct {
+		name          string
+		before, after models.Money
+	}{
+		{"total", b.totals.Total, order.Totals.Total},
+		{"due", b.totals.Due, order.Totals.Due},
+		{"paid", b.totals.Paid, order.Totals.Paid},
+		{"tips", b.totals.Tips, order.Totals.Tips},
+		{"refunded", b.totals.Refunded, order.Totals.Refunded},
+	}
+	for _, total := range totals {
+		if total.before.Amount != total.after.Amount {
+			changes = append(changes, fmt.Sprintf("%s %s → %s", total.name, total.before, total.after))
+		}
+	}
+
+	// Square changed something the API does not keep, only the version is brought up to date
+	if len(changes) == 0 && b.version != order.Version {
+		changes = append(changes, fmt.Sprintf("version %d → %d", b.version, order.Version))
+	}
+	return changes
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+)
+
+// ErrIllegalTransition is returned when an order cannot move to the requested state, e.g. paying a canceled order
+var ErrIllegalTransition = errors.New("illegal order state transition")
+
+// TransitionOrder moves an order through the states staff set by hand: opening a draft, sending it to the kitchen,
+// serving it and closing it once paid
+func (s *SquareService) TransitionOrder(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway, staff models.Staff, orderID string, req models.TransitionRequest) (*models.Order, error) {
+	switch req.State {
+	case models.OrderStateOpen, models.OrderStateSentToKitchen, models.OrderStateServed, models.OrderStateClosed:
+	case models.OrderStatePartiallyPaid, models.OrderStatePaid, models.OrderStateCanceled, models.OrderStateRefunded:
+		return nil, fmt.Errorf("%w: orders become %s by paying, cancelling or refunding them", ErrInvalidOrder, req.State)
+	default:
+		return nil, fmt.Errorf("%w: unknown state %q", ErrInvalidOrder, req.State)
+	}
+
+	if err := requireVersion(req.Version); err != nil {
+		return nil, err
+	}
+	order, err := s.loadOrder(restaurant, location, orderID)
+	if err != nil {
+		return nil, err
+	}
+	// States other than drafts being opened are ours, the stored version is checked for them
+	if order.State != models.OrderStateDraft && req.Version != order.Version {
+		return nil, fmt.Errorf("%w: the order is at version %d", ErrVersionConflict, order.Version)
+	}
+	from := order.State
+	if err := transition(order, req.State, staff.ID, strings.TrimSpace(req.Reason)); err != nil {
+		return nil, err
+	}
+
+	// Square only knows about drafts being opened, the other states are ours
+	if from == models.OrderStateDraft {
+		current, err := s.currentOrder(ctx, gateway, order, req.Version)
+		if err != nil {
+			return nil, err
+		}
+		return s.updateOrder(ctx, restaurant, gateway, order, current, &square.Order{State: square.OrderStateOpen.Ptr()}, nil)
+	}
+
+	if err := s.db.Save(order).Error; err != nil {
+		s.Logger.Error("Failed to save order state", "error", err, "order_id", orderID)
+		return nil, fmt.Errorf("failed to save order: %w", err)
+	}
+
+	s.Logger.Info("Order state changed", "order_id", orderID, "from", string(from), "to", string(req.State), "staff_id", fmt.Sprintf("%d", staff.ID))
+	return order, nil
+}
+
+// transition moves the order to a new state and adds the change to its history, which is saved with the order
+func transition(order *models.Order, to models.OrderState, staffID uint, reason string) error {
+	if !order.State.CanTransition(to) {
+		from := order.State
+		if from == "" {
+			from = "new"
+		}
+		return fmt.Errorf("%w: a %s order cannot become %s", ErrIllegalTransition, from, to)
+	}
+	recordTransition(order, to, staffID, reason)
+	return nil
+}
+
+// recordTransition moves the order to a new state without checking it, for changes Square already made
+func recordTransition(order *models.Order, to models.OrderState, staffID uint, reason string) {
+	order.Transitions = append(order.Transitions, models.OrderTransition{
+		OrderID: order.ID,
+		From:    order.State,
+		To:      to,
+		StaffID: staffID,
+		Reason:  reason,
+	})
+	order.State = to
+}
+
+// syncState follows state changes made in Square, e.g. an order paid or cancelled on a terminal
+func syncState(order *models.Order, sq *square.Order) {
+	if sq.State == nil {
+		return
+	}
+	switch *sq.State {
+	case square.OrderStateOpen:
+		if order.State == models.OrderStateDraft {
+			recordTransition(order, models.OrderStateOpen, 0, "")
+		}
+		// Part of the bill was paid outside the API, e.g. on a terminal
+		if order.Totals.Paid.Amount > 0 && order.State.CanTransition(models.OrderStatePartiallyPaid) {
+			recordTransition(order, models.OrderStatePartiallyPaid, 0, "")
+		}
+	case square.OrderStateCompleted:
+		switch order.State {
+		case models.OrderStatePaid, models.OrderStateClosed, models.OrderStateRefunded:
+		default:
+			recordTransition(order, models.OrderStatePaid, 0, "")
+		}
+		// Everything paid was given back, e.g. from the Square Dashboard
+		paid := order.Totals.Paid.Add(order.Totals.Tips)
+		if paid.Amount > 0 && order.Totals.Refunded.Amount >= paid.Amount && order.State.CanTransition(models.OrderStateRefunded) {
+			recordTransition(order, models.OrderStateRefunded, 0, "")
+		}
+	case square.OrderStateCanceled:
+		if order.State != models.OrderStateCanceled {
+			recordTransition(order, models.OrderStateCanceled, 0, "")
+		}
+	}
+}
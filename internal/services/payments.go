@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/square/square-go-sdk"
+)
+
+// maxPaymentRange limits how far apart the dates of a payment listing may be
+const maxPaymentRange = 93 * 24 * time.Hour
+
+// ListOrderPayments returns the payments of an order, oldest first
+func (s *SquareService) ListOrderPayments(ctx context.Context, restaurant models.Restaurant, location models.Location, orderID string) ([]models.Payment, error) {
+	if _, err := s.loadOrder(restaurant, location, orderID); err != nil {
+		return nil, err
+	}
+
+	var payments []models.Payment
+	if err := s.db.Where(&models.Payment{RestaurantID: restaurant.ID, OrderID: orderID}).Order("id").Find(&payments).Error; err != nil {
+		s.Logger.Error("Failed to list payments", "error", err, "order_id", orderID)
+		return nil, fmt.Errorf("failed to list payments: %w", err)
+	}
+	return payments, nil
+}
+
+// ListPayments returns the restaurant's payments taken from from until to, of one location when locationID is set
+func (s *SquareService) ListPayments(ctx context.Context, restaurant models.Restaurant, from, to time.Time, locationID string) ([]models.Payment, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("%w: from must be before to", ErrInvalidPayment)
+	}
+	if to.Sub(from) > maxPaymentRange {
+		return nil, fmt.Errorf("%w: the range may span at most %d days", ErrInvalidPayment, int(maxPaymentRange.Hours()/24))
+	}
+
+	query := s.db.Where(&models.Payment{RestaurantID: restaurant.ID, LocationID: locationID}).
+		Where("created_at >= ? AND created_at < ?", from, to)
+
+	var payments []models.Payment
+	if err := query.Order("created_at").Find(&payments).Error; err != nil {
+		s.Logger.Error("Failed to list payments", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to list payments: %w", err)
+	}
+	return payments, nil
+}
+
+// paymentFromSquare copies the amounts, status and tender of a Square payment
+func paymentFromSquare(p *square.Payment, currency string) *models.Payment {
+	payment := &models.Payment{
+		SquarePaymentID: stringValue(p.ID),
+		TenderType:      stringValue(p.SourceType),
+		Amount:          moneyFromSquare(p.AmountMoney, currency),
+		Tip:             moneyFromSquare(p.TipMoney, currency),
+		Refunded:        moneyFromSquare(p.RefundedMoney, currency),
+		Change:          models.NewMoney(0, currency),
+		Status:          stringValue(p.Status),
+	}
+	if p.CashDetails != nil {
+		payment.Change = moneyFromSquare(p.CashDetails.ChangeBackMoney, currency)
+	}
+	if p.CardDetails != nil && p.CardDetails.Card != nil {
+		card := p.CardDetails.Card
+		if card.CardBrand != nil {
+			payment.CardBrand = string(*card.CardBrand)
+		}
+		payment.CardLast4 = stringValue(card.Last4)
+	}
+	return payment
+}
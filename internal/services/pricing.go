@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidPricingRule is returned for tax rules and service charges that fail validation
+	ErrInvalidPricingRule = errors.New("invalid pricing rule")
+	// ErrPricingRuleNotFound is returned for rules that do not belong to the restaurant
+	ErrPricingRuleNotFound = errors.New("pricing rule not found")
+)
+
+// PricingService manages the tax rules and service charges added to a restaurant's orders
+type PricingService struct {
+	db     *gorm.DB
+	Logger *logger.Logger
+}
+
+func NewPricing(db *gorm.DB, log *logger.Logger) *PricingService {
+	return &PricingService{
+		db:     db,
+		Logger: log,
+	}
+}
+
+// ListTaxRules returns the restaurant's tax rules
+func (s *PricingService) ListTaxRules(ctx context.Context, restaurant models.Restaurant) ([]models.TaxRule, error) {
+	var rules []models.TaxRule
+	if err := s.db.Where(&models.TaxRule{RestaurantID: restaurant.ID}).Order("id").Find(&rules).Error; err != nil {
+		s.Logger.Error("Failed to list tax rules", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to list tax rules: %w", err)
+	}
+	return rules, nil
+}
+
+// CreateTaxRule adds a tax to the restaurant's future orders
+func (s *PricingService) CreateTaxRule(ctx context.Context, restaurant models.Restaurant, rule models.TaxRule) (*models.TaxRule, error) {
+	rule.Name = strings.TrimSpace(rule.Name)
+	rule.Category = strings.TrimSpace(rule.Category)
+	if rule.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidPricingRule)
+	}
+	if !validPercentage(rule.Percentage) {
+		return nil, fmt.Errorf("%w: percentage must be a decimal between 0 and 100", ErrInvalidPricingRule)
+	}
+
+	rule.ID = 0
+	rule.RestaurantID = restaurant.ID
+	if err := s.db.Create(&rule).Error; err != nil {
+		s.Logger.Error("Failed to create tax rule", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to create tax rule: %w", err)
+	}
+
+	s.Logger.Info("Tax rule created", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "tax_rule_id", fmt.Sprintf("%d", rule.ID))
+	return &rule, nil
+}
+
+// DeleteTaxRule stops charging a tax, orders already created keep it
+func (s *PricingService) DeleteTaxRule(ctx context.Context, restaurant models.Restaurant, id uint) error {
+	return s.delete(&models.TaxRule{}, restaurant, id)
+}
+
+// ListServiceCharges returns the restaurant's service charges
+func (s *PricingService) ListServiceCharges(ctx context.Context, restaurant models.Restaurant) ([]models.ServiceCharge, error) {
+	var charges []models.ServiceCharge
+	if err := s.db.Where(&models.ServiceCharge{RestaurantID: restaurant.ID}).Order("id").Find(&charges).Error; err != nil {
+		s.Logger.Error("Failed to list service charges", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to list service charges: %w", err)
+	}
+	return charges, nil
+}
+
+// CreateServiceCharge adds a service charge to the restaurant's future orders
+func (s *PricingService) CreateServiceCharge(ctx context.Context, restaurant models.Restaurant, charge models.ServiceCharge) (*models.ServiceCharge, error) {
+	charge.Name = strings.TrimSpace(charge.Name)
+	if charge.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidPricingRule)
+	}
+	if charge.MinGuests < 0 {
+		return nil, fmt.Errorf("%w: minGuests must not be negative", ErrInvalidPricingRule)
+	}
+
+	switch {
+	case charge.Percentage != "" && charge.Amount.Amount != 0:
+		return nil, fmt.Errorf("%w: set either percentage or amount", ErrInvalidPricingRule)
+	case charge.Percentage != "":
+		if !validPercentage(charge.Percentage) {
+			return nil, fmt.Errorf("%w: percentage must be a decimal between 0 and 100", ErrInvalidPricingRule)
+		}
+		charge.Amount = models.Money{}
+	default:
+		currency, err := locationCurrency(s.db, restaurant)
+		if err != nil {
+			return nil, err
+		}
+		if currency == "" {
+			return nil, ErrNoCurrency
+		}
+		if err := checkMoney("amount", &charge.Amount, currency); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPricingRule, err)
+		}
+		if charge.Amount.Amount == 0 {
+			return nil, fmt.Errorf("%w: percentage or amount is required", ErrInvalidPricingRule)
+		}
+		// A fixed charge is added to the orders of every location, which must all charge in its currency
+		var other models.Location
+		err = s.db.Where("restaurant_id = ? AND currency <> '' AND currency <> ?", restaurant.ID, charge.Amount.Currency).First(&other).Error
+		if err == nil {
+			return nil, fmt.Errorf("%w: location %s charges in %s, not in %s, use a percentage", ErrInvalidPricingRule, other.Name, other.Currency, charge.Amount.Currency)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to load locations: %w", err)
+		}
+	}
+
+	charge.ID = 0
+	charge.RestaurantID = restaurant.ID
+	if err := s.db.Create(&charge).Error; err != nil {
+		s.Logger.Error("Failed to create service charge", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to create service charge: %w", err)
+	}
+
+	s.Logger.Info("Service charge created", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "service_charge_id", fmt.Sprintf("%d", charge.ID))
+	return &charge, nil
+}
+
+// DeleteServiceCharge stops adding a service charge, orders already created keep it
+func (s *PricingService) DeleteServiceCharge(ctx context.Context, restaurant models.Restaurant, id uint) error {
+	return s.delete(&models.ServiceCharge{}, restaurant, id)
+}
+
+func (s *PricingService) delete(model any, restaurant models.Restaurant, id uint) error {
+	result := s.db.Where("id = ? AND restaurant_id = ?", id, restaurant.ID).Delete(model)
+	if result.Error != nil {
+		s.Logger.Error("Failed to delete pricing rule", "error", result.Error, "restaurant_id", restaurant.ID)
+		return fmt.Errorf("failed to delete pricing rule: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrPricingRuleNotFound
+	}
+	return nil
+}
+
+// loadPricing returns the tax rules and service charges that apply to new orders of the restaurant
+func loadPricing(db *gorm.DB, restaurantID uint) ([]models.TaxRule, []models.ServiceCharge, error) {
+	var taxes []models.TaxRule
+	if err := db.Where(&models.TaxRule{RestaurantID: restaurantID}).Order("id").Find(&taxes).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to load tax rules: %w", err)
+	}
+	var charges []models.ServiceCharge
+	if err := db.Where(&models.ServiceCharge{RestaurantID: restaurantID}).Order("id").Find(&charges).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to load service charges: %w", err)
+	}
+	return taxes, charges, nil
+}
+
+func validPercentage(s string) bool {
+	percentage, err := strconv.ParseFloat(s, 64)
+	return err == nil && percentage > 0 && percentage <= 100
+}
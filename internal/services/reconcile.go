@@ -0,0 +1,258 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/keyring"
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrPaymentProcessing is returned when Square could not be reached and may or may not have taken a payment
+var ErrPaymentProcessing = errors.New("payment is still processing")
+
+// paymentReference is the reference_id a payment is sent to Square with, the reconciler finds it by it
+func paymentReference(payment *models.Payment) string {
+	return fmt.Sprintf("payment-%d", payment.ID)
+}
+
+// finalizePayment stores what Square reports for a processing payment and adds it to the order.
+// A payment that is no longer processing has already been stored and is returned as it is
+func (s *SquareService) finalizePayment(ctx context.Context, gateway pos.Gateway, id uint, taken *square.Payment) (*models.Payment, error) {
+	// The payment bumps the Square order's version, clients base item changes on it
+	version := 0
+	if taken.OrderID != nil {
+		if current, err := gateway.GetOrder(ctx, *taken.OrderID); err == nil {
+			version = squareVersion(current.Order)
+		}
+	}
+
+	var payment models.Payment
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// The order is locked before the payment, like when payments are recorded, so payments of the
+		// same order, e.g. of two checks, are added to its totals one after the other
+		if err := tx.First(&payment, id).Error; err != nil {
+			return err
+		}
+		order, err := lockOrder(tx, payment.RestaurantID, payment.OrderID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, id).Error; err != nil {
+			return err
+		}
+		if payment.Status != models.PaymentProcessing {
+			return nil
+		}
+
+		currency := order.Currency
+		stored := paymentFromSquare(taken, currency)
+		payment.SquarePaymentID = stored.SquarePaymentID
+		payment.Amount = stored.Amount
+		payment.Tip = stored.Tip
+		payment.Refunded = stored.Refunded
+		payment.Status = stored.Status
+		payment.CardBrand = stored.CardBrand
+		payment.CardLast4 = stored.CardLast4
+		if stored.Change.Amount != 0 {
+			payment.Change = stored.Change
+		}
+		if err := tx.Save(&payment).Error; err != nil {
+			return err
+		}
+		if payment.Status != "COMPLETED" && payment.Status != "APPROVED" {
+			return nil
+		}
+
+		order.Totals.Paid = order.Totals.Paid.Add(payment.Amount)
+		order.Totals.Tips = order.Totals.Tips.Add(payment.Tip)
+		for i := range order.Checks {
+			check := &order.Checks[i]
+			if check.ID != payment.CheckID {
+				continue
+			}
+			check.Paid = check.Paid.Add(payment.Amount)
+			check.Settled = check.Paid.Amount >= check.Amount.Amount
+			if err := tx.Save(check).Error; err != nil {
+				return err
+			}
+		}
+		state := models.OrderStatePartiallyPaid
+		// A split bill is paid once every check is
+		if order.Totals.Paid.Amount >= order.Totals.Due.Amount && checksSettled(order) {
+			state = models.OrderStatePaid
+		}
+		if state != order.State && order.State.CanTransition(state) {
+			recordTransition(order, state, payment.StaffID, "")
+		}
+		if version != 0 {
+			order.Version = version
+		}
+		return tx.Save(order).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store payment: %w", err)
+	}
+	return &payment, nil
+}
+
+// lockOrder loads the order with its totals and checks and locks its row until the transaction ends
+func lockOrder(tx *gorm.DB, restaurantID uint, orderID string) (*models.Order, error) {
+	var order models.Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(&models.Order{ID: orderID, RestautantID: restaurantID}).
+		Preload("Totals").Preload("Checks").First(&order).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// failPayment marks a processing payment as failed, Square refused it or never took it
+func (s *SquareService) failPayment(payment *models.Payment) error {
+	err := s.db.Model(&models.Payment{}).
+		Where("id = ? AND status = ?", payment.ID, models.PaymentProcessing).
+		Update("status", models.PaymentFailed).Error
+	if err != nil {
+		return fmt.Errorf("failed to mark payment failed: %w", err)
+	}
+	payment.Status = models.PaymentFailed
+	return nil
+}
+
+// reconcilePayment looks for a processing payment among the tenders of its Square order, storing it when
+// Square took it and failing it otherwise
+func (s *SquareService) reconcilePayment(ctx context.Context, gateway pos.Gateway, payment *models.Payment) error {
+	resp, err := gateway.GetOrder(ctx, payment.OrderID)
+	if errors.Is(err, pos.ErrNotFound) {
+		return s.failPayment(payment)
+	}
+	if err != nil {
+		return fmt.Errorf("payment %d: failed to fetch square order: %w", payment.ID, err)
+	}
+
+	reference := paymentReference(payment)
+	for _, tender := range resp.Order.Tenders {
+		if tender.PaymentID == nil {
+			continue
+		}
+		// Tenders of payments that are already stored are not fetched again
+		var stored int64
+		if err := s.db.Model(&models.Payment{}).Where("square_payment_id = ?", *tender.PaymentID).Count(&stored).Error; err != nil {
+			return fmt.Errorf("payment %d: failed to look up tender: %w", payment.ID, err)
+		}
+		if stored > 0 {
+			continue
+		}
+
+		taken, err := gateway.GetPayment(ctx, *tender.PaymentID)
+		if err != nil {
+			return fmt.Errorf("payment %d: failed to fetch square payment: %w", payment.ID, err)
+		}
+		if stringValue(taken.Payment.ReferenceID) != reference {
+			continue
+		}
+		if _, err := s.finalizePayment(ctx, gateway, payment.ID, taken.Payment); err != nil {
+			return fmt.Errorf("payment %d: %w", payment.ID, err)
+		}
+		s.Logger.Info("Reconciled payment", "order_id", payment.OrderID, "payment_id", payment.IdempotencyKey, "square_payment_id", *tender.PaymentID)
+		return nil
+	}
+
+	s.Logger.Info("Payment was never taken", "order_id", payment.OrderID, "payment_id", payment.IdempotencyKey)
+	return s.failPayment(payment)
+}
+
+// PaymentReconciler resolves payments left processing, e.g. when the API stopped between asking Square
+// to take a payment and storing it
+type PaymentReconciler struct {
+	db        *gorm.DB
+	payments  *SquareService
+	connector pos.Connector
+	keys      *keyring.Keyring
+	Logger    *logger.Logger
+}
+
+func NewPaymentReconciler(db *gorm.DB, payments *SquareService, connector pos.Connector, keys *keyring.Keyring, log *logger.Logger) *PaymentReconciler {
+	return &PaymentReconciler{
+		db:        db,
+		payments:  payments,
+		connector: connector,
+		keys:      keys,
+		Logger:    log,
+	}
+}
+
+// Reconcile resolves the payments that have been processing for longer than after.
+// Younger payments may still be waiting for Square's answer
+func (r *PaymentReconciler) Reconcile(ctx context.Context, after time.Duration) error {
+	var payments []models.Payment
+	if err := r.db.Where("status = ? AND created_at < ?", models.PaymentProcessing, time.Now().Add(-after)).
+		Order("id").Find(&payments).Error; err != nil {
+		r.Logger.Error("Failed to find processing payments", "error", err)
+		return fmt.Errorf("failed to find processing payments: %w", err)
+	}
+
+	gateways := make(map[uint]pos.Gateway)
+	var errs []error
+	for i := range payments {
+		payment := &payments[i]
+		gateway, ok := gateways[payment.RestaurantID]
+		if !ok {
+			var err error
+			if gateway, err = r.gateway(payment.RestaurantID); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			gateways[payment.RestaurantID] = gateway
+		}
+		if err := r.payments.reconcilePayment(ctx, gateway, payment); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run reconciles processing payments right away and then every interval until ctx is done
+func (r *PaymentReconciler) Run(ctx context.Context, interval, after time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Reconcile(ctx, after); err != nil {
+			r.Logger.Error("Failed to reconcile payments", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// gateway connects to Square with the restaurant's stored token
+func (r *PaymentReconciler) gateway(restaurantID uint) (pos.Gateway, error) {
+	var restaurant models.Restaurant
+	if err := r.db.First(&restaurant, restaurantID).Error; err != nil {
+		return nil, fmt.Errorf("restaurant %d: %w", restaurantID, err)
+	}
+	return connectRestaurant(r.connector, r.keys, restaurant)
+}
+
+// connectRestaurant opens a gateway with the restaurant's stored token, for work done outside of its requests
+func connectRestaurant(connector pos.Connector, keys *keyring.Keyring, restaurant models.Restaurant) (pos.Gateway, error) {
+	if restaurant.RevokedAt != nil {
+		return nil, fmt.Errorf("restaurant %d: square authorization revoked", restaurant.ID)
+	}
+	token, err := keys.Open(restaurant.SquareToken)
+	if err != nil {
+		return nil, fmt.Errorf("restaurant %d: failed to decrypt token: %w", restaurant.ID, err)
+	}
+	return connector.Connect(restaurant.SquareEnvironment, token), nil
+}
@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrInvalidRefund is returned for refund requests that fail validation
+	ErrInvalidRefund = errors.New("invalid refund")
+	// ErrPaymentNotFound is returned for payments that do not belong to the order
+	ErrPaymentNotFound = errors.New("payment not found")
+)
+
+// RefundPayment gives back all or part of a payment of an order. Retrying with the same idempotency key
+// returns the refund that was already made
+func (s *SquareService) RefundPayment(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway, staff models.Staff, orderID, paymentID string, req models.RefundRequest) (*models.Refund, error) {
+	key := strings.TrimSpace(req.IdempotencyKey)
+	reason := strings.TrimSpace(req.Reason)
+	if key == "" {
+		return nil, fmt.Errorf("%w: idempotencyKey is required", ErrInvalidRefund)
+	}
+	if reason == "" {
+		return nil, fmt.Errorf("%w: reason is required", ErrInvalidRefund)
+	}
+
+	var existing models.Refund
+	err := s.db.Where(&models.Refund{RestaurantID: restaurant.ID, IdempotencyKey: key}).First(&existing).Error
+	if err == nil {
+		if existing.OrderID != orderID || existing.SquarePaymentID != paymentID {
+			return nil, fmt.Errorf("%w: idempotencyKey was already used for another refund", ErrInvalidRefund)
+		}
+		return &existing, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to look up refund: %w", err)
+	}
+
+	order, err := s.loadOrder(restaurant, location, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := gateway.GetPayment(ctx, paymentID)
+	if errors.Is(err, pos.ErrNotFound) {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		s.Logger.Error("Failed to fetch square payment", "error", err, "payment_id", paymentID)
+		return nil, fmt.Errorf("failed to fetch square payment: %w", err)
+	}
+	payment := resp.Payment
+	if payment.OrderID == nil || *payment.OrderID != orderID {
+		return nil, ErrPaymentNotFound
+	}
+	if payment.Status == nil || *payment.Status != "COMPLETED" {
+		return nil, fmt.Errorf("%w: only completed payments can be refunded", ErrInvalidRefund)
+	}
+
+	currency := order.Currency
+	refundable := moneyFromSquare(payment.TotalMoney, currency).Amount - moneyFromSquare(payment.RefundedMoney, currency).Amount
+	amount := req.Amount
+	if amount.Amount == 0 {
+		amount = models.NewMoney(refundable, currency)
+	} else if err := checkMoney("amount", &amount, currency); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRefund, err)
+	}
+	if amount.Amount <= 0 || refundable <= 0 {
+		return nil, fmt.Errorf("%w: the payment is already fully refunded", ErrInvalidRefund)
+	}
+	if amount.Amount > refundable {
+		return nil, fmt.Errorf("%w: only %s of the payment can still be refunded", ErrInvalidRefund, models.NewMoney(refundable, currency))
+	}
+
+	refundResp, err := gateway.RefundPayment(ctx, &square.RefundPaymentRequest{
+		IdempotencyKey: key,
+		AmountMoney:    squareMoney(amount),
+		PaymentID:      square.String(paymentID),
+		Reason:         square.String(reason),
+	})
+	if err != nil {
+		s.Logger.Error("Failed to refund payment", "error", err, "payment_id", paymentID)
+		return nil, fmt.Errorf("failed to refund payment: %w", err)
+	}
+
+	refund := &models.Refund{
+		RestaurantID:    restaurant.ID,
+		OrderID:         orderID,
+		SquarePaymentID: paymentID,
+		SquareRefundID:  refundResp.Refund.ID,
+		IdempotencyKey:  key,
+		Amount:          moneyFromSquare(refundResp.Refund.AmountMoney, currency),
+		Reason:          reason,
+		Status:          stringValue(refundResp.Refund.Status),
+		StaffID:         staff.ID,
+	}
+	counted := refund.Status != "REJECTED" && refund.Status != "FAILED"
+	if counted {
+		order.Totals.Refunded = order.Totals.Refunded.Add(refund.Amount)
+	}
+	// Giving back everything that was paid refunds the order, smaller refunds leave it as it is
+	paid := order.Totals.Paid.Add(order.Totals.Tips)
+	if order.Totals.Refunded.Amount >= paid.Amount && order.State.CanTransition(models.OrderStateRefunded) {
+		recordTransition(order, models.OrderStateRefunded, staff.ID, reason)
+	}
+
+	// Amounts are set rather than added to, a webhook for the refund may have stored them already
+	refunded := moneyFromSquare(payment.RefundedMoney, currency).Amount
+	if counted {
+		refunded += refund.Amount.Amount
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "square_refund_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"idempotency_key", "reason", "staff_id"}),
+		}).Create(refund).Error
+		if err != nil {
+			return err
+		}
+		if counted {
+			err := tx.Model(&models.Payment{}).
+				Where(&models.Payment{RestaurantID: restaurant.ID, SquarePaymentID: paymentID}).
+				Updates(map[string]any{
+					"refunded_amount":   refunded,
+					"refunded_currency": currency,
+				}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Save(order).Error
+	})
+	if err != nil {
+		// Square has made the refund, the log has what is needed to record it
+		s.Logger.Error("Failed to save refund", "error", err, "order_id", orderID, "refund_id", refund.SquareRefundID)
+		return nil, fmt.Errorf("failed to save refund: %w", err)
+	}
+
+	s.Logger.Info("Payment refunded", "order_id", orderID, "payment_id", paymentID, "amount", refund.Amount.String())
+	return refund, nil
+}
+
+// ListRefunds returns the refunds of an order, oldest first
+func (s *SquareService) ListRefunds(ctx context.Context, restaurant models.Restaurant, location models.Location, orderID string) ([]models.Refund, error) {
+	if _, err := s.loadOrder(restaurant, location, orderID); err != nil {
+		return nil, err
+	}
+
+	var refunds []models.Refund
+	if err := s.db.Where(&models.Refund{RestaurantID: restaurant.ID, OrderID: orderID}).Order("id").Find(&refunds).Error; err != nil {
+		s.Logger.Error("Failed to list refunds", "error", err, "order_id", orderID)
+		return nil, fmt.Errorf("failed to list refunds: %w", err)
+	}
+	return refunds, nil
+}
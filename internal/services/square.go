@@ -3,16 +3,26 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/sasirura/restaurant-api/internal/logger"
 	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
 	"github.com/square/square-go-sdk"
-	"github.com/square/square-go-sdk/client"
 	"gorm.io/gorm"
 )
 
+var (
+	// ErrInvalidOrder is returned for order requests that fail validation
+	ErrInvalidOrder = errors.New("invalid order")
+	// ErrInvalidPayment is returned for payment requests that fail validation
+	ErrInvalidPayment = errors.New("invalid payment")
+	// ErrOrderNotFound is returned for orders that do not exist at the location
+	ErrOrderNotFound = errors.New("order not found")
+)
+
 type SquareService struct {
 	db     *gorm.DB
 	Logger *logger.Logger
@@ -35,69 +45,108 @@ func New(db *gorm.DB, log *logger.Logger) *SquareService {
 }
 
 // CreateOrder creates a new order
-func (s *SquareService) CreateOrder(ctx context.Context, restaurant models.Restaurant, client *client.Client, tableNumber string, items []models.OrderItem) (*models.Order, error) {
+func (s *SquareService) CreateOrder(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway, staff models.Staff, req models.OrderRequest) (*models.Order, error) {
 
-	// OrderRequst
-	lineItems := make([]*square.OrderLineItem, len(items))
-	for i, item := range items {
-		quantity := fmt.Sprintf("%d", item.Quantity)
-		lineItems[i] = &square.OrderLineItem{
-			Name:     &item.Name,
-			Quantity: quantity,
-			BasePriceMoney: &square.Money{
-				Amount:   square.Int64(int64(item.UnitPrice)),
-				Currency: square.CurrencyUsd.Ptr(),
-			},
+	currency := location.Currency
+	if currency == "" {
+		return nil, ErrNoCurrency
+	}
+	if err := s.applyMenu(restaurant, location, staff, req.Items); err != nil {
+		return nil, err
+	}
+	if err := validateOrderRequest(&req, currency); err != nil {
+		return nil, err
+	}
+
+	taxes, charges, err := loadPricing(s.db, restaurant.ID)
+	if err != nil {
+		s.Logger.Error("Failed to load pricing rules", "error", err, "restaurant_id", restaurant.ID)
+		return nil, err
+	}
+	for _, charge := range charges {
+		if charge.Percentage == "" && charge.Amount.Currency != currency {
+			return nil, fmt.Errorf("%w: service charge %q is in %s, not in the location's currency %s", ErrInvalidOrder, charge.Name, charge.Amount.Currency, currency)
 		}
 	}
 
+	// A retried request sends Square the same key and UIDs, Square answers with the order it already made
+	key := orderIdempotencyKey(restaurant, location, req.IdempotencyKey)
+	assignUIDs(req.Items, req.Discounts, squareUIDs(key))
+
+	// OrderRequst
 	createOrderReq := &square.CreateOrderRequest{
-		Order: &square.Order{
-			LocationID: restaurant.LocationID,
-			LineItems:  lineItems,
-		},
+		Order:          squareOrder(location.SquareLocationID, req, taxes, charges),
+		IdempotencyKey: square.String(key),
+	}
+	initial := models.OrderStateOpen
+	if req.Draft {
+		initial = models.OrderStateDraft
+		createOrderReq.Order.State = square.OrderStateDraft.Ptr()
 	}
 
-	resp, err := client.Orders.Create(ctx, createOrderReq)
+	resp, err := gateway.CreateOrder(ctx, createOrderReq)
 	if err != nil {
 		s.Logger.Error("Failed to create square order", "error", err, "restaurant_id", restaurant.ID)
 		return nil, fmt.Errorf("failed to create square order: %w", err)
 	}
+	// The first attempt may have been saved before its response was lost
+	var stored int64
+	if err := s.db.Model(&models.Order{}).Where(&models.Order{ID: *resp.Order.ID, RestautantID: restaurant.ID}).Count(&stored).Error; err != nil {
+		return nil, fmt.Errorf("failed to look up order: %w", err)
+	}
+	if stored > 0 {
+		return s.loadOrder(restaurant, location, *resp.Order.ID)
+	}
+	applySquareAmounts(req.Items, req.Discounts, resp.Order, currency)
 
-	totalPaidAmount := *resp.Order.TotalMoney.Amount - *resp.Order.NetAmountDueMoney.Amount
+	total := moneyFromSquare(resp.Order.TotalMoney, currency)
+	due := moneyFromSquare(resp.Order.NetAmountDueMoney, currency)
 	order := &models.Order{
 		ID:           *resp.Order.ID,
 		RestautantID: restaurant.ID,
-		TableNumber:  tableNumber,
-		IsClosed:     *resp.Order.State == square.OrderStateCompleted,
-		Items:        items,
+		LocationID:   location.SquareLocationID,
+		Currency:     currency,
+		StaffID:      staff.ID,
+		TableNumber:  req.TableNumber,
+		GuestCount:   req.GuestCount,
+		Version:      squareVersion(resp.Order),
+		Items:        req.Items,
+		Discounts:    req.Discounts,
 		OpenAt:       time.Now(),
 		Totals: models.OrderTotals{
-			OrderID:   *resp.Order.ID,
-			Discounts: float64(*resp.Order.TotalDiscountMoney.Amount),
-			Due:       float64(*resp.Order.NetAmountDueMoney.Amount),
-			Paid:      float64(totalPaidAmount),
-			Tips:      float64(*resp.Order.TotalTipMoney.Amount),
-			Total:     float64(*resp.Order.TotalMoney.Amount),
+			OrderID:       *resp.Order.ID,
+			Discounts:     moneyFromSquare(resp.Order.TotalDiscountMoney, currency),
+			Due:           due,
+			Tax:           moneyFromSquare(resp.Order.TotalTaxMoney, currency),
+			ServiceCharge: moneyFromSquare(resp.Order.TotalServiceChargeMoney, currency),
+			Paid:          models.NewMoney(total.Amount-due.Amount, currency),
+			Tips:          moneyFromSquare(resp.Order.TotalTipMoney, currency),
+			Total:         total,
 		},
 	}
+	if err := transition(order, initial, staff.ID, ""); err != nil {
+		return nil, err
+	}
+	syncState(order, resp.Order)
 
 	err = s.db.Create(order).Error
 	if err != nil {
 		s.Logger.Error("Failed to save order to database", "error", err, "order_id", order.ID)
+		return nil, fmt.Errorf("failed to save order: %w", err)
 	}
 
-	s.Logger.Info("Order created", "order_id", order.ID, "restautant_id", restaurant.ID)
+	s.Logger.Info("Order created", "order_id", order.ID, "restautant_id", restaurant.ID, "location_id", location.SquareLocationID)
 	return order, nil
 }
 
-// GetOrdersByTable retrieves orders by table number
-func (s *SquareService) GetOrdersByTable(ctx context.Context, restaurant models.Restaurant, tableNumber string) ([]models.Order, error) {
+// GetOrdersByTable retrieves orders by table number at a location
+func (s *SquareService) GetOrdersByTable(ctx context.Context, restaurant models.Restaurant, location models.Location, tableNumber string) ([]models.Order, error) {
 	var orders []models.Order
 	if err := s.db.Where(&models.Order{
 		RestautantID: restaurant.ID,
+		LocationID:   location.SquareLocationID,
 		TableNumber:  tableNumber,
-	}).Preload("Items").Preload("Totals").Find(&orders).Error; err != nil {
+	}).Preload("Items.Modifiers").Preload("Items.Discounts").Preload("Discounts").Preload("Totals").Preload("Transitions").Preload("Checks").Find(&orders).Error; err != nil {
 		s.Logger.Error("Failed to fetch orders by table", "error", err, "table_number", tableNumber)
 		return nil, fmt.Errorf("failed to fetch orders: %w", err)
 	}
@@ -105,13 +154,14 @@ func (s *SquareService) GetOrdersByTable(ctx context.Context, restaurant models.
 	return orders, nil
 }
 
-// GetOrderByID retrieves an order by ID
-func (s *SquareService) GetOrderByID(ctx context.Context, restaurant models.Restaurant, orderID string) (*models.Order, error) {
+// GetOrderByID retrieves an order by ID at a location
+func (s *SquareService) GetOrderByID(ctx context.Context, restaurant models.Restaurant, location models.Location, orderID string) (*models.Order, error) {
 	var order models.Order
 	if err := s.db.Where(&models.Order{
 		ID:           orderID,
 		RestautantID: restaurant.ID,
-	}).Preload("Items").Preload("Totals").First(&order).Error; err != nil {
+		LocationID:   location.SquareLocationID,
+	}).Preload("Items.Modifiers").Preload("Items.Discounts").Preload("Discounts").Preload("Totals").Preload("Transitions").Preload("Checks").First(&order).Error; err != nil {
 		s.Logger.Error("Failed to fetch order by ID", "error", err, "order_id", orderID)
 		return nil, fmt.Errorf("order not found: %w", err)
 	}
@@ -120,61 +170,151 @@ func (s *SquareService) GetOrderByID(ctx context.Context, restaurant models.Rest
 	return &order, nil
 }
 
-// ProcessPayment processes a payment for an order
-func (s *SquareService) ProcessPayment(ctx context.Context, restaurant models.Restaurant, client *client.Client, orderID string, req models.PaymentRequest) error {
+// ProcessPayment processes a payment for an order. The payment is recorded as processing before Square is asked
+// to take it, so a payment Square took is never lost. Retrying with the same paymentId returns the payment that
+// was already taken, or asks Square again while it is still processing
+func (s *SquareService) ProcessPayment(ctx context.Context, restaurant models.Restaurant, location models.Location, gateway pos.Gateway, staff models.Staff, orderID string, req models.PaymentRequest) (*models.Payment, error) {
+	var order models.Order
+	if err := s.db.Where(&models.Order{
+		ID:           orderID,
+		RestautantID: restaurant.ID,
+		LocationID:   location.SquareLocationID,
+	}).Preload("Totals").Preload("Checks").First(&order).Error; err != nil {
+		s.Logger.Error("Order not found in database", "error", err, "order_id", orderID)
+		return nil, fmt.Errorf("%w: %v", ErrOrderNotFound, err)
+	}
+
+	if req.PaymentID == "" {
+		return nil, fmt.Errorf("%w: paymentId is required", ErrInvalidPayment)
+	}
+	var payment *models.Payment
+	var existing models.Payment
+	err := s.db.Where(&models.Payment{RestaurantID: restaurant.ID, IdempotencyKey: req.PaymentID}).First(&existing).Error
+	if err == nil {
+		if existing.OrderID != orderID {
+			return nil, fmt.Errorf("%w: paymentId was already used for another order", ErrInvalidPayment)
+		}
+		if existing.Status == models.PaymentFailed {
+			return nil, fmt.Errorf("%w: payment %s failed, retry with a new paymentId", ErrInvalidPayment, req.PaymentID)
+		}
+		if existing.Status != models.PaymentProcessing {
+			return &existing, nil
+		}
+		payment = &existing
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to look up payment: %w", err)
+	}
+
+	if !order.State.CanTransition(models.OrderStatePaid) {
+		return nil, fmt.Errorf("%w: a %s order cannot be paid", ErrIllegalTransition, order.State)
+	}
+
+	// Payments are charged in the currency the order was created in
+	currency := order.Currency
+	if err := checkMoney("billAmount", &req.BillAmount, currency); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayment, err)
+	}
+	if err := checkMoney("tipAmount", &req.TipAmount, currency); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayment, err)
+	}
+	if req.BillAmount.Amount == 0 {
+		return nil, fmt.Errorf("%w: billAmount must be positive", ErrInvalidPayment)
+	}
 
 	// Create payment request
 	paymentReq := &square.CreatePaymentRequest{
 		IdempotencyKey: req.PaymentID,
-		SourceID:       "CASH",
 		OrderID:        &orderID,
-		AmountMoney: &square.Money{
-			Amount:   square.Int64(int64(req.BillAmount)),
-			Currency: square.CurrencyUsd.Ptr(),
-		},
-		TipMoney: &square.Money{
-			Amount:   square.Int64(int64(req.TipAmount)),
-			Currency: square.CurrencyUsd.Ptr(),
-		},
-		CashDetails: &square.CashPaymentDetails{
-			BuyerSuppliedMoney: &square.Money{
-				Amount:   square.Int64(int64(req.BillAmount)),
-				Currency: square.CurrencyUsd.Ptr(),
-			},
-		},
-		LocationID: &restaurant.LocationID,
+		AmountMoney:    squareMoney(req.BillAmount),
+		TipMoney:       squareMoney(req.TipAmount),
+		LocationID:     square.String(location.SquareLocationID),
 	}
-
-	resp, err := client.Payments.Create(ctx, paymentReq)
+	change, err := applyTender(paymentReq, &req, currency)
 	if err != nil {
-		s.Logger.Error("Failed to process payment", "error", err, "order_id", orderID)
-		return fmt.Errorf("failed to process payment: %w", err)
+		return nil, err
 	}
 
-	// Update order in database
-	var order models.Order
-	if err := s.db.Where(&models.Order{
-		ID: orderID,
-	}).First(&order).Error; err != nil {
-		s.Logger.Error("Order not found in database", "error", err, "order_id", orderID)
-		return fmt.Errorf("order not found: %w", err)
-	}
+	// Payments of an order are recorded one at a time with the order locked, so concurrent payments
+	// cannot pay more than is left on a check
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockOrder(tx, restaurant.ID, orderID)
+		if err != nil {
+			return err
+		}
+		var reserved int64
+		if req.CheckID != 0 {
+			processing := tx.Model(&models.Payment{}).
+				Where("order_id = ? AND check_id = ? AND status = ?", orderID, req.CheckID, models.PaymentProcessing)
+			if payment != nil {
+				processing = processing.Where("id <> ?", payment.ID)
+			}
+			if err := processing.Select("COALESCE(SUM(amount_amount), 0)").Scan(&reserved).Error; err != nil {
+				return err
+			}
+		}
+		check, err := payableCheck(locked, req, reserved)
+		if err != nil {
+			return err
+		}
 
-	if resp.Payment.AmountMoney != nil {
-		order.Totals.Paid += float64(*resp.Payment.AmountMoney.Amount)
+		var checkID uint
+		if check != nil {
+			checkID = check.ID
+		}
+		if payment != nil {
+			if payment.CheckID != checkID || payment.TenderType != string(req.TenderType) ||
+				payment.Amount != req.BillAmount || payment.Tip != req.TipAmount {
+				// Square refuses a retried payment that differs from the first attempt
+				return fmt.Errorf("%w: paymentId was already used for a different payment", ErrInvalidPayment)
+			}
+			return nil
+		}
+		payment = &models.Payment{
+			RestaurantID:   restaurant.ID,
+			LocationID:     location.SquareLocationID,
+			OrderID:        orderID,
+			CheckID:        checkID,
+			IdempotencyKey: req.PaymentID,
+			TenderType:     string(req.TenderType),
+			Amount:         req.BillAmount,
+			Tip:            req.TipAmount,
+			Refunded:       models.NewMoney(0, currency),
+			Change:         change,
+			Status:         models.PaymentProcessing,
+			StaffID:        staff.ID,
+		}
+		return tx.Create(payment).Error
+	})
+	if errors.Is(err, ErrInvalidPayment) || errors.Is(err, ErrCheckNotFound) {
+		return nil, err
 	}
-	if resp.Payment.TipMoney != nil {
-		order.Totals.Tips += float64(*resp.Payment.TipMoney.Amount)
+	if err != nil {
+		s.Logger.Error("Failed to record payment", "error", err, "order_id", orderID)
+		return nil, fmt.Errorf("failed to record payment: %w", err)
 	}
-	if order.Totals.Paid >= order.Totals.Due {
-		order.IsClosed = true
+	paymentReq.ReferenceID = square.String(paymentReference(payment))
+
+	resp, err := gateway.CreatePayment(ctx, paymentReq)
+	if errors.Is(err, pos.ErrRejected) || errors.Is(err, pos.ErrNotFound) || errors.Is(err, pos.ErrUnauthorized) {
+		s.Logger.Error("Failed to process payment", "error", err, "order_id", orderID)
+		if err := s.failPayment(payment); err != nil {
+			s.Logger.Error("Failed to mark payment failed", "error", err, "payment_id", req.PaymentID)
+		}
+		return nil, fmt.Errorf("failed to process payment: %w", err)
+	}
+	if err != nil {
+		// Square may have taken the payment, retrying or the reconciler finds out
+		s.Logger.Error("Payment outcome unknown", "error", err, "order_id", orderID, "payment_id", req.PaymentID)
+		return payment, fmt.Errorf("%w: %v", ErrPaymentProcessing, err)
 	}
 
-	if err := s.db.Save(&order).Error; err != nil {
+	payment, err = s.finalizePayment(ctx, gateway, payment.ID, resp.Payment)
+	if err != nil {
+		// The payment stays processing until the reconciler stores it
 		s.Logger.Error("Failed to update order in database", "error", err, "order_id", orderID)
-		return fmt.Errorf("failed to update order: %w", err)
+		return nil, fmt.Errorf("failed to update order: %w", err)
 	}
 
-	s.Logger.Info("Payment processed", "order_id", orderID, "payment_id", req.PaymentID)
-	return nil
+	s.Logger.Info("Payment processed", "order_id", orderID, "payment_id", req.PaymentID, "amount", req.BillAmount.String())
+	return payment, nil
 }
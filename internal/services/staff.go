@@ -0,0 +1,390 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sasirura/restaurant-api/internal/auth"
+	"github.com/sasirura/restaurant-api/internal/keyring"
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxFailedLogins = 5
+	lockoutDuration = 15 * time.Minute
+	minPasswordLen  = 10
+)
+
+var (
+	ErrInvalidStaff       = errors.New("invalid staff member")
+	ErrStaffNotFound      = errors.New("staff member not found")
+	ErrForbidden          = errors.New("not allowed")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrStaffLocked        = errors.New("too many failed logins, try again later")
+	ErrSessionInvalid     = errors.New("staff session invalid or expired")
+	ErrLoginRequired      = errors.New("staff login required")
+)
+
+// StaffInput creates or changes a staff member, nil fields are left untouched
+type StaffInput struct {
+	Name     *string `json:"name"`
+	Username *string `json:"username"`
+	Role     *string `json:"role"`
+	PIN      *string `json:"pin"`
+	Password *string `json:"password"`
+	Tables   *string `json:"tables"`
+	Active   *bool   `json:"active"`
+}
+
+// LoginRequest identifies a staff member by ID and PIN or by username and password
+type LoginRequest struct {
+	StaffID  uint   `json:"staffId"`
+	PIN      string `json:"pin"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// StaffService manages staff accounts and their login sessions
+type StaffService struct {
+	db         *gorm.DB
+	keys       *keyring.Keyring
+	sessionTTL time.Duration
+	Logger     *logger.Logger
+}
+
+func NewStaff(db *gorm.DB, keys *keyring.Keyring, sessionTTL time.Duration, log *logger.Logger) *StaffService {
+	return &StaffService{
+		db:         db,
+		keys:       keys,
+		sessionTTL: sessionTTL,
+		Logger:     log,
+	}
+}
+
+// CanOpenTable reports whether the staff member may open orders for a table
+func CanOpenTable(staff models.Staff, tableNumber string) bool {
+	if auth.Role(staff.Role) != auth.RoleServer || strings.TrimSpace(staff.Tables) == "" {
+		return true
+	}
+	for _, table := range strings.Split(staff.Tables, ",") {
+		if strings.TrimSpace(table) == tableNumber {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns every staff member of the restaurant
+func (s *StaffService) List(ctx context.Context, restaurant models.Restaurant) ([]models.Staff, error) {
+	var staff []models.Staff
+	if err := s.db.Where(&models.Staff{RestaurantID: restaurant.ID}).Order("id").Find(&staff).Error; err != nil {
+		s.Logger.Error("Failed to list staff", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to list staff: %w", err)
+	}
+	return staff, nil
+}
+
+// Create adds a staff member. Actor is nil only when creating the first admin of a restaurant, which is checked
+// under a lock on the restaurant so that only one request can claim it
+func (s *StaffService) Create(ctx context.Context, restaurant models.Restaurant, actor *models.Staff, input StaffInput) (*models.Staff, error) {
+	if input.Name == nil || strings.TrimSpace(*input.Name) == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidStaff)
+	}
+	if input.Role == nil {
+		return nil, fmt.Errorf("%w: role is required", ErrInvalidStaff)
+	}
+	if input.PIN == nil && input.Password == nil {
+		return nil, fmt.Errorf("%w: a pin or password is required", ErrInvalidStaff)
+	}
+
+	staff := &models.Staff{
+		RestaurantID: restaurant.ID,
+		Active:       true,
+	}
+	if err := s.apply(staff, actor, input); err != nil {
+		return nil, err
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if actor == nil {
+			// The restaurant row is locked so that two requests cannot both create the first admin
+			var locked models.Restaurant
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&locked, restaurant.ID).Error; err != nil {
+				return err
+			}
+			var count int64
+			if err := tx.Model(&models.Staff{}).Where(&models.Staff{RestaurantID: restaurant.ID}).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrLoginRequired
+			}
+			if auth.Role(staff.Role) != auth.RoleAdmin {
+				return fmt.Errorf("%w: the first staff member must be an admin", ErrInvalidStaff)
+			}
+		}
+		return tx.Create(staff).Error
+	})
+	if errors.Is(err, ErrLoginRequired) || errors.Is(err, ErrInvalidStaff) {
+		return nil, err
+	}
+	if err != nil {
+		s.Logger.Error("Failed to create staff", "error", err, "restaurant_id", restaurant.ID)
+		return nil, fmt.Errorf("failed to create staff: %w", err)
+	}
+
+	s.Logger.Info("Staff created", "restaurant_id", fmt.Sprintf("%d", restaurant.ID), "staff_id", fmt.Sprintf("%d", staff.ID), "role", staff.Role)
+	return staff, nil
+}
+
+// Update changes a staff member of the restaurant
+func (s *StaffService) Update(ctx context.Context, restaurant models.Restaurant, actor models.Staff, id uint, input StaffInput) (*models.Staff, error) {
+	staff, err := s.get(restaurant, id)
+	if err != nil {
+		return nil, err
+	}
+	if !auth.Role(actor.Role).CanManage(auth.Role(staff.Role)) {
+		return nil, ErrForbidden
+	}
+
+	if err := s.apply(staff, &actor, input); err != nil {
+		return nil, err
+	}
+
+	// Deactivated staff and staff whose PIN or password changed are logged out everywhere
+	logout := !staff.Active || input.PIN != nil || input.Password != nil
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(staff).Error; err != nil {
+			return err
+		}
+		if !logout {
+			return nil
+		}
+		return tx.Model(&models.StaffSession{}).
+			Where("staff_id = ? AND revoked_at IS NULL", staff.ID).
+			Update("revoked_at", time.Now()).Error
+	})
+	if err != nil {
+		s.Logger.Error("Failed to update staff", "error", err, "staff_id", id)
+		return nil, fmt.Errorf("failed to update staff: %w", err)
+	}
+
+	s.Logger.Info("Staff updated", "staff_id", fmt.Sprintf("%d", staff.ID), "actor_id", fmt.Sprintf("%d", actor.ID))
+	return staff, nil
+}
+
+// Login checks the credentials and starts a session, returning its token
+func (s *StaffService) Login(ctx context.Context, restaurant models.Restaurant, req LoginRequest) (string, *models.StaffSession, *models.Staff, error) {
+	var staff models.Staff
+	query := s.db.Where(&models.Staff{RestaurantID: restaurant.ID})
+	switch {
+	case req.StaffID != 0 && req.PIN != "":
+		query = query.Where("id = ?", req.StaffID)
+	case req.Username != "" && req.Password != "":
+		query = query.Where("username = ?", req.Username)
+	default:
+		return "", nil, nil, ErrInvalidCredentials
+	}
+	if err := query.First(&staff).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", nil, nil, ErrInvalidCredentials
+		}
+		return "", nil, nil, fmt.Errorf("failed to look up staff: %w", err)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, nil, err
+	}
+	token := "ss_" + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	session := &models.StaffSession{
+		StaffID:      staff.ID,
+		RestaurantID: restaurant.ID,
+		TokenHash:    s.keys.Hash(token),
+		ExpiresAt:    now.Add(s.sessionTTL),
+	}
+	failed := false
+	// The staff row stays locked while the credentials are checked, so parallel guesses are counted one at a time
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&staff, staff.ID).Error; err != nil {
+			return err
+		}
+		if !staff.Active {
+			return ErrInvalidCredentials
+		}
+		if staff.LockedUntil != nil && now.Before(*staff.LockedUntil) {
+			return ErrStaffLocked
+		}
+
+		hash, secret := staff.PINHash, req.PIN
+		if req.PIN == "" {
+			hash, secret = staff.PasswordHash, req.Password
+		}
+		if len(hash) == 0 || bcrypt.CompareHashAndPassword(hash, []byte(secret)) != nil {
+			failed = true
+			staff.FailedLogins++
+			if staff.FailedLogins >= maxFailedLogins {
+				lockedUntil := now.Add(lockoutDuration)
+				staff.LockedUntil = &lockedUntil
+				staff.FailedLogins = 0
+				s.Logger.Info("Staff locked out", "staff_id", fmt.Sprintf("%d", staff.ID))
+			}
+			return tx.Model(&staff).Select("failed_logins", "locked_until").Updates(&staff).Error
+		}
+
+		if err := tx.Create(session).Error; err != nil {
+			return err
+		}
+		return tx.Model(&staff).Updates(map[string]any{
+			"failed_logins": 0,
+			"locked_until":  nil,
+			"last_login_at": now,
+		}).Error
+	})
+	if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrStaffLocked) {
+		return "", nil, nil, err
+	}
+	if failed {
+		if err != nil {
+			s.Logger.Error("Failed to record failed login", "error", err, "staff_id", staff.ID)
+		}
+		return "", nil, nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		s.Logger.Error("Failed to start staff session", "error", err, "staff_id", staff.ID)
+		return "", nil, nil, fmt.Errorf("failed to start session: %w", err)
+	}
+
+	s.Logger.Info("Staff logged in", "staff_id", fmt.Sprintf("%d", staff.ID), "restaurant_id", fmt.Sprintf("%d", restaurant.ID))
+	return token, session, &staff, nil
+}
+
+// Logout ends the session of token
+func (s *StaffService) Logout(ctx context.Context, token string) error {
+	if err := s.db.Model(&models.StaffSession{}).
+		Where("token_hash = ? AND revoked_at IS NULL", s.keys.Hash(token)).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		s.Logger.Error("Failed to end staff session", "error", err)
+		return fmt.Errorf("failed to end session: %w", err)
+	}
+	return nil
+}
+
+// Authenticate returns the active staff member logged in with token at the restaurant
+func (s *StaffService) Authenticate(ctx context.Context, restaurant models.Restaurant, token string) (*models.Staff, error) {
+	var session models.StaffSession
+	err := s.db.Where("token_hash = ? AND restaurant_id = ? AND revoked_at IS NULL AND expires_at > ?",
+		s.keys.Hash(token), restaurant.ID, time.Now()).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up session: %w", err)
+	}
+
+	var staff models.Staff
+	if err := s.db.First(&staff, session.StaffID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load staff: %w", err)
+	}
+	if !staff.Active {
+		return nil, ErrSessionInvalid
+	}
+	return &staff, nil
+}
+
+func (s *StaffService) get(restaurant models.Restaurant, id uint) (*models.Staff, error) {
+	var staff models.Staff
+	err := s.db.Where(&models.Staff{RestaurantID: restaurant.ID}).First(&staff, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrStaffNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load staff: %w", err)
+	}
+	return &staff, nil
+}
+
+// apply validates input and copies it onto staff
+func (s *StaffService) apply(staff *models.Staff, actor *models.Staff, input StaffInput) error {
+	if input.Name != nil {
+		name := strings.TrimSpace(*input.Name)
+		if name == "" {
+			return fmt.Errorf("%w: name must not be empty", ErrInvalidStaff)
+		}
+		staff.Name = name
+	}
+	if input.Username != nil {
+		username := strings.TrimSpace(*input.Username)
+		if username == "" {
+			staff.Username = nil
+		} else {
+			staff.Username = &username
+		}
+	}
+	if input.Role != nil {
+		role := auth.Role(*input.Role)
+		if !role.Valid() {
+			return fmt.Errorf("%w: unknown role %q", ErrInvalidStaff, *input.Role)
+		}
+		if actor != nil && !auth.Role(actor.Role).CanManage(role) {
+			return ErrForbidden
+		}
+		staff.Role = string(role)
+	}
+	if input.PIN != nil {
+		if !validPIN(*input.PIN) {
+			return fmt.Errorf("%w: pin must be 4 to 8 digits", ErrInvalidStaff)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(*input.PIN), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		staff.PINHash = hash
+	}
+	if input.Password != nil {
+		if len(*input.Password) < minPasswordLen {
+			return fmt.Errorf("%w: password must be at least %d characters", ErrInvalidStaff, minPasswordLen)
+		}
+		if staff.Username == nil {
+			return fmt.Errorf("%w: a username is required to log in with a password", ErrInvalidStaff)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(*input.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		staff.PasswordHash = hash
+	}
+	if input.Tables != nil {
+		staff.Tables = strings.TrimSpace(*input.Tables)
+	}
+	if input.Active != nil {
+		if actor != nil && actor.ID == staff.ID && !*input.Active {
+			return fmt.Errorf("%w: staff cannot deactivate themselves", ErrInvalidStaff)
+		}
+		staff.Active = *input.Active
+	}
+	return nil
+}
+
+func validPIN(pin string) bool {
+	if len(pin) < 4 || len(pin) > 8 {
+		return false
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
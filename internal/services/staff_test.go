@@ -0,0 +1,45 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+)
+
+func TestCanOpenTable(t *testing.T) {
+	tests := []struct {
+		role   string
+		tables string
+		table  string
+		want   bool
+	}{
+		{"server", "", "12", true},
+		{"server", "1, 2,12", "12", true},
+		{"server", "1,2", "12", false},
+		{"server", "1,2", "", false},
+		{"manager", "1,2", "12", true},
+		{"cashier", "1", "12", true},
+	}
+
+	for _, tt := range tests {
+		staff := models.Staff{Role: tt.role, Tables: tt.tables}
+		if got := CanOpenTable(staff, tt.table); got != tt.want {
+			t.Errorf("%s with tables %q opening %q = %v, want %v", tt.role, tt.tables, tt.table, got, tt.want)
+		}
+	}
+}
+
+func TestValidPIN(t *testing.T) {
+	for pin, want := range map[string]bool{
+		"1234":      true,
+		"12345678":  true,
+		"123":       false,
+		"123456789": false,
+		"12a4":      false,
+		"":          false,
+	} {
+		if got := validPIN(pin); got != want {
+			t.Errorf("validPIN(%q) = %v, want %v", pin, got, want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/square/square-go-sdk"
+)
+
+// externalPaymentTypes are the types Square accepts for payments taken outside of it
+var externalPaymentTypes = []string{
+	"CHECK", "BANK_TRANSFER", "OTHER_GIFT_CARD", "CRYPTO", "SQUARE_CASH", "SOCIAL",
+	"EXTERNAL", "EMONEY", "CARD", "STORED_BALANCE", "FOOD_VOUCHER", "OTHER",
+}
+
+// applyTender validates the tender of a payment request and sets the matching source on the Square request.
+// For cash it returns the change due to the guest
+func applyTender(paymentReq *square.CreatePaymentRequest, req *models.PaymentRequest, currency string) (models.Money, error) {
+	change := models.NewMoney(0, currency)
+	if req.TenderType == "" {
+		req.TenderType = models.TenderCash
+	}
+	req.SourceID = strings.TrimSpace(req.SourceID)
+	if req.TenderType != models.TenderCash && req.BuyerSupplied.Amount != 0 {
+		return change, fmt.Errorf("%w: buyerSupplied is only used for cash", ErrInvalidPayment)
+	}
+	if req.TenderType != models.TenderExternal && req.External != nil {
+		return change, fmt.Errorf("%w: external is only used for EXTERNAL tenders", ErrInvalidPayment)
+	}
+	if req.TenderType != models.TenderCardOnFile && req.CustomerID != "" {
+		return change, fmt.Errorf("%w: customerId is only used for CARD_ON_FILE tenders", ErrInvalidPayment)
+	}
+
+	switch req.TenderType {
+	case models.TenderCash:
+		if req.SourceID != "" {
+			return change, fmt.Errorf("%w: sourceId is not used for cash", ErrInvalidPayment)
+		}
+		total := req.BillAmount.Add(req.TipAmount)
+		supplied := req.BuyerSupplied
+		if supplied.Amount == 0 {
+			supplied = total
+		}
+		if err := checkMoney("buyerSupplied", &supplied, currency); err != nil {
+			return change, fmt.Errorf("%w: %v", ErrInvalidPayment, err)
+		}
+		if supplied.Amount < total.Amount {
+			return change, fmt.Errorf("%w: buyerSupplied must cover the bill and tip of %s", ErrInvalidPayment, total)
+		}
+		paymentReq.SourceID = "CASH"
+		paymentReq.CashDetails = &square.CashPaymentDetails{
+			BuyerSuppliedMoney: squareMoney(supplied),
+		}
+		change.Amount = supplied.Amount - total.Amount
+
+	case models.TenderCard, models.TenderGiftCard:
+		if req.SourceID == "" {
+			return change, fmt.Errorf("%w: sourceId is required for %s tenders", ErrInvalidPayment, req.TenderType)
+		}
+		paymentReq.SourceID = req.SourceID
+
+	case models.TenderCardOnFile:
+		if req.SourceID == "" || req.CustomerID == "" {
+			return change, fmt.Errorf("%w: sourceId and customerId are required for CARD_ON_FILE tenders", ErrInvalidPayment)
+		}
+		paymentReq.SourceID = req.SourceID
+		paymentReq.CustomerID = square.String(req.CustomerID)
+
+	case models.TenderExternal:
+		if req.SourceID != "" {
+			return change, fmt.Errorf("%w: sourceId is not used for EXTERNAL tenders", ErrInvalidPayment)
+		}
+		if req.External == nil || strings.TrimSpace(req.External.Source) == "" {
+			return change, fmt.Errorf("%w: external.type and external.source are required for EXTERNAL tenders", ErrInvalidPayment)
+		}
+		if !slices.Contains(externalPaymentTypes, req.External.Type) {
+			return change, fmt.Errorf("%w: external.type must be one of %s", ErrInvalidPayment, strings.Join(externalPaymentTypes, ", "))
+		}
+		paymentReq.SourceID = "EXTERNAL"
+		paymentReq.ExternalDetails = &square.ExternalPaymentDetails{
+			Type:   req.External.Type,
+			Source: strings.TrimSpace(req.External.Source),
+		}
+
+	default:
+		return change, fmt.Errorf("%w: unknown tenderType %q", ErrInvalidPayment, req.TenderType)
+	}
+	return change, nil
+}
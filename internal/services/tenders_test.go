@@ -0,0 +1,149 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/square/square-go-sdk"
+)
+
+func TestApplyTender(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        models.PaymentRequest
+		wantErr    bool
+		wantSource string
+		wantChange models.Money
+	}{
+		{
+			name:       "cash defaults to the exact amount",
+			req:        models.PaymentRequest{BillAmount: usd(1200), TipAmount: usd(300)},
+			wantSource: "CASH",
+			wantChange: usd(0),
+		},
+		{
+			name:       "cash with change",
+			req:        models.PaymentRequest{TenderType: models.TenderCash, BillAmount: usd(1200), TipAmount: usd(300), BuyerSupplied: usd(2000)},
+			wantSource: "CASH",
+			wantChange: usd(500),
+		},
+		{
+			name:    "cash short of the tip",
+			req:     models.PaymentRequest{BillAmount: usd(1200), TipAmount: usd(300), BuyerSupplied: usd(1400)},
+			wantErr: true,
+		},
+		{
+			name:    "cash in another currency",
+			req:     models.PaymentRequest{BillAmount: usd(1200), BuyerSupplied: models.NewMoney(2000, "EUR")},
+			wantErr: true,
+		},
+		{
+			name:    "cash with a source",
+			req:     models.PaymentRequest{BillAmount: usd(1200), SourceID: "cnon:card-nonce-ok"},
+			wantErr: true,
+		},
+		{
+			name:       "card",
+			req:        models.PaymentRequest{TenderType: models.TenderCard, BillAmount: usd(1200), SourceID: " cnon:card-nonce-ok "},
+			wantSource: "cnon:card-nonce-ok",
+			wantChange: usd(0),
+		},
+		{
+			name:    "card without a source",
+			req:     models.PaymentRequest{TenderType: models.TenderCard, BillAmount: usd(1200)},
+			wantErr: true,
+		},
+		{
+			name:    "card with cash handed over",
+			req:     models.PaymentRequest{TenderType: models.TenderCard, BillAmount: usd(1200), SourceID: "cnon:card-nonce-ok", BuyerSupplied: usd(2000)},
+			wantErr: true,
+		},
+		{
+			name:       "gift card",
+			req:        models.PaymentRequest{TenderType: models.TenderGiftCard, BillAmount: usd(1200), SourceID: "gftc:gift"},
+			wantSource: "gftc:gift",
+			wantChange: usd(0),
+		},
+		{
+			name:       "card on file",
+			req:        models.PaymentRequest{TenderType: models.TenderCardOnFile, BillAmount: usd(1200), SourceID: "ccof:card", CustomerID: "customer"},
+			wantSource: "ccof:card",
+			wantChange: usd(0),
+		},
+		{
+			name:    "card on file without a customer",
+			req:     models.PaymentRequest{TenderType: models.TenderCardOnFile, BillAmount: usd(1200), SourceID: "ccof:card"},
+			wantErr: true,
+		},
+		{
+			name:    "customer on a card",
+			req:     models.PaymentRequest{TenderType: models.TenderCard, BillAmount: usd(1200), SourceID: "cnon:card-nonce-ok", CustomerID: "customer"},
+			wantErr: true,
+		},
+		{
+			name:       "external",
+			req:        models.PaymentRequest{TenderType: models.TenderExternal, BillAmount: usd(1200), External: &models.ExternalTender{Type: "OTHER_GIFT_CARD", Source: " Giftly "}},
+			wantSource: "EXTERNAL",
+			wantChange: usd(0),
+		},
+		{
+			name:    "external of an unknown type",
+			req:     models.PaymentRequest{TenderType: models.TenderExternal, BillAmount: usd(1200), External: &models.ExternalTender{Type: "IOU", Source: "Giftly"}},
+			wantErr: true,
+		},
+		{
+			name:    "external without a source",
+			req:     models.PaymentRequest{TenderType: models.TenderExternal, BillAmount: usd(1200), External: &models.ExternalTender{Type: "CHECK"}},
+			wantErr: true,
+		},
+		{
+			name:    "external details on cash",
+			req:     models.PaymentRequest{BillAmount: usd(1200), External: &models.ExternalTender{Type: "CHECK", Source: "Bank"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown tender",
+			req:     models.PaymentRequest{TenderType: "BARTER", BillAmount: usd(1200)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paymentReq square.CreatePaymentRequest
+			change, err := applyTender(&paymentReq, &tt.req, "USD")
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidPayment) {
+					t.Fatalf("err = %v, want ErrInvalidPayment", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyTender: %v", err)
+			}
+			if paymentReq.SourceID != tt.wantSource {
+				t.Errorf("source %q, want %q", paymentReq.SourceID, tt.wantSource)
+			}
+			if change != tt.wantChange {
+				t.Errorf("change %s, want %s", change, tt.wantChange)
+			}
+
+			switch tt.req.TenderType {
+			case models.TenderCash:
+				supplied := paymentReq.CashDetails.BuyerSuppliedMoney
+				if want := tt.req.BillAmount.Amount + tt.req.TipAmount.Amount + change.Amount; *supplied.Amount != want {
+					t.Errorf("buyer supplied %d, want %d", *supplied.Amount, want)
+				}
+			case models.TenderCardOnFile:
+				if paymentReq.CustomerID == nil || *paymentReq.CustomerID != tt.req.CustomerID {
+					t.Errorf("customer %v, want %q", paymentReq.CustomerID, tt.req.CustomerID)
+				}
+			case models.TenderExternal:
+				if details := paymentReq.ExternalDetails; details.Type != tt.req.External.Type || details.Source != "Giftly" {
+					t.Errorf("external details %+v, want %s from Giftly", details, tt.req.External.Type)
+				}
+			}
+		})
+	}
+}
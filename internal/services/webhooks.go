@@ -0,0 +1,361 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sasirura/restaurant-api/internal/keyring"
+	"github.com/sasirura/restaurant-api/internal/logger"
+	"github.com/sasirura/restaurant-api/internal/models"
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrInvalidSignature is returned for webhook notifications Square did not sign
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrInvalidWebhook is returned for webhook notifications that cannot be read
+	ErrInvalidWebhook = errors.New("invalid webhook notification")
+)
+
+// squareEvent is the body of a Square webhook notification
+type squareEvent struct {
+	MerchantID string `json:"merchant_id"`
+	Type       string `json:"type"`
+	EventID    string `json:"event_id"`
+	Data       struct {
+		Type   string          `json:"type"`
+		ID     string          `json:"id"`
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// WebhookService applies changes made in Square, e.g. orders paid on a terminal, to the stored orders, payments and menus
+type WebhookService struct {
+	db        *gorm.DB
+	orders    *SquareService
+	menu      *MenuService
+	connector pos.Connector
+	keys      *keyring.Keyring
+	// environment is the Square environment of the subscription, only its restaurants get its events
+	environment pos.Environment
+	// signatureKey and notificationURL are those of the webhook subscription, Square signs both with the body
+	signatureKey    string
+	notificationURL string
+	Logger          *logger.Logger
+}
+
+func NewWebhooks(db *gorm.DB, orders *SquareService, menu *MenuService, connector pos.Connector, keys *keyring.Keyring, environment pos.Environment, signatureKey, notificationURL string, log *logger.Logger) *WebhookService {
+	return &WebhookService{
+		db:              db,
+		orders:          orders,
+		menu:            menu,
+		connector:       connector,
+		keys:            keys,
+		environment:     environment,
+		signatureKey:    signatureKey,
+		notificationURL: notificationURL,
+		Logger:          log,
+	}
+}
+
+// Verify checks the signature Square sends with a notification, a base64 HMAC-SHA256 of the notification URL and body
+func (s *WebhookService) Verify(body []byte, signature string) error {
+	if signature == "" {
+		return fmt.Errorf("%w: signature is missing", ErrInvalidSignature)
+	}
+	mac := hmac.New(sha256.New, []byte(s.signatureKey))
+	mac.Write([]byte(s.notificationURL))
+	mac.Write(body)
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Handle applies a verified notification. Events that were already handled are skipped, events that fail
+// are forgotten so Square's retry applies them again
+func (s *WebhookService) Handle(ctx context.Context, body []byte) error {
+	var event squareEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+	if event.EventID == "" || event.Type == "" {
+		return fmt.Errorf("%w: event_id and type are required", ErrInvalidWebhook)
+	}
+
+	record := models.WebhookEvent{EventID: event.EventID, MerchantID: event.MerchantID, Type: event.Type}
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		s.Logger.Error("Failed to record webhook event", "error", result.Error, "event_id", event.EventID)
+		return fmt.Errorf("failed to record webhook event: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		s.Logger.Info("Skipped duplicate webhook event", "event_id", event.EventID, "type", event.Type)
+		return nil
+	}
+
+	if err := s.apply(ctx, event); err != nil {
+		s.Logger.Error("Failed to apply webhook event", "error", err, "event_id", event.EventID, "type", event.Type)
+		if err := s.db.Unscoped().Delete(&record).Error; err != nil {
+			s.Logger.Error("Failed to forget webhook event", "error", err, "event_id", event.EventID)
+		}
+		return err
+	}
+
+	s.Logger.Info("Applied webhook event", "event_id", event.EventID, "type", event.Type, "merchant_id", event.MerchantID)
+	return nil
+}
+
+// apply applies the event to every connected restaurant of the merchant in the subscription's environment.
+// Restaurants only sync orders, payments and refunds they own, so a change reaches the one it belongs to
+func (s *WebhookService) apply(ctx context.Context, event squareEvent) error {
+	var restaurants []models.Restaurant
+	err := s.db.Where("merchant_id = ? AND square_environment = ? AND revoked_at IS NULL", event.MerchantID, s.environment).
+		Order("id").Find(&restaurants).Error
+	if err != nil {
+		return fmt.Errorf("failed to find restaurant: %w", err)
+	}
+	if len(restaurants) == 0 {
+		// Events of merchants that are gone or never onboarded are acknowledged and dropped
+		s.Logger.Info("Ignored webhook event of unknown merchant", "merchant_id", event.MerchantID, "event_id", event.EventID)
+		return nil
+	}
+
+	for _, restaurant := range restaurants {
+		if err := s.applyTo(ctx, restaurant, event); err != nil {
+			return fmt.Errorf("restaurant %d: %w", restaurant.ID, err)
+		}
+	}
+	return nil
+}
+
+// applyTo applies the event to one restaurant
+func (s *WebhookService) applyTo(ctx context.Context, restaurant models.Restaurant, event squareEvent) error {
+	gateway, err := connectRestaurant(s.connector, s.keys, restaurant)
+	if err != nil {
+		return err
+	}
+
+	switch event.Type {
+	case "order.created", "order.updated":
+		return s.orders.syncSquareOrder(ctx, restaurant, gateway, event.Data.ID)
+
+	case "catalog.version.updated":
+		_, err := s.menu.Sync(ctx, restaurant, gateway)
+		return err
+
+	case "payment.created", "payment.updated":
+		var object struct {
+			Payment *square.Payment `json:"payment"`
+		}
+		if err := json.Unmarshal(event.Data.Object, &object); err != nil || object.Payment == nil {
+			return fmt.Errorf("%w: payment is missing", ErrInvalidWebhook)
+		}
+		return s.orders.syncSquarePayment(ctx, restaurant, gateway, object.Payment)
+
+	case "refund.created", "refund.updated":
+		var object struct {
+			Refund *square.PaymentRefund `json:"refund"`
+		}
+		if err := json.Unmarshal(event.Data.Object, &object); err != nil || object.Refund == nil {
+			return fmt.Errorf("%w: refund is missing", ErrInvalidWebhook)
+		}
+		return s.orders.syncSquareRefund(ctx, restaurant, gateway, object.Refund)
+	}
+
+	s.Logger.Info("Ignored webhook event", "type", event.Type, "event_id", event.EventID)
+	return nil
+}
+
+// syncSquareOrder brings a stored order up to date with Square. Orders the API does not know are left alone
+func (s *SquareService) syncSquareOrder(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, orderID string) error {
+	var stored int64
+	if err := s.db.Model(&models.Order{}).Where(&models.Order{ID: orderID, RestautantID: restaurant.ID}).Count(&stored).Error; err != nil {
+		return fmt.Errorf("failed to look up order: %w", err)
+	}
+	if stored == 0 {
+		return nil
+	}
+
+	// The order is fetched rather than read from the notification, so notifications arriving out of order
+	// still leave the latest version
+	resp, err := gateway.GetOrder(ctx, orderID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch square order: %w", err)
+	}
+
+	// The stored order is read and saved with its row locked, so a payment recorded in between is not overwritten
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		order, err := lockSyncedOrder(tx, restaurant.ID, orderID)
+		if err != nil {
+			return err
+		}
+		// Another sync stored a later version while this one waited
+		if order.Version > squareVersion(resp.Order) {
+			return nil
+		}
+		adoptSquareUIDs(order, resp.Order)
+		importLineItems(order, resp.Order)
+		due := order.Totals.Due
+		removed := syncOrder(order, resp.Order)
+		return saveSyncedOrder(tx, order, due, removed)
+	})
+	if err != nil {
+		s.Logger.Error("Failed to save updated order", "error", err, "order_id", orderID)
+		return fmt.Errorf("failed to save order: %w", err)
+	}
+	return nil
+}
+
+// importLineItems adds the line items added to the order in Square, e.g. on a terminal, to the stored order
+func importLineItems(order *models.Order, sq *square.Order) {
+	for _, line := range sq.LineItems {
+		if line.UID == nil || slices.ContainsFunc(order.Items, func(item models.OrderItem) bool { return item.SquareUID == *line.UID }) {
+			continue
+		}
+		quantity, _ := strconv.Atoi(line.Quantity)
+		order.Items = append(order.Items, models.OrderItem{
+			OrderID:     order.ID,
+			SquareUID:   *line.UID,
+			Name:        stringValue(line.Name),
+			VariationID: stringValue(line.CatalogObjectID),
+			UnitPrice:   moneyFromSquare(line.BasePriceMoney, order.Currency),
+			Quantity:    quantity,
+		})
+	}
+}
+
+// syncSquarePayment stores the latest status of a payment. Payments the API was still processing are completed,
+// payments taken in Square for a stored order are added to it
+func (s *SquareService) syncSquarePayment(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, p *square.Payment) error {
+	if p.ID == nil {
+		return fmt.Errorf("%w: payment id is missing", ErrInvalidWebhook)
+	}
+	orderID := stringValue(p.OrderID)
+
+	var payment models.Payment
+	err := s.db.Where(&models.Payment{RestaurantID: restaurant.ID, SquarePaymentID: *p.ID}).First(&payment).Error
+	switch {
+	case err == nil:
+		taken := paymentFromSquare(p, payment.Amount.Currency)
+		payment.Status = taken.Status
+		payment.Refunded = taken.Refunded
+		payment.CardBrand = taken.CardBrand
+		payment.CardLast4 = taken.CardLast4
+		if err := s.db.Save(&payment).Error; err != nil {
+			return fmt.Errorf("failed to save payment: %w", err)
+		}
+
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// The notification can arrive before the request that took the payment has stored it
+		if _, err := s.storeSquarePayment(ctx, restaurant, gateway, p); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("failed to look up payment: %w", err)
+	}
+
+	if orderID == "" {
+		return nil
+	}
+	return s.syncSquareOrder(ctx, restaurant, gateway, orderID)
+}
+
+// storeSquarePayment stores a payment the API has no record of. A payment the API is still processing is completed,
+// one taken in Square for a stored order is added to it. Payments of other orders are ignored and nil is returned
+func (s *SquareService) storeSquarePayment(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, p *square.Payment) (*models.Payment, error) {
+	if id, ok := strings.CutPrefix(stringValue(p.ReferenceID), "payment-"); ok {
+		var processing models.Payment
+		err := s.db.Where("id = ? AND restaurant_id = ? AND status = ?", id, restaurant.ID, models.PaymentProcessing).First(&processing).Error
+		if err == nil {
+			return s.finalizePayment(ctx, gateway, processing.ID, p)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to look up payment: %w", err)
+		}
+	}
+
+	var order models.Order
+	err := s.db.Where(&models.Order{ID: stringValue(p.OrderID), RestautantID: restaurant.ID}).First(&order).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load order: %w", err)
+	}
+	payment := paymentFromSquare(p, order.Currency)
+	payment.RestaurantID = restaurant.ID
+	payment.LocationID = order.LocationID
+	payment.OrderID = order.ID
+	// Payments taken in Square have no paymentId of ours
+	payment.IdempotencyKey = "square:" + *p.ID
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(payment).Error; err != nil {
+		return nil, fmt.Errorf("failed to save payment: %w", err)
+	}
+	return payment, nil
+}
+
+// syncSquareRefund stores the latest status of a refund, refunds made in Square for a stored order are added to it
+func (s *SquareService) syncSquareRefund(ctx context.Context, restaurant models.Restaurant, gateway pos.Gateway, r *square.PaymentRefund) error {
+	orderID := stringValue(r.OrderID)
+	paymentID := stringValue(r.PaymentID)
+
+	var order models.Order
+	err := s.db.Where(&models.Order{ID: orderID, RestautantID: restaurant.ID}).First(&order).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load order: %w", err)
+	}
+
+	refund := models.Refund{
+		RestaurantID:    restaurant.ID,
+		OrderID:         orderID,
+		SquarePaymentID: paymentID,
+		SquareRefundID:  r.ID,
+		// Refunds made in Square have no idempotency key of ours
+		IdempotencyKey: "square:" + r.ID,
+		Amount:         moneyFromSquare(r.AmountMoney, order.Currency),
+		Reason:         stringValue(r.Reason),
+		Status:         stringValue(r.Status),
+	}
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "square_refund_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "amount_amount", "amount_currency", "updated_at"}),
+	}).Create(&refund).Error
+	if err != nil {
+		return fmt.Errorf("failed to save refund: %w", err)
+	}
+
+	// The payment's refunded amount is taken from Square, it counts every refund that was not rejected
+	if paymentID != "" {
+		resp, err := gateway.GetPayment(ctx, paymentID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch square payment: %w", err)
+		}
+		err = s.db.Model(&models.Payment{}).
+			Where(&models.Payment{RestaurantID: restaurant.ID, SquarePaymentID: paymentID}).
+			Updates(map[string]any{
+				"refunded_amount":   moneyFromSquare(resp.Payment.RefundedMoney, order.Currency).Amount,
+				"refunded_currency": order.Currency,
+			}).Error
+		if err != nil {
+			return fmt.Errorf("failed to save payment: %w", err)
+		}
+	}
+	return s.syncSquareOrder(ctx, restaurant, gateway, orderID)
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/sasirura/restaurant-api/internal/pos"
+)
+
+func sign(key, url string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(url))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookVerify(t *testing.T) {
+	const (
+		key = "signature-key"
+		url = "https://api.example.com/webhooks/square"
+	)
+	body := []byte(`{"merchant_id":"ML1","type":"order.updated","event_id":"e1"}`)
+	webhooks := NewWebhooks(nil, nil, nil, nil, nil, pos.Sandbox, key, url, nil)
+
+	tests := []struct {
+		name      string
+		body      []byte
+		signature string
+		wantErr   bool
+	}{
+		{"signed by Square", body, sign(key, url, body), false},
+		{"missing signature", body, "", true},
+		{"changed body", []byte(`{"merchant_id":"ML2","type":"order.updated","event_id":"e1"}`), sign(key, url, body), true},
+		{"other key", body, sign("other-key", url, body), true},
+		{"other notification URL", body, sign(key, "https://evil.example.com/webhooks/square", body), true},
+		{"not base64", body, "not a signature", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := webhooks.Verify(tt.body, tt.signature)
+			if tt.wantErr && !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("err = %v, want ErrInvalidSignature", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+// Package squaretest
+package squaretest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/square/square-go-sdk"
+)
+
+// Routes served by the stand-in, usable with Fail and Calls
+const (
+	RouteTokenStatus   = "POST /oauth2/token/status"
+	RouteListLocations = "GET /v2/locations"
+	RouteCreateOrder   = "POST /v2/orders"
+	RouteGetOrder      = "GET /v2/orders/{id}"
+	RouteUpdateOrder   = "PUT /v2/orders/{id}"
+	RouteSearchOrders  = "POST /v2/orders/search"
+	RouteCreatePayment = "POST /v2/payments"
+	RouteGetPayment    = "GET /v2/payments/{id}"
+	RouteRefundPayment = "POST /v2/refunds"
+	RouteSearchCatalog = "POST /v2/catalog/search"
+)
+
+// Failure is a scripted error response returned instead of handling a request
+type Failure struct {
+	Status int
+	Code   square.ErrorCode
+	Detail string
+	// Times is the number of consecutive requests that fail, zero means one
+	Times int
+}
+
+// Handler implements the subset of the Square REST API used by this project on top of pos.Fake
+type Handler struct {
+	fake *pos.Fake
+	mux  *http.ServeMux
+
+	mu       sync.Mutex
+	failures map[string][]Failure
+	rejected map[string]bool
+	calls    map[string]int
+}
+
+func NewHandler() *Handler {
+	h := &Handler{
+		fake:     pos.NewFake(),
+		mux:      http.NewServeMux(),
+		failures: make(map[string][]Failure),
+		rejected: make(map[string]bool),
+		calls:    make(map[string]int),
+	}
+
+	h.handle(RouteTokenStatus, h.tokenStatus)
+	h.handle(RouteListLocations, h.listLocations)
+	h.handle(RouteCreateOrder, h.createOrder)
+	h.handle(RouteGetOrder, h.getOrder)
+	h.handle(RouteUpdateOrder, h.updateOrder)
+	h.handle(RouteSearchOrders, h.searchOrders)
+	h.handle(RouteCreatePayment, h.createPayment)
+	h.handle(RouteGetPayment, h.getPayment)
+	h.handle(RouteRefundPayment, h.refundPayment)
+	h.handle(RouteSearchCatalog, h.searchCatalog)
+
+	return h
+}
+
+// Server is a Handler listening on a local httptest server
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a stand-in Square API, point the Square connector at its URL
+func NewServer() *Server {
+	h := NewHandler()
+	return &Server{
+		Server:  httptest.NewServer(h),
+		Handler: h,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Fail makes the next requests to route respond with the failure
+func (h *Handler) Fail(route string, f Failure) {
+	if f.Times <= 0 {
+		f.Times = 1
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures[route] = append(h.failures[route], f)
+}
+
+// RejectToken makes every request authenticated with token fail with 401 UNAUTHORIZED
+func (h *Handler) RejectToken(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rejected[token] = true
+}
+
+// Calls returns the number of requests received for route, including failed ones
+func (h *Handler) Calls(route string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls[route]
+}
+
+// Reset clears scripted failures, rejected tokens and call counts
+func (h *Handler) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = make(map[string][]Failure)
+	h.rejected = make(map[string]bool)
+	h.calls = make(map[string]int)
+}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, gateway pos.Gateway)
+
+func (h *Handler) handle(route string, fn handlerFunc) {
+	h.mux.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		h.mu.Lock()
+		h.calls[route]++
+		failure, scripted := h.nextFailure(route)
+		rejected := token == "" || h.rejected[token]
+		h.mu.Unlock()
+
+		switch {
+		case scripted:
+			writeError(w, failure.Status, failure.Code, failure.Detail)
+		case rejected:
+			writeError(w, http.StatusUnauthorized, square.ErrorCodeUnauthorized, "This request could not be authorized.")
+		default:
+			fn(w, r, h.fake.Connect(pos.Sandbox, token))
+		}
+	})
+}
+
+// nextFailure pops the scripted failure for route, callers must hold h.mu
+func (h *Handler) nextFailure(route string) (Failure, bool) {
+	queue := h.failures[route]
+	if len(queue) == 0 {
+		return Failure{}, false
+	}
+
+	failure := queue[0]
+	queue[0].Times--
+	if queue[0].Times == 0 {
+		h.failures[route] = queue[1:]
+	}
+	return failure, true
+}
+
+func (h *Handler) tokenStatus(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	resp, err := gateway.RetrieveTokenStatus(r.Context())
+	respond(w, resp, err)
+}
+
+func (h *Handler) listLocations(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	resp, err := gateway.ListLocations(r.Context())
+	respond(w, resp, err)
+}
+
+func (h *Handler) createOrder(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	var req square.CreateOrderRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	resp, err := gateway.CreateOrder(r.Context(), &req)
+	respond(w, resp, err)
+}
+
+func (h *Handler) getOrder(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	resp, err := gateway.GetOrder(r.Context(), r.PathValue("id"))
+	respond(w, resp, err)
+}
+
+func (h *Handler) updateOrder(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	var req square.UpdateOrderRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	req.OrderID = r.PathValue("id")
+	resp, err := gateway.UpdateOrder(r.Context(), &req)
+	respond(w, resp, err)
+}
+
+func (h *Handler) searchOrders(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	var req square.SearchOrdersRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	resp, err := gateway.SearchOrders(r.Context(), &req)
+	respond(w, resp, err)
+}
+
+func (h *Handler) getPayment(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	resp, err := gateway.GetPayment(r.Context(), r.PathValue("id"))
+	respond(w, resp, err)
+}
+
+func (h *Handler) createPayment(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	var req square.CreatePaymentRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	resp, err := gateway.CreatePayment(r.Context(), &req)
+	respond(w, resp, err)
+}
+
+func (h *Handler) refundPayment(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	var req square.RefundPaymentRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	resp, err := gateway.RefundPayment(r.Context(), &req)
+	respond(w, resp, err)
+}
+
+func (h *Handler) searchCatalog(w http.ResponseWriter, r *http.Request, gateway pos.Gateway) {
+	var req square.SearchCatalogObjectsRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	resp, err := gateway.SearchCatalog(r.Context(), &req)
+	respond(w, resp, err)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, square.ErrorCodeBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func respond(w http.ResponseWriter, resp any, err error) {
+	switch {
+	case errors.Is(err, pos.ErrNotFound):
+		writeError(w, http.StatusNotFound, square.ErrorCodeNotFound, err.Error())
+	case errors.Is(err, pos.ErrVersionMismatch):
+		writeError(w, http.StatusBadRequest, pos.VersionMismatch, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadRequest, square.ErrorCodeBadRequest, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code square.ErrorCode, detail string) {
+	category := square.ErrorCategoryInvalidRequestError
+	switch {
+	case status == http.StatusUnauthorized:
+		category = square.ErrorCategoryAuthenticationError
+	case status == http.StatusTooManyRequests:
+		category = square.ErrorCategoryRateLimitError
+	case status >= http.StatusInternalServerError:
+		category = square.ErrorCategoryAPIError
+	}
+
+	writeJSON(w, status, map[string][]*square.Error{
+		"errors": {{Category: category, Code: code, Detail: square.String(detail)}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,231 @@
+package squaretest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/sasirura/restaurant-api/internal/pos"
+	"github.com/sasirura/restaurant-api/internal/squaretest"
+	"github.com/square/square-go-sdk"
+)
+
+func newGateway(t *testing.T, token string) (*squaretest.Server, pos.Gateway) {
+	t.Helper()
+	server := squaretest.NewServer()
+	t.Cleanup(server.Close)
+	return server, pos.NewSquare(server.URL).Connect(pos.Sandbox, token)
+}
+
+func createOrder(t *testing.T, gateway pos.Gateway) *square.Order {
+	t.Helper()
+	resp, err := gateway.CreateOrder(context.Background(), &square.CreateOrderRequest{
+		Order: &square.Order{
+			LocationID: pos.FakeLocationID(pos.FakeMerchantID("token")),
+			LineItems: []*square.OrderLineItem{{
+				CatalogObjectID: square.String(pos.FakeVariationBurgerRegular),
+				Quantity:        "2",
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	return resp.Order
+}
+
+func TestServerOrderAndPayment(t *testing.T) {
+	ctx := context.Background()
+	server, gateway := newGateway(t, "token")
+
+	status, err := gateway.RetrieveTokenStatus(ctx)
+	if err != nil {
+		t.Fatalf("RetrieveTokenStatus: %v", err)
+	}
+	if *status.MerchantID != pos.FakeMerchantID("token") {
+		t.Errorf("merchant = %s, want %s", *status.MerchantID, pos.FakeMerchantID("token"))
+	}
+	locations, err := gateway.ListLocations(ctx)
+	if err != nil {
+		t.Fatalf("ListLocations: %v", err)
+	}
+	if len(locations.Locations) != 1 || *locations.Locations[0].Currency != square.CurrencyUsd {
+		t.Fatalf("locations = %+v, want one USD location", locations.Locations)
+	}
+
+	order := createOrder(t, gateway)
+	if *order.TotalMoney.Amount != 2400 {
+		t.Errorf("total = %d, want 2400", *order.TotalMoney.Amount)
+	}
+
+	payment, err := gateway.CreatePayment(ctx, &square.CreatePaymentRequest{
+		IdempotencyKey: "pay",
+		SourceID:       "cnon:card-nonce-ok",
+		AmountMoney:    &square.Money{Amount: square.Int64(2400), Currency: square.CurrencyUsd.Ptr()},
+		TipMoney:       &square.Money{Amount: square.Int64(300), Currency: square.CurrencyUsd.Ptr()},
+		OrderID:        order.ID,
+		ReferenceID:    square.String("payment-1"),
+	})
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if *payment.Payment.TotalMoney.Amount != 2700 {
+		t.Errorf("payment total = %d, want 2700", *payment.Payment.TotalMoney.Amount)
+	}
+
+	paid, err := gateway.GetOrder(ctx, *order.ID)
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	if *paid.Order.State != square.OrderStateCompleted {
+		t.Errorf("state = %s, want COMPLETED", *paid.Order.State)
+	}
+	if len(paid.Order.Tenders) != 1 || *paid.Order.Tenders[0].AmountMoney.Amount != 2700 {
+		t.Errorf("tenders = %+v, want one of 2700 including the tip", paid.Order.Tenders)
+	}
+
+	for route, want := range map[string]int{
+		squaretest.RouteTokenStatus:   1,
+		squaretest.RouteListLocations: 1,
+		squaretest.RouteCreateOrder:   1,
+		squaretest.RouteCreatePayment: 1,
+		squaretest.RouteGetOrder:      1,
+		squaretest.RouteRefundPayment: 0,
+	} {
+		if got := server.Calls(route); got != want {
+			t.Errorf("%s called %d times, want %d", route, got, want)
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(server *squaretest.Server)
+		call    func(ctx context.Context, gateway pos.Gateway, order *square.Order) error
+		wantErr error
+	}{
+		{
+			name: "rejected token",
+			setup: func(server *squaretest.Server) {
+				server.RejectToken("token")
+			},
+			call: func(ctx context.Context, gateway pos.Gateway, order *square.Order) error {
+				_, err := gateway.ListLocations(ctx)
+				return err
+			},
+			wantErr: pos.ErrUnauthorized,
+		},
+		{
+			name: "unknown order",
+			call: func(ctx context.Context, gateway pos.Gateway, order *square.Order) error {
+				_, err := gateway.GetOrder(ctx, "NOPE")
+				return err
+			},
+			wantErr: pos.ErrNotFound,
+		},
+		{
+			name: "stale order version",
+			call: func(ctx context.Context, gateway pos.Gateway, order *square.Order) error {
+				_, err := gateway.UpdateOrder(ctx, &square.UpdateOrderRequest{
+					OrderID: *order.ID,
+					Order:   &square.Order{LocationID: order.LocationID, Version: square.Int(*order.Version + 1)},
+				})
+				return err
+			},
+			wantErr: pos.ErrVersionMismatch,
+		},
+		{
+			name: "declined card",
+			setup: func(server *squaretest.Server) {
+				server.Fail(squaretest.RouteCreatePayment, squaretest.Failure{
+					Status: http.StatusPaymentRequired,
+					Code:   square.ErrorCodeCardDeclined,
+					Detail: "Card declined.",
+				})
+			},
+			call: func(ctx context.Context, gateway pos.Gateway, order *square.Order) error {
+				_, err := gateway.CreatePayment(ctx, &square.CreatePaymentRequest{
+					IdempotencyKey: "pay",
+					SourceID:       "cnon:card-nonce-declined",
+					AmountMoney:    &square.Money{Amount: square.Int64(2400), Currency: square.CurrencyUsd.Ptr()},
+					OrderID:        order.ID,
+				})
+				return err
+			},
+			wantErr: pos.ErrRejected,
+		},
+		{
+			name: "refund of more than was paid",
+			call: func(ctx context.Context, gateway pos.Gateway, order *square.Order) error {
+				payment, err := gateway.CreatePayment(ctx, &square.CreatePaymentRequest{
+					IdempotencyKey: "pay",
+					SourceID:       "CASH",
+					AmountMoney:    &square.Money{Amount: square.Int64(2400), Currency: square.CurrencyUsd.Ptr()},
+					OrderID:        order.ID,
+				})
+				if err != nil {
+					return err
+				}
+				_, err = gateway.RefundPayment(ctx, &square.RefundPaymentRequest{
+					IdempotencyKey: "refund",
+					PaymentID:      payment.Payment.ID,
+					AmountMoney:    &square.Money{Amount: square.Int64(2500), Currency: square.CurrencyUsd.Ptr()},
+				})
+				return err
+			},
+			wantErr: pos.ErrRejected,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			server, gateway := newGateway(t, "token")
+			order := createOrder(t, gateway)
+			if tt.setup != nil {
+				tt.setup(server)
+			}
+			if err := tt.call(ctx, gateway, order); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerScriptedFailuresRunOut(t *testing.T) {
+	ctx := context.Background()
+	server, gateway := newGateway(t, "token")
+	server.Fail(squaretest.RouteListLocations, squaretest.Failure{Status: http.StatusNotFound, Code: square.ErrorCodeNotFound, Times: 2})
+
+	for i := range 2 {
+		if _, err := gateway.ListLocations(ctx); !errors.Is(err, pos.ErrNotFound) {
+			t.Fatalf("call %d: err = %v, want ErrNotFound", i+1, err)
+		}
+	}
+	if _, err := gateway.ListLocations(ctx); err != nil {
+		t.Fatalf("call after the failures: %v", err)
+	}
+	if got := server.Calls(squaretest.RouteListLocations); got != 3 {
+		t.Errorf("%d calls, want 3", got)
+	}
+
+	server.Reset()
+	if got := server.Calls(squaretest.RouteListLocations); got != 0 {
+		t.Errorf("%d calls after Reset, want 0", got)
+	}
+}
+
+func TestServerSearchCatalog(t *testing.T) {
+	_, gateway := newGateway(t, "token")
+	resp, err := gateway.SearchCatalog(context.Background(), &square.SearchCatalogObjectsRequest{
+		ObjectTypes: []square.CatalogObjectType{square.CatalogObjectTypeModifierList},
+	})
+	if err != nil {
+		t.Fatalf("SearchCatalog: %v", err)
+	}
+	if len(resp.Objects) != 1 || resp.Objects[0].ModifierList == nil || resp.Objects[0].ModifierList.ID != pos.FakeModifierListAddOns {
+		t.Fatalf("objects = %+v, want the add-ons modifier list", resp.Objects)
+	}
+}